@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// anf.go converts expressions to A-normal form.
+//
+// in A-normal form, the operands of every BinExpr, CallExpr, TupleExpr,
+// ValuesExpr, TupleIndexExpr, PrimExpr, DotExpr, ListExpr, IndexExpr,
+// ListLenExpr, AppendExpr, DictExpr, DictOpExpr, RecordExpr, VariantExpr,
+// VariantTagExpr and VariantGetExpr are atomic:
+// variables or literals.
+// anything more complicated is bound to a temporary variable first.
+//
+//	f(g(x) + 1, 2)
+//
+// becomes
+//
+//	let $t1 = g(x) in let $t2 = $t1 + 1 in f($t2, 2) end end
+//
+// the conditions of if expressions, and the left side of 'and' and 'or',
+// are left as comparisons of atoms when possible so that lower can
+// still branch on them directly. they never make calls.
+//
+// the right side of 'and' and 'or' and the branches of an if are only
+// evaluated some of the time, so their temporaries stay inside them.
+//
+// this pass runs after typechecking and uncoverTuples.
+// the expressions it builds get the types of the ones they replace,
+// and the temporaries get the types of their values.
+
+func anf(expr Expr, types *typeTable) Expr {
+	a := anfConverter{types: types}
+	return a.expr(expr)
+}
+
+type anfConverter struct {
+	lastvar int
+	types   *typeTable
+}
+
+type anfBinding struct {
+	Var string
+	Val Expr
+}
+
+// newvar returns a fresh temporary: $t1, $t2, and so on.
+// (see uniquify for how the compiler keeps its names apart from the program's)
+func (a *anfConverter) newvar() string {
+	a.lastvar++
+	return "$t" + strconv.Itoa(a.lastvar)
+}
+
+// expr normalizes an expression whose value is the result
+// of the enclosing function, let binding, or branch
+func (a *anfConverter) expr(expr Expr) Expr {
+	var binds []anfBinding
+	var result Expr
+	switch e := expr.(type) {
+	case *LetExpr:
+		result = &LetExpr{
+			Span: e.Span,
+			Var:  e.Var,
+			Type: e.Type,
+			Val:  a.expr(e.Val),
+			Body: a.expr(e.Body),
+		}
+	case *LetValuesExpr:
+		result = &LetValuesExpr{
+			Span: e.Span,
+			Vars: e.Vars,
+			Val:  a.expr(e.Val),
+			Body: a.expr(e.Body),
+		}
+	case *LetRecExpr:
+		vals := make([]Expr, len(e.Vals))
+		for i := range e.Vals {
+			vals[i] = a.expr(e.Vals[i])
+		}
+		result = &LetRecExpr{
+			Span: e.Span,
+			Vars: e.Vars,
+			Vals: vals,
+			Body: a.expr(e.Body),
+		}
+	case *LetTypeExpr:
+		result = &LetTypeExpr{Span: e.Span, Types: e.Types, Body: a.expr(e.Body)}
+	case *IfExpr:
+		result = &IfExpr{
+			Span: e.Span,
+			Cond: a.cond(e.Cond, &binds),
+			Then: a.expr(e.Then),
+			Else: a.expr(e.Else),
+		}
+	default:
+		result = a.simple(e, &binds)
+	}
+	// the lets around it have its type too
+	a.types.same(expr, result)
+	return a.types.same(expr, wrapBindings(binds, result))
+}
+
+// wrapBindings wraps an expression in a let for each binding
+func wrapBindings(binds []anfBinding, e Expr) Expr {
+	for i := len(binds) - 1; i >= 0; i-- {
+		e = &LetExpr{
+			Span: spanOf(binds[i].Val),
+			Var:  binds[i].Var,
+			Val:  binds[i].Val,
+			Body: e,
+		}
+	}
+	return e
+}
+
+// simple normalizes an expression so that its operands are atomic.
+// any temporaries it needs are added to binds.
+func (a *anfConverter) simple(expr Expr, binds *[]anfBinding) Expr {
+	return a.types.same(expr, a.operands(expr, binds))
+}
+
+// operands builds the expression for simple
+func (a *anfConverter) operands(expr Expr, binds *[]anfBinding) Expr {
+	switch e := expr.(type) {
+	case *VarExpr, *IntExpr, *StrExpr, *BoolExpr, *BadExpr:
+		return e
+	case *DotExpr:
+		return &DotExpr{Span: e.Span, Op: e.Op, Left: a.atom(e.Left, binds), Right: e.Right}
+	case *BinExpr:
+		return &BinExpr{
+			Span:  e.Span,
+			Op:    e.Op,
+			Left:  a.atom(e.Left, binds),
+			Right: a.atom(e.Right, binds),
+		}
+	case *CallExpr:
+		f := a.atom(e.Func, binds)
+		args := make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = a.atom(e.Args[i], binds)
+		}
+		return &CallExpr{Span: e.Span, Func: f, Args: args}
+	case *TupleExpr:
+		args := make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = a.atom(e.Args[i], binds)
+		}
+		return &TupleExpr{Span: e.Span, Args: args}
+	case *ValuesExpr:
+		args := make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = a.atom(e.Args[i], binds)
+		}
+		return &ValuesExpr{Span: e.Span, Args: args}
+	case *TupleIndexExpr:
+		return &TupleIndexExpr{Span: e.Span, Base: a.atom(e.Base, binds), Index: e.Index}
+	case *PrimExpr:
+		args := make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = a.atom(e.Args[i], binds)
+		}
+		return &PrimExpr{Span: e.Span, Name: e.Name, Args: args}
+	case *ListExpr:
+		args := make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = a.atom(e.Args[i], binds)
+		}
+		return &ListExpr{Span: e.Span, Args: args}
+	case *IndexExpr:
+		return &IndexExpr{Span: e.Span, Base: a.atom(e.Base, binds), Index: a.atom(e.Index, binds)}
+	case *ListLenExpr:
+		return &ListLenExpr{Span: e.Span, List: a.atom(e.List, binds)}
+	case *DictExpr:
+		keys := make([]Expr, len(e.Keys))
+		vals := make([]Expr, len(e.Vals))
+		for i := range e.Keys {
+			keys[i] = a.atom(e.Keys[i], binds)
+			vals[i] = a.atom(e.Vals[i], binds)
+		}
+		return &DictExpr{Span: e.Span, Keys: keys, Vals: vals}
+	case *DictOpExpr:
+		args := make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = a.atom(e.Args[i], binds)
+		}
+		return &DictOpExpr{Span: e.Span, Op: e.Op, Args: args}
+	case *RecordExpr:
+		vals := make([]Expr, len(e.Vals))
+		for i := range e.Vals {
+			vals[i] = a.atom(e.Vals[i], binds)
+		}
+		return &RecordExpr{Span: e.Span, Type: e.Type, Fields: e.Fields, Vals: vals}
+	case *VariantExpr:
+		var args []Expr
+		for _, x := range e.Args {
+			args = append(args, a.atom(x, binds))
+		}
+		return &VariantExpr{Span: e.Span, Type: e.Type, Tag: e.Tag, Args: args}
+	case *VariantTagExpr:
+		return &VariantTagExpr{Span: e.Span, Base: a.atom(e.Base, binds)}
+	case *VariantGetExpr:
+		return &VariantGetExpr{Span: e.Span, Base: a.atom(e.Base, binds), Type: e.Type, Tag: e.Tag, Index: e.Index}
+	case *AppendExpr:
+		return &AppendExpr{Span: e.Span, List: a.atom(e.List, binds), Elem: a.atom(e.Elem, binds)}
+	case *AndExpr:
+		return &AndExpr{Span: e.Span, Left: a.cond(e.Left, binds), Right: a.expr(e.Right)}
+	case *OrExpr:
+		return &OrExpr{Span: e.Span, Left: a.cond(e.Left, binds), Right: a.expr(e.Right)}
+	case *FuncExpr:
+		return &FuncExpr{
+			Span:        e.Span,
+			Name:        e.Name,
+			Args:        e.Args,
+			ArgTypes:    e.ArgTypes,
+			ReturnTypes: e.ReturnTypes,
+			Body:        a.expr(e.Body),
+		}
+	case *LetExpr, *LetValuesExpr, *LetRecExpr, *LetTypeExpr, *IfExpr:
+		return a.expr(e)
+	default:
+		panic(fmt.Sprintf("unhandled case in anf: %T", e))
+	}
+}
+
+// atom normalizes an operand.
+// if it isn't a variable or a literal, it is bound to a temporary.
+func (a *anfConverter) atom(expr Expr, binds *[]anfBinding) Expr {
+	switch e := expr.(type) {
+	case *VarExpr, *IntExpr, *StrExpr, *BoolExpr, *BadExpr:
+		return e
+	}
+	val := a.simple(expr, binds)
+	name := a.newvar()
+	a.types.bind(name, val)
+	*binds = append(*binds, anfBinding{name, val})
+	return &VarExpr{Span: spanOf(expr), Name: name}
+}
+
+// cond normalizes the condition of an if
+// or the left side of an 'and' or 'or'.
+// comparisons and logical operators stay put,
+// but anything that makes a call is bound to a temporary.
+func (a *anfConverter) cond(expr Expr, binds *[]anfBinding) Expr {
+	switch e := expr.(type) {
+	case *VarExpr, *IntExpr, *StrExpr, *BoolExpr, *BadExpr, *BinExpr:
+		return a.simple(e, binds)
+	case *AndExpr, *OrExpr:
+		s := a.simple(e, binds)
+		if isTrivial(s) {
+			return s
+		}
+		name := a.newvar()
+		a.types.bind(name, s)
+		*binds = append(*binds, anfBinding{name, s})
+		return &VarExpr{Span: spanOf(e), Name: name}
+	default:
+		return a.atom(e, binds)
+	}
+}
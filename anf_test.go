@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestANF(t *testing.T) {
+	const source = `let f = func(x) x end in
+if f(1) < 2 then f(get(tuple(1 + 2 * 3), 0)) else 0 < 1 and f(3) end
+end`
+	// nested operands are bound to temporaries in evaluation order,
+	// but the comparison in the if condition and the
+	// conditionally-evaluated right side of 'and' stay put
+	const want = `let f = func (x)
+  x
+end in
+  let $t1 = f(1) in
+    if $t1 < 2 then
+      let $t2 = 2 * 3 in
+        let $t3 = 1 + $t2 in
+          let $t4 = #tuple($t3) in
+            let $t5 = #get($t4, 0) in
+              f($t5)
+            end
+          end
+        end
+      end
+    else
+      0 < 1 and f(3)
+    end
+  end
+end
+`
+	expr, err := parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	var buf bytes.Buffer
+	formatExpr(&buf, anf(uncoverTuples(expr, nil), nil))
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
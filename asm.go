@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 )
 
 // asm converts ops into assembly code
@@ -16,33 +17,145 @@ import (
 //       | jmp label | label: instr
 
 type AsmPrinter struct {
-	w io.Writer
+	w      io.Writer
+	prefix string // prepended to block labels
 }
 
+// psc_main is the entry point called by the runtime.
+// it initializes the garbage collector, calls the toplevel procedure,
+// and prints its result.
+// the extra 8 bytes keep the stack 16-byte aligned for the calls.
+// every int and tuple in a live stack frame gets a slot on the root stack,
+// so it needs to be a lot bigger than the heap to start with.
 const asmPrologue = `
 	.globl psc_main
 psc_main:
 	pushq %rbp
 	movq %rsp, %rbp
 	pushq  %r15
+	subq   $8,%rsp
 	movq   $4096,%rsi
-	movq   $4096,%rdi
+	movq   $1048576,%rdi
 	callq  psc_gcinit
 	movq   rootstack_begin(%rip),%r15
 `
 
 const asmEpilogue = `
+	addq $8, %rsp
 	popq %r15
 	popq %rbp
 	ret
 `
 
-func (pr *AsmPrinter) ConvertProg(p *asmProg) {
+// tells the linker we don't need an executable stack
+const asmTrailer = `
+	.section .note.GNU-stack,"",@progbits
+`
+
+// ConvertProg writes out a whole program:
+// psc_main, which calls the first procedure and prints its result,
+// followed by all the procedures, the string literals,
+// and psc_retbuf, which holds the results after the second
+// of a function which returns more than two.
+// result is the type of the program's result.
+func (pr *AsmPrinter) ConvertProg(procs []*asmProg, strlits []string, result Type) {
 	io.WriteString(pr.w, asmPrologue)
+	pr.write("\tcallq " + string(procs[0].name) + "\n")
+	if fn := printFunc(result); fn != "" {
+		pr.write("\tmovq %rax, %rdi\n")
+		pr.write("\tcallq " + fn + "\n")
+	}
+	io.WriteString(pr.w, asmEpilogue)
+	for _, p := range procs {
+		pr.ConvertProc(p)
+	}
+	if len(strlits) > 0 {
+		pr.write("\n\t.section .rodata\n")
+		for i, s := range strlits {
+			pr.ConvertString(stringSymbol(int64(i)), s)
+		}
+	}
+	retbuf := 0
+	for _, p := range procs {
+		if p.retbuf > retbuf {
+			retbuf = p.retbuf
+		}
+	}
+	if retbuf > 0 {
+		pr.write("\n\t.bss\n")
+		pr.write("\t.p2align 3\n")
+		pr.write("psc_retbuf:\n")
+		pr.write("\t.zero " + strconv.Itoa(8*retbuf) + "\n")
+	}
+	io.WriteString(pr.w, asmTrailer)
+}
+
+// the kind of a string object. see struct string in runtime.c
+const stringKind = 0xfe
+
+// ConvertString writes out a string literal.
+// it has the same layout as a string in the heap,
+// so the runtime can't tell the difference; the collector
+// leaves it alone because it isn't in the heap.
+func (pr *AsmPrinter) ConvertString(sym asmLabel, s string) {
+	pr.write("\t.p2align 3\n")
+	pr.write(string(sym) + ":\n")
+	pr.write("\t.byte " + strconv.Itoa(stringKind) + "\n")
+	pr.write("\t.zero 7\n")
+	pr.write("\t.quad " + strconv.Itoa(len(s)) + "\n")
+	pr.write("\t.zero 48\n")
+	pr.write("\t.quad 0\n") // forwarding
+	if s != "" {
+		pr.write("\t.ascii " + asmQuote(s) + "\n")
+	}
+}
+
+// asmQuote quotes a string for the assembler's .ascii directive.
+// anything other than printable ASCII is written as an octal escape.
+func asmQuote(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&buf, "\\%03o", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// printFunc returns the runtime function which prints a value of type t,
+// or "" if there isn't one
+func printFunc(t Type) string {
+	switch t.(type) {
+	case IntT:
+		return "psc_printint"
+	case BoolT:
+		return "psc_printbool"
+	case StrT:
+		return "psc_printstr"
+	default:
+		return ""
+	}
+}
+
+// ConvertProc writes out a single procedure.
+// block labels are prefixed with the procedure name
+// so that they don't collide with the blocks of other procedures.
+func (pr *AsmPrinter) ConvertProc(p *asmProg) {
+	pr.write("\n" + string(p.name) + ":\n")
+	pr.prefix = string(p.name) + "."
 	for _, b := range p.blocks {
 		pr.ConvertBlock(b)
 	}
-	io.WriteString(pr.w, asmEpilogue)
+	pr.prefix = ""
 }
 
 func (pr *AsmPrinter) convertSingleBlockProgram(b *asmBlock) {
@@ -52,7 +165,7 @@ func (pr *AsmPrinter) convertSingleBlockProgram(b *asmBlock) {
 }
 
 func (pr *AsmPrinter) ConvertBlock(b *asmBlock) {
-	pr.write(".L" + string(b.label) + ":\n")
+	pr.write(".L" + pr.prefix + string(b.label) + ":\n")
 	if len(b.args) > 0 {
 		fatalf("block with nonzero args: %+v", b)
 	}
@@ -65,12 +178,22 @@ func (pr *AsmPrinter) ConvertBlock(b *asmBlock) {
 			pr.write("\t" + l.asmInstr() + "\n")
 		case asmJump:
 			if l.variant != "" {
-				pr.write("\tj" + l.variant + " .L" + string(l.label) + "\n")
+				pr.write("\tj" + l.variant + " .L" + pr.prefix + string(l.label) + "\n")
 			} else {
-				pr.write("\tjmp .L" + string(l.label) + "\n")
+				pr.write("\tjmp .L" + pr.prefix + string(l.label) + "\n")
 			}
 		case asmCall:
-			pr.write("\tcallq " + string(l.label) + "\n")
+			if l.label != "" {
+				pr.write("\tcallq " + string(l.label) + "\n")
+			} else {
+				pr.write("\tcallq *" + l.args[0].String() + "\n")
+			}
+		case asmTailCall:
+			if l.label != "" {
+				pr.write("\tjmp " + string(l.label) + "\n")
+			} else {
+				pr.write("\tjmp *" + l.args[0].String() + "\n")
+			}
 		default:
 			fatalf("unhandled op: %v", l)
 		}
@@ -100,12 +223,16 @@ func fatalf(s string, args ...interface{}) {
 	panic("fatal compile error: " + msg)
 }
 
+// An asmProg is a single procedure in assembly form.
 type asmProg struct {
+	name      asmLabel
 	blocks    []*asmBlock
 	registers []string        // used registers
 	gcable    map[asmArg]bool // see gcableVars
 	stacksize int
 	rootsize  int
+	stackargs int // how many of our parameters our caller passed on the stack
+	retbuf    int // how many slots of psc_retbuf it uses
 }
 
 // An asmblock is a non-portable representation of a group of assembly instructions.
@@ -121,8 +248,9 @@ type asmBlock struct {
 type asmOp struct {
 	tag     asmTag
 	variant string
-	args    []asmArg
+	args    []asmArg // for calls and tail calls, the registers holding the arguments
 	label   asmLabel
+	stack   int // for calls and tail calls, how many arguments are passed on the stack
 	// type information?
 	// line number?
 }
@@ -131,12 +259,13 @@ const (
 	_ asmTag = iota
 
 	asmInstr // $variant arg, arg
-	asmCall  // call label (int?)
+	asmCall  // call label, or call *arg if there is no label
 	//asmRet   // ret
 	//asmPush  // push arg
 	//asmPop   // pop arg
 	asmJump // jmp label
 	// j$cc label
+	asmTailCall // jmp to another procedure: label, or *arg if there is no label
 )
 
 type asmTag int
@@ -147,14 +276,21 @@ type asmArg struct {
 	Reg   string // rax, rbx, ... r10, r11 etc
 	Imm   int64
 	Deref bool
+	// a symbol, addressed relative to rip
+	Sym string
 	// a variable name, for the passes before assignHomes
 	// TODO: ugh i don't like this; it should be in the portable IR, not here
 	Var string
+	// a parameter passed on the stack, for the passes before
+	// addStackFrameInstructions. Imm is its offset from rsp on entry
+	Incoming bool
 }
 
 func (a asmArg) String() string {
 	if a.Var != "" {
 		return "\u2018" + a.Var + "\u2019" // obviously invalid asm syntax
+	} else if a.Sym != "" {
+		return a.Sym + "(%rip)"
 	} else if a.Deref {
 		return fmt.Sprintf("%d(%%%s)", a.Imm, a.Reg)
 	} else if a.Reg != "" {
@@ -184,7 +320,49 @@ func (b *asmBlock) patchInstructions() {
 			switch l.variant {
 			case "imul":
 				// imul's second arg can be register, memory, or imm
-				// no patch necessary
+				// but its destination has to be a register
+				if l.args[0].isMem() {
+					b.code = append(b.code[:i+2], b.code[i:]...)
+					b.code[i] = mkinstr("movq", rax, l.args[0])
+					b.code[i+1] = mkinstr("imul", rax, l.args[1])
+					b.code[i+2] = mkinstr("movq", l.args[0], rax)
+					i += 2
+				}
+			case "movq":
+				// only movq to a register can take a 64-bit immediate
+				if l.args[0].isMem() && !l.args[1].isMem() && l.args[1].Reg == "" && l.args[1].Imm != int64(int32(l.args[1].Imm)) {
+					b.code = append(b.code[:i+1], b.code[i:]...)
+					b.code[i] = mkinstr("movq", rax, l.args[1])
+					b.code[i+1] = mkinstr("movq", l.args[0], rax)
+					i++
+				} else if l.args[0].isMem() && l.args[1].isMem() {
+					b.code = append(b.code[:i+1], b.code[i:]...)
+					b.code[i] = mkinstr("movq", rax, l.args[1])
+					b.code[i+1] = mkinstr("movq", l.args[0], rax)
+					i++
+				}
+			case "cmpq":
+				// cmpq's first operand can't be an immediate,
+				// and it can't have two memory operands either
+				if !l.args[0].isMem() && l.args[0].Reg == "" {
+					b.code = append(b.code[:i+1], b.code[i:]...)
+					b.code[i] = mkinstr("movq", rax, l.args[0])
+					b.code[i+1] = mkinstr("cmpq", rax, l.args[1])
+					i++
+				} else if l.args[0].isMem() && l.args[1].isMem() {
+					b.code = append(b.code[:i+1], b.code[i:]...)
+					b.code[i] = mkinstr("movq", rax, l.args[1])
+					b.code[i+1] = mkinstr("cmpq", l.args[0], rax)
+					i++
+				}
+			case "leaq", "movzbq":
+				// leaq's and movzbq's destination has to be a register
+				if l.args[0].isMem() {
+					b.code = append(b.code[:i+1], b.code[i:]...)
+					b.code[i] = mkinstr(l.variant, rax, l.args[1])
+					b.code[i+1] = mkinstr("movq", l.args[0], rax)
+					i++
+				}
 			default:
 				// we don't have any instrucions that take more than
 				// one argument yet, so we can just check for 2
@@ -212,7 +390,7 @@ func mkmem(reg string, offset int64) asmArg {
 	return asmArg{Reg: reg, Imm: offset, Deref: true}
 }
 
-func (a *asmArg) isMem() bool { return a.Deref }
+func (a *asmArg) isMem() bool { return a.Deref || a.Sym != "" }
 
 const useFancyAllocator = true
 
@@ -223,9 +401,18 @@ func (p *asmProg) assignHomes(gcable map[asmArg]bool) {
 	// for each variable we find, we bump the stack pointer
 	// the stack grows down, so the variables are above the stack pointer
 	// which means we need to use positive offsets from rsp
+	// the bottom of the frame holds the arguments
+	// we pass on the stack (see selectCall)
 	rp := 0
 	sp := 0
-	stacksize := 0
+	for _, b := range p.blocks {
+		for _, l := range b.code {
+			if 8*l.stack > sp {
+				sp = 8 * l.stack
+			}
+		}
+	}
+	stacksize := sp
 	rootsize := 0
 	spill := func(varname string) asmArg {
 		// TODO: get size from type info?
@@ -244,7 +431,9 @@ func (p *asmProg) assignHomes(gcable map[asmArg]bool) {
 	if useFancyAllocator {
 		// allocate registers
 		R := regalloc(p)
-		fmt.Println(R)
+		if verbose {
+			fmt.Println(R)
+		}
 		// R maps each var used by the function to a virtual register
 		// each of which needs to be mapped to a machine register or a stack location
 		// we keep track of the stack location of each virtual in this map
@@ -313,50 +502,156 @@ func (p *asmProg) assignHomes(gcable map[asmArg]bool) {
 	p.rootsize = rootsize
 }
 
-// Adds instructions to the entry and exit blocks of a program to adjust the
-// stack pointer before and after the code. Also the GC root stack.
-// Also saves & restores any registers listed in p.registers.
+// Adds instructions to the entry block of a procedure to adjust the
+// stack pointer and the GC root stack, and undoes them before every ret
+// and tail call.
+// Also saves & restores any callee-save registers listed in p.registers.
 // 	pushq %rbx
 // 	subq rsp, $stackframe
 // 	...
 // 	addq rsp, $stackframe
 // 	popq %rbx
+// 	ret
 func (p *asmProg) addStackFrameInstructions(params *regallocParams) {
 	if len(p.blocks) == 0 {
 		return
 	}
-	entry := p.blocks[0]
-	exit := p.blocks[len(p.blocks)-1]
+	var calleeSave = map[string]bool{}
+	for _, reg := range params.CalleeSave {
+		calleeSave[reg] = true
+	}
+	var prologue, epilogue []asmOp
+	var saved int
+	for _, reg := range p.registers {
+		if !calleeSave[reg] {
+			continue
+		}
+		pushq := mkinstr("pushq", asmArg{Reg: reg})
+		popq := mkinstr("popq", asmArg{Reg: reg})
+		prologue = append(prologue, pushq)
+		epilogue = append([]asmOp{popq}, epilogue...)
+		saved += 8
+	}
+	if p.hasCalls() {
+		// the stack has to be 16-byte aligned at every call.
+		// the return address pushed by our caller
+		// leaves it 8 bytes off on entry.
+		if (saved+p.stacksize)%16 == 0 {
+			p.stacksize += 8
+		}
+	}
+	if p.stacksize != 0 {
+		subq := mkinstr("subq", asmArg{Reg: "rsp"}, asmArg{Imm: int64(p.stacksize)})
+		addq := mkinstr("addq", asmArg{Reg: "rsp"}, asmArg{Imm: int64(p.stacksize)})
+		prologue = append(prologue, subq)
+		epilogue = append([]asmOp{addq}, epilogue...)
+	}
 	if p.rootsize != 0 {
 		addq := mkinstr("addq", asmArg{Reg: "r15"}, asmArg{Imm: int64(p.rootsize)})
 		subq := mkinstr("subq", asmArg{Reg: "r15"}, asmArg{Imm: int64(p.rootsize)})
-		var init []asmOp
-		init = append(init, addq)
+		prologue = append(prologue, addq)
+		// deep recursion runs out of root stack long before
+		// it runs out of machine stack
+		cmpq := mkinstr("cmpq", asmArg{Reg: "r15"}, asmArg{Sym: "rootstack_limit"})
+		prologue = append(prologue, cmpq, asmOp{tag: asmJump, variant: "a", label: "overflow"})
+		p.blocks = append(p.blocks, &asmBlock{label: "overflow", code: []asmOp{
+			mkinstr("andq", asmArg{Reg: "rsp"}, asmArg{Imm: -16}),
+			{tag: asmCall, label: "psc_stack_overflow"},
+		}})
 		for i := int64(0); i < int64(p.rootsize); i += 8 {
-			init = append(init, mkinstr("movq", mkmem("r15", -8-i), asmArg{Imm: int64(0)}))
+			prologue = append(prologue, mkinstr("movq", mkmem("r15", -8-i), asmArg{Imm: int64(0)}))
 		}
-		entry.code = append(init, entry.code...)
-		exit.code = append(exit.code, subq)
+		epilogue = append([]asmOp{subq}, epilogue...)
 	}
-	if p.stacksize != 0 {
-		subq := mkinstr("subq", asmArg{Reg: "rsp"}, asmArg{Imm: int64(p.stacksize)})
-		addq := mkinstr("addq", asmArg{Reg: "rsp"}, asmArg{Imm: int64(p.stacksize)})
-		entry.code = append([]asmOp{subq}, entry.code...)
-		exit.code = append(exit.code, addq)
+	entry := p.blocks[0]
+	entry.code = append(prologue, entry.code...)
+	// our stack parameters are above the frame and the return address
+	frame := int64(saved + p.stacksize)
+	for _, b := range p.blocks {
+		for _, l := range b.code {
+			for i, a := range l.args {
+				if a.Incoming {
+					l.args[i] = mkmem("rsp", a.Imm+frame)
+				}
+			}
+		}
+	}
+	for _, b := range p.blocks {
+		var code []asmOp
+		for _, l := range b.code {
+			if l.tag == asmTailCall && (l.stack != 0 || p.stackargs != 0) {
+				code = append(code, p.tailCallEpilogue(l, params, frame)...)
+			} else if l.tag == asmInstr && l.variant == "ret" || l.tag == asmTailCall {
+				code = append(code, epilogue...)
+			}
+			code = append(code, l)
+		}
+		b.code = code
+	}
+}
+
+// tailCallEpilogue tears down the stack frame before a tail call
+// which passes arguments on the stack, or which leaves a procedure
+// that was passed arguments on the stack.
+// The callee pops its stack arguments when it returns,
+// so the callee's arguments replace ours above the return address:
+// selectCall leaves them at the bottom of our frame
+// and we copy them up once the registers are restored.
+// r10 and r11 are free here, since they are never allocated
+// and never hold arguments.
+// 	movq 8(%rsp), %r10
+// 	movq %r10, frame+8+shift(%rsp)
+// 	...
+// 	addq $frame+shift, %rsp
+// 	jmp f
+func (p *asmProg) tailCallEpilogue(l asmOp, params *regallocParams, frame int64) []asmOp {
+	var code []asmOp
+	if p.rootsize != 0 {
+		code = append(code, mkinstr("subq", asmArg{Reg: "r15"}, asmArg{Imm: int64(p.rootsize)}))
 	}
+	// restore the callee-save registers without popping them
 	var calleeSave = map[string]bool{}
 	for _, reg := range params.CalleeSave {
 		calleeSave[reg] = true
 	}
+	slot := frame
 	for _, reg := range p.registers {
-		if !calleeSave[reg] {
-			continue
+		if calleeSave[reg] {
+			slot -= 8
+			code = append(code, mkinstr("movq", asmArg{Reg: reg}, mkmem("rsp", slot)))
 		}
-		pushq := mkinstr("pushq", asmArg{Reg: reg})
-		popq := mkinstr("popq", asmArg{Reg: reg})
-		entry.code = append([]asmOp{pushq}, entry.code...)
-		exit.code = append(exit.code, popq)
 	}
+	// the new return address goes where the callee's arguments
+	// end up just below the top of ours
+	top := frame + 8 + 8*int64(p.stackargs)
+	ret := top - 8 - 8*int64(l.stack)
+	r10 := asmArg{Reg: "r10"}
+	r11 := asmArg{Reg: "r11"}
+	code = append(code, mkinstr("movq", r11, mkmem("rsp", frame)))
+	// the arguments only move up, so copy the top one first
+	for i := int64(l.stack) - 1; i >= 0; i-- {
+		code = append(code, mkinstr("movq", r10, mkmem("rsp", 8*i)))
+		code = append(code, mkinstr("movq", mkmem("rsp", ret+8+8*i), r10))
+	}
+	code = append(code, mkinstr("movq", mkmem("rsp", ret), r11))
+	if ret != 0 {
+		code = append(code, mkinstr("addq", asmArg{Reg: "rsp"}, asmArg{Imm: ret}))
+	}
+	return code
+}
+
+// hasCalls reports whether a procedure calls any other procedures.
+// tail calls don't count, since by the time we jump
+// the stack is back the way our caller left it.
+func (p *asmProg) hasCalls() bool {
+	for _, b := range p.blocks {
+		for _, l := range b.code {
+			if l.tag == asmCall {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (a *asmArg) isVar() bool { return a.Var != "" }
@@ -372,9 +667,13 @@ func (b *asmBlock) checkMachineInstructions() error {
 		} else {
 			switch l.variant {
 			case "movq":
+			case "leaq":
 			case "addq":
 			case "subq":
 			case "negq":
+			case "andq":
+			case "testq":
+			case "sarq":
 			case "imul":
 			case "idiv":
 			case "cqto":
@@ -383,6 +682,13 @@ func (b *asmBlock) checkMachineInstructions() error {
 			case "pushq":
 			case "setz", "setnz", "setl", "setle", "setge", "setg":
 			case "movzbq":
+			// for psc/prim
+			case "addl", "subl", "adcq":
+			case "mull", "mulq", "divl", "divq":
+			case "orq", "xorq":
+			case "shll", "shlq", "shrl", "shrq", "sarl":
+			case "setb", "seta":
+			case "movl", "movslq":
 			case "ret":
 			default:
 				return fmt.Errorf("invalid instruction: %s is not an x86 instruction in %+v",
@@ -393,6 +699,10 @@ func (b *asmBlock) checkMachineInstructions() error {
 	return nil
 }
 
+// the offset of the first element of a tuple.
+// see struct tuple in runtime.c
+const tupleElemOffset = 72
+
 // select-instructions pass
 // converts from Block to asmBlock
 //
@@ -406,64 +716,93 @@ func (b *block) SelectInstructions(f *Func) *asmBlock {
 	rbase := asmArg{Reg: "r11"}
 	var out asmBlock
 	cc := ""
+	if b == f.blocks[0] {
+		// function parameters arrive in the argument registers
+		// and the rest on the stack, above the return address
+		for i, a := range b.args {
+			src := asmArg{Reg: "rsp", Imm: int64(8 * (i - len(arch.Args) + 1)), Deref: true, Incoming: true}
+			if i < len(arch.Args) {
+				src = asmArg{Reg: arch.Args[i]}
+			}
+			out.code = append(out.code, mkinstr("movq", asmArg{Var: string(a)}, src))
+		}
+	}
 	for i, l := range b.code {
 		switch l.Opcode {
 		case FuncLiteralOp:
-			// TODO
+			name := l.Value.(string)
+			f.addFuncLiteral(l.Dst[0], name)
+			out.code = append(out.code, mkinstr("leaq", asmArg{Var: string(l.Dst[0])}, asmArg{Sym: string(funcSymbol(name))}))
+		case StringLiteralOp:
+			index := l.Value.(int64)
+			out.code = append(out.code, mkinstr("leaq", asmArg{Var: string(l.Dst[0])}, asmArg{Sym: string(stringSymbol(index))}))
 		case LiteralOp:
+			var n int64
 			if v, ok := l.Value.(string); ok {
-				if n, err := strconv.ParseInt(v, 0, 64); err != nil {
+				// an int from the source code.
+				// lower has already split up any that don't fit in a small int
+				var err error
+				if n, err = strconv.ParseInt(v, 0, 64); err != nil || n < minSmallInt || n > maxSmallInt {
 					fatalf("error parsing int literal: %v: %v", l, err)
-				} else {
-					f.addLiteral(l.Dst[0], n)
 				}
+				n = n<<1 | 1
 			} else if v, ok := l.Value.(int64); ok {
-				f.addLiteral(l.Dst[0], v)
+				n = v
 			} else {
 				fatalf("unsupported value in LiteralOp: %v", l)
 			}
+			if n != int64(int32(n)) {
+				// most instructions only take 32-bit immediates
+				out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[0])}, asmArg{Imm: n}))
+			} else {
+				f.addLiteral(l.Dst[0], n)
+			}
 		case BinOp:
-			// X86 arithmetic instructions don't have a 3-form
-			// if the destination is not the same as the first src register,
-			// then first mov the first argument to the desination
-			// and the add/subtract the second argument from it.
+			if p, ok := primFuncs[l.Variant]; ok {
+				out.code = append(out.code, f.selectPrim(l, p)...)
+				break
+			}
+			// arithmetic on small ints, which are tagged: n is stored as 2n+1.
+			// we untag one or both operands in rax and r11,
+			// do the operation, and retag the result,
+			// making sure that the overflow flag is still set
+			// if the result doesn't fit in a small int.
+			// leaq doesn't touch the flags.
+			rax := asmArg{Reg: "rax"}
+			r11 := asmArg{Reg: "r11"}
 			switch l.Variant {
 			case "*":
-				out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[0])}, f.getLiteral(l.Src[0])))
-				out.code = append(out.code, mkinstr("imul", asmArg{Var: string(l.Dst[0])}, f.getLiteral(l.Src[1])))
+				// (2y) * z + 1
+				out.code = append(out.code, mkinstr("movq", rax, f.getLiteral(l.Src[0])))
+				out.code = append(out.code, mkinstr("subq", rax, asmArg{Imm: 1}))
+				out.code = append(out.code, mkinstr("movq", r11, f.getLiteral(l.Src[1])))
+				out.code = append(out.code, mkinstr("sarq", r11, asmArg{Imm: 1}))
+				out.code = append(out.code, mkinstr("imul", rax, r11))
+				out.code = append(out.code, mkinstr("leaq", rax, mkmem("rax", 1)))
+				out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[0])}, rax))
 			case "/":
-				//out.code = append(out.code, mkinstr("pushq", asmArg{Reg: "rdx"}))
-				out.code = append(out.code, mkinstr("movq", asmArg{Reg: "rax"}, f.getLiteral(l.Src[0])))
+				// 2(y / z) + 1
+				out.code = append(out.code, mkinstr("movq", rax, f.getLiteral(l.Src[0])))
+				out.code = append(out.code, mkinstr("sarq", rax, asmArg{Imm: 1}))
+				out.code = append(out.code, mkinstr("movq", r11, f.getLiteral(l.Src[1])))
+				out.code = append(out.code, mkinstr("sarq", r11, asmArg{Imm: 1}))
 				out.code = append(out.code, mkinstr("cqto"))
-				out.code = append(out.code, mkinstr("idiv", f.getLiteral(l.Src[1]))) // TODO: can't be a literal
-				out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[0])}, asmArg{Reg: "rax"}))
-				//out.code = append(out.code, mkinstr("popq", asmArg{Reg: "rdx"}))
+				out.code = append(out.code, mkinstr("idiv", r11))
+				out.code = append(out.code, mkinstr("addq", rax, rax))
+				out.code = append(out.code, mkinstr("leaq", rax, mkmem("rax", 1)))
+				out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[0])}, rax))
 			case "+":
-				if l.Dst[0] == l.Src[0] {
-					out.code = append(out.code, mkinstr("addq", asmArg{Var: string(l.Dst[0])}, f.getLiteral(l.Src[1])))
-				} else if l.Dst[0] == l.Src[1] {
-					// addition is associative, so we can flip the arguments
-					out.code = append(out.code, mkinstr("addq", asmArg{Var: string(l.Dst[0])}, f.getLiteral(l.Src[0])))
-				} else {
-					out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[0])}, f.getLiteral(l.Src[0])))
-					out.code = append(out.code, mkinstr("addq", asmArg{Var: string(l.Dst[0])}, f.getLiteral(l.Src[1])))
-				}
+				// (2y) + (2z+1)
+				out.code = append(out.code, mkinstr("movq", rax, f.getLiteral(l.Src[0])))
+				out.code = append(out.code, mkinstr("subq", rax, asmArg{Imm: 1}))
+				out.code = append(out.code, mkinstr("addq", rax, f.getLiteral(l.Src[1])))
+				out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[0])}, rax))
 			case "-":
-				if l.Dst[0] == l.Src[0] {
-					out.code = append(out.code, mkinstr("subq", asmArg{Var: string(l.Dst[0])}, f.getLiteral(l.Src[1])))
-				} else if f.getLiteral(l.Src[0]) == (asmArg{Imm: 0}) {
-					// dst = 0 - src1
-					// can be compiled to a negq instruction
-					if l.Dst[0] == l.Src[1] {
-						out.code = append(out.code, mkinstr("negq", asmArg{Var: string(l.Dst[0])}))
-					} else {
-						out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[0])}, f.getLiteral(l.Src[1])))
-						out.code = append(out.code, mkinstr("negq", asmArg{Var: string(l.Dst[0])}))
-					}
-				} else {
-					out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[0])}, f.getLiteral(l.Src[0])))
-					out.code = append(out.code, mkinstr("subq", asmArg{Var: string(l.Dst[0])}, f.getLiteral(l.Src[1])))
-				}
+				// (2y+1) - (2z+1) + 1
+				out.code = append(out.code, mkinstr("movq", rax, f.getLiteral(l.Src[0])))
+				out.code = append(out.code, mkinstr("subq", rax, f.getLiteral(l.Src[1])))
+				out.code = append(out.code, mkinstr("leaq", rax, mkmem("rax", 1)))
+				out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[0])}, rax))
 			case "eq", "ne", "<", "<=", ">=", ">":
 				var cc string
 				switch l.Variant {
@@ -491,6 +830,20 @@ func (b *block) SelectInstructions(f *Func) *asmBlock {
 			if !(i+1 < len(b.code) && b.code[i+1].Opcode == BranchOp) {
 				fatalf("compare must be followed by a branch: %d %s", i, l)
 			}
+			if l.Variant == "small" {
+				// are both ints small?
+				rax := asmArg{Reg: "rax"}
+				out.code = append(out.code, mkinstr("movq", rax, f.getLiteral(l.Src[0])))
+				out.code = append(out.code, mkinstr("andq", rax, f.getLiteral(l.Src[1])))
+				out.code = append(out.code, mkinstr("testq", rax, asmArg{Imm: 1}))
+				cc = "nz"
+				break
+			}
+			if l.Variant == "overflow" {
+				// did the preceding binop overflow?
+				cc = "o"
+				break
+			}
 			out.code = append(out.code, mkinstr("cmpq", f.getLiteral(l.Src[0]), f.getLiteral(l.Src[1])))
 			switch l.Variant {
 			case "eq":
@@ -516,25 +869,45 @@ func (b *block) SelectInstructions(f *Func) *asmBlock {
 			out.code = append(out.code, asmOp{tag: asmJump, variant: cc, label: asmLabel(l.Label[0])})
 			out.code = append(out.code, asmOp{tag: asmJump, label: asmLabel(l.Label[1])})
 		case CallOp:
-			if len(l.Src) > len(arch.Args) {
-				fatalf("too many arguments in call op: have %d but only %d registers: %v", len(l.Src), len(arch.Args), l.String())
+			if l.Variant != "" {
+				// call into the runtime
+				if len(l.Src)+1 > len(arch.Args) {
+					fatalf("too many arguments in call op: have %d but only %d registers: %v", len(l.Src), len(arch.Args), l.String())
+				}
+				// XXX uhh psc_newtuple should definitely be its own Op
+				uses := []asmArg{{Reg: arch.Args[0]}}
+				out.code = append(out.code, mkinstr("movq", uses[0], rootstack))
+				for i, a := range l.Src {
+					reg := asmArg{Reg: arch.Args[i+1]}
+					out.code = append(out.code, mkinstr("movq", reg, f.getLiteral(a)))
+					uses = append(uses, reg)
+				}
+				out.code = append(out.code, asmOp{tag: asmCall, label: asmLabel(l.Variant), args: uses})
+				out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[0])}, asmArg{Reg: "rax"}))
+				break
 			}
-			// XXX uhh psc_newtuple should definitely be its own Op
-			out.code = append(out.code, mkinstr("movq", asmArg{Reg: string(arch.Args[0])}, rootstack))
-			for i, a := range l.Src {
-				i := i + 1 // XXX
-				out.code = append(out.code, mkinstr("movq", asmArg{Reg: string(arch.Args[i])}, f.getLiteral(a)))
+			// call to a user-defined function
+			out.code = append(out.code, f.selectCall(l, asmCall)...)
+			if n := len(l.Src) - 1 - len(arch.Args); n > 0 {
+				// the callee popped its stack arguments
+				// out of the bottom of our frame
+				out.code = append(out.code, mkinstr("subq", asmArg{Reg: "rsp"}, asmArg{Imm: int64(8 * n)}))
+			}
+			for i, loc := range resultLocs(len(l.Dst)) {
+				out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[i])}, loc))
 			}
-			out.code = append(out.code, asmOp{tag: asmCall, label: asmLabel(l.Variant)})
-			out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[0])}, asmArg{Reg: "rax"}))
+		case CallWithContinuationOp:
+			// tail call.
+			// addStackFrameInstructions tears down our stack frame before the jump
+			out.code = append(out.code, f.selectCall(l, asmTailCall)...)
 		case RecordSetOp:
 			index := l.Value.(int64)
 			out.code = append(out.code, mkinstr("movq", rbase, asmArg{Var: string(l.Src[0])})) // tuple address
-			out.code = append(out.code, mkinstr("movq", mkmem(rbase.Reg, index*8), f.getLiteral(l.Src[1])))
+			out.code = append(out.code, mkinstr("movq", mkmem(rbase.Reg, tupleElemOffset+index*8), f.getLiteral(l.Src[1])))
 		case RecordGetOp:
 			index := l.Value.(int64)
 			out.code = append(out.code, mkinstr("movq", rbase, asmArg{Var: string(l.Src[0])})) // tuple address
-			out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[0])}, mkmem(rbase.Reg, index*8)))
+			out.code = append(out.code, mkinstr("movq", asmArg{Var: string(l.Dst[0])}, mkmem(rbase.Reg, tupleElemOffset+index*8)))
 		case JumpOp:
 			params := f.getBlockArgs(l.Label[0])
 			if len(l.Src) != len(params) {
@@ -545,7 +918,18 @@ func (b *block) SelectInstructions(f *Func) *asmBlock {
 			}
 			out.code = append(out.code, asmOp{tag: asmJump, label: asmLabel(l.Label[0])})
 		case ReturnOp:
-			out.code = append(out.code, mkinstr("movq", asmArg{Reg: "rax"}, f.getLiteral(l.Src[0])))
+			// fill in rax last, since patchInstructions
+			// might need it to store the other results
+			locs := resultLocs(len(l.Src))
+			for i := len(locs) - 1; i >= 0; i-- {
+				out.code = append(out.code, mkinstr("movq", locs[i], f.getLiteral(l.Src[i])))
+			}
+			if n := len(f.blocks[0].args) - len(arch.Args); n > 0 {
+				// pop our stack arguments
+				out.code = append(out.code, mkinstr("ret", asmArg{Imm: int64(8 * n)}))
+			} else {
+				out.code = append(out.code, mkinstr("ret"))
+			}
 		default:
 			fatalf("unhandled op: %s", l)
 		}
@@ -554,12 +938,129 @@ func (b *block) SelectInstructions(f *Func) *asmBlock {
 	return &out
 }
 
+// resultLocs returns where a function returns its results.
+// the first two go in rax and rdx and the rest go in psc_retbuf,
+// which ConvertProg makes big enough for all of them (see retbufSlots).
+func resultLocs(n int) []asmArg {
+	var locs []asmArg
+	for i := 0; i < n; i++ {
+		switch i {
+		case 0:
+			locs = append(locs, asmArg{Reg: "rax"})
+		case 1:
+			locs = append(locs, asmArg{Reg: "rdx"})
+		default:
+			locs = append(locs, asmArg{Sym: fmt.Sprintf("psc_retbuf+%d", 8*(i-2))})
+		}
+	}
+	return locs
+}
+
+// retbufSlots returns how many slots of psc_retbuf a function uses,
+// either to return its results or to receive the results of its calls.
+func retbufSlots(f *Func) int {
+	slots := 0
+	for _, b := range f.blocks {
+		for _, l := range b.code {
+			n := 0
+			switch l.Opcode {
+			case ReturnOp:
+				n = len(l.Src)
+			case CallOp:
+				n = len(l.Dst)
+			}
+			if n-2 > slots {
+				slots = n - 2
+			}
+		}
+	}
+	return slots
+}
+
+// selectCall sets up the arguments for a call to a user-defined function.
+// Src[0] is the function; the rest are arguments.
+// Arguments which don't fit in the argument registers go at the bottom
+// of our stack frame, where the callee finds them above its return address,
+// and the callee pops them when it returns.
+// addStackFrameInstructions moves them up for a tail call.
+func (f *Func) selectCall(l Op, tag asmTag) []asmOp {
+	arch := sysvRegisters
+	args := l.Src[1:]
+	var code []asmOp
+	var uses []asmArg
+	stack := 0
+	for i, a := range args {
+		if i >= len(arch.Args) {
+			code = append(code, mkinstr("movq", mkmem("rsp", int64(8*stack)), f.getLiteral(a)))
+			stack++
+			continue
+		}
+		reg := asmArg{Reg: arch.Args[i]}
+		code = append(code, mkinstr("movq", reg, f.getLiteral(a)))
+		uses = append(uses, reg)
+	}
+	if name, ok := f.funclits[l.Src[0]]; ok {
+		// we know which function this is, so call it directly
+		code = append(code, asmOp{tag: tag, label: funcSymbol(name), args: uses, stack: stack})
+	} else {
+		// indirect call.
+		// load the function pointer last so that it doesn't
+		// get clobbered while we're setting up the arguments
+		rax := asmArg{Reg: "rax"}
+		code = append(code, mkinstr("movq", rax, asmArg{Var: string(l.Src[0])}))
+		code = append(code, asmOp{tag: tag, args: append([]asmArg{rax}, uses...), stack: stack})
+	}
+	return code
+}
+
 func (l *Op) String() string {
 	var buf bytes.Buffer
 	l.debugstr(&buf)
 	return buf.String()
 }
 
+// every function's assembly symbol starts with this prefix
+// so that it can't collide with symbols from the runtime or libc
+const symbolPrefix = "psc."
+
+// symbol returns the assembly symbol for a function
+func (f *Func) symbol() asmLabel {
+	return funcSymbol(f.Name)
+}
+
+// funcSymbol turns a function's name into a symbol.
+// a top-level function in a module is named after the module,
+// like std/int.add, which becomes psc.std.int.add.
+// anything else which can't be in a symbol becomes an underscore.
+func funcSymbol(name string) asmLabel {
+	name = strings.TrimPrefix(strings.Trim(name, "<>"), "./")
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/':
+			return '.'
+		case r == '_' || r == '.' || r == '$',
+			'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+	return asmLabel(symbolPrefix + name)
+}
+
+// stringSymbol returns the symbol for a string literal.
+// it is a local label, like the labels of blocks,
+// but it can't collide with them because theirs all start with .Lpsc.
+func stringSymbol(index int64) asmLabel {
+	return asmLabel(".Lstr." + strconv.FormatInt(index, 10))
+}
+
+func (f *Func) addFuncLiteral(r Reg, name string) {
+	if f.funclits == nil {
+		f.funclits = make(map[Reg]string)
+	}
+	f.funclits[r] = name
+}
+
 func (f *Func) addLiteral(r Reg, value int64) {
 	if f.literals == nil {
 		f.literals = make(map[Reg]int64)
@@ -567,6 +1068,101 @@ func (f *Func) addLiteral(r Reg, value int64) {
 	f.literals[r] = value
 }
 
+// selectPrim selects instructions for a binop from psc/prim.
+// the operands are loaded into rax and r11 (or rcx, for a shift count)
+// and operated on there, with 32- or 64-bit instructions.
+// 32-bit instructions zero the upper half of their destination,
+// which keeps int32s zero-extended.
+func (f *Func) selectPrim(l Op, p *primFunc) []asmOp {
+	rax := asmArg{Reg: "rax"}
+	r11 := asmArg{Reg: "r11"}
+	rdx := asmArg{Reg: "rdx"}
+	// the registers and suffix for the operation's size
+	a, t, suffix := rax, r11, "q"
+	if p.Size == 32 {
+		a, t, suffix = asmArg{Reg: "eax"}, asmArg{Reg: "r11d"}, "l"
+	}
+	var code []asmOp
+	emit := func(variant string, args ...asmArg) {
+		code = append(code, mkinstr(variant, args...))
+	}
+	dst := func(i int) asmArg { return asmArg{Var: string(l.Dst[i])} }
+	load := func() {
+		emit("movq", rax, f.getLiteral(l.Src[0]))
+		if len(l.Src) > 1 {
+			emit("movq", r11, f.getLiteral(l.Src[1]))
+		}
+	}
+	switch p.Op {
+	case "add", "sub":
+		// the carry flag is the second result.
+		// movq doesn't touch the flags
+		load()
+		emit(p.Op+suffix, a, t)
+		emit("movq", dst(0), rax)
+		emit("movq", dst(1), asmArg{Imm: 0})
+		emit("adcq", dst(1), asmArg{Imm: 0})
+	case "mul":
+		// rdx:rax = rax * r11
+		load()
+		emit("mul"+suffix, t)
+		emit("movq", dst(1), rax)
+		emit("movq", dst(0), rdx)
+	case "divmod":
+		// rax, rdx = rdx:rax / r11
+		load()
+		emit("movq", rdx, asmArg{Imm: 0})
+		emit("div"+suffix, t)
+		emit("movq", dst(1), rdx)
+		emit("movq", dst(0), rax)
+	case "and", "or", "xor":
+		// int32s are zero-extended, so these are the same for both sizes
+		load()
+		emit(p.Op+"q", rax, r11)
+		emit("movq", dst(0), rax)
+	case "shl", "shr", "shrs":
+		// the shift count has to be in cl
+		var op = map[string]string{"shl": "shl", "shr": "shr", "shrs": "sar"}[p.Op]
+		emit("movq", rax, f.getLiteral(l.Src[0]))
+		emit("movq", asmArg{Reg: "rcx"}, f.getLiteral(l.Src[1]))
+		emit(op+suffix, a, asmArg{Reg: "cl"})
+		emit("movq", dst(0), rax)
+	case "eq", "less", "gt":
+		// unsigned comparisons.
+		// int32s are zero-extended, so these are the same for both sizes
+		var cc = map[string]string{"eq": "z", "less": "b", "gt": "a"}[p.Op]
+		emit("cmpq", f.getLiteral(l.Src[0]), f.getLiteral(l.Src[1]))
+		emit("set"+cc, asmArg{Reg: "al"})
+		emit("movzbq", dst(0), asmArg{Reg: "al"})
+	case "toint":
+		// untag a small int.
+		// lower calls into the runtime for the others
+		emit("movq", rax, f.getLiteral(l.Src[0]))
+		emit("sarq", rax, asmArg{Imm: 1})
+		if p.Size == 32 {
+			emit("movl", a, a)
+		}
+		emit("movq", dst(0), rax)
+	case "fromint", "fromints":
+		// tag an int32, zero- or sign-extending it first.
+		// an int64 might not fit in a small int, so lower
+		// calls into the runtime for those
+		if p.Size != 32 {
+			fatalf("unsupported operation %s in binop: %s", l.Variant, l)
+		}
+		emit("movq", rax, f.getLiteral(l.Src[0]))
+		if p.Op == "fromints" {
+			emit("movslq", rax, a)
+		}
+		emit("addq", rax, rax)
+		emit("leaq", rax, mkmem("rax", 1))
+		emit("movq", dst(0), rax)
+	default:
+		fatalf("unsupported operation %s in binop: %s", l.Variant, l)
+	}
+	return code
+}
+
 // getLiteral converts a Reg into a asmArg
 // it returns a Imm if the Reg corresponds to an integer literal
 // and a Var otherwise
@@ -614,7 +1210,7 @@ func (a *asmArg) isReg() bool { return !a.Deref && a.Reg != "" }
 func gcableVars(f *Func) map[asmArg]bool {
 	gcable := make(map[asmArg]bool)
 	for r, t := range f.regtype {
-		if isTupleT(t) {
+		if mayPoint(t) {
 			gcable[asmArg{Var: string(r)}] = true
 		}
 	}
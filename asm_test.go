@@ -3,7 +3,10 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -25,8 +28,9 @@ psc_main:
 	pushq %rbp
 	movq %rsp, %rbp
 	pushq  %r15
+	subq   $8,%rsp
 	movq   $4096,%rsi
-	movq   $4096,%rdi
+	movq   $1048576,%rdi
 	callq  psc_gcinit
 	movq   rootstack_begin(%rip),%r15
 .L0:
@@ -35,6 +39,7 @@ psc_main:
 	subq $2, %rax
 	negq %rax
 
+	addq $8, %rsp
 	popq %r15
 	popq %rbp
 	ret
@@ -155,53 +160,466 @@ func TestAssignHomes(t *testing.T) {
 	}
 }
 
-func printAsmBlock(b *asmBlock) {
-	var p AsmPrinter
-	p.w = os.Stdout
-	p.ConvertBlock(b)
-}
-
 func TestCompile(t *testing.T) {
 	if !useFancyAllocator {
 		t.Skip("fancy allocator not enabled")
 	}
 	const source = `let v = 1 in let w = 42 in let x = v + 7 in let y = x in let z = x + w in z - y end end end end end`
 	const want = asmPrologue +
-		`.Lentry:
-	movq $1, %rcx
-	addq $7, %rcx
-	movq %rcx, %rdx
-	addq $42, %rdx
-	subq %rcx, %rdx
-	movq %rdx, %rax
-` + asmEpilogue
+		"\tcallq psc.toplevel\n" +
+		"\tmovq %rax, %rdi\n" +
+		"\tcallq psc_printint\n" +
+		asmEpilogue + `
+psc.toplevel:
+.Lpsc.toplevel.entry:
+	subq $8, %rsp
+	addq $8, %r15
+	cmpq rootstack_limit(%rip), %r15
+	ja .Lpsc.toplevel.overflow
+	movq $0, -8(%r15)
+	movq $3, %rax
+	andq $15, %rax
+	testq $1, %rax
+	jnz .Lpsc.toplevel.fast.1
+	jmp .Lpsc.toplevel.slow.3
+.Lpsc.toplevel.fast.1:
+	movq $3, %rax
+	subq $1, %rax
+	addq $15, %rax
+	movq %rax, %rcx
+	jo .Lpsc.toplevel.slow.3
+	jmp .Lpsc.toplevel.ok.2
+.Lpsc.toplevel.ok.2:
+	movq %rcx, -8(%r15)
+	jmp .Lpsc.toplevel.end.4
+.Lpsc.toplevel.slow.3:
+	movq %r15, %rdi
+	movq $3, %rsi
+	movq $15, %rdx
+	callq psc_int_add
+	movq %rax, %rcx
+	movq %rcx, -8(%r15)
+	jmp .Lpsc.toplevel.end.4
+.Lpsc.toplevel.end.4:
+	movq -8(%r15), %rax
+	andq $85, %rax
+	testq $1, %rax
+	jnz .Lpsc.toplevel.fast.5
+	jmp .Lpsc.toplevel.slow.7
+.Lpsc.toplevel.fast.5:
+	movq -8(%r15), %rax
+	subq $1, %rax
+	addq $85, %rax
+	movq %rax, %rcx
+	jo .Lpsc.toplevel.slow.7
+	jmp .Lpsc.toplevel.ok.6
+.Lpsc.toplevel.ok.6:
+	jmp .Lpsc.toplevel.end.8
+.Lpsc.toplevel.slow.7:
+	movq %r15, %rdi
+	movq -8(%r15), %rsi
+	movq $85, %rdx
+	callq psc_int_add
+	movq %rax, %rcx
+	jmp .Lpsc.toplevel.end.8
+.Lpsc.toplevel.end.8:
+	movq %rcx, %rax
+	andq -8(%r15), %rax
+	testq $1, %rax
+	jnz .Lpsc.toplevel.fast.9
+	jmp .Lpsc.toplevel.slow.11
+.Lpsc.toplevel.fast.9:
+	movq %rcx, %rax
+	subq -8(%r15), %rax
+	leaq 1(%rax), %rax
+	movq %rax, %rdx
+	jo .Lpsc.toplevel.slow.11
+	jmp .Lpsc.toplevel.ok.10
+.Lpsc.toplevel.ok.10:
+	movq %rdx, %rcx
+	jmp .Lpsc.toplevel.end.12
+.Lpsc.toplevel.slow.11:
+	movq %r15, %rdi
+	movq %rcx, %rsi
+	movq -8(%r15), %rdx
+	callq psc_int_sub
+	movq %rax, %rcx
+	jmp .Lpsc.toplevel.end.12
+.Lpsc.toplevel.end.12:
+	movq %rcx, %rax
+	subq $8, %r15
+	addq $8, %rsp
+	ret
+.Lpsc.toplevel.overflow:
+	andq $-16, %rsp
+	callq psc_stack_overflow
+` + asmTrailer
 
 	expr, err := parse(strings.NewReader(source))
 	if err != nil {
 		t.Fatal("parse failed: ", err)
 	}
-	prog := lower(expr)
-	block := prog.funcs[0].blocks[0]
-	b := block.SelectInstructions(prog.funcs[0])
-	if err := b.checkMachineInstructions(); err != nil {
-		printAsmBlock(b)
-		t.Fatal("chechMachineInstructions failed: ", err)
+	expr, types, err := check(expr)
+	if err != nil {
+		t.Fatal("typecheck failed: ", err)
+	}
+	asm, err := compile(expr, types)
+	if err != nil {
+		t.Fatal("compile failed: ", err)
 	}
+	got := string(asm)
+	if want != got {
+		t.Errorf("want:%s\ngot:%s", want, got)
+	}
+}
 
-	p := &asmProg{blocks: []*asmBlock{b}}
-	p.assignHomes(nil)
-	p.addStackFrameInstructions(sysvRegisters)
+func TestFuncSymbol(t *testing.T) {
+	for _, tt := range []struct{ name, want string }{
+		{"f", "psc.f"},
+		{"f.1", "psc.f.1"},
+		{"<lambda>", "psc.lambda"},
+		{"std/int.add", "psc.std.int.add"},
+		{"./util.double", "psc.util.double"},
+		{"example.com/foo@v1/bar.f", "psc.example.com.foo_v1.bar.f"},
+	} {
+		if got := funcSymbol(tt.name); got != asmLabel(tt.want) {
+			t.Errorf("funcSymbol(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
 
-	b.patchInstructions()
+// runTests are whole programs which are built with cc and run,
+// both directly and via continuation-passing style,
+// and checked against what they print.
+// a program with wantErr set is expected to fail with that message.
+var runTests = []struct {
+	name    string
+	source  string
+	want    string
+	wantErr string
+	direct  bool // don't run it via continuation-passing style
+}{
+	{
+		// each function gets its own procedure,
+		// even if another function has the same name
+		name:   "functions",
+		source: `let f = func f(x) x + 1 end in let g = func f(y) y * 2 end in let h = func(z) z - 3 end in f(1) * 100 + g(5) * 10 + h(4) end end end`,
+		want:   "301",
+	},
+	{
+		// fac calls itself directly, apply calls its parameter,
+		// and tailapply jumps to it
+		name: "calls",
+		source: `let fac = func fac(x) if x < 2 then 1 else x * fac(x - 1) end end in
+let apply = func(f, y) f(y) + 0 end in
+let tailapply = func(f, y) f(y) end in
+apply(fac, 5) + tailapply(fac, 6)
+end end end`,
+		want: "840",
+	},
+	{
+		name:   "six params",
+		source: `let f = func(a, b, c, d, e, g) a + 2*b + 3*c + 4*d + 5*e + 6*g end in f(1, 2, 3, 4, 5, 6) end`,
+		want:   "91",
+	},
+	{
+		// the closure's environment is a seventh argument
+		name:   "six params and a closure",
+		source: `let k = 1000 in let f = func(a, b, c, d, e, g) k + a + 2*b + 3*c + 4*d + 5*e + 6*g end in f(1, 2, 3, 4, 5, 6) + 0 end end`,
+		want:   "1091",
+	},
+	{
+		name: "stack args",
+		source: `func h(a, b, c, d, e, f, g, i, j) a - b + c - d + e - f + g - i + j end
+func k(a, b, c, d, e, f, g, i, j, m) h(m, a, b, c, d, e, f, g, i) * 100 + h(a, b, c, d, e, f, g, i, j) end
+k(1, 2, 3, 4, 5, 6, 7, 8, 9, 10)`,
+		want: "1405",
+	},
+	{
+		// deep enough to overflow the stack if the tail calls grew it
+		name:   "self tail call",
+		source: `func loop(n, a, b, c, d) if n == 0 then a + b + c + d else loop(n - 1, b, c, d, a + 1) end end loop(10000000, 1, 2, 3, 4)`,
+		want:   "10000010",
+	},
+	{
+		// g and k pass different numbers of arguments on the stack
+		name: "mutual tail calls",
+		source: `func g(n, a, b, c, d, e, f, h) if n == 0 then a + b + c + d + e + f + h else k(n - 1, a + 1, b, c, d, e, f, h, 1) end end
+func k(n, a, b, c, d, e, f, h, i) if n == 0 then 0 else g(n - 1, a + i, b, c, d, e, f, h) end end
+g(10000000, 1, 2, 3, 4, 5, 6, 7)`,
+		want: "10000028",
+	},
+	{
+		// the root stack runs out first.
+		// in continuation-passing style, the stack doesn't grow
+		name:    "stack overflow",
+		source:  `func f(n) if n == 0 then 0 else 1 + f(n - 1) end end f(10000000)`,
+		wantErr: "stack overflow",
+		direct:  true,
+	},
+	{
+		// the first two results are returned in registers
+		name:   "two results",
+		source: `let f = func(x) values(x, x * 10) end in let a, b = f(3) in a - b end end`,
+		want:   "-27",
+	},
+	{
+		// the results after the second are returned in memory
+		name: "twenty results",
+		source: `let f = func(x) values(x, x + 1, x + 2, x + 3, x + 4, x + 5, x + 6, x + 7, x + 8, x + 9, x + 10, x + 11, x + 12, x + 13, x + 14, x + 15, x + 16, x + 17, x + 18, x + 19) end in
+let r0, r1, r2, r3, r4, r5, r6, r7, r8, r9, r10, r11, r12, r13, r14, r15, r16, r17, r18, r19 = f(1) in r0 + r1 + r2 + r3 + r4 + r5 + r6 + r7 + r8 + r9 + r10 + r11 + r12 + r13 + r14 + r15 + r16 + r17 + r18 + r19 end end`,
+		want: "210",
+	},
+	{
+		name:   "division",
+		source: `let y = 10 in let z = 3 in y / z * 100 + -7 / 2 * 10 + y / (0 - z) end end`,
+		want:   "267",
+	},
+	{
+		// the fast path mustn't trap on a small zero
+		name:    "divide by zero",
+		source:  `let z = 0 in 10 / z end`,
+		wantErr: "integer divide by zero",
+	},
+	{
+		// either kind of operand, in the same function
+		name:   "concat",
+		source: `func show(x) "<" .. x .. ">" end show(1) .. show("one")`,
+		want:   "<1><one>",
+	},
+	{
+		name: "add with carry",
+		source: `import "psc/prim"
+let s, c = prim.add32(prim.toint32(4294967295), prim.toint32(2)) in
+let d, b = prim.sub32(prim.one32, prim.toint32(2)) in
+let s64, c64 = prim.add64(prim.toint64(0 - 1), prim.one64) in
+prim.fromint32(s) * 1000 + prim.fromint32(c) * 100 + prim.fromint32(d) * 10 + prim.fromint32(b) + prim.fromint64(s64) + prim.fromint64(c64)
+end end end`,
+		want: "42949674052",
+	},
+	{
+		name: "mul hi and lo",
+		source: `import "psc/prim"
+let hi, lo = prim.mul32(prim.toint32(65536), prim.toint32(196609)) in
+let hi64, lo64 = prim.mul64(prim.toint64(4294967296), prim.toint64(4294967297)) in
+prim.fromint32(hi) * 1000000 + prim.fromint32(lo) + prim.fromint64(hi64) * 10000000000 + prim.fromint64(lo64)
+end end`,
+		want: "14298032832",
+	},
+	{
+		// even and odd refer to each other before they are defined
+		name: "top-level functions",
+		source: `func even(n) if n < 1 then true else odd(n - 1) end end
+func odd(n) if n < 1 then false else even(n - 1) end end
+let ten = 10
+public let answer = if even(ten) and odd(7) then ten * 4 + 2 else 0 end
+answer`,
+		want: "42",
+	},
+	{
+		// the standard library is in lib
+		name: "std",
+		source: `import "std" ( math )
+math.max(math.abs(-3), math.min(2, 5)) * 10 + math.sign(-4)`,
+		want: "29",
+	},
+	{
+		// each literal is printed the same as a string built at runtime
+		name:   "string literals",
+		source: `let s = "a" .. 1 in if s < "a\n" then s else "a\n" .. s .. "\"" end end`,
+		want:   "a\na1\"",
+	},
+	{
+		name: "string comparison",
+		source: `func b(x) if x then "t" else "f" end end
+b("a" < "b") .. b("ab" < "b") .. b("b" < "ab") .. b("a" < "a\n") .. b("abc" == "ab" .. "c") .. b("" < "a") .. b("a" >= "a")`,
+		want: "ttftttt",
+	},
+	{
+		name:   "string conversion",
+		source: `"n=" .. 12345678901234567890 .. "," .. (0 - 7) .. "," .. ""`,
+		want:   "n=12345678901234567890,-7,",
+	},
+	{
+		// append changes the list in place
+		name: "lists",
+		source: `func join(xs, i) if i == len(xs) then "" else xs[i] .. " " .. join(xs, i + 1) end end
+let xs = [3, 1, 2] in
+let ys = append(xs, 4) in
+join(for x in xs do x * 10 end, 0) .. len(ys)
+end end`,
+		want: "30 10 20 40 4",
+	},
+	{
+		name:    "list index too big",
+		source:  `let xs = [1, 2] in xs[2] end`,
+		wantErr: "index out of range",
+	},
+	{
+		name:    "negative list index",
+		source:  `let xs = [1, 2] in xs[0 - 1] end`,
+		wantErr: "index out of range",
+	},
+	{
+		// setting a key again doesn't move it,
+		// but deleting it and adding it back does
+		name: "dict order",
+		source: `func join(xs, i) if i == len(xs) then "" else xs[i] .. " " .. join(xs, i + 1) end end
+let d = {"b": 1, "a": 2, "c": 3} in
+let d = set(delete(set(d, "b", 10), "a"), "a", 20) in
+join(keys(d), 0) .. lookup(d, "b") .. " " .. lookup(d, "a")
+end end`,
+		want: "b c a 10 20",
+	},
+	{
+		// keys are equal if their values are,
+		// even if they were built separately
+		name: "dict keys",
+		source: `let s = {"ab": 1} in
+let t = {tuple(1, "x"): 2} in
+let n = {12345678901234567890: 3, 0 - 5: 4} in
+let b = {true: 5} in
+lookup(s, "a" .. "b") * 10000 + lookup(t, tuple(0 + 1, "x")) * 1000 + lookup(n, 12345678901234567889 + 1) * 100 + lookup(n, 0 - 5) * 10 + lookup(b, 1 < 2)
+end end end end`,
+		want: "12345",
+	},
+	{
+		name:    "missing dict key",
+		source:  `let d = {1: 2} in lookup(d, 2) end`,
+		wantErr: "key not found",
+	},
+	{
+		// a record with more than 63 fields doesn't fit in an ordinary tuple
+		name: "records",
+		source: `type point { x int, y int }
+type mixed { s str, n int, b bool, p point }
+type big { ` + seq(70, "f%d int") + ` }
+let m = mixed{p: point{y: 4, x: 3}, b: true, n: 2, s: "s"} in
+let g = big{` + seq(70, "f%[1]d: %[1]d") + `} in
+m.s .. m.n .. (if m.b then "t" else "f" end) .. m.p.x .. m.p.y .. " " .. g.f0 .. " " .. g.f1 .. " " .. g.f35 .. " " .. g.f69
+end end`,
+		want: "s2t34 0 1 35 69",
+	},
+	{
+		// a variant with more than 62 values doesn't fit in an
+		// ordinary tuple with its tag
+		name: "variants",
+		source: `type shape = circle(int) | rect(int, int) | empty | named(str, shape)
+type big = wide(` + strings.TrimSuffix(strings.Repeat("int, ", 70), ", ") + `) | narrow
+func area(s)
+  match s
+  case circle(r) then 3 * r * r
+  case rect(w, h) then w * h
+  case empty then 0
+  case named(n, t) then area(t)
+  end
+end
+func name(s)
+  match s
+  case named(n, t) then n
+  else "?"
+  end
+end
+func join(xs, i) if i == len(xs) then "" else xs[i] .. " " .. join(xs, i + 1) end end
+let shapes = [rect(2, 3), empty, circle(2), named("sq", rect(4, 4)), rect(5, 1)] in
+join(for s in shapes do area(s) .. name(s) end, 0) ..
+match wide(` + seq(70, "%d") + `) case wide(` + seq(70, "v%d") + `) then v0 + v1 + v69 case narrow then 0 end
+end`,
+		want: "6? 0? 12? 16sq 5? 70",
+	},
+	{
+		// the heap starts out small, so this collects many times
+		name: "collection",
+		source: `type point { x int, y int }
+type tree = leaf | node(tree, int, tree)
+func build(n) if n == 0 then leaf else node(build(n - 1), n, build(n - 1)) end end
+func sum(t) match t case leaf then 0 case node(l, n, r) then sum(l) + n + sum(r) end end
+func loop(n, xs, d) if n == 0 then 0 else let p = point{x: n, y: n * 2} in loop(n - 1, append(xs, p), set(d, "k" .. n, p)) end end end
+let t = build(10) in
+let xs = [point{x: 0, y: 0}] in
+let d = {"k0": point{x: 0, y: 0}} in
+let ignore = loop(2000, xs, d) in
+sum(t) .. " " .. len(xs) .. " " .. xs[1000].y .. " " .. lookup(d, "k" .. 1500).x .. " " .. lookup(d, "k1").y
+end end end end`,
+		want: "2036 2001 2002 1500 2",
+	},
+	{
+		// the collector mustn't take raw ints for pointers
+		// in lists, dicts and tuples while it moves them
+		name: "sized ints across collections",
+		source: `import "psc/prim"
+func loop(n, xs, d) if n == 0 then tuple(xs, d) else loop(n - 1, append(xs, prim.toint64(n * 4096)), set(d, "k" .. n, prim.toint64(n * 8))) end end
+let r = loop(3000, [prim.zero64], {"k0": prim.zero64}) in
+let xs = get(r, 0) in
+let d = get(r, 1) in
+prim.fromint64(xs[1]) .. " " .. prim.fromint64(xs[3000]) .. " " .. prim.fromint64(lookup(d, "k2999")) .. " " .. len(xs)
+end end end`,
+		want: "12288000 4096 23992 3001",
+	},
+}
 
-	var pr AsmPrinter
-	buf := new(bytes.Buffer)
-	pr.w = buf
-	pr.convertSingleBlockProgram(b)
+func TestRun(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("cc not found")
+	}
+	dir, err := ioutil.TempDir("", "psctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(cps bool) { useCPS = cps }(useCPS)
+	for i, tt := range runTests {
+		filename := filepath.Join(dir, fmt.Sprintf("test%d.lang", i))
+		if err := ioutil.WriteFile(filename, []byte(tt.source), 0o666); err != nil {
+			t.Fatal(err)
+		}
+		for _, cps := range []bool{false, true} {
+			if cps && tt.direct {
+				continue
+			}
+			useCPS = cps
+			exeName := filepath.Join(dir, fmt.Sprintf("test%d", i))
+			if err := build(filename, exeName); err != nil {
+				t.Errorf("%s (cps %v): build failed: %v", tt.name, cps, err)
+				continue
+			}
+			var stderr bytes.Buffer
+			cmd := exec.Command(exeName)
+			cmd.Stderr = &stderr
+			out, err := cmd.Output()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(stderr.String(), tt.wantErr) {
+					t.Errorf("%s (cps %v): got error %v and output %q, want %q", tt.name, cps, err, stderr.String(), tt.wantErr)
+				}
+			} else if err != nil {
+				t.Errorf("%s (cps %v): %v", tt.name, cps, err)
+			}
+			if got := programOutput(out); got != tt.want {
+				t.Errorf("%s (cps %v): got %q, want %q", tt.name, cps, got, tt.want)
+			}
+		}
+	}
+}
 
-	got := buf.String()
+// programOutput returns what a program printed,
+// without the collector's debugging output
+func programOutput(out []byte) string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		switch line {
+		case "COLLECT", "SHRINK", "GROW":
+		default:
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
 
-	if want != got {
-		t.Errorf("want:%s\ngot:%s", want, got)
+// seq formats the numbers from 0 to n-1 and joins them with commas
+func seq(n int, format string) string {
+	var list []string
+	for i := 0; i < n; i++ {
+		list = append(list, fmt.Sprintf(format, i))
 	}
+	return strings.Join(list, ", ")
 }
@@ -1,72 +1,446 @@
 package main
 
+import (
+	"fmt"
+	"text/scanner"
+)
+
 type Expr interface{}
 
+// A Span is the range of source text that an Expr was parsed from.
+// Start is the position of the first character
+// and End is the position immediately after the last character.
+// Exprs which are invented by the compiler may have a zero Span.
+type Span struct {
+	Start scanner.Position
+	End   scanner.Position
+}
+
+func (s Span) span() Span { return s }
+
+type spanner interface {
+	span() Span
+}
+
+// spanOf returns the source span of an expression
+func spanOf(e Expr) Span {
+	if n, ok := e.(spanner); ok {
+		return n.span()
+	}
+	return Span{}
+}
+
+// between returns a span covering everything from a to b.
+// a and b may be Exprs or Spans.
+func between(a, b interface{}) Span {
+	return Span{Start: spanOf(a).Start, End: spanOf(b).End}
+}
+
+// An Error is a diagnostic about a particular position in the source.
+type Error struct {
+	Pos scanner.Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	if !e.Pos.IsValid() {
+		return e.Msg
+	}
+	return e.Pos.String() + ": " + e.Msg
+}
+
+// errorAt returns an error located at the start of an expression
+func errorAt(e Expr, format string, v ...interface{}) error {
+	return &Error{Pos: spanOf(e).Start, Msg: fmt.Sprintf(format, namedTypes(v)...)}
+}
+
 type VarExpr struct {
+	Span
 	Name string
 }
 
 type BoolExpr struct {
+	Span
 	Value bool
 }
 
 type IntExpr struct {
+	Span
+	Value string
+}
+
+// StrExpr is a string literal.
+// Value has already been unquoted.
+type StrExpr struct {
+	Span
 	Value string
 }
 
 type BinExpr struct {
+	Span
 	Op    string
 	Left  Expr
 	Right Expr
+	Neg   bool // written as -Right; the parser supplies a 0 for Left
 }
 
 type AndExpr struct {
+	Span
 	Left  Expr
 	Right Expr
 }
 
 type OrExpr struct {
+	Span
 	Left  Expr
 	Right Expr
 }
 
 type CallExpr struct {
+	Span
 	Func Expr
 	Args []Expr
 }
 
 type DotExpr struct {
+	Span
 	Op    string
 	Left  Expr
 	Right string
 }
 
+// RecordExpr constructs a record, naming each of its fields.
+//
+//	point{x: 1, y: 2}
+type RecordExpr struct {
+	Span
+	Type   string // the record type's name
+	Fields []string
+	Vals   []Expr
+}
+
+// VariantExpr constructs a value of a variant type.
+// the parser sees an ordinary call or variable;
+// the linker knows which names are constructors.
+//
+//	circle(2)
+type VariantExpr struct {
+	Span
+	Type string // the variant type's name
+	Tag  string // the constructor's name
+	Args []Expr
+}
+
+// MatchExpr chooses one of its cases according to which variant
+// its value is, and binds the variant's values to the case's variables.
+// if there is no case for a variant, Else is evaluated instead.
+//
+//	match s
+//	case circle(r) then r * r * 3
+//	case rect(w, h) then w * h
+//	else 0
+//	end
+type MatchExpr struct {
+	Span
+	Var   string // holds the value while the cases look at it
+	Val   Expr
+	Cases []*MatchCase
+	Else  Expr // may be nil
+}
+
+type MatchCase struct {
+	Span
+	Type  string // the variant type's name, filled in by the linker
+	Tag   string
+	Index int // which variant of the type it is, also from the linker
+	Vars  []string
+	Body  Expr
+}
+
 type LetExpr struct {
+	Span
 	Var  string
+	Type TypeExpr // may be nil
+	Val  Expr
+	Body Expr
+}
+
+// LetValuesExpr binds the results of an expression
+// which produces more than one value, like a call to
+// a function with multiple results.
+//
+//	let q, r = divmod(a, b) in ... end
+type LetValuesExpr struct {
+	Span
+	Vars []string
 	Val  Expr
 	Body Expr
 }
 
 type IfExpr struct {
+	Span
 	Cond Expr
 	Then Expr
 	Else Expr
 }
 
+// ListExpr is a list literal.
+//
+//	[a, b, c]
+type ListExpr struct {
+	Span
+	Args []Expr
+}
+
+// IndexExpr gets an element of a list.
+//
+//	xs[i]
+type IndexExpr struct {
+	Span
+	Base  Expr
+	Index Expr
+}
+
+// ForExpr evaluates its body for each element of a list,
+// and collects the results in a new list.
+//
+//	for x in xs do x * 2 end
+type ForExpr struct {
+	Span
+	Var  string
+	List Expr
+	Body Expr
+}
+
+// DictExpr is a dict literal.
+// Keys and Vals are the same length.
+//
+//	{"a": 1, "b": 2}
+type DictExpr struct {
+	Span
+	Keys []Expr
+	Vals []Expr
+}
+
 type FuncExpr struct {
+	Span
+	Name        string
+	Args        []string
+	ArgTypes    []TypeExpr // nil, or one for each arg; unannotated args are nil
+	ReturnTypes []TypeExpr // may be nil
+	Body        Expr
+}
+
+// top-level syntax
+
+// A File is a parsed source file: its imports,
+// its top-level declarations, and the expression
+// whose value is the result of the program.
+type File struct {
+	Imports  []*ImportDecl
+	Decls    []Decl
+	Body     Expr       // nil in a module which is only imported
+	Comments []*Comment // in source order, for the formatter
+}
+
+// a Comment is a // or /* */ comment, including the slashes
+type Comment struct {
+	Span
+	Text string
+}
+
+// ImportDecl imports one module from a package (see load.go).
+//
+//	import "std" ( fmt urlpkg "net/url" )
+//
+// is two ImportDecls.
+type ImportDecl struct {
+	Span
+	Package string // the package's path, without the version; "." for the importing package
+	Version string // the version after the @, if any
+	Module  string // the module's path within the package; empty for the base module
+	Name    string // the name the module goes by in this file
+}
+
+type Decl interface{}
+
+// LetDecl is a top-level let. it has no body;
+// the variable is in scope for the rest of the module,
+// and in modules which import it if it is public.
+type LetDecl struct {
+	Span
+	Public bool
+	Var    string
+	Type   TypeExpr // may be nil
+	Val    Expr
+}
+
+// FuncDecl is a named function at the top level of a file.
+// the top-level functions in a module can all call each other.
+//
+//	public func add(a, b) ... end
+type FuncDecl struct {
+	Span
+	Public bool
+	Func   *FuncExpr
+}
+
+// TypeDecl declares a record type or a variant type
+// at the top level of a file.
+//
+//	type point { x int, y int }
+//	type shape = circle(int) | rect(int, int) | empty
+type TypeDecl struct {
+	Span
+	Public   bool
+	Name     string
+	Fields   []string
+	Types    []TypeExpr
+	Variants []*Variant // nil for a record type
+}
+
+// a Variant is one of the alternatives of a variant type:
+// its constructor's name and the types of its values
+type Variant struct {
+	Span
+	Tag   string
+	Types []TypeExpr
+}
+
+// type expressions, for type annotations
+
+type TypeExpr interface{}
+
+// NamedTypeExpr is a type referred to by name, like int,
+// possibly with type arguments, like tuple(int, bool)
+type NamedTypeExpr struct {
+	Span
 	Name string
-	Args []string
-	Body Expr
+	Args []TypeExpr
+}
+
+type FuncTypeExpr struct {
+	Span
+	Params  []TypeExpr
+	Results []TypeExpr
+}
+
+// TupleTypeExpr is a tuple type written (int, bool).
+// tuple(int, bool) is a NamedTypeExpr.
+type TupleTypeExpr struct {
+	Span
+	Types []TypeExpr
+}
+
+// BadExpr is a placeholder for a part of the program
+// which had a syntax error.
+// Later passes skip over it without reporting any more errors.
+type BadExpr struct {
+	Span
 }
 
 // these are used internally by the compiler
 // they are not created during parsing
 
 type TupleExpr struct {
+	Span
+	Args []Expr
+}
+
+// ValuesExpr produces multiple values.
+// it comes from the values(...) builtin.
+type ValuesExpr struct {
+	Span
 	Args []Expr
 }
 
 type TupleIndexExpr struct {
+	Span
+	Base  Expr
+	Index int
+}
+
+// ListLenExpr is the length of a list.
+// it comes from the len(...) builtin.
+type ListLenExpr struct {
+	Span
+	List Expr
+}
+
+// AppendExpr adds an element to the end of a list, in place,
+// and produces the list. it comes from the append(...) builtin.
+type AppendExpr struct {
+	Span
+	List Expr
+	Elem Expr
+}
+
+// DictOpExpr is an operation on a dict, Args[0].
+// it comes from one of the dict builtins:
+//
+//	lookup(d, k)    the value of k, which must be in d
+//	set(d, k, v)    sets the value of k in place and produces d
+//	delete(d, k)    removes k, if it is there, and produces d
+//	contains(d, k)  whether k is in d
+//	keys(d)         a new list of the keys in d, oldest first
+type DictOpExpr struct {
+	Span
+	Op   string
+	Args []Expr
+}
+
+// VariantTagExpr is the tag of a variant value:
+// the index of its variant in the type declaration.
+// it comes from a match expression.
+type VariantTagExpr struct {
+	Span
+	Base Expr
+}
+
+// VariantGetExpr is one of the values of a variant,
+// which must be the variant named Tag.
+// it comes from a match expression.
+type VariantGetExpr struct {
+	Span
 	Base  Expr
+	Type  string // the variant type's name
+	Tag   string
 	Index int
 }
+
+// PrimExpr is a use of a function or constant from psc/prim,
+// like prim.add32(x, y) or prim.zero32. see prim.go.
+// a function may produce more than one value.
+type PrimExpr struct {
+	Span
+	Name string
+	Args []Expr // nil for a constant
+}
+
+// LetRecExpr binds a group of functions which can call each other,
+// like the top-level functions of a module. it is created by the linker.
+// Vals are anonymous FuncExprs, until closure conversion
+// turns them into ClosureExprs.
+type LetRecExpr struct {
+	Span
+	Vars []string
+	Vals []Expr
+	Body Expr
+}
+
+// LetTypeExpr declares the record types of a module, which can refer
+// to each other. it is created by the linker, which gives the types
+// their global names.
+type LetTypeExpr struct {
+	Span
+	Types []*TypeDecl
+	Body  Expr
+}
+
+// ClosureExpr is a function together with the values of its free variables.
+// It is created by closure conversion.
+type ClosureExpr struct {
+	Span
+	Func *FuncExpr // takes the closure as its first argument
+	Free []Expr
+}
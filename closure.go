@@ -0,0 +1,403 @@
+package main
+
+import "fmt"
+
+// closure.go does closure conversion.
+//
+// every function becomes a closure: a tuple whose first element is
+// the function's code and whose remaining elements are the values of
+// the function's free variables, copied when the closure is created.
+// the function gets the closure as an extra first parameter, $env,
+// and references to free variables become loads from $env.
+//
+//	let a = 1 in
+//	let f = func(b) a + b end in
+//	f(2)
+//
+// becomes
+//
+//	let a = 1 in
+//	let f = #closure(func($env, b) #get($env, 1) + b end, a) in
+//	f(2)
+//
+// a reference to the function's own name becomes a reference to $env.
+// the functions in a LetRecExpr are free variables of each other.
+// calls are left alone; lower knows that a function value is a closure
+// and passes it along as the first argument.
+//
+// this pass runs after typechecking and uncoverTuples.
+// the expressions it builds get the types of the ones they replace;
+// a function keeps its type even with $env added, because lower
+// knows about that.
+
+// the name of the closure parameter.
+// a program can't have a variable called $env of its own,
+// so it never shadows one in the function body.
+const envName = "$env"
+
+func convertClosures(e Expr, types *typeTable) Expr {
+	c := closureConverter{types}
+	var top scope
+	return c.expr(&top, e)
+}
+
+type closureConverter struct {
+	types *typeTable
+}
+
+func (c *closureConverter) expr(s *scope, expr Expr) Expr {
+	return c.types.same(expr, c.node(s, expr))
+}
+
+// the scope maps each variable to the expression which replaces it:
+// either a VarExpr for itself, or a load from the closure environment
+func (c *closureConverter) node(s *scope, expr Expr) Expr {
+	switch e := expr.(type) {
+	case *VarExpr:
+		if !s.has(e.Name) {
+			// typechecking already complained
+			break
+		}
+		switch r := s.lookup(e.Name).(type) {
+		case *VarExpr:
+			return &VarExpr{Span: e.Span, Name: r.Name}
+		case *TupleIndexExpr:
+			return &TupleIndexExpr{Span: e.Span, Base: r.Base, Index: r.Index}
+		default:
+			panic(fmt.Sprintf("unhandled case: %T", r))
+		}
+	case *BoolExpr:
+		break
+	case *IntExpr:
+		break
+	case *StrExpr:
+		break
+	case *BadExpr:
+		break
+	case *DotExpr:
+		return &DotExpr{
+			Span:  e.Span,
+			Op:    e.Op,
+			Left:  c.expr(s, e.Left),
+			Right: e.Right,
+		}
+	case *BinExpr:
+		return &BinExpr{
+			Span:  e.Span,
+			Op:    e.Op,
+			Left:  c.expr(s, e.Left),
+			Right: c.expr(s, e.Right),
+		}
+	case *AndExpr:
+		return &AndExpr{
+			Span:  e.Span,
+			Left:  c.expr(s, e.Left),
+			Right: c.expr(s, e.Right),
+		}
+	case *OrExpr:
+		return &OrExpr{
+			Span:  e.Span,
+			Left:  c.expr(s, e.Left),
+			Right: c.expr(s, e.Right),
+		}
+	case *CallExpr:
+		var args = make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = c.expr(s, e.Args[i])
+		}
+		return &CallExpr{
+			Span: e.Span,
+			Func: c.expr(s, e.Func),
+			Args: args,
+		}
+	case *LetExpr:
+		inner := s.push()
+		inner.vars[e.Var] = &VarExpr{Name: e.Var}
+		return &LetExpr{
+			Span: e.Span,
+			Var:  e.Var,
+			Val:  c.expr(s, e.Val),
+			Body: c.expr(inner, e.Body),
+		}
+	case *LetValuesExpr:
+		inner := s.push()
+		for _, name := range e.Vars {
+			inner.vars[name] = &VarExpr{Name: name}
+		}
+		return &LetValuesExpr{
+			Span: e.Span,
+			Vars: e.Vars,
+			Val:  c.expr(s, e.Val),
+			Body: c.expr(inner, e.Body),
+		}
+	case *LetRecExpr:
+		// each function's closure holds the other functions in the group
+		// as free variables; lower fills them in once they all exist.
+		// giving the function a name lets it refer to itself as $env.
+		inner := s.push()
+		for _, name := range e.Vars {
+			inner.vars[name] = &VarExpr{Name: name}
+		}
+		vals := make([]Expr, len(e.Vals))
+		for i, val := range e.Vals {
+			f := *val.(*FuncExpr)
+			f.Name = e.Vars[i]
+			vals[i] = c.expr(inner, c.types.same(val, &f))
+		}
+		return &LetRecExpr{
+			Span: e.Span,
+			Vars: e.Vars,
+			Vals: vals,
+			Body: c.expr(inner, e.Body),
+		}
+	case *LetTypeExpr:
+		return &LetTypeExpr{Span: e.Span, Types: e.Types, Body: c.expr(s, e.Body)}
+	case *IfExpr:
+		return &IfExpr{
+			Span: e.Span,
+			Cond: c.expr(s, e.Cond),
+			Then: c.expr(s, e.Then),
+			Else: c.expr(s, e.Else),
+		}
+	case *TupleExpr:
+		var args = make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = c.expr(s, e.Args[i])
+		}
+		return &TupleExpr{Span: e.Span, Args: args}
+	case *ValuesExpr:
+		var args = make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = c.expr(s, e.Args[i])
+		}
+		return &ValuesExpr{Span: e.Span, Args: args}
+	case *TupleIndexExpr:
+		return &TupleIndexExpr{
+			Span:  e.Span,
+			Base:  c.expr(s, e.Base),
+			Index: e.Index,
+		}
+	case *PrimExpr:
+		var args = make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = c.expr(s, e.Args[i])
+		}
+		return &PrimExpr{Span: e.Span, Name: e.Name, Args: args}
+	case *ListExpr:
+		var args = make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = c.expr(s, e.Args[i])
+		}
+		return &ListExpr{Span: e.Span, Args: args}
+	case *IndexExpr:
+		return &IndexExpr{
+			Span:  e.Span,
+			Base:  c.expr(s, e.Base),
+			Index: c.expr(s, e.Index),
+		}
+	case *DictExpr:
+		var keys = make([]Expr, len(e.Keys))
+		var vals = make([]Expr, len(e.Vals))
+		for i := range e.Keys {
+			keys[i] = c.expr(s, e.Keys[i])
+			vals[i] = c.expr(s, e.Vals[i])
+		}
+		return &DictExpr{Span: e.Span, Keys: keys, Vals: vals}
+	case *DictOpExpr:
+		var args = make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = c.expr(s, e.Args[i])
+		}
+		return &DictOpExpr{Span: e.Span, Op: e.Op, Args: args}
+	case *RecordExpr:
+		var vals = make([]Expr, len(e.Vals))
+		for i := range e.Vals {
+			vals[i] = c.expr(s, e.Vals[i])
+		}
+		return &RecordExpr{Span: e.Span, Type: e.Type, Fields: e.Fields, Vals: vals}
+	case *VariantExpr:
+		var args []Expr
+		for _, a := range e.Args {
+			args = append(args, c.expr(s, a))
+		}
+		return &VariantExpr{Span: e.Span, Type: e.Type, Tag: e.Tag, Args: args}
+	case *VariantTagExpr:
+		return &VariantTagExpr{Span: e.Span, Base: c.expr(s, e.Base)}
+	case *VariantGetExpr:
+		return &VariantGetExpr{
+			Span:  e.Span,
+			Base:  c.expr(s, e.Base),
+			Type:  e.Type,
+			Tag:   e.Tag,
+			Index: e.Index,
+		}
+	case *ListLenExpr:
+		return &ListLenExpr{Span: e.Span, List: c.expr(s, e.List)}
+	case *AppendExpr:
+		return &AppendExpr{
+			Span: e.Span,
+			List: c.expr(s, e.List),
+			Elem: c.expr(s, e.Elem),
+		}
+	case *FuncExpr:
+		free := freeVars(s, e)
+		env := &VarExpr{Span: e.Span, Name: envName}
+		inner := s.push()
+		if e.Name != "" {
+			inner.vars[e.Name] = env
+		}
+		for i, name := range free {
+			inner.vars[name] = &TupleIndexExpr{Base: env, Index: i + 1}
+		}
+		for _, name := range e.Args {
+			inner.vars[name] = &VarExpr{Name: name}
+		}
+		// the captured values are evaluated in the enclosing scope
+		vals := make([]Expr, len(free))
+		for i, name := range free {
+			vals[i] = c.expr(s, &VarExpr{Span: e.Span, Name: name})
+		}
+		return &ClosureExpr{
+			Span: e.Span,
+			Func: c.types.same(e, &FuncExpr{
+				Span: e.Span,
+				Name: e.Name,
+				Args: append([]string{envName}, e.Args...),
+				Body: c.expr(inner, e.Body),
+			}).(*FuncExpr),
+			Free: vals,
+		}
+	default:
+		panic(fmt.Sprintf("unhandled case: %T", e))
+	}
+	return expr
+}
+
+// freeVars returns the variables from the enclosing scope s which are
+// referenced in the body of a function, in order of first appearance
+func freeVars(s *scope, e *FuncExpr) []string {
+	var free []string
+	seen := make(map[string]bool)
+	inner := newscope(nil)
+	if e.Name != "" {
+		inner.vars[e.Name] = true
+	}
+	for _, name := range e.Args {
+		inner.vars[name] = true
+	}
+	var visit func(bound *scope, e Expr)
+	visit = func(bound *scope, e Expr) {
+		switch e := e.(type) {
+		case *VarExpr:
+			if !bound.has(e.Name) && s.has(e.Name) && !seen[e.Name] {
+				seen[e.Name] = true
+				free = append(free, e.Name)
+			}
+		case *BoolExpr, *IntExpr, *StrExpr, *BadExpr:
+			// nothing
+		case *DotExpr:
+			visit(bound, e.Left)
+		case *BinExpr:
+			visit(bound, e.Left)
+			visit(bound, e.Right)
+		case *AndExpr:
+			visit(bound, e.Left)
+			visit(bound, e.Right)
+		case *OrExpr:
+			visit(bound, e.Left)
+			visit(bound, e.Right)
+		case *CallExpr:
+			visit(bound, e.Func)
+			for _, a := range e.Args {
+				visit(bound, a)
+			}
+		case *LetExpr:
+			visit(bound, e.Val)
+			inner := bound.push()
+			inner.vars[e.Var] = true
+			visit(inner, e.Body)
+		case *LetValuesExpr:
+			visit(bound, e.Val)
+			inner := bound.push()
+			for _, name := range e.Vars {
+				inner.vars[name] = true
+			}
+			visit(inner, e.Body)
+		case *LetRecExpr:
+			inner := bound.push()
+			for _, name := range e.Vars {
+				inner.vars[name] = true
+			}
+			for _, val := range e.Vals {
+				visit(inner, val)
+			}
+			visit(inner, e.Body)
+		case *LetTypeExpr:
+			visit(bound, e.Body)
+		case *IfExpr:
+			visit(bound, e.Cond)
+			visit(bound, e.Then)
+			visit(bound, e.Else)
+		case *TupleExpr:
+			for _, a := range e.Args {
+				visit(bound, a)
+			}
+		case *ValuesExpr:
+			for _, a := range e.Args {
+				visit(bound, a)
+			}
+		case *TupleIndexExpr:
+			visit(bound, e.Base)
+		case *PrimExpr:
+			for _, a := range e.Args {
+				visit(bound, a)
+			}
+		case *ListExpr:
+			for _, a := range e.Args {
+				visit(bound, a)
+			}
+		case *IndexExpr:
+			visit(bound, e.Base)
+			visit(bound, e.Index)
+		case *DictExpr:
+			for i := range e.Keys {
+				visit(bound, e.Keys[i])
+				visit(bound, e.Vals[i])
+			}
+		case *DictOpExpr:
+			for _, a := range e.Args {
+				visit(bound, a)
+			}
+		case *RecordExpr:
+			for _, a := range e.Vals {
+				visit(bound, a)
+			}
+		case *VariantExpr:
+			for _, a := range e.Args {
+				visit(bound, a)
+			}
+		case *VariantTagExpr:
+			visit(bound, e.Base)
+		case *VariantGetExpr:
+			visit(bound, e.Base)
+		case *ListLenExpr:
+			visit(bound, e.List)
+		case *AppendExpr:
+			visit(bound, e.List)
+			visit(bound, e.Elem)
+		case *FuncExpr:
+			inner := bound.push()
+			if e.Name != "" {
+				inner.vars[e.Name] = true
+			}
+			for _, name := range e.Args {
+				inner.vars[name] = true
+			}
+			visit(inner, e.Body)
+		default:
+			panic(fmt.Sprintf("unhandled case in freeVars: %T", e))
+		}
+	}
+	visit(inner, e.Body)
+	return free
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestConvertClosures(t *testing.T) {
+	const source = `let a = 1 in
+let f = func f(b) if b < 1 then a else f(b - a) end end in
+f((func(a) let g = func(c) 5 + a + c end in g(a) end end)(a))
+end end`
+	expr, err := parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	// f refers to itself through its closure and captures a;
+	// the anonymous function's parameter shadows a, so it captures nothing;
+	// g captures the inner a
+	const want = `let a = 1 in
+  let f = #closure(func f($env, b)
+    if b < 1 then
+      #get($env, 1)
+    else
+      $env(b - #get($env, 1))
+    end
+  end, a) in
+    f(#closure(func ($env, a)
+      let g = #closure(func ($env, c)
+        5 + #get($env, 1) + c
+      end, a) in
+        g(a)
+      end
+    end)(a))
+  end
+end
+`
+	var buf bytes.Buffer
+	formatExpr(&buf, convertClosures(expr, nil))
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestConvertClosuresLetRec(t *testing.T) {
+	const source = `let a = 1
+func even(n) if n < 1 then a else odd(n - 1) end end
+func odd(n) if n < 1 then 0 else even(n - a) end end
+even(4)
+`
+	expr, err := parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	// each function refers to itself through $env,
+	// and captures a and the other function
+	const want = `let a = 1 in
+  #letrec even = #closure(func even($env, n)
+    if n < 1 then
+      #get($env, 1)
+    else
+      #get($env, 2)(n - 1)
+    end
+  end, a, odd) and odd = #closure(func odd($env, n)
+    if n < 1 then
+      0
+    else
+      #get($env, 1)(n - #get($env, 2))
+    end
+  end, even, a) in
+    even(4)
+  end
+end
+`
+	var buf bytes.Buffer
+	formatExpr(&buf, convertClosures(expr, nil))
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -1,59 +1,321 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 // cps.go does an ast-to-ast transformation
 // from arbitrary source code into continuation passing style
 
-// C[k] [ func(...) body end ] = func(k1, ...) k1(C[k][ body ]) end
+// C[k] [ func(...) body end ] = k(func(..., k1) C[k1][ body ] end)
 // C[k] [ let v = x in body end ] = C[ func(v) C[k][ body ] ][ x ]
+// C[k] [ if c then x else y end ] = let k1 = k in if c then C[k1][ x ] else C[k1][ y ] end
+// C[k] [ let a, b = x in body end ] = C[ func(a, b) C[k][ body ] ][ x ]
+// C[k] [ f(x, y) ] = f(x, y, k)
+// C[k] [ values(x, y) ] = k(x, y)
+// C[k] [ prim.f(x, y) ] = let a, b = prim.f(x, y) in k(a, b) end  (if it has more than one result)
 // C[k] [ expr ] = k(expr)
+//
+// the input has to be in A-normal form (see anf.go),
+// so that the operands of every expression are trivial.
+//
+// the output is an ordinary program in which every call is a tail call.
+// it goes through closure conversion and lower like any other program.
+
+// cpsProgram converts a whole program to CPS.
+// the final continuation just returns its argument.
+//
+// the values keep their types. the functions don't: they take
+// a continuation and never return, except for the final one.
+func cpsProgram(expr Expr, types *typeTable) Expr {
+	c := cpsConverter{types: types}
+	result := types.single(expr)
+	types.define("$x", result)
+	halt := &FuncExpr{
+		Args: []string{"$x"},
+		Body: &VarExpr{Name: "$x"},
+	}
+	types.set(halt, &FuncT{Params: []Type{result}, Return: []Type{result}})
+	return c.convert(halt, expr)
+}
 
 func cpsConvert(k, expr Expr) Expr {
+	var c cpsConverter
+	return c.convert(k, expr)
+}
+
+type cpsConverter struct {
+	lastvar int
+	types   *typeTable
+}
+
+// newvar returns a fresh variable name, like $k1 for a continuation
+// or $v1 for a value passed to one.
+// the numbers are shared between the prefixes, and anf uses $t,
+// so every name we make up is different.
+func (c *cpsConverter) newvar(prefix string) string {
+	c.lastvar++
+	return prefix + strconv.Itoa(c.lastvar)
+}
+
+// isContinuation reports whether a variable introduced by CPS conversion
+// holds a continuation. continuations are always closures, which the
+// garbage collector needs to know about.
+func isContinuation(name string) bool {
+	return strings.HasPrefix(name, "$k")
+}
+
+// the type of a continuation (as far as we know)
+var continuationType = &TupleT{Type: []Type{&FuncT{Params: []Type{AnyT{}}}}}
+
+func (c *cpsConverter) convert(k, expr Expr) Expr {
 	switch e := expr.(type) {
-	case *VarExpr:
-		return &CallExpr{Func: k, Args: []Expr{e}}
-	case *IntExpr:
-		return &CallExpr{Func: k, Args: []Expr{e}}
-	case *DotExpr:
-		return &CallExpr{Func: k, Args: []Expr{e}}
-	case *BinExpr:
+	case *VarExpr, *IntExpr, *StrExpr, *BoolExpr, *DotExpr, *BinExpr, *TupleExpr, *TupleIndexExpr,
+		*ListExpr, *IndexExpr, *ListLenExpr, *AppendExpr, *DictExpr, *DictOpExpr, *RecordExpr,
+		*VariantExpr, *VariantTagExpr, *VariantGetExpr:
 		// assume the operands are trivial
-		return &CallExpr{Func: k, Args: []Expr{e}}
+		return &CallExpr{Span: spanOf(e), Func: k, Args: []Expr{c.value(e)}}
+	case *AndExpr:
+		if isTrivial(e.Right) {
+			return &CallExpr{Span: e.Span, Func: k, Args: []Expr{c.value(e)}}
+		}
+		// the right side is only evaluated if the left side is true
+		return c.convert(k, &IfExpr{
+			Span: e.Span,
+			Cond: e.Left,
+			Then: e.Right,
+			Else: &BoolExpr{Span: e.Span, Value: false},
+		})
+	case *OrExpr:
+		if isTrivial(e.Right) {
+			return &CallExpr{Span: e.Span, Func: k, Args: []Expr{c.value(e)}}
+		}
+		return c.convert(k, &IfExpr{
+			Span: e.Span,
+			Cond: e.Left,
+			Then: &BoolExpr{Span: e.Span, Value: true},
+			Else: e.Right,
+		})
 	case *CallExpr:
-		// arguments cannot be function calls
-		// maybe this shoud be a separate pass?
-		// yeah, just assume that's already been done
+		// arguments cannot be function calls;
+		// anf took care of that
 		//
 		// add continuation parameter
+		args := make([]Expr, len(e.Args), len(e.Args)+1)
+		for i := range e.Args {
+			args[i] = c.value(e.Args[i])
+		}
 		return &CallExpr{
-			Func: e.Func,
-			//Args: append([]Expr{k}, e.Args...),
-			Args: append(e.Args[:len(e.Args):len(e.Args)], k),
+			Span: e.Span,
+			Func: c.value(e.Func),
+			Args: append(args, k),
 		}
 	case *LetExpr:
+		if isTrivial(e.Val) {
+			// no need for a continuation
+			return &LetExpr{
+				Span: e.Span,
+				Var:  e.Var,
+				Val:  c.value(e.Val),
+				Body: c.convert(k, e.Body),
+			}
+		}
 		// construct a continuation
 		k1 := &FuncExpr{
+			Span: e.Span,
 			Args: []string{e.Var},
-			Body: cpsConvert(k, e.Body),
+			Body: c.convert(k, e.Body),
+		}
+		return c.convert(k1, e.Val)
+	case *LetValuesExpr:
+		if isTrivial(e.Val) {
+			// a prim function with more than one result.
+			// no need for a continuation
+			return &LetValuesExpr{
+				Span: e.Span,
+				Vars: e.Vars,
+				Val:  c.value(e.Val),
+				Body: c.convert(k, e.Body),
+			}
+		}
+		// the continuation takes all the values
+		k1 := &FuncExpr{
+			Span: e.Span,
+			Args: e.Vars,
+			Body: c.convert(k, e.Body),
+		}
+		return c.convert(k1, e.Val)
+	case *LetRecExpr:
+		// the functions are values; only the body needs k
+		vals := make([]Expr, len(e.Vals))
+		for i := range e.Vals {
+			vals[i] = c.value(e.Vals[i])
+		}
+		return &LetRecExpr{
+			Span: e.Span,
+			Vars: e.Vars,
+			Vals: vals,
+			Body: c.convert(k, e.Body),
+		}
+	case *LetTypeExpr:
+		return &LetTypeExpr{Span: e.Span, Types: e.Types, Body: c.convert(k, e.Body)}
+	case *ValuesExpr:
+		args := make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = c.value(e.Args[i])
+		}
+		return &CallExpr{Span: e.Span, Func: k, Args: args}
+	case *PrimExpr:
+		n := len(primFuncs[e.Name].Results)
+		if n == 1 {
+			return &CallExpr{Span: e.Span, Func: k, Args: []Expr{c.value(e)}}
+		}
+		// bind the results so we can pass them all to k
+		vars := make([]string, n)
+		args := make([]Expr, n)
+		types := c.types.of(e)
+		for i := range vars {
+			vars[i] = c.newvar("$v")
+			args[i] = &VarExpr{Span: e.Span, Name: vars[i]}
+			if i < len(types) {
+				c.types.define(vars[i], types[i])
+			}
+		}
+		return &LetValuesExpr{
+			Span: e.Span,
+			Vars: vars,
+			Val:  c.value(e),
+			Body: &CallExpr{Span: e.Span, Func: k, Args: args},
 		}
-		return cpsConvert(k1, e.Val)
 	case *IfExpr:
+		// both branches use the continuation.
+		// bind it to a variable so that we don't duplicate it
+		if _, ok := k.(*VarExpr); !ok {
+			name := c.newvar("$k")
+			return &LetExpr{
+				Span: e.Span,
+				Var:  name,
+				Val:  k,
+				Body: c.convert(&VarExpr{Span: e.Span, Name: name}, e),
+			}
+		}
 		return &IfExpr{
-			Cond: e.Cond,
-			Then: cpsConvert(k, e.Then),
-			Else: cpsConvert(k, e.Else),
+			Span: e.Span,
+			Cond: c.value(e.Cond),
+			Then: c.convert(k, e.Then),
+			Else: c.convert(k, e.Else),
 		}
+	case *FuncExpr:
+		return &CallExpr{Span: e.Span, Func: k, Args: []Expr{c.value(e)}}
+	default:
+		panic(fmt.Sprintf("unhandled case: %T", e))
+	}
+}
+
+// value converts a trivial expression.
+// it doesn't need a continuation, but any functions inside it
+// need to be converted.
+func (c *cpsConverter) value(expr Expr) Expr {
+	v := c.convertValue(expr)
+	if _, ok := expr.(*FuncExpr); !ok {
+		c.types.same(expr, v)
+	}
+	return v
+}
+
+func (c *cpsConverter) convertValue(expr Expr) Expr {
+	switch e := expr.(type) {
+	case *VarExpr, *IntExpr, *StrExpr, *BoolExpr:
+		return e
+	case *DotExpr:
+		return &DotExpr{Span: e.Span, Op: e.Op, Left: c.value(e.Left), Right: e.Right}
+	case *BinExpr:
+		return &BinExpr{Span: e.Span, Op: e.Op, Left: c.value(e.Left), Right: c.value(e.Right)}
+	case *AndExpr:
+		return &AndExpr{Span: e.Span, Left: c.value(e.Left), Right: c.value(e.Right)}
+	case *OrExpr:
+		return &OrExpr{Span: e.Span, Left: c.value(e.Left), Right: c.value(e.Right)}
+	case *TupleExpr:
+		args := make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = c.value(e.Args[i])
+		}
+		return &TupleExpr{Span: e.Span, Args: args}
+	case *TupleIndexExpr:
+		return &TupleIndexExpr{Span: e.Span, Base: c.value(e.Base), Index: e.Index}
+	case *PrimExpr:
+		args := make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = c.value(e.Args[i])
+		}
+		return &PrimExpr{Span: e.Span, Name: e.Name, Args: args}
+	case *ListExpr:
+		args := make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = c.value(e.Args[i])
+		}
+		return &ListExpr{Span: e.Span, Args: args}
+	case *IndexExpr:
+		return &IndexExpr{Span: e.Span, Base: c.value(e.Base), Index: c.value(e.Index)}
+	case *ListLenExpr:
+		return &ListLenExpr{Span: e.Span, List: c.value(e.List)}
+	case *DictExpr:
+		keys := make([]Expr, len(e.Keys))
+		vals := make([]Expr, len(e.Vals))
+		for i := range e.Keys {
+			keys[i] = c.value(e.Keys[i])
+			vals[i] = c.value(e.Vals[i])
+		}
+		return &DictExpr{Span: e.Span, Keys: keys, Vals: vals}
+	case *DictOpExpr:
+		args := make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = c.value(e.Args[i])
+		}
+		return &DictOpExpr{Span: e.Span, Op: e.Op, Args: args}
+	case *RecordExpr:
+		vals := make([]Expr, len(e.Vals))
+		for i := range e.Vals {
+			vals[i] = c.value(e.Vals[i])
+		}
+		return &RecordExpr{Span: e.Span, Type: e.Type, Fields: e.Fields, Vals: vals}
+	case *VariantExpr:
+		var args []Expr
+		for _, a := range e.Args {
+			args = append(args, c.value(a))
+		}
+		return &VariantExpr{Span: e.Span, Type: e.Type, Tag: e.Tag, Args: args}
+	case *VariantTagExpr:
+		return &VariantTagExpr{Span: e.Span, Base: c.value(e.Base)}
+	case *VariantGetExpr:
+		return &VariantGetExpr{Span: e.Span, Base: c.value(e.Base), Type: e.Type, Tag: e.Tag, Index: e.Index}
+	case *AppendExpr:
+		return &AppendExpr{Span: e.Span, List: c.value(e.List), Elem: c.value(e.Elem)}
+	case *LetExpr:
+		return &LetExpr{Span: e.Span, Var: e.Var, Val: c.value(e.Val), Body: c.value(e.Body)}
+	case *LetRecExpr:
+		vals := make([]Expr, len(e.Vals))
+		for i := range e.Vals {
+			vals[i] = c.value(e.Vals[i])
+		}
+		return &LetRecExpr{Span: e.Span, Vars: e.Vars, Vals: vals, Body: c.value(e.Body)}
+	case *LetTypeExpr:
+		return &LetTypeExpr{Span: e.Span, Types: e.Types, Body: c.value(e.Body)}
+	case *IfExpr:
+		return &IfExpr{Span: e.Span, Cond: c.value(e.Cond), Then: c.value(e.Then), Else: c.value(e.Else)}
 	case *FuncExpr:
 		// add continuation argument
-		f := &FuncExpr{Name: e.Name,
-			//Args: append([]string{"k"}, e.Args...),
-			Args: append(e.Args[:len(e.Args):len(e.Args)], "k"),
-			Body: cpsConvert(&VarExpr{"k"}, e.Body),
+		k := c.newvar("$k")
+		return &FuncExpr{
+			Span: e.Span,
+			Name: e.Name,
+			Args: append(e.Args[:len(e.Args):len(e.Args)], k),
+			Body: c.convert(&VarExpr{Span: e.Span, Name: k}, e.Body),
 		}
-		return &CallExpr{Func: k, Args: []Expr{f}}
 	default:
-		panic(fmt.Sprintf("unhandled case: %T", e))
+		panic(fmt.Sprintf("unhandled case in cps value: %T", e))
 	}
 }
 
@@ -69,29 +331,98 @@ func isTrivial(e Expr) bool {
 		return true
 	case *IntExpr:
 		return true
+	case *StrExpr:
+		return true
+	case *BoolExpr:
+		return true
 	case *BinExpr:
 		return isTrivial(e.Left) && isTrivial(e.Right)
+	case *AndExpr:
+		return isTrivial(e.Left) && isTrivial(e.Right)
+	case *OrExpr:
+		return isTrivial(e.Left) && isTrivial(e.Right)
 	case *CallExpr:
 		return false
 	case *DotExpr:
 		return isTrivial(e.Left)
 	case *LetExpr:
 		return isTrivial(e.Val) && isTrivial(e.Body)
+	case *LetValuesExpr, *ValuesExpr:
+		// the values are passed to a continuation
+		return false
+	case *LetRecExpr:
+		// the functions are trivial
+		return isTrivial(e.Body)
+	case *LetTypeExpr:
+		return isTrivial(e.Body)
 	case *IfExpr:
-		return isTrivial(e.Then) && isTrivial(e.Else)
+		return isTrivial(e.Cond) && isTrivial(e.Then) && isTrivial(e.Else)
 	case *FuncExpr:
 		return true // !!
+	case *TupleExpr:
+		for _, a := range e.Args {
+			if !isTrivial(a) {
+				return false
+			}
+		}
+		return true
+	case *TupleIndexExpr:
+		return isTrivial(e.Base)
+	case *PrimExpr:
+		// even the ones with more than one result
+		for _, a := range e.Args {
+			if !isTrivial(a) {
+				return false
+			}
+		}
+		return true
+	case *ListExpr:
+		// the runtime calls don't count
+		for _, a := range e.Args {
+			if !isTrivial(a) {
+				return false
+			}
+		}
+		return true
+	case *IndexExpr:
+		return isTrivial(e.Base) && isTrivial(e.Index)
+	case *ListLenExpr:
+		return isTrivial(e.List)
+	case *DictExpr:
+		return areTrivial(e.Keys) && areTrivial(e.Vals)
+	case *DictOpExpr:
+		return areTrivial(e.Args)
+	case *RecordExpr:
+		return areTrivial(e.Vals)
+	case *VariantExpr:
+		return areTrivial(e.Args)
+	case *VariantTagExpr:
+		return isTrivial(e.Base)
+	case *VariantGetExpr:
+		return isTrivial(e.Base)
+	case *AppendExpr:
+		return isTrivial(e.List) && isTrivial(e.Elem)
 	default:
 		panic(fmt.Sprintf("unhandled case in isTrivial: %T", e))
 	}
 }
 
+func areTrivial(list []Expr) bool {
+	for _, e := range list {
+		if !isTrivial(e) {
+			return false
+		}
+	}
+	return true
+}
+
 // Generic visit function, for eas of copy-pasting...
 func visitSkeleton(expr Expr) Expr {
 	switch e := expr.(type) {
 	case *VarExpr:
 	case *IntExpr:
 	case *BoolExpr:
+	case *BadExpr:
 	case *BinExpr:
 	case *AndExpr:
 	case *OrExpr:
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCPSProgram(t *testing.T) {
+	const source = `let f = func(x) x + 1 end in
+if f(1) < 3 and f(2) < 4 then f(f(3)) else 0 end
+end`
+	// the calls in operand positions are bound to temporaries,
+	// the 'and' becomes an if because its right side makes a call,
+	// and the continuations of the ifs are bound to variables
+	// so that both branches can share them
+	const want = `let f = func (x, $k1)
+  $k1(x + 1)
+end in
+  f(1, func ($t1)
+    let $k3 = func ($t3)
+      let $k2 = func ($x)
+        $x
+      end in
+        if $t3 then
+          f(3, func ($t4)
+            f($t4, $k2)
+          end)
+        else
+          $k2(0)
+        end
+      end
+    end in
+      if $t1 < 3 then
+        f(2, func ($t2)
+          $k3($t2 < 4)
+        end)
+      else
+        $k3(#false)
+      end
+    end
+  end)
+end
+`
+	expr, err := parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	expr = uncoverBools(expr)
+	var buf bytes.Buffer
+	formatExpr(&buf, cpsProgram(anf(expr, nil), nil))
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCompileCPS(t *testing.T) {
+	const source = `let fac = func fac(x) if x < 2 then 1 else x * fac(x-1) end end in fac(5) + 1 end`
+	expr, err := parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	useCPS = true
+	defer func() { useCPS = false }()
+	expr, types, err := check(expr)
+	if err != nil {
+		t.Fatal("typecheck failed: ", err)
+	}
+	asm, err := compile(expr, types)
+	if err != nil {
+		t.Fatal("compile failed: ", err)
+	}
+	// every call to a user function is a tail call.
+	// calls into the runtime are fine
+	for _, line := range strings.Split(string(asm), "\n") {
+		if strings.HasPrefix(line, "\tcallq ") && !strings.HasPrefix(line, "\tcallq psc_") && line != "\tcallq psc.toplevel" && line != "\tcallq  psc_gcinit" {
+			t.Errorf("found non-tail call %q in output:\n%s", line, asm)
+		}
+	}
+}
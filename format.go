@@ -3,7 +3,11 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
+	"text/scanner"
 )
 
 // format.go converts an AST back to source code
@@ -11,13 +15,79 @@ import (
 type formatter struct {
 	buf     bytes.Buffer
 	nindent int
+	bol     bool             // at the beginning of a line
+	last    scanner.Position // the end of the last expression written
+	// the comments which haven't been written yet.
+	// each one goes at the end of the line with the last thing
+	// before it in the source, if they were on the same line,
+	// or else on its own line before the first thing after it
+	comments []*Comment
 }
 
 func printExpr(expr Expr) {
+	formatExpr(os.Stdout, expr)
+}
+
+func formatExpr(w io.Writer, expr Expr) error {
 	var f formatter
 	f.visitExpr(expr, 0)
 	f.write("\n")
-	f.buf.WriteTo(os.Stdout)
+	_, err := f.buf.WriteTo(w)
+	return err
+}
+
+// formatFile formats a whole source file,
+// with its imports and top-level declarations
+func formatFile(w io.Writer, file *File) error {
+	f := formatter{comments: file.Comments}
+	eol := func() { f.write("\n") }
+	for _, imp := range file.Imports {
+		f.flushComments(imp.Start, eol)
+		f.visitImport(imp)
+		f.last = imp.End
+		f.trailingComments()
+		f.write("\n")
+	}
+	if len(file.Imports) > 0 {
+		f.write("\n")
+	}
+	for _, d := range file.Decls {
+		f.flushComments(spanOf(d).Start, eol)
+		f.visitDecl(d)
+		f.trailingComments()
+		f.write("\n\n")
+	}
+	if file.Body != nil {
+		f.flushComments(spanOf(file.Body).Start, eol)
+		f.visitExpr(file.Body, 0)
+		f.trailingComments()
+		f.write("\n")
+	}
+	// and the ones at the end of the file
+	for _, c := range f.comments {
+		f.write(c.Text + "\n")
+	}
+	_, err := f.buf.WriteTo(w)
+	return err
+}
+
+// trailingComments writes the comments which start on or before
+// the line of the last expression written, at the end of the line
+func (f *formatter) trailingComments() {
+	for len(f.comments) > 0 && f.comments[0].Start.Line <= f.last.Line {
+		f.write(" " + f.comments[0].Text)
+		f.comments = f.comments[1:]
+	}
+}
+
+// flushComments writes the comments which come before pos,
+// calling end after each one
+func (f *formatter) flushComments(pos scanner.Position, end func()) {
+	for len(f.comments) > 0 && f.comments[0].Start.Offset < pos.Offset {
+		f.write(f.comments[0].Text)
+		f.comments = f.comments[1:]
+		end()
+	}
 }
 
 var binOpPrec = map[string]int{
@@ -26,21 +96,31 @@ var binOpPrec = map[string]int{
 	"eq":  2,
 	"<":   2,
 	"<=":  2,
-	"=>":  2,
+	">=":  2,
 	">":   2,
-	"+":   3,
-	"-":   3,
-	"*":   4,
-	"/":   4,
-	".":   5,
+	"..":  3,
+	"+":   4,
+	"-":   4,
+	"*":   5,
+	"/":   5,
+	"neg": 6,
+	".":   7,
 }
 
 func (f *formatter) visitExpr(e Expr, prec int) {
+	if f.bol {
+		f.flushComments(spanOf(e).Start, f.newline)
+	}
+	f.seen(spanOf(e).Start)
 	switch e := e.(type) {
 	case *VarExpr:
 		f.write(e.Name)
 	case *IntExpr:
 		f.write(e.Value)
+	case *StrExpr:
+		f.write(strconv.Quote(e.Value))
+	case *BadExpr:
+		f.write("#bad")
 	case *BoolExpr:
 		if e.Value == true {
 			f.write("#true")
@@ -48,13 +128,34 @@ func (f *formatter) visitExpr(e Expr, prec int) {
 			f.write("#false")
 		}
 	case *BinExpr:
+		if e.Neg {
+			op := binOpPrec["neg"]
+			if op < prec {
+				f.write("(")
+			}
+			f.write("-")
+			if r, ok := e.Right.(*BinExpr); ok && r.Neg {
+				f.write(" ") // not --x
+			}
+			f.visitExpr(e.Right, op)
+			if op < prec {
+				f.write(")")
+			}
+			break
+		}
 		op := binOpPrec[e.Op]
 		if op < prec {
 			f.write("(")
 		}
 		f.visitExpr(e.Left, op)
-		f.write(" " + e.Op + " ")
-		f.visitExpr(e.Right, op)
+		if e.Op == "eq" {
+			f.write(" == ")
+		} else {
+			f.write(" " + e.Op + " ")
+		}
+		// all the binary operators are left-associative,
+		// so the right operand needs parens if it has the same precedence
+		f.visitExpr(e.Right, op+1)
 		if op < prec {
 			f.write(")")
 		}
@@ -65,7 +166,7 @@ func (f *formatter) visitExpr(e Expr, prec int) {
 		}
 		f.visitExpr(e.Left, op)
 		f.write(" and ")
-		f.visitExpr(e.Right, op)
+		f.visitExpr(e.Right, op+1)
 		if op < prec {
 			f.write(")")
 		}
@@ -76,12 +177,12 @@ func (f *formatter) visitExpr(e Expr, prec int) {
 		}
 		f.visitExpr(e.Left, op)
 		f.write(" or ")
-		f.visitExpr(e.Right, op)
+		f.visitExpr(e.Right, op+1)
 		if op < prec {
 			f.write(")")
 		}
 	case *CallExpr:
-		f.visitExpr(e.Func, 0)
+		f.visitExpr(e.Func, binOpPrec["."])
 		f.write("(")
 		for i, a := range e.Args {
 			if i != 0 {
@@ -96,13 +197,60 @@ func (f *formatter) visitExpr(e Expr, prec int) {
 		//f.visitExpr(e.Right, 0)
 		f.write(e.Right)
 	case *LetExpr:
-		f.write("let " + e.Var + " = ")
+		f.write("let " + e.Var)
+		if e.Type != nil {
+			f.write(": ")
+			f.visitType(e.Type)
+		}
+		f.write(" = ")
+		f.visitExpr(e.Val, 0)
+		f.write(" in")
+		f.indent()
+		f.visitExpr(e.Body, 0)
+		f.dedent()
+		f.write("end")
+	case *LetValuesExpr:
+		f.write("let ")
+		for i, name := range e.Vars {
+			if i != 0 {
+				f.write(", ")
+			}
+			f.write(name)
+		}
+		f.write(" = ")
 		f.visitExpr(e.Val, 0)
 		f.write(" in")
 		f.indent()
 		f.visitExpr(e.Body, 0)
 		f.dedent()
 		f.write("end")
+	case *LetRecExpr:
+		f.write("#letrec ")
+		for i, name := range e.Vars {
+			if i != 0 {
+				f.write(" and ")
+			}
+			f.write(name + " = ")
+			f.visitExpr(e.Vals[i], 0)
+		}
+		f.write(" in")
+		f.indent()
+		f.visitExpr(e.Body, 0)
+		f.dedent()
+		f.write("end")
+	case *LetTypeExpr:
+		f.write("#type ")
+		for i, d := range e.Types {
+			if i != 0 {
+				f.write(" and ")
+			}
+			f.visitDecl(d)
+		}
+		f.write(" in")
+		f.indent()
+		f.visitExpr(e.Body, 0)
+		f.dedent()
+		f.write("end")
 	case *IfExpr:
 		f.write("if ")
 		f.visitExpr(e.Cond, 0)
@@ -124,8 +272,13 @@ func (f *formatter) visitExpr(e Expr, prec int) {
 				f.write(", ")
 			}
 			f.write(name)
+			if e.ArgTypes != nil && e.ArgTypes[i] != nil {
+				f.write(" ")
+				f.visitType(e.ArgTypes[i])
+			}
 		}
 		f.write(")")
+		f.visitResults(e.ReturnTypes)
 		f.indent()
 		f.visitExpr(e.Body, 0)
 		f.dedent()
@@ -139,6 +292,140 @@ func (f *formatter) visitExpr(e Expr, prec int) {
 			f.visitExpr(a, 0)
 		}
 		f.write(")")
+	case *ValuesExpr:
+		f.write("#values(")
+		for i, a := range e.Args {
+			if i != 0 {
+				f.write(", ")
+			}
+			f.visitExpr(a, 0)
+		}
+		f.write(")")
+	case *ClosureExpr:
+		f.write("#closure(")
+		f.visitExpr(e.Func, 0)
+		for _, a := range e.Free {
+			f.write(", ")
+			f.visitExpr(a, 0)
+		}
+		f.write(")")
+	case *PrimExpr:
+		f.write(primPackage + "." + e.Name)
+		if !primFuncs[e.Name].Const {
+			f.write("(")
+			for i, a := range e.Args {
+				if i != 0 {
+					f.write(", ")
+				}
+				f.visitExpr(a, 0)
+			}
+			f.write(")")
+		}
+	case *ListExpr:
+		f.write("[")
+		for i, a := range e.Args {
+			if i != 0 {
+				f.write(", ")
+			}
+			f.visitExpr(a, 0)
+		}
+		f.write("]")
+	case *IndexExpr:
+		f.visitExpr(e.Base, binOpPrec["."])
+		f.write("[")
+		f.visitExpr(e.Index, 0)
+		f.write("]")
+	case *DictExpr:
+		f.write("{")
+		for i := range e.Keys {
+			if i != 0 {
+				f.write(", ")
+			}
+			f.visitExpr(e.Keys[i], 0)
+			f.write(": ")
+			f.visitExpr(e.Vals[i], 0)
+		}
+		f.write("}")
+	case *RecordExpr:
+		f.write(e.Type + "{")
+		for i := range e.Fields {
+			if i != 0 {
+				f.write(", ")
+			}
+			f.write(e.Fields[i] + ": ")
+			f.visitExpr(e.Vals[i], 0)
+		}
+		f.write("}")
+	case *DictOpExpr:
+		f.write("#" + e.Op + "(")
+		for i, a := range e.Args {
+			if i != 0 {
+				f.write(", ")
+			}
+			f.visitExpr(a, 0)
+		}
+		f.write(")")
+	case *VariantExpr:
+		f.write(e.Tag)
+		if e.Args != nil {
+			f.write("(")
+			for i, a := range e.Args {
+				if i != 0 {
+					f.write(", ")
+				}
+				f.visitExpr(a, 0)
+			}
+			f.write(")")
+		}
+	case *MatchExpr:
+		f.write("match ")
+		f.visitExpr(e.Val, 0)
+		f.newline()
+		for _, c := range e.Cases {
+			f.write("case " + c.Tag)
+			if c.Vars != nil {
+				f.write("(" + strings.Join(c.Vars, ", ") + ")")
+			}
+			f.write(" then")
+			f.indent()
+			f.visitExpr(c.Body, 0)
+			f.dedent()
+		}
+		if e.Else != nil {
+			f.write("else")
+			f.indent()
+			f.visitExpr(e.Else, 0)
+			f.dedent()
+		}
+		f.write("end")
+	case *VariantTagExpr:
+		f.write("#tag(")
+		f.visitExpr(e.Base, 0)
+		f.write(")")
+	case *VariantGetExpr:
+		f.write("#get_" + e.Tag + "(")
+		f.visitExpr(e.Base, 0)
+		f.write(", ")
+		f.write(fmt.Sprint(e.Index))
+		f.write(")")
+	case *ForExpr:
+		f.write("for " + e.Var + " in ")
+		f.visitExpr(e.List, 0)
+		f.write(" do")
+		f.indent()
+		f.visitExpr(e.Body, 0)
+		f.dedent()
+		f.write("end")
+	case *ListLenExpr:
+		f.write("#len(")
+		f.visitExpr(e.List, 0)
+		f.write(")")
+	case *AppendExpr:
+		f.write("#append(")
+		f.visitExpr(e.List, 0)
+		f.write(", ")
+		f.visitExpr(e.Elem, 0)
+		f.write(")")
 	case *TupleIndexExpr:
 		f.write("#get(")
 		f.visitExpr(e.Base, 0)
@@ -148,24 +435,161 @@ func (f *formatter) visitExpr(e Expr, prec int) {
 	default:
 		panic(fmt.Sprintf("unhandled case in formatter.visitExpr: %T", e))
 	}
+	f.seen(spanOf(e).End)
+}
+
+// seen records that everything up to pos has been written,
+// so that a comment on the same line goes at the end of the line
+// rather than before the next thing.
+// a func's header, for example, ends the line after its start
+func (f *formatter) seen(pos scanner.Position) {
+	if pos.Line > 0 && pos.Offset >= f.last.Offset {
+		f.last = pos
+	}
+}
+
+func (f *formatter) visitImport(imp *ImportDecl) {
+	path := imp.Package
+	if imp.Version != "" {
+		path += "@" + imp.Version
+	}
+	if path != "." {
+		path = strconv.Quote(path)
+	}
+	f.write("import " + path)
+	if imp.Module != "" {
+		f.write(" ( ")
+		if imp.Name != imp.Module[strings.LastIndex(imp.Module, "/")+1:] {
+			f.write(imp.Name + " " + strconv.Quote(imp.Module))
+		} else {
+			f.write(imp.Module)
+		}
+		f.write(" )")
+	}
+}
+
+func (f *formatter) visitDecl(d Decl) {
+	switch d := d.(type) {
+	case *LetDecl:
+		if d.Public {
+			f.write("public ")
+		}
+		f.write("let " + d.Var)
+		if d.Type != nil {
+			f.write(": ")
+			f.visitType(d.Type)
+		}
+		f.write(" = ")
+		f.visitExpr(d.Val, 0)
+	case *FuncDecl:
+		if d.Public {
+			f.write("public ")
+		}
+		f.visitExpr(d.Func, 0)
+	case *TypeDecl:
+		if d.Public {
+			f.write("public ")
+		}
+		f.write("type " + d.Name)
+		if d.Variants != nil {
+			f.write(" =")
+			for i, v := range d.Variants {
+				if i != 0 {
+					f.write(" |")
+				}
+				f.write(" " + v.Tag)
+				if v.Types != nil {
+					f.visitTypeList(v.Types)
+				}
+			}
+			break
+		}
+		f.write(" {")
+		for i, name := range d.Fields {
+			if i != 0 {
+				f.write(",")
+			}
+			f.write(" " + name + " ")
+			f.visitType(d.Types[i])
+		}
+		if len(d.Fields) > 0 {
+			f.write(" ")
+		}
+		f.write("}")
+	default:
+		panic(fmt.Sprintf("unhandled case in formatter.visitDecl: %T", d))
+	}
+}
+
+func (f *formatter) visitType(t TypeExpr) {
+	switch t := t.(type) {
+	case *NamedTypeExpr:
+		f.write(t.Name)
+		if t.Args != nil {
+			f.visitTypeList(t.Args)
+		}
+	case *FuncTypeExpr:
+		f.write("func")
+		f.visitTypeList(t.Params)
+		f.visitResults(t.Results)
+	case *TupleTypeExpr:
+		f.visitTypeList(t.Types)
+	default:
+		panic(fmt.Sprintf("unhandled case in formatter.visitType: %T", t))
+	}
+}
+
+func (f *formatter) visitTypeList(list []TypeExpr) {
+	f.write("(")
+	for i, t := range list {
+		if i != 0 {
+			f.write(", ")
+		}
+		f.visitType(t)
+	}
+	f.write(")")
+}
+
+func (f *formatter) visitResults(list []TypeExpr) {
+	switch len(list) {
+	case 0:
+		// nothing
+	case 1:
+		f.write(" -> ")
+		if t, ok := list[0].(*TupleTypeExpr); ok {
+			// -> (int, bool) would be two results
+			f.write("tuple")
+			f.visitTypeList(t.Types)
+			break
+		}
+		f.visitType(list[0])
+	default:
+		f.write(" -> ")
+		f.visitTypeList(list)
+	}
 }
 
 func (f *formatter) indent() {
 	f.nindent++
-	f.write("\n")
-	for i := 0; i < f.nindent; i++ {
-		f.write("  ")
-	}
+	f.newline()
 }
 
 func (f *formatter) dedent() {
 	f.nindent--
-	f.write("\n")
+	f.newline()
+}
+
+// newline starts a new line at the current indentation
+func (f *formatter) newline() {
+	f.trailingComments()
+	f.buf.WriteString("\n")
 	for i := 0; i < f.nindent; i++ {
-		f.write("  ")
+		f.buf.WriteString("  ")
 	}
+	f.bol = true
 }
 
 func (f *formatter) write(s string) {
 	f.buf.WriteString(s)
+	f.bol = false
 }
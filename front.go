@@ -1,5 +1,6 @@
 // front-end passes
 //
+// * uniquify
 // * uncover booleans
 // * uncover tuples
 
@@ -8,8 +9,247 @@ package main
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
+// the uniquify pass renames variables so that every binder in the program
+// (let variables, function parameters, and function names) has a distinct name.
+// the first variable with a given name keeps it;
+// later ones get a numeric suffix, like x.1.
+// free variables, like the builtins, are left alone.
+//
+// every name the compiler makes up follows the same rule as x.1:
+// it has a character which the lexer doesn't allow in an identifier,
+// like the . here, the $ in the temporaries of the later passes,
+// or the / in the variables of imported modules,
+// so the names in the program can never clash with it.
+//
+// it returns a map from each new name back to the original,
+// for reporting errors.
+func uniquify(e Expr) (Expr, map[string]string) {
+	r := &renamer{
+		count: make(map[string]int),
+		names: make(map[string]string),
+	}
+	return r.expr(newscope(nil), e), r.names
+}
+
+type renamer struct {
+	count map[string]int    // number of binders seen with each name
+	names map[string]string // new name -> original name
+}
+
+// bind defines a variable in s and returns its new name
+func (r *renamer) bind(s *scope, name string) string {
+	newname := name
+	if n := r.count[name]; n > 0 {
+		newname = name + "." + strconv.Itoa(n)
+		r.names[newname] = name
+	}
+	r.count[name]++
+	s.vars[name] = newname
+	return newname
+}
+
+func (r *renamer) expr(s *scope, expr Expr) Expr {
+	switch e := expr.(type) {
+	case *VarExpr:
+		if s.has(e.Name) {
+			return &VarExpr{Span: e.Span, Name: s.lookup(e.Name).(string)}
+		}
+		break
+	case *BoolExpr:
+		break
+	case *IntExpr:
+		break
+	case *StrExpr:
+		break
+	case *BadExpr:
+		break
+	case *DotExpr:
+		return &DotExpr{
+			Span:  e.Span,
+			Op:    e.Op,
+			Left:  r.expr(s, e.Left),
+			Right: e.Right,
+		}
+	case *BinExpr:
+		return &BinExpr{
+			Span:  e.Span,
+			Op:    e.Op,
+			Left:  r.expr(s, e.Left),
+			Right: r.expr(s, e.Right),
+		}
+	case *AndExpr:
+		return &AndExpr{
+			Span:  e.Span,
+			Left:  r.expr(s, e.Left),
+			Right: r.expr(s, e.Right),
+		}
+	case *OrExpr:
+		return &OrExpr{
+			Span:  e.Span,
+			Left:  r.expr(s, e.Left),
+			Right: r.expr(s, e.Right),
+		}
+	case *CallExpr:
+		var args = make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = r.expr(s, e.Args[i])
+		}
+		return &CallExpr{
+			Span: e.Span,
+			Func: r.expr(s, e.Func),
+			Args: args,
+		}
+	case *LetExpr:
+		// the value is evaluated before the variable is in scope
+		val := r.expr(s, e.Val)
+		inner := s.push()
+		name := r.bind(inner, e.Var)
+		return &LetExpr{
+			Span: e.Span,
+			Var:  name,
+			Type: e.Type,
+			Val:  val,
+			Body: r.expr(inner, e.Body),
+		}
+	case *LetValuesExpr:
+		val := r.expr(s, e.Val)
+		inner := s.push()
+		vars := make([]string, len(e.Vars))
+		for i, name := range e.Vars {
+			vars[i] = r.bind(inner, name)
+		}
+		return &LetValuesExpr{
+			Span: e.Span,
+			Vars: vars,
+			Val:  val,
+			Body: r.expr(inner, e.Body),
+		}
+	case *LetRecExpr:
+		// the functions can all see each other
+		inner := s.push()
+		vars := make([]string, len(e.Vars))
+		for i, name := range e.Vars {
+			vars[i] = r.bind(inner, name)
+		}
+		vals := make([]Expr, len(e.Vals))
+		for i := range e.Vals {
+			vals[i] = r.expr(inner, e.Vals[i])
+		}
+		return &LetRecExpr{
+			Span: e.Span,
+			Vars: vars,
+			Vals: vals,
+			Body: r.expr(inner, e.Body),
+		}
+	case *LetTypeExpr:
+		return &LetTypeExpr{Span: e.Span, Types: e.Types, Body: r.expr(s, e.Body)}
+	case *ListExpr:
+		var args = make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = r.expr(s, e.Args[i])
+		}
+		return &ListExpr{Span: e.Span, Args: args}
+	case *IndexExpr:
+		return &IndexExpr{
+			Span:  e.Span,
+			Base:  r.expr(s, e.Base),
+			Index: r.expr(s, e.Index),
+		}
+	case *DictExpr:
+		var keys = make([]Expr, len(e.Keys))
+		var vals = make([]Expr, len(e.Vals))
+		for i := range e.Keys {
+			keys[i] = r.expr(s, e.Keys[i])
+			vals[i] = r.expr(s, e.Vals[i])
+		}
+		return &DictExpr{Span: e.Span, Keys: keys, Vals: vals}
+	case *RecordExpr:
+		var vals = make([]Expr, len(e.Vals))
+		for i := range e.Vals {
+			vals[i] = r.expr(s, e.Vals[i])
+		}
+		return &RecordExpr{Span: e.Span, Type: e.Type, Fields: e.Fields, Vals: vals}
+	case *VariantExpr:
+		var args []Expr
+		for _, a := range e.Args {
+			args = append(args, r.expr(s, a))
+		}
+		return &VariantExpr{Span: e.Span, Type: e.Type, Tag: e.Tag, Args: args}
+	case *MatchExpr:
+		// each case's variables are only in scope in its body.
+		// the match's own variable isn't in scope anywhere,
+		// but it still needs a unique name
+		val := r.expr(s, e.Val)
+		name := r.bind(s.push(), e.Var)
+		cases := make([]*MatchCase, len(e.Cases))
+		for i, c := range e.Cases {
+			inner := s.push()
+			vars := make([]string, len(c.Vars))
+			for j, v := range c.Vars {
+				vars[j] = r.bind(inner, v)
+			}
+			cases[i] = &MatchCase{
+				Span:  c.Span,
+				Type:  c.Type,
+				Tag:   c.Tag,
+				Index: c.Index,
+				Vars:  vars,
+				Body:  r.expr(inner, c.Body),
+			}
+		}
+		var els Expr
+		if e.Else != nil {
+			els = r.expr(s, e.Else)
+		}
+		return &MatchExpr{Span: e.Span, Var: name, Val: val, Cases: cases, Else: els}
+	case *ForExpr:
+		// like a let, the loop variable is only in scope in the body
+		list := r.expr(s, e.List)
+		inner := s.push()
+		name := r.bind(inner, e.Var)
+		return &ForExpr{
+			Span: e.Span,
+			Var:  name,
+			List: list,
+			Body: r.expr(inner, e.Body),
+		}
+	case *IfExpr:
+		return &IfExpr{
+			Span: e.Span,
+			Cond: r.expr(s, e.Cond),
+			Then: r.expr(s, e.Then),
+			Else: r.expr(s, e.Else),
+		}
+	case *FuncExpr:
+		// the function's name is visible in its body,
+		// but the parameters shadow it
+		inner := s.push()
+		var name string
+		if e.Name != "" {
+			name = r.bind(inner, e.Name)
+		}
+		params := inner.push()
+		args := make([]string, len(e.Args))
+		for i, p := range e.Args {
+			args[i] = r.bind(params, p)
+		}
+		return &FuncExpr{
+			Span:        e.Span,
+			Name:        name,
+			Args:        args,
+			ArgTypes:    e.ArgTypes,
+			ReturnTypes: e.ReturnTypes,
+			Body:        r.expr(params, e.Body),
+		}
+	default:
+		panic(fmt.Sprintf("unhandled case: %T", e))
+	}
+	return expr
+}
+
 // the uncover-bools pass replaces any unshadowed "true" or "false" variables
 // with a BoolExpr
 func uncoverBools(e Expr) Expr {
@@ -24,10 +264,10 @@ func uncoverBoolsExpr(s *scope, expr Expr) Expr {
 	case *VarExpr:
 		if !s.has(e.Name) {
 			if e.Name == "true" {
-				return &BoolExpr{true}
+				return &BoolExpr{Span: e.Span, Value: true}
 			}
 			if e.Name == "false" {
-				return &BoolExpr{false}
+				return &BoolExpr{Span: e.Span, Value: false}
 			}
 		}
 		break
@@ -35,24 +275,33 @@ func uncoverBoolsExpr(s *scope, expr Expr) Expr {
 		break
 	case *IntExpr:
 		break
+	case *StrExpr:
+		break
+	case *BadExpr:
+		break
 	case *DotExpr:
 		return &DotExpr{
+			Span:  e.Span,
+			Op:    e.Op,
 			Left:  uncoverBoolsExpr(s, e.Left),
 			Right: e.Right,
 		}
 	case *BinExpr:
 		return &BinExpr{
+			Span:  e.Span,
 			Op:    e.Op,
 			Left:  uncoverBoolsExpr(s, e.Left),
 			Right: uncoverBoolsExpr(s, e.Right),
 		}
 	case *AndExpr:
 		return &AndExpr{
+			Span:  e.Span,
 			Left:  uncoverBoolsExpr(s, e.Left),
 			Right: uncoverBoolsExpr(s, e.Right),
 		}
 	case *OrExpr:
 		return &OrExpr{
+			Span:  e.Span,
 			Left:  uncoverBoolsExpr(s, e.Left),
 			Right: uncoverBoolsExpr(s, e.Right),
 		}
@@ -62,6 +311,7 @@ func uncoverBoolsExpr(s *scope, expr Expr) Expr {
 			args[i] = uncoverBoolsExpr(s, e.Args[i])
 		}
 		return &CallExpr{
+			Span: e.Span,
 			Func: uncoverBoolsExpr(s, e.Func),
 			Args: args,
 		}
@@ -69,25 +319,130 @@ func uncoverBoolsExpr(s *scope, expr Expr) Expr {
 		inner := s.push()
 		inner.define(e.Var)
 		return &LetExpr{
+			Span: e.Span,
 			Var:  e.Var,
+			Type: e.Type,
 			Val:  uncoverBoolsExpr(s, e.Val),
 			Body: uncoverBoolsExpr(inner, e.Body),
 		}
+	case *LetValuesExpr:
+		inner := s.push()
+		for _, name := range e.Vars {
+			inner.define(name)
+		}
+		return &LetValuesExpr{
+			Span: e.Span,
+			Vars: e.Vars,
+			Val:  uncoverBoolsExpr(s, e.Val),
+			Body: uncoverBoolsExpr(inner, e.Body),
+		}
+	case *LetRecExpr:
+		inner := s.push()
+		for _, name := range e.Vars {
+			inner.define(name)
+		}
+		vals := make([]Expr, len(e.Vals))
+		for i := range e.Vals {
+			vals[i] = uncoverBoolsExpr(inner, e.Vals[i])
+		}
+		return &LetRecExpr{
+			Span: e.Span,
+			Vars: e.Vars,
+			Vals: vals,
+			Body: uncoverBoolsExpr(inner, e.Body),
+		}
+	case *LetTypeExpr:
+		return &LetTypeExpr{Span: e.Span, Types: e.Types, Body: uncoverBoolsExpr(s, e.Body)}
+	case *ListExpr:
+		var args = make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = uncoverBoolsExpr(s, e.Args[i])
+		}
+		return &ListExpr{Span: e.Span, Args: args}
+	case *IndexExpr:
+		return &IndexExpr{
+			Span:  e.Span,
+			Base:  uncoverBoolsExpr(s, e.Base),
+			Index: uncoverBoolsExpr(s, e.Index),
+		}
+	case *DictExpr:
+		var keys = make([]Expr, len(e.Keys))
+		var vals = make([]Expr, len(e.Vals))
+		for i := range e.Keys {
+			keys[i] = uncoverBoolsExpr(s, e.Keys[i])
+			vals[i] = uncoverBoolsExpr(s, e.Vals[i])
+		}
+		return &DictExpr{Span: e.Span, Keys: keys, Vals: vals}
+	case *RecordExpr:
+		var vals = make([]Expr, len(e.Vals))
+		for i := range e.Vals {
+			vals[i] = uncoverBoolsExpr(s, e.Vals[i])
+		}
+		return &RecordExpr{Span: e.Span, Type: e.Type, Fields: e.Fields, Vals: vals}
+	case *VariantExpr:
+		var args []Expr
+		for _, a := range e.Args {
+			args = append(args, uncoverBoolsExpr(s, a))
+		}
+		return &VariantExpr{Span: e.Span, Type: e.Type, Tag: e.Tag, Args: args}
+	case *MatchExpr:
+		cases := make([]*MatchCase, len(e.Cases))
+		for i, c := range e.Cases {
+			inner := s.push()
+			for _, name := range c.Vars {
+				inner.define(name)
+			}
+			cases[i] = &MatchCase{
+				Span:  c.Span,
+				Type:  c.Type,
+				Tag:   c.Tag,
+				Index: c.Index,
+				Vars:  c.Vars,
+				Body:  uncoverBoolsExpr(inner, c.Body),
+			}
+		}
+		var els Expr
+		if e.Else != nil {
+			els = uncoverBoolsExpr(s, e.Else)
+		}
+		return &MatchExpr{
+			Span:  e.Span,
+			Var:   e.Var,
+			Val:   uncoverBoolsExpr(s, e.Val),
+			Cases: cases,
+			Else:  els,
+		}
+	case *ForExpr:
+		inner := s.push()
+		inner.define(e.Var)
+		return &ForExpr{
+			Span: e.Span,
+			Var:  e.Var,
+			List: uncoverBoolsExpr(s, e.List),
+			Body: uncoverBoolsExpr(inner, e.Body),
+		}
 	case *IfExpr:
 		return &IfExpr{
-			Cond: e.Cond,
+			Span: e.Span,
+			Cond: uncoverBoolsExpr(s, e.Cond),
 			Then: uncoverBoolsExpr(s, e.Then),
 			Else: uncoverBoolsExpr(s, e.Else),
 		}
 	case *FuncExpr:
 		inner := s.push()
+		if e.Name != "" {
+			inner.define(e.Name)
+		}
 		for _, p := range e.Args {
 			inner.define(p)
 		}
 		return &FuncExpr{
-			Name: e.Name,
-			Args: e.Args,
-			Body: uncoverBoolsExpr(s, e.Body),
+			Span:        e.Span,
+			Name:        e.Name,
+			Args:        e.Args,
+			ArgTypes:    e.ArgTypes,
+			ReturnTypes: e.ReturnTypes,
+			Body:        uncoverBoolsExpr(inner, e.Body),
 		}
 	default:
 		panic(fmt.Sprintf("unhandled case: %T", e))
@@ -96,14 +451,31 @@ func uncoverBoolsExpr(s *scope, expr Expr) Expr {
 }
 
 // the uncover-tuples pass replaces tuple(..) with TupleExpr
-// and get(x, n) with TupleIndexExpr
+// and get(x, n) with TupleIndexExpr.
+// it also replaces values(...) with ValuesExpr,
+// len(xs) and append(xs, x) with ListLenExpr and AppendExpr,
+// the dict builtins with DictOpExpr,
+// for loops with recursive functions (see forLoop),
+// matches with ifs which test the variant's tag (see matchCases),
+// and uses of psc/prim, like prim.add32(x, y), with PrimExpr
 // TODO: prim.tuple and prim.get?
-func uncoverTuples(e Expr) Expr {
+//
+// the expressions it builds get the types of the ones they replace.
+func uncoverTuples(e Expr, types *typeTable) Expr {
+	u := tupleUncoverer{types}
 	var top scope
-	return uncoverTuplesExpr(&top, e)
+	return u.expr(&top, e)
+}
+
+type tupleUncoverer struct {
+	types *typeTable
 }
 
-func uncoverTuplesExpr(s *scope, expr Expr) Expr {
+func (u *tupleUncoverer) expr(s *scope, expr Expr) Expr {
+	return u.types.same(expr, u.node(s, expr))
+}
+
+func (u *tupleUncoverer) node(s *scope, expr Expr) Expr {
 	// the VarExpr case is the only one that does any work
 	// the rest just propagate the recursion
 	switch e := expr.(type) {
@@ -115,68 +487,174 @@ func uncoverTuplesExpr(s *scope, expr Expr) Expr {
 			if e.Name == "get" {
 				fmt.Println("error: get in non-call context")
 			}
+			if e.Name == "values" {
+				fmt.Println("error: values in non-call context")
+			}
 		}
 		break
 	case *BoolExpr:
 		break
 	case *IntExpr:
 		break
+	case *StrExpr:
+		break
+	case *BadExpr:
+		break
 	case *DotExpr:
+		if name, ok := primName(s, e); ok {
+			return &PrimExpr{Span: e.Span, Name: name}
+		}
 		return &DotExpr{
-			Left:  uncoverTuplesExpr(s, e.Left),
+			Span:  e.Span,
+			Op:    e.Op,
+			Left:  u.expr(s, e.Left),
 			Right: e.Right,
 		}
 	case *BinExpr:
 		return &BinExpr{
+			Span:  e.Span,
 			Op:    e.Op,
-			Left:  uncoverTuplesExpr(s, e.Left),
-			Right: uncoverTuplesExpr(s, e.Right),
+			Left:  u.expr(s, e.Left),
+			Right: u.expr(s, e.Right),
 		}
 	case *AndExpr:
 		return &AndExpr{
-			Left:  uncoverTuplesExpr(s, e.Left),
-			Right: uncoverTuplesExpr(s, e.Right),
+			Span:  e.Span,
+			Left:  u.expr(s, e.Left),
+			Right: u.expr(s, e.Right),
 		}
 	case *OrExpr:
 		return &OrExpr{
-			Left:  uncoverTuplesExpr(s, e.Left),
-			Right: uncoverTuplesExpr(s, e.Right),
+			Span:  e.Span,
+			Left:  u.expr(s, e.Left),
+			Right: u.expr(s, e.Right),
 		}
 	case *CallExpr:
 		var args = make([]Expr, len(e.Args))
 		for i := range e.Args {
-			args[i] = uncoverTuplesExpr(s, e.Args[i])
+			args[i] = u.expr(s, e.Args[i])
+		}
+		if name, ok := primName(s, e.Func); ok {
+			return &PrimExpr{Span: e.Span, Name: name, Args: args}
 		}
 		if e := uncoverTupleBuiltins(s, e, args); e != nil {
 			return e
 		}
 		return &CallExpr{
-			Func: uncoverTuplesExpr(s, e.Func),
+			Span: e.Span,
+			Func: u.expr(s, e.Func),
 			Args: args,
 		}
 	case *LetExpr:
 		inner := s.push()
 		inner.define(e.Var)
 		return &LetExpr{
+			Span: e.Span,
 			Var:  e.Var,
-			Val:  uncoverTuplesExpr(s, e.Val),
-			Body: uncoverTuplesExpr(inner, e.Body),
+			Type: e.Type,
+			Val:  u.expr(s, e.Val),
+			Body: u.expr(inner, e.Body),
+		}
+	case *LetValuesExpr:
+		inner := s.push()
+		for _, name := range e.Vars {
+			inner.define(name)
 		}
+		return &LetValuesExpr{
+			Span: e.Span,
+			Vars: e.Vars,
+			Val:  u.expr(s, e.Val),
+			Body: u.expr(inner, e.Body),
+		}
+	case *LetRecExpr:
+		inner := s.push()
+		for _, name := range e.Vars {
+			inner.define(name)
+		}
+		vals := make([]Expr, len(e.Vals))
+		for i := range e.Vals {
+			vals[i] = u.expr(inner, e.Vals[i])
+		}
+		return &LetRecExpr{
+			Span: e.Span,
+			Vars: e.Vars,
+			Vals: vals,
+			Body: u.expr(inner, e.Body),
+		}
+	case *LetTypeExpr:
+		return &LetTypeExpr{Span: e.Span, Types: e.Types, Body: u.expr(s, e.Body)}
+	case *ListExpr:
+		var args = make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = u.expr(s, e.Args[i])
+		}
+		return &ListExpr{Span: e.Span, Args: args}
+	case *IndexExpr:
+		return &IndexExpr{
+			Span:  e.Span,
+			Base:  u.expr(s, e.Base),
+			Index: u.expr(s, e.Index),
+		}
+	case *DictExpr:
+		var keys = make([]Expr, len(e.Keys))
+		var vals = make([]Expr, len(e.Vals))
+		for i := range e.Keys {
+			keys[i] = u.expr(s, e.Keys[i])
+			vals[i] = u.expr(s, e.Vals[i])
+		}
+		return &DictExpr{Span: e.Span, Keys: keys, Vals: vals}
+	case *RecordExpr:
+		var vals = make([]Expr, len(e.Vals))
+		for i := range e.Vals {
+			vals[i] = u.expr(s, e.Vals[i])
+		}
+		return &RecordExpr{Span: e.Span, Type: e.Type, Fields: e.Fields, Vals: vals}
+	case *VariantExpr:
+		var args []Expr
+		for _, a := range e.Args {
+			args = append(args, u.expr(s, a))
+		}
+		return &VariantExpr{Span: e.Span, Type: e.Type, Tag: e.Tag, Args: args}
+	case *MatchExpr:
+		bodies := make([]Expr, len(e.Cases))
+		for i, c := range e.Cases {
+			inner := s.push()
+			for _, name := range c.Vars {
+				inner.define(name)
+			}
+			bodies[i] = u.expr(inner, c.Body)
+		}
+		var els Expr
+		if e.Else != nil {
+			els = u.expr(s, e.Else)
+		}
+		return u.matchCases(e, u.expr(s, e.Val), bodies, els)
+	case *ForExpr:
+		inner := s.push()
+		inner.define(e.Var)
+		return u.forLoop(e, u.expr(s, e.List), u.expr(inner, e.Body))
 	case *IfExpr:
 		return &IfExpr{
-			Cond: e.Cond,
-			Then: uncoverTuplesExpr(s, e.Then),
-			Else: uncoverTuplesExpr(s, e.Else),
+			Span: e.Span,
+			Cond: u.expr(s, e.Cond),
+			Then: u.expr(s, e.Then),
+			Else: u.expr(s, e.Else),
 		}
 	case *FuncExpr:
 		inner := s.push()
+		if e.Name != "" {
+			inner.define(e.Name)
+		}
 		for _, p := range e.Args {
 			inner.define(p)
 		}
 		return &FuncExpr{
-			Name: e.Name,
-			Args: e.Args,
-			Body: uncoverTuplesExpr(s, e.Body),
+			Span:        e.Span,
+			Name:        e.Name,
+			Args:        e.Args,
+			ArgTypes:    e.ArgTypes,
+			ReturnTypes: e.ReturnTypes,
+			Body:        u.expr(inner, e.Body),
 		}
 	default:
 		panic(fmt.Sprintf("unhandled case: %T", e))
@@ -192,12 +670,31 @@ func uncoverTupleBuiltins(s *scope, e *CallExpr, args []Expr) Expr {
 	switch v.Name {
 	case "tuple":
 		return &TupleExpr{
+			Span: e.Span,
 			Args: args,
 		}
+	case "values":
+		return &ValuesExpr{
+			Span: e.Span,
+			Args: args,
+		}
+	case "len":
+		if len(args) == 1 {
+			return &ListLenExpr{Span: e.Span, List: args[0]}
+		}
+	case "append":
+		if len(args) == 2 {
+			return &AppendExpr{Span: e.Span, List: args[0], Elem: args[1]}
+		}
+	case "lookup", "set", "delete", "contains", "keys":
+		if len(args) == dictOps[v.Name] {
+			return &DictOpExpr{Span: e.Span, Op: v.Name, Args: args}
+		}
 	case "get":
 		if len(e.Args) == 2 && isInt(args[1]) {
 			n, _ := strconv.Atoi(args[1].(*IntExpr).Value)
 			return &TupleIndexExpr{
+				Span:  e.Span,
 				Base:  args[0],
 				Index: n,
 			}
@@ -210,3 +707,155 @@ func isInt(e Expr) bool {
 	_, ok := e.(*IntExpr)
 	return ok
 }
+
+// forLoop turns a for loop into a recursive function
+// which appends the value of the body to a new list
+// for each element of the old one.
+//
+//	for x in xs do body end
+//
+// becomes
+//
+//	let $list.x = xs in
+//	  let $for.x = func $loop.x($i.x, $out.x)
+//	    if $i.x < #len($list.x) then
+//	      let x = $list.x[$i.x] in
+//	        $loop.x($i.x + 1, #append($out.x, body))
+//	      end
+//	    else
+//	      $out.x
+//	    end
+//	  end in
+//	    $for.x(0, [])
+//	  end
+//	end
+//
+// the loop variable has a unique name (see uniquify),
+// so the new variables are named after it.
+func (u *tupleUncoverer) forLoop(e *ForExpr, list, body Expr) Expr {
+	t := u.types
+	name := func(prefix string) string { return prefix + e.Var }
+	ref := func(prefix string) Expr { return &VarExpr{Span: e.Span, Name: name(prefix)} }
+	intExpr := func(value string) Expr { return t.set(&IntExpr{Span: e.Span, Value: value}, IntT{}) }
+	// the new list has the type of the whole loop
+	out := t.single(e)
+	loopType := &FuncT{Params: []Type{IntT{}, out}, Return: []Type{out}}
+	t.define(name("$list."), t.single(list))
+	t.define(name("$for."), loopType)
+	t.define(name("$loop."), loopType)
+	t.define(name("$i."), IntT{})
+	t.define(name("$out."), out)
+	loop := &FuncExpr{
+		Span: e.Span,
+		Name: name("$loop."),
+		Args: []string{name("$i."), name("$out.")},
+		Body: t.set(&IfExpr{
+			Span: e.Span,
+			Cond: t.set(binExpr("<", ref("$i."), t.set(&ListLenExpr{Span: e.Span, List: ref("$list.")}, IntT{})), BoolT{}),
+			Then: t.set(&LetExpr{
+				Span: e.Span,
+				Var:  e.Var,
+				Val:  t.set(&IndexExpr{Span: e.Span, Base: ref("$list."), Index: ref("$i.")}, t.varType(e.Var)),
+				Body: t.set(&CallExpr{
+					Span: e.Span,
+					Func: ref("$loop."),
+					Args: []Expr{
+						t.set(binExpr("+", ref("$i."), intExpr("1")), IntT{}),
+						t.set(&AppendExpr{Span: e.Span, List: ref("$out."), Elem: body}, out),
+					},
+				}, out),
+			}, out),
+			Else: ref("$out."),
+		}, out),
+	}
+	return &LetExpr{
+		Span: e.Span,
+		Var:  name("$list."),
+		Val:  list,
+		Body: t.set(&LetExpr{
+			Span: e.Span,
+			Var:  name("$for."),
+			Val:  t.set(loop, loopType),
+			Body: t.set(&CallExpr{
+				Span: e.Span,
+				Func: ref("$for."),
+				Args: []Expr{intExpr("0"), t.set(&ListExpr{Span: e.Span}, out)},
+			}, out),
+		}, out),
+	}
+}
+
+// matchCases turns a match into a chain of ifs
+// which compare the variant's tag with each case's.
+//
+//	match val
+//	case circle(r) then body1
+//	case empty then body2
+//	else body3
+//	end
+//
+// becomes
+//
+//	let $match = val in
+//	  let $tag = #tag($match) in
+//	    if $tag == 0 then
+//	      let r = #get_circle($match, 0) in
+//	        body1
+//	      end
+//	    else
+//	      if $tag == 2 then
+//	        body2
+//	      else
+//	        body3
+//	      end
+//	    end
+//	  end
+//	end
+//
+// without an else, the typechecker has made sure there is
+// a case for every variant, so the last case isn't tested.
+// the match variable has a unique name (see uniquify),
+// so the tag variable is named after it.
+func (u *tupleUncoverer) matchCases(e *MatchExpr, val Expr, bodies []Expr, els Expr) Expr {
+	t := u.types
+	tag := "$tag" + strings.TrimPrefix(e.Var, "$match")
+	ref := func(name string) Expr { return &VarExpr{Span: e.Span, Name: name} }
+	result := t.single(e)
+	t.bind(e.Var, val)
+	t.define(tag, IntT{})
+	chain := els
+	for i := len(e.Cases) - 1; i >= 0; i-- {
+		c := e.Cases[i]
+		body := bodies[i]
+		for j := len(c.Vars) - 1; j >= 0; j-- {
+			body = t.set(&LetExpr{
+				Span: c.Span,
+				Var:  c.Vars[j],
+				Val:  t.set(&VariantGetExpr{Span: c.Span, Base: ref(e.Var), Type: c.Type, Tag: c.Tag, Index: j}, t.varType(c.Vars[j])),
+				Body: body,
+			}, result)
+		}
+		if chain == nil {
+			chain = body
+			continue
+		}
+		index := t.set(&IntExpr{Span: c.Span, Value: strconv.Itoa(c.Index)}, IntT{})
+		chain = t.set(&IfExpr{
+			Span: c.Span,
+			Cond: t.set(binExpr("eq", ref(tag), index), BoolT{}),
+			Then: body,
+			Else: chain,
+		}, result)
+	}
+	return &LetExpr{
+		Span: e.Span,
+		Var:  e.Var,
+		Val:  val,
+		Body: t.set(&LetExpr{
+			Span: e.Span,
+			Var:  tag,
+			Val:  t.set(&VariantTagExpr{Span: e.Span, Base: ref(e.Var)}, IntT{}),
+			Body: chain,
+		}, result),
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUniquify(t *testing.T) {
+	const source = `let x = 1 in
+let x = x + 1 in
+let f = func f(x, y) if x < 1 then y else f(x - 1, y) end end in
+let g = func f(f) f + x end in
+f(x, g(tuple(x)))
+end end end end`
+	expr, err := parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	// a let value is renamed before its variable;
+	// the second function's name is shadowed by its parameter;
+	// free variables like tuple are left alone
+	const want = `let x = 1 in
+  let x.1 = x + 1 in
+    let f.1 = func f(x.2, y)
+      if x.2 < 1 then
+        y
+      else
+        f(x.2 - 1, y)
+      end
+    end in
+      let g = func f.2(f.3)
+        f.3 + x.1
+      end in
+        f.1(x.1, g(tuple(x.1)))
+      end
+    end
+  end
+end
+`
+	expr, names := uniquify(expr)
+	var buf bytes.Buffer
+	formatExpr(&buf, expr)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	wantNames := map[string]string{
+		"x.1": "x",
+		"x.2": "x",
+		"f.1": "f",
+		"f.2": "f",
+		"f.3": "f",
+	}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("got names %v, want %v", names, wantNames)
+	}
+}
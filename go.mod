@@ -1,5 +1,3 @@
 module github.com/magical/pumpkin-spice-compiler
 
 go 1.14
-
-require github.com/kr/pretty v0.2.1
@@ -2,41 +2,280 @@
 
 package main
 
+import "strings"
+
+func binExpr(op string, left, right Expr) Expr {
+	return &BinExpr{Span: between(left, right), Op: op, Left: left, Right: right}
+}
+
+// badExpr returns a BadExpr covering the gap between two tokens.
+// (the error token itself doesn't have a useful span.)
+func badExpr(before, after Span) Expr {
+	return &BadExpr{Span: Span{Start: before.End, End: after.Start}}
+}
+
+// dictExpr makes a dict literal out of alternating keys and values
+func dictExpr(span Span, pairs []Expr) Expr {
+	e := &DictExpr{Span: span}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		e.Keys = append(e.Keys, pairs[i])
+		e.Vals = append(e.Vals, pairs[i+1])
+	}
+	return e
+}
+
+// a param is a function parameter and its type, if it has one
+type param struct {
+	name string
+	typ  TypeExpr
+}
+
+// a fieldInit is the value of one field in a record constructor
+type fieldInit struct {
+	name string
+	val  Expr
+}
+
+func recordExpr(span Span, typ string, inits []fieldInit) Expr {
+	e := &RecordExpr{Span: span, Type: typ}
+	for _, f := range inits {
+		e.Fields = append(e.Fields, f.name)
+		e.Vals = append(e.Vals, f.val)
+	}
+	return e
+}
+
+// matchExpr makes a match expression. the variable which holds
+// the value gets a unique name from uniquify, like any other.
+func matchExpr(span Span, val Expr, cases []*MatchCase, els Expr) Expr {
+	return &MatchExpr{Span: span, Var: "$match", Val: val, Cases: cases, Else: els}
+}
+
+func typeDecl(span Span, name string, fields []param) *TypeDecl {
+	d := &TypeDecl{Span: span, Name: name}
+	for _, f := range fields {
+		d.Fields = append(d.Fields, f.name)
+		d.Types = append(d.Types, f.typ)
+	}
+	return d
+}
+
+func funcExpr(span Span, name string, params []param, results []TypeExpr, body Expr) *FuncExpr {
+	e := &FuncExpr{Span: span, Name: name, Body: body, ReturnTypes: results}
+	for _, p := range params {
+		e.Args = append(e.Args, p.name)
+	}
+	for i, p := range params {
+		if p.typ != nil {
+			if e.ArgTypes == nil {
+				e.ArgTypes = make([]TypeExpr, len(params))
+			}
+			e.ArgTypes[i] = p.typ
+		}
+	}
+	return e
+}
+
+// importDecls fills in the package for the modules in an import.
+// an import with no list of modules imports the package's base module,
+// which goes by the last element of the package's path.
+func importDecls(span Span, path string, list []*ImportDecl) []*ImportDecl {
+	version := ""
+	if i := strings.LastIndex(path, "@"); i >= 0 {
+		path, version = path[:i], path[i+1:]
+	}
+	if list == nil {
+		list = []*ImportDecl{{Span: span, Name: path[strings.LastIndex(path, "/")+1:]}}
+	}
+	for _, imp := range list {
+		imp.Package = path
+		imp.Version = version
+	}
+	return list
+}
+
+// newFile sorts out the items at the top level of a file.
+// a named function is a declaration; any other expression
+// is the result of the program, which has to come last.
+func newFile(l *lexer, imports []*ImportDecl, items []Decl) *File {
+	f := &File{Imports: imports}
+	for i, item := range items {
+		if fn, ok := item.(*FuncExpr); ok && fn.Name != "" {
+			item = &FuncDecl{Span: fn.Span, Func: fn}
+		}
+		switch d := item.(type) {
+		case *LetDecl, *TypeDecl:
+			f.Decls = append(f.Decls, d)
+		case *FuncDecl:
+			if d.Func.Name == "" {
+				l.errorAt(d.Span.Start, "a public function must have a name")
+			}
+			f.Decls = append(f.Decls, d)
+		default:
+			if i != len(items)-1 {
+				l.errorAt(spanOf(d).Start, "only the last item in a file can be an expression")
+			}
+			f.Body = d
+		}
+	}
+	return f
+}
+
+// qualifiedName is the name of a record type in another module, like geo.point
+func qualifiedName(l *lexer, mod Expr, name string) string {
+	v, ok := mod.(*VarExpr)
+	if !ok {
+		l.errorAt(spanOf(mod).Start, "record type must be a name or module.name")
+		return name
+	}
+	return v.Name + "." + name
+}
+
+// publicDecl marks a declaration as public
+func publicDecl(public Span, d Decl) Decl {
+	switch d := d.(type) {
+	case *LetDecl:
+		d.Public = true
+		d.Span.Start = public.Start
+	case *TypeDecl:
+		d.Public = true
+		d.Span.Start = public.Start
+	}
+	return d
+}
+
 %}
 
 %union {
+    span Span // every token has a span
     ident string
     num string
+    str string
     args []string
+    params []param
+    inits []fieldInit
+    variants []*Variant
+    variant *Variant
+    cases []*MatchCase
+    mcase *MatchCase
     expr Expr
     exprlist []Expr
+    typ TypeExpr
+    types []TypeExpr
+    file *File
+    imports []*ImportDecl
+    decls []Decl
+    decl Decl
 }
 
-%type <args> args arglist0 arglist1
-%type <exprlist> exprlist0 exprlist1
-%type <expr> expr body func call let if
+%type <params> args arglist0 arglist1 fieldlist0 fieldlist1
+%type <inits> initlist0 initlist1
+%type <args> identlist varlist0 varlist1
+%type <exprlist> exprlist0 exprlist1 pairlist0 pairlist1
+%type <expr> expr body func call let if for match
+%type <variants> variants
+%type <variant> variant
+%type <cases> cases
+%type <mcase> case pattern
 %type <num> num
 %type <ident> ident
+%type <typ> type ntype
+%type <types> results typelist0 typelist1
+%type <file> file
+%type <imports> imports import importlist
+%type <decls> items
+%type <decl> item decl
+%type <str> pkgpath modpath
 
 %token <ident> tIdent
 %token <num> tNumber
-%token kLet kIn kIf kThen kElse kFunc kEnd
+%token <str> tString
+%token kImport kPublic kType
+%token kLet kIn kIf kThen kElse kFunc kEnd kFor kDo kMatch kCase
+%token tArrow tConcat
+
+// a type name followed by '(' is a type with arguments, like tuple(int, int),
+// even after a function's return type where the '(' could start the body
+%nonassoc tIdent
+
+// likewise, a '(' after an import path starts a list of modules
+%nonassoc kImport
 
 %left kAnd kOr
 %left '<' '>' '='
-
+%left tConcat
 %left '+' '-'
 %left '*' '/'
 %left unary
-%left '('       // function call
+%left '(' '['   // function call, list index
 %left '.'
+%left '{'       // a name followed by '{' is a record constructor
 
 %%
 
-top: expr { yylex.(*lexer).result = $1 }
+top: file  { yylex.(*lexer).result = $1 }
+top: error { yylex.(*lexer).result = &File{Body: &BadExpr{}} }
 
-expr: ident { $$ = &VarExpr{$1} }
-expr: num   { $$ = &IntExpr{$1} }
+// a file is some imports, then some declarations,
+// then the expression which is the result of the program
+file: imports items { $$ = newFile(yylex.(*lexer), $1, $2) }
+
+imports:                { $$ = nil }
+imports: imports import { $$ = append($1, $2...) }
+
+// import "path" imports a package's base module.
+// import "path" ( a b/c d "e/f" ) imports modules from the package;
+// an identifier followed by a string gives the module a different name.
+import: kImport pkgpath %prec kImport      { $$ = importDecls(between($<span>1, $<span>2), $2, nil) }
+import: kImport pkgpath '(' importlist ')' { $$ = importDecls(between($<span>1, $<span>5), $2, $4) }
+
+pkgpath: tString
+pkgpath: ident { $$ = $1 }
+pkgpath: '.' { $$ = "." }
+
+importlist: { $$ = []*ImportDecl{} }
+importlist: importlist modpath { $$ = append($1, &ImportDecl{Span: $<span>2, Module: $2, Name: $2[strings.LastIndex($2, "/")+1:]}) }
+importlist: importlist ident tString { $$ = append($1, &ImportDecl{Span: between($<span>2, $<span>3), Module: $3, Name: $2}) }
+
+modpath: ident { $$ = $1 }
+modpath: modpath '/' ident { $$ = $1 + "/" + $3; $<span>$ = between($<span>1, $<span>3) }
+
+// a top-level let is like an ordinary let without the body,
+// and a function with a name is declared by itself.
+// public ones can be used by the modules which import this one.
+// the result of the program can't start with '(', '[', '{' or '-'
+// right after a declaration, because that continues its value.
+items:            { $$ = nil }
+items: items item { $$ = append($1, $2) }
+
+item: decl
+item: kPublic decl       { $$ = publicDecl($<span>1, $2) }
+item: kPublic func       { $$ = &FuncDecl{Span: between($<span>1, $2), Public: true, Func: $2.(*FuncExpr)} }
+item: expr %prec kImport { $$ = $1 }
+
+decl: kLet ident '=' expr          { $$ = &LetDecl{Span: between($<span>1, $4), Var: $2, Val: $4} }
+decl: kLet ident ':' type '=' expr { $$ = &LetDecl{Span: between($<span>1, $6), Var: $2, Type: $4, Val: $6} }
+
+// a record type has a list of fields, each with a type
+decl: kType ident '{' fieldlist0 '}' { $$ = typeDecl(between($<span>1, $<span>5), $2, $4) }
+
+fieldlist0:       { $$ = nil }
+fieldlist0: fieldlist1
+fieldlist0: fieldlist1 ','
+fieldlist1: ident type                { $$ = []param{{name: $1, typ: $2}} }
+fieldlist1: fieldlist1 ',' ident type { $$ = append($1, param{name: $3, typ: $4}) }
+
+// a variant type is a list of constructors, each with the types of its values
+decl: kType ident '=' variants { $$ = &TypeDecl{Span: between($<span>1, $4[len($4)-1]), Name: $2, Variants: $4} }
+
+variants: variant              { $$ = []*Variant{$1} }
+variants: variants '|' variant { $$ = append($1, $3) }
+variant: ident %prec tIdent      { $$ = &Variant{Span: $<span>1, Tag: $1} }
+variant: ident '(' typelist0 ')' { $$ = &Variant{Span: between($<span>1, $<span>4), Tag: $1, Types: $3} }
+
+expr: ident %prec tIdent { $$ = &VarExpr{Span: $<span>1, Name: $1} }
+expr: num   { $$ = &IntExpr{Span: $<span>1, Value: $1} }
+expr: tString { $$ = &StrExpr{Span: $<span>1, Value: $1} }
 expr: '(' expr ')' { $$ = $2 }
 
 // idea for a comment form which removes an entire expression
@@ -44,50 +283,152 @@ expr: '(' expr ')' { $$ = $2 }
 //expr: '#' '(' expr ')' expr { $$ = $5 }
 
 // TODO: boolean operators should have mutually undefined precedence
-expr: expr kAnd expr { $$ = &AndExpr{$1, $3} }
-expr: expr kOr expr { $$ = &OrExpr{$1, $3} }
+expr: expr kAnd expr { $$ = &AndExpr{Span: between($1, $3), Left: $1, Right: $3} }
+expr: expr kOr expr { $$ = &OrExpr{Span: between($1, $3), Left: $1, Right: $3} }
+
+expr: expr '.' ident { $$ = &DotExpr{Span: between($1, $<span>3), Op: ".", Left: $1, Right: $3} }
 
-expr: expr '.' ident { $$ = &DotExpr{".", $1, $3} }
+expr: expr '=' '=' expr %prec '=' { $$ = binExpr("eq", $1, $4) }
+expr: expr '<' '=' expr %prec '<' { $$ = binExpr("<=", $1, $4) }
+expr: expr '>' '=' expr %prec '>' { $$ = binExpr(">=", $1, $4) }
+expr: expr '<' expr { $$ = binExpr("<", $1, $3) }
+expr: expr '>' expr { $$ = binExpr(">", $1, $3) }
 
-expr: expr '=' '=' expr %prec '=' { $$ = &BinExpr{"eq", $1, $4} }
-expr: expr '<' '=' expr %prec '<' { $$ = &BinExpr{"<=", $1, $4} }
-expr: expr '>' '=' expr %prec '>' { $$ = &BinExpr{">=", $1, $4} }
-expr: expr '<' expr { $$ = &BinExpr{"<", $1, $3} }
-expr: expr '>' expr { $$ = &BinExpr{">", $1, $3} }
+expr: expr tConcat expr { $$ = binExpr("..", $1, $3) }
 
-expr: expr '+' expr { $$ = &BinExpr{"+", $1, $3} }
-expr: expr '-' expr { $$ = &BinExpr{"-", $1, $3} }
-expr: expr '*' expr { $$ = &BinExpr{"*", $1, $3} }
-expr: expr '/' expr { $$ = &BinExpr{"/", $1, $3} }
+expr: expr '+' expr { $$ = binExpr("+", $1, $3) }
+expr: expr '-' expr { $$ = binExpr("-", $1, $3) }
+expr: expr '*' expr { $$ = binExpr("*", $1, $3) }
+expr: expr '/' expr { $$ = binExpr("/", $1, $3) }
 
-expr: '-' expr %prec unary { $$ = &BinExpr{"-", &IntExpr{"0"}, $2} }
+expr: '-' expr %prec unary { $$ = &BinExpr{Span: between($<span>1, $2), Op: "-", Left: &IntExpr{Span: $<span>1, Value: "0"}, Right: $2, Neg: true} }
 
 expr: let
-let: kLet ident '=' expr kIn expr kEnd { $$ = &LetExpr{Var: $2, Val: $4, Body: $6} }
+let: kLet ident '=' expr kIn expr kEnd { $$ = &LetExpr{Span: between($<span>1, $<span>7), Var: $2, Val: $4, Body: $6} }
+let: kLet ident ':' type '=' expr kIn expr kEnd { $$ = &LetExpr{Span: between($<span>1, $<span>9), Var: $2, Type: $4, Val: $6, Body: $8} }
+let: kLet identlist '=' expr kIn expr kEnd { $$ = &LetValuesExpr{Span: between($<span>1, $<span>7), Vars: $2, Val: $4, Body: $6} }
+
+// two or more identifiers
+identlist: ident ',' ident     { $$ = []string{$1, $3} }
+identlist: identlist ',' ident { $$ = append($1, $3) }
+
+// error recovery.
+// the parser resynchronizes at the next keyword which ends the broken part
+// and substitutes a BadExpr for it.
+let: kLet error kEnd { $$ = &BadExpr{Span: between($<span>1, $<span>3)} }
+let: kLet ident '=' error kIn expr kEnd { $$ = &LetExpr{Span: between($<span>1, $<span>7), Var: $2, Val: badExpr($<span>3, $<span>5), Body: $6} }
+let: kLet ident '=' expr kIn error kEnd { $$ = &LetExpr{Span: between($<span>1, $<span>7), Var: $2, Val: $4, Body: badExpr($<span>5, $<span>7)} }
 
 expr: if
-if: kIf expr kThen expr kElse expr kEnd { $$ = &IfExpr{$2, $4, $6} }
+if: kIf expr kThen expr kElse expr kEnd { $$ = &IfExpr{Span: between($<span>1, $<span>7), Cond: $2, Then: $4, Else: $6} }
+if: kIf error kThen expr kElse expr kEnd { $$ = &IfExpr{Span: between($<span>1, $<span>7), Cond: badExpr($<span>1, $<span>3), Then: $4, Else: $6} }
+if: kIf expr kThen error kElse expr kEnd { $$ = &IfExpr{Span: between($<span>1, $<span>7), Cond: $2, Then: badExpr($<span>3, $<span>5), Else: $6} }
+if: kIf expr kThen expr kElse error kEnd { $$ = &IfExpr{Span: between($<span>1, $<span>7), Cond: $2, Then: $4, Else: badExpr($<span>5, $<span>7)} }
 
 expr: func
-func: kFunc        '(' args ')' body kEnd { $$ = &FuncExpr{"", $3, $5} }
-func: kFunc tIdent '(' args ')' body kEnd { $$ = &FuncExpr{$2, $4, $6} }
+func: kFunc        '(' args ')' results body kEnd { $$ = funcExpr(between($<span>1, $<span>7), "", $3, $5, $6) }
+func: kFunc tIdent '(' args ')' results body kEnd { $$ = funcExpr(between($<span>1, $<span>8), $2, $4, $6, $7) }
+func: kFunc        '(' args ')' results error kEnd { $$ = funcExpr(between($<span>1, $<span>7), "", $3, $5, badExpr($<span>4, $<span>7)) }
+func: kFunc tIdent '(' args ')' results error kEnd { $$ = funcExpr(between($<span>1, $<span>8), $2, $4, $6, badExpr($<span>5, $<span>8)) }
 args: arglist0
 body: expr
 
 arglist0:       { $$ = nil }
 arglist0: arglist1
 arglist0: arglist1 ','
-arglist1: ident              { $$ = []string{$1} }
-arglist1: arglist1 ',' ident { $$ = append($1, $3) }
+arglist1: ident                   { $$ = []param{{name: $1}} }
+arglist1: ident type              { $$ = []param{{name: $1, typ: $2}} }
+arglist1: arglist1 ',' ident      { $$ = append($1, param{name: $3}) }
+arglist1: arglist1 ',' ident type { $$ = append($1, param{name: $3, typ: $4}) }
+
+// a function can declare its result types:
+// -> int or, if there is more than one, -> (int, bool).
+// so a single tuple result has to be written -> tuple(int, bool)
+results:                        { $$ = nil }
+results: tArrow ntype           { $$ = []TypeExpr{$2} }
+results: tArrow '(' typelist0 ')' { $$ = $3 }
+
+// type expressions.
+// a tuple type is written like a tuple, (int, bool);
+// the ones with fewer than two elements have to be written tuple() and tuple(int)
+type: ntype
+type: '(' typelist1 ',' type ')' { $$ = &TupleTypeExpr{Span: between($<span>1, $<span>5), Types: append($2, $4)} }
+ntype: ident %prec tIdent        { $$ = &NamedTypeExpr{Span: $<span>1, Name: $1} }
+ntype: ident '.' ident          { $$ = &NamedTypeExpr{Span: between($<span>1, $<span>3), Name: $1 + "." + $3} }
+ntype: ident '(' typelist0 ')'  { $$ = &NamedTypeExpr{Span: between($<span>1, $<span>4), Name: $1, Args: $3} }
+ntype: kFunc '(' typelist0 ')' results { $$ = &FuncTypeExpr{Span: between($<span>1, $<span>4), Params: $3, Results: $5} }
+
+typelist0:       { $$ = nil }
+typelist0: typelist1
+typelist0: typelist1 ','
+typelist1: type               { $$ = []TypeExpr{$1} }
+typelist1: typelist1 ',' type { $$ = append($1, $3) }
 
 expr: call
-call: expr '(' exprlist0 ')' { $$ = &CallExpr{Func: $1, Args: $3} }
+call: expr '(' exprlist0 ')' { $$ = &CallExpr{Span: between($1, $<span>4), Func: $1, Args: $3} }
+
+// lists
+expr: '[' exprlist0 ']' { $$ = &ListExpr{Span: between($<span>1, $<span>3), Args: $2} }
+expr: expr '[' expr ']' { $$ = &IndexExpr{Span: between($1, $<span>4), Base: $1, Index: $3} }
+
+// dicts
+expr: '{' pairlist0 '}' { $$ = dictExpr(between($<span>1, $<span>3), $2) }
+
+// records, by the name of their type, which may be in another module
+expr: ident '{' initlist0 '}' { $$ = recordExpr(between($<span>1, $<span>4), $1, $3) }
+expr: expr '.' ident '{' initlist0 '}' { $$ = recordExpr(between($1, $<span>6), qualifiedName(yylex.(*lexer), $1, $3), $5) }
+
+// a match has a case for each variant it handles.
+// a pattern is a constructor's name, and variables for its values.
+expr: match
+match: kMatch expr cases kEnd                { $$ = matchExpr(between($<span>1, $<span>4), $2, $3, nil) }
+match: kMatch expr cases kElse expr kEnd     { $$ = matchExpr(between($<span>1, $<span>6), $2, $3, $5) }
+match: kMatch error kEnd                     { $$ = &BadExpr{Span: between($<span>1, $<span>3)} }
+
+cases: case       { $$ = []*MatchCase{$1} }
+cases: cases case { $$ = append($1, $2) }
+case: kCase pattern kThen expr  { c := $2; c.Span = between($<span>1, $4); c.Body = $4; $$ = c }
+case: kCase pattern kThen error { c := $2; c.Span = $<span>1; c.Body = badExpr($<span>3, $<span>3); $$ = c }
+
+pattern: ident                                 { $$ = &MatchCase{Tag: $1} }
+pattern: ident '(' varlist0 ')'                { $$ = &MatchCase{Tag: $1, Vars: $3} }
+pattern: ident '.' ident                       { $$ = &MatchCase{Tag: $1 + "." + $3} }
+pattern: ident '.' ident '(' varlist0 ')'      { $$ = &MatchCase{Tag: $1 + "." + $3, Vars: $5} }
+
+varlist0:       { $$ = nil }
+varlist0: varlist1
+varlist0: varlist1 ','
+varlist1: ident              { $$ = []string{$1} }
+varlist1: varlist1 ',' ident { $$ = append($1, $3) }
+
+expr: for
+for: kFor ident kIn expr kDo expr kEnd { $$ = &ForExpr{Span: between($<span>1, $<span>7), Var: $2, List: $4, Body: $6} }
+for: kFor error kEnd { $$ = &BadExpr{Span: between($<span>1, $<span>3)} }
 
 exprlist0: { $$ = nil }
 exprlist0: exprlist1
 exprlist0: exprlist1 ','
 exprlist1: expr               { $$ = []Expr{$1} }
 exprlist1: exprlist1 ',' expr { $$ = append($1, $3) }
+exprlist1: error               { $$ = []Expr{&BadExpr{}} }
+exprlist1: exprlist1 ',' error { $$ = append($1, &BadExpr{Span: Span{Start: $<span>2.End}}) }
+
+// the keys and values of a dict literal, alternating
+pairlist0: { $$ = nil }
+pairlist0: pairlist1
+pairlist0: pairlist1 ','
+pairlist1: expr ':' expr               { $$ = []Expr{$1, $3} }
+pairlist1: pairlist1 ',' expr ':' expr { $$ = append($1, $3, $5) }
+pairlist1: error                       { $$ = []Expr{&BadExpr{}, &BadExpr{}} }
+pairlist1: pairlist1 ',' error         { $$ = append($1, &BadExpr{Span: Span{Start: $<span>2.End}}, &BadExpr{Span: Span{Start: $<span>2.End}}) }
+
+initlist0:       { $$ = nil }
+initlist0: initlist1
+initlist0: initlist1 ','
+initlist1: ident ':' expr               { $$ = []fieldInit{{name: $1, val: $3}} }
+initlist1: initlist1 ',' ident ':' expr { $$ = append($1, fieldInit{name: $3, val: $5}) }
+initlist1: error                        { $$ = []fieldInit{{val: &BadExpr{}}} }
+initlist1: initlist1 ',' error          { $$ = append($1, fieldInit{val: &BadExpr{Span: Span{Start: $<span>2.End}}}) }
 
 ident: tIdent
 num: tNumber
@@ -1,42 +1,98 @@
 package main
 
-//go:generate goyacc grammar.y
+//go:generate goyacc -o y.go -v "" grammar.y
 
 import (
-	"errors"
-	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"text/scanner"
 )
 
-const scannerMode = scanner.ScanIdents | scanner.ScanInts | scanner.SkipComments
+// the scanner doesn't recognize floats, chars or raw strings,
+// so that they reach the parser as punctuation, which it rejects.
+// comments are tokens, so that fmt can keep them; Lex sets them aside
+const scannerMode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanStrings | scanner.ScanComments
 
 // TODO: allow question marks in identifiers
 
 // lexer implements yyLexer { Lex(lval *yySymType) int; Error(e string) }
 type lexer struct {
-	result  Expr
-	scanner scanner.Scanner
-	errors  []error
+	result   *File
+	scanner  scanner.Scanner
+	errors   []error
+	comments []*Comment // the parser doesn't see them, but fmt keeps them
 }
 
-func (l *lexer) Init(r io.Reader) {
+func (l *lexer) Init(filename string, r io.Reader) {
 	l.scanner.Error = func(s *scanner.Scanner, msg string) {
-		l.Error(msg)
+		l.errorAt(s.Pos(), msg)
 	}
-	l.scanner.Mode = scannerMode
 	l.scanner.Init(r)
+	// Init resets the mode to GoTokens
+	l.scanner.Mode = scannerMode
+	l.scanner.Filename = filename
+}
+
+func init() {
+	yyErrorVerbose = true
 }
 
+// tokenNames translates the token names in
+// the parser's error messages into source syntax
+var tokenNames = strings.NewReplacer(
+	"$end", "end of file",
+	"tIdent", "identifier",
+	"tNumber", "number",
+	"tString", "string",
+	"kImport", "'import'",
+	"kPublic", "'public'",
+	"kType", "'type'",
+	"kLet", "'let'",
+	"kIn", "'in'",
+	"kIf", "'if'",
+	"kThen", "'then'",
+	"kElse", "'else'",
+	"kFunc", "'func'",
+	"kEnd", "'end'",
+	"kFor", "'for'",
+	"kMatch", "'match'",
+	"kCase", "'case'",
+	"kDo", "'do'",
+	"kOr", "'or'",
+	"kAnd", "'and'",
+	"tArrow", "'->'",
+	"tConcat", "'..'",
+)
+
+// Error reports a syntax error at the most recently scanned token
 func (l *lexer) Error(e string) {
-	l.errors = append(l.errors, errors.New(e))
-	fmt.Println(e)
+	e = strings.Replace(e, "$unk", strconv.Quote(l.scanner.TokenText()), 1)
+	l.errorAt(l.scanner.Position, tokenNames.Replace(e))
+}
+
+func (l *lexer) errorAt(pos scanner.Position, msg string) {
+	l.errors = append(l.errors, &Error{Pos: pos, Msg: msg})
 }
 
 func (l *lexer) Lex(lval *yySymType) int {
 	r := l.scanner.Scan()
+	for r == scanner.Comment {
+		l.comments = append(l.comments, &Comment{
+			Span: Span{Start: l.scanner.Position, End: l.scanner.Pos()},
+			Text: l.scanner.TokenText(),
+		})
+		r = l.scanner.Scan()
+	}
+	lval.span = Span{Start: l.scanner.Position, End: l.scanner.Pos()}
 	if r == scanner.Ident {
 		switch token := l.scanner.TokenText(); token {
+		case "import":
+			return kImport
+		case "public":
+			return kPublic
+		case "type":
+			return kType
 		case "let":
 			return kLet
 		case "in":
@@ -51,6 +107,14 @@ func (l *lexer) Lex(lval *yySymType) int {
 			return kFunc
 		case "end":
 			return kEnd
+		case "for":
+			return kFor
+		case "do":
+			return kDo
+		case "match":
+			return kMatch
+		case "case":
+			return kCase
 		case "or":
 			return kOr
 		case "and":
@@ -64,5 +128,23 @@ func (l *lexer) Lex(lval *yySymType) int {
 		lval.num = l.scanner.TokenText()
 		return tNumber
 	}
+	if r == scanner.String {
+		s, err := strconv.Unquote(l.scanner.TokenText())
+		if err != nil {
+			l.errorAt(l.scanner.Position, "invalid string literal")
+		}
+		lval.str = s
+		return tString
+	}
+	if r == '-' && l.scanner.Peek() == '>' {
+		l.scanner.Next()
+		lval.span.End = l.scanner.Pos()
+		return tArrow
+	}
+	if r == '.' && l.scanner.Peek() == '.' {
+		l.scanner.Next()
+		lval.span.End = l.scanner.Pos()
+		return tConcat
+	}
 	return int(r)
 }
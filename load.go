@@ -0,0 +1,963 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/scanner"
+)
+
+// load.go finds the modules which a program imports,
+// parses them, and links everything together into a single expression.
+//
+// a package is a tree of source code which is versioned as a unit,
+// and a module is a directory within a package. all the .lang files
+// in a module share its top-level declarations.
+// (go calls these modules and packages; see imports.txt.)
+//
+// the path in an import says where to find the package:
+//
+//	"psc/prim"  the built-in primitives (see prim.go)
+//	"std"       the standard library, in the lib directory next to the runtime
+//	"."         the package which the importing module is in.
+//	            the main program's package is the nearest directory
+//	            above it with a psc.pkg file, or else the one it's in.
+//	"https://github.com/magical/foo@devel"
+//	            anything else is a remote package, which has to be required
+//	            by the main package's psc.pkg. the version to use is
+//	            chosen by minimal version selection (see mvs.go).
+//
+// linking turns the top-level declarations in every module into lets
+// around the main program. the variables in an imported module are
+// renamed to module.name, like std/fmt.print, which can't collide with
+// anything else, and references to them from other modules (fmt.print)
+// become plain variables with that name. only the declarations marked
+// public can be used from other modules. record types are renamed
+// the same way, but they are in a separate namespace. the constructors
+// of a variant type are in the same namespace as the variables, and
+// references to them become VariantExprs.
+
+type loader struct {
+	stdDir   string                  // the standard library
+	pkgDir   string                  // the package cache, where remote packages are found
+	manifest string                  // the main package's psc.pkg
+	selected map[string]string       // the version of each remote package to use
+	sums     *sumFile                // nil if there is no manifest
+	modules  map[string]*module      // by path
+	imported map[*ImportDecl]*module // nil if the import failed
+	order    []*module               // imported modules, in dependency order
+	errors   []error
+}
+
+// a module is a directory of source files
+type module struct {
+	path    string // like std/fmt; empty for the main program
+	pkgPath string // the package it is in, like std
+	pkgDir  string // the package's directory
+	files   []*File
+	names   map[string]string // top-level variables -> their names after linking
+	public  map[string]bool   // top-level variables which other modules can use
+	types   map[string]string // record types -> their names after linking
+	pubtype map[string]bool   // record types which other modules can use
+	ctors   map[string]ctor   // variant constructors
+	loading bool              // true while its imports are being loaded
+}
+
+// a ctor is a constructor of a variant type
+type ctor struct {
+	typ    string // the type's name after linking
+	index  int    // which variant of the type it is
+	public bool
+}
+
+// primModule stands in for psc/prim, which has no source code
+var primModule = &module{path: primPath, pkgPath: primPath}
+
+func newLoader() *loader {
+	pkgDir := os.Getenv("PSCPKGDIR")
+	if pkgDir == "" {
+		if dir, err := os.UserCacheDir(); err == nil {
+			pkgDir = filepath.Join(dir, "psc", "pkg")
+		}
+	}
+	return &loader{
+		stdDir:   filepath.Join(filepath.Dir(findRuntime()), "lib"),
+		pkgDir:   pkgDir,
+		modules:  make(map[string]*module),
+		imported: make(map[*ImportDecl]*module),
+	}
+}
+
+// loadProgram parses the program in filename and the modules it imports,
+// and links them together
+func loadProgram(filename string) (Expr, error) {
+	f, err := parseFile(filename)
+	if f == nil {
+		return nil, err
+	}
+	return newLoader().load(filename, f, err)
+}
+
+// parseReader parses a program from r and links it with the modules it imports.
+// filename is used in error messages.
+// imports from "." are found in the current directory.
+func parseReader(filename string, r io.Reader) (Expr, error) {
+	f, err := parseSource(filename, r)
+	return newLoader().load(filename, f, err)
+}
+
+func parse(r io.Reader) (Expr, error) {
+	return parseReader("", r)
+}
+
+// load links the main program, f, with the modules it imports.
+// its package is the directory that filename is in.
+// err is the result of parsing f; like check, we keep going
+// after syntax errors in order to report everything we can.
+func (l *loader) load(filename string, f *File, err error) (Expr, error) {
+	l.error(err)
+	if f.Body == nil {
+		pos := scanner.Position{Filename: filename, Line: 1, Column: 1}
+		l.error(&Error{Pos: pos, Msg: "program has no result"})
+	}
+	root := findPackageRoot(filepath.Dir(filename))
+	main := &module{pkgPath: ".", pkgDir: root, files: []*File{f}}
+	l.selectVersions(root)
+	l.loadImports(main)
+	expr := l.link(main)
+	if l.sums != nil {
+		l.error(l.sums.write())
+	}
+	if len(l.errors) > 0 {
+		return expr, ErrorList(l.errors)
+	}
+	return expr, nil
+}
+
+// findPackageRoot returns the nearest directory above dir
+// which has a manifest, or dir itself if there isn't one
+func findPackageRoot(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return dir
+	}
+	for d := abs; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, manifestName)); err == nil {
+			return d
+		}
+		if filepath.Dir(d) == d {
+			return dir
+		}
+	}
+}
+
+// selectVersions reads the main package's manifest, if it has one,
+// and picks the versions of the remote packages that it needs
+func (l *loader) selectVersions(root string) {
+	l.manifest = filepath.Join(root, manifestName)
+	man, err := readManifest(l.manifest)
+	if os.IsNotExist(err) {
+		return
+	}
+	l.error(err)
+	if man == nil {
+		return
+	}
+	l.sums, err = readSums(filepath.Join(root, sumName))
+	if err != nil {
+		l.error(err)
+		return
+	}
+	l.selected, err = buildList(man.Requires, l.requirements)
+	l.error(err)
+}
+
+// requirements returns the requirements of a version of a package,
+// from its manifest in the package cache.
+// a package which doesn't require anything doesn't need a manifest.
+func (l *loader) requirements(r requirement) ([]requirement, error) {
+	dir, err := l.versionDir(r.Path, r.Version)
+	if err != nil {
+		return nil, err
+	}
+	man, err := readManifest(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if path, _ := splitChannel(r.Path); man.Path != "" && man.Path != path {
+		return nil, fmt.Errorf("%s@%s declares its path as %s", path, r.Version, man.Path)
+	}
+	return man.Requires, nil
+}
+
+// versionDir returns the directory of a version of a package in the cache,
+// after checking its contents against psc.sum
+func (l *loader) versionDir(path, version string) (string, error) {
+	path, _ = splitChannel(path)
+	key := path + "@" + version
+	if l.pkgDir == "" {
+		return "", fmt.Errorf("cannot find %s: PSCPKGDIR is not set", key)
+	}
+	dir := filepath.Join(l.pkgDir, filepath.FromSlash(key))
+	if _, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("cannot find %s in the package cache (%s)", key, l.pkgDir)
+	}
+	if l.sums != nil {
+		if err := l.sums.verify(key, dir); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+func (l *loader) error(err error) {
+	if list, ok := err.(ErrorList); ok {
+		l.errors = append(l.errors, list...)
+	} else if err != nil {
+		l.errors = append(l.errors, err)
+	}
+}
+
+// loadImports loads the modules which m imports,
+// and the ones they import, and so on
+func (l *loader) loadImports(m *module) {
+	m.loading = true
+	for _, f := range m.files {
+		seen := make(map[string]bool)
+		for _, imp := range f.Imports {
+			if !isIdent(imp.Name) {
+				l.error(errorAt(imp, "invalid module name %q", imp.Name))
+			} else if seen[imp.Name] {
+				l.error(errorAt(imp, "%s is already imported", imp.Name))
+			}
+			seen[imp.Name] = true
+			l.imported[imp] = l.importModule(m, imp)
+		}
+	}
+	m.loading = false
+}
+
+// importModule finds the module named by an import in from and loads it,
+// if that hasn't been done already
+func (l *loader) importModule(from *module, imp *ImportDecl) *module {
+	pkgPath, pkgDir, err := l.findPackage(from, imp)
+	if err == errReported {
+		return nil
+	} else if err != nil {
+		l.error(errorAt(imp, "%v", err))
+		return nil
+	}
+	if pkgPath == primPath {
+		if imp.Module != "" && imp.Module != primPackage {
+			l.error(errorAt(imp, "cannot find module %s/%s", primPath, imp.Module))
+			return nil
+		}
+		return primModule
+	}
+	path, dir := pkgPath, pkgDir
+	if imp.Module != "" {
+		if !validPath(imp.Module) {
+			l.error(errorAt(imp, "invalid module path %q", imp.Module))
+			return nil
+		}
+		path = pkgPath + "/" + imp.Module
+		dir = filepath.Join(pkgDir, filepath.FromSlash(imp.Module))
+	}
+	if m, ok := l.modules[path]; ok {
+		if m != nil && m.loading {
+			l.error(errorAt(imp, "import cycle: %s imports %s", from.path, path))
+		}
+		return m
+	}
+	filenames, _ := filepath.Glob(filepath.Join(dir, "*.lang"))
+	if len(filenames) == 0 {
+		l.error(errorAt(imp, "cannot find module %s in %s", path, dir))
+		l.modules[path] = nil
+		return nil
+	}
+	m := &module{path: path, pkgPath: pkgPath, pkgDir: pkgDir}
+	l.modules[path] = m
+	for _, filename := range filenames {
+		f, err := parseFile(filename)
+		l.error(err)
+		if f == nil {
+			continue
+		}
+		// the parser already reported a file it couldn't make sense of
+		if _, bad := f.Body.(*BadExpr); f.Body != nil && !bad {
+			l.error(errorAt(f.Body, "only the main program can have a result"))
+		}
+		m.files = append(m.files, f)
+	}
+	l.loadImports(m)
+	l.order = append(l.order, m)
+	return m
+}
+
+// findPackage returns the path and directory of the package
+// which an import in the module from refers to
+func (l *loader) findPackage(from *module, imp *ImportDecl) (path, dir string, err error) {
+	switch imp.Package {
+	case primPath, "std", ".":
+		if imp.Version != "" {
+			return "", "", fmt.Errorf("package %s does not have versions", imp.Package)
+		}
+	}
+	switch imp.Package {
+	case primPath:
+		return primPath, "", nil
+	case "std":
+		return "std", l.stdDir, nil
+	case ".":
+		return from.pkgPath, from.pkgDir, nil
+	}
+	path = strings.TrimPrefix(strings.TrimPrefix(imp.Package, "https://"), "http://")
+	if !validPackagePath(path) {
+		return "", "", fmt.Errorf("invalid package path %q", imp.Package)
+	}
+	if imp.Version != "" {
+		path += "@" + imp.Version
+	}
+	version, ok := l.selected[path]
+	if !ok {
+		return "", "", fmt.Errorf("package %s is not required by %s", path, l.manifest)
+	}
+	dir, err = l.versionDir(path, version)
+	return path, dir, err
+}
+
+// validPackagePath reports whether p is a valid path for a remote package.
+// like a url without the scheme, it starts with a host name.
+func validPackagePath(p string) bool {
+	return validPath(p) && strings.Contains(strings.Split(p, "/")[0], ".")
+}
+
+// validPath reports whether p is a slash-separated path
+// which stays inside the directory it is relative to
+func validPath(p string) bool {
+	for _, elem := range strings.Split(p, "/") {
+		if elem == "" || elem == "." || elem == ".." || strings.ContainsAny(elem, `\:`) {
+			return false
+		}
+	}
+	return true
+}
+
+func isIdent(s string) bool {
+	var sc scanner.Scanner
+	sc.Init(strings.NewReader(s))
+	sc.Mode = scanner.ScanIdents
+	sc.Error = func(*scanner.Scanner, string) {}
+	return sc.Scan() == scanner.Ident && sc.TokenText() == s && sc.Scan() == scanner.EOF
+}
+
+// link turns the modules into one expression.
+// the top-level declarations in each module go around the modules
+// which import it, and the main program's result is in the middle.
+//
+// a module's record types are declared first, by a LetTypeExpr,
+// so that everything in the module can use them.
+// its functions are bound by LetRecExprs, so that they can call
+// each other (see sccs). its lets are evaluated in order before
+// the functions, so that the functions can use them, except for the
+// ones which use the functions; those come after.
+func (l *loader) link(main *module) Expr {
+	var binds []Expr // LetExprs, LetRecExprs and LetTypeExprs, without their bodies
+	var body Expr
+	for _, m := range append(l.order, main) {
+		m.names = make(map[string]string)
+		m.public = make(map[string]bool)
+		m.types = make(map[string]string)
+		m.pubtype = make(map[string]bool)
+		m.ctors = make(map[string]ctor)
+		global := func(name string) string {
+			if m == main {
+				return name
+			}
+			return m.path + "." + name
+		}
+		redeclared := func(name string) bool {
+			_, ok1 := m.names[name]
+			_, ok2 := m.ctors[name]
+			return ok1 || ok2
+		}
+		declare := func(d Decl, name string, public bool) {
+			if redeclared(name) {
+				l.error(errorAt(d, "%s redeclared in this module", name))
+			}
+			m.names[name] = global(name)
+			m.public[name] = public
+		}
+		resolvers := make([]*resolver, len(m.files))
+		for i, f := range m.files {
+			r := &resolver{l: l, m: m, imports: make(map[string]*module)}
+			for _, imp := range f.Imports {
+				if _, ok := r.imports[imp.Name]; !ok {
+					r.imports[imp.Name] = l.imported[imp]
+				}
+			}
+			resolvers[i] = r
+			// functions and types are in scope everywhere in the module
+			for _, d := range f.Decls {
+				switch d := d.(type) {
+				case *FuncDecl:
+					declare(d, d.Func.Name, d.Public)
+				case *TypeDecl:
+					if _, ok := m.types[d.Name]; ok {
+						l.error(errorAt(d, "type %s redeclared in this module", d.Name))
+					}
+					m.types[d.Name] = global(d.Name)
+					m.pubtype[d.Name] = d.Public
+					for i, v := range d.Variants {
+						if redeclared(v.Tag) {
+							l.error(errorAt(v, "%s redeclared in this module", v.Tag))
+						}
+						m.ctors[v.Tag] = ctor{typ: global(d.Name), index: i, public: d.Public}
+					}
+				}
+			}
+		}
+		types := &LetTypeExpr{}
+		for i, f := range m.files {
+			r := resolvers[i]
+			for _, d := range f.Decls {
+				d, ok := d.(*TypeDecl)
+				if !ok {
+					continue
+				}
+				if len(types.Types) == 0 {
+					types.Span = d.Span
+				}
+				var variants []*Variant
+				for _, v := range d.Variants {
+					variants = append(variants, &Variant{Span: v.Span, Tag: v.Tag, Types: r.types(v.Types)})
+				}
+				types.Types = append(types.Types, &TypeDecl{
+					Span:     d.Span,
+					Public:   d.Public,
+					Name:     m.types[d.Name],
+					Fields:   d.Fields,
+					Types:    r.types(d.Types),
+					Variants: variants,
+				})
+			}
+		}
+		if len(types.Types) > 0 {
+			binds = append(binds, types)
+		}
+		// late is the set of functions, and lets which use them
+		late := make(map[string]bool)
+		for _, name := range m.names {
+			late[name] = true
+		}
+		var lets, lateLets []Expr
+		var lateVars []string
+		for i, f := range m.files {
+			r := resolvers[i]
+			for _, d := range f.Decls {
+				d, ok := d.(*LetDecl)
+				if !ok {
+					continue
+				}
+				// the variable isn't in scope in its own value
+				r.used = make(map[string]bool)
+				val := r.expr(newscope(nil), d.Val)
+				declare(d, d.Var, d.Public)
+				let := &LetExpr{Span: d.Span, Var: global(d.Var), Type: r.typ(d.Type), Val: val}
+				if usesAny(r.used, late) {
+					late[let.Var] = true
+					lateLets = append(lateLets, let)
+					lateVars = append(lateVars, d.Var)
+				} else {
+					lets = append(lets, let)
+				}
+			}
+		}
+		binds = append(binds, lets...)
+		var funcs []*FuncDecl
+		var vars []string
+		var vals []Expr
+		var uses []map[string]bool
+		for i, f := range m.files {
+			r := resolvers[i]
+			for _, d := range f.Decls {
+				d, ok := d.(*FuncDecl)
+				if !ok {
+					continue
+				}
+				// the function's name refers to the global variable,
+				// like any other function in the module
+				fn := *d.Func
+				fn.Name = ""
+				r.used = make(map[string]bool)
+				val := r.expr(newscope(nil), &fn)
+				for i, let := range lateLets {
+					if r.used[let.(*LetExpr).Var] {
+						l.error(errorAt(d, "function %s cannot use %s, which is initialized after this module's functions", d.Func.Name, lateVars[i]))
+					}
+				}
+				funcs = append(funcs, d)
+				uses = append(uses, r.used)
+				vars = append(vars, m.names[d.Func.Name])
+				vals = append(vals, val)
+			}
+		}
+		// the typechecker only generalizes a function's type
+		// once it has checked its whole group, so the functions are
+		// bound in the smallest groups which call each other,
+		// and each group comes before the ones which use it
+		for _, scc := range sccs(vars, uses) {
+			rec := &LetRecExpr{Span: funcs[scc[0]].Span}
+			for _, i := range scc {
+				rec.Vars = append(rec.Vars, vars[i])
+				rec.Vals = append(rec.Vals, vals[i])
+			}
+			binds = append(binds, rec)
+		}
+		binds = append(binds, lateLets...)
+		if m == main {
+			for i, f := range m.files {
+				if f.Body != nil {
+					body = resolvers[i].expr(newscope(nil), f.Body)
+				}
+			}
+		}
+	}
+	if body == nil {
+		body = &BadExpr{}
+	}
+	for i := len(binds) - 1; i >= 0; i-- {
+		switch b := binds[i].(type) {
+		case *LetExpr:
+			b.Body = body
+		case *LetRecExpr:
+			b.Body = body
+		case *LetTypeExpr:
+			b.Body = body
+		}
+		body = binds[i]
+	}
+	return body
+}
+
+// sccs splits a group of functions into its strongly connected components,
+// where uses[i] is the set of names which the function names[i] uses.
+// each component comes after the components it uses,
+// and lists its functions in their original order.
+// it is Tarjan's algorithm.
+func sccs(names []string, uses []map[string]bool) [][]int {
+	index := make(map[string]int)
+	for i, name := range names {
+		index[name] = i
+	}
+	var (
+		sccs    [][]int
+		stack   []int
+		onStack = make([]bool, len(names))
+		order   = make([]int, len(names)) // when each function was visited, from 1
+		low     = make([]int, len(names))
+		visited = 0
+	)
+	var visit func(i int)
+	visit = func(i int) {
+		visited++
+		order[i], low[i] = visited, visited
+		stack = append(stack, i)
+		onStack[i] = true
+		// visit the callees in order, so that the result doesn't
+		// depend on the order of the map
+		var callees []int
+		for name := range uses[i] {
+			if j, ok := index[name]; ok {
+				callees = append(callees, j)
+			}
+		}
+		sort.Ints(callees)
+		for _, j := range callees {
+			if order[j] == 0 {
+				visit(j)
+				if low[j] < low[i] {
+					low[i] = low[j]
+				}
+			} else if onStack[j] && order[j] < low[i] {
+				low[i] = order[j]
+			}
+		}
+		if low[i] != order[i] {
+			return
+		}
+		// i is the root of a component
+		var scc []int
+		for {
+			j := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[j] = false
+			scc = append(scc, j)
+			if j == i {
+				break
+			}
+		}
+		sort.Ints(scc)
+		sccs = append(sccs, scc)
+	}
+	for i := range names {
+		if order[i] == 0 {
+			visit(i)
+		}
+	}
+	return sccs
+}
+
+// usesAny reports whether any of the names in used are in set
+func usesAny(used, set map[string]bool) bool {
+	for name := range used {
+		if set[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// a resolver rewrites the references to top-level variables
+// and imported modules in a file
+type resolver struct {
+	l       *loader
+	m       *module
+	imports map[string]*module // by the name they go by; nil if the import failed
+	used    map[string]bool    // the module's own variables which have been referred to, by their linked names
+}
+
+// module returns the module which name refers to, if it refers to one
+func (r *resolver) module(s *scope, name string) (*module, bool) {
+	if s.has(name) {
+		return nil, false
+	}
+	if _, ok := r.m.names[name]; ok {
+		return nil, false
+	}
+	if _, ok := r.m.ctors[name]; ok {
+		return nil, false
+	}
+	m, ok := r.imports[name]
+	return m, ok
+}
+
+func (r *resolver) expr(s *scope, expr Expr) Expr {
+	switch e := expr.(type) {
+	case *VarExpr:
+		if s.has(e.Name) {
+			break
+		}
+		if name, ok := r.m.names[e.Name]; ok {
+			if r.used != nil {
+				r.used[name] = true
+			}
+			return &VarExpr{Span: e.Span, Name: name}
+		}
+		if c, ok := r.m.ctors[e.Name]; ok {
+			return &VariantExpr{Span: e.Span, Type: c.typ, Tag: e.Name}
+		}
+		if _, ok := r.imports[e.Name]; ok {
+			r.l.error(errorAt(e, "use of module %s without selector", e.Name))
+			return &BadExpr{Span: e.Span}
+		}
+	case *BoolExpr:
+		break
+	case *IntExpr:
+		break
+	case *StrExpr:
+		break
+	case *BadExpr:
+		break
+	case *DotExpr:
+		if v, ok := e.Left.(*VarExpr); ok {
+			if m, ok := r.module(s, v.Name); ok {
+				return r.qualified(e, v.Name, m)
+			}
+		}
+		return &DotExpr{
+			Span:  e.Span,
+			Op:    e.Op,
+			Left:  r.expr(s, e.Left),
+			Right: e.Right,
+		}
+	case *BinExpr:
+		return &BinExpr{
+			Span:  e.Span,
+			Op:    e.Op,
+			Left:  r.expr(s, e.Left),
+			Right: r.expr(s, e.Right),
+		}
+	case *AndExpr:
+		return &AndExpr{
+			Span:  e.Span,
+			Left:  r.expr(s, e.Left),
+			Right: r.expr(s, e.Right),
+		}
+	case *OrExpr:
+		return &OrExpr{
+			Span:  e.Span,
+			Left:  r.expr(s, e.Left),
+			Right: r.expr(s, e.Right),
+		}
+	case *CallExpr:
+		args := make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = r.expr(s, e.Args[i])
+		}
+		f := r.expr(s, e.Func)
+		if v, ok := f.(*VariantExpr); ok && v.Args == nil {
+			// a constructor with values
+			return &VariantExpr{Span: e.Span, Type: v.Type, Tag: v.Tag, Args: args}
+		}
+		return &CallExpr{
+			Span: e.Span,
+			Func: f,
+			Args: args,
+		}
+	case *LetExpr:
+		val := r.expr(s, e.Val)
+		inner := s.push()
+		inner.vars[e.Var] = true
+		return &LetExpr{
+			Span: e.Span,
+			Var:  e.Var,
+			Type: r.typ(e.Type),
+			Val:  val,
+			Body: r.expr(inner, e.Body),
+		}
+	case *LetValuesExpr:
+		val := r.expr(s, e.Val)
+		inner := s.push()
+		for _, name := range e.Vars {
+			inner.vars[name] = true
+		}
+		return &LetValuesExpr{
+			Span: e.Span,
+			Vars: e.Vars,
+			Val:  val,
+			Body: r.expr(inner, e.Body),
+		}
+	case *ListExpr:
+		args := make([]Expr, len(e.Args))
+		for i := range e.Args {
+			args[i] = r.expr(s, e.Args[i])
+		}
+		return &ListExpr{Span: e.Span, Args: args}
+	case *IndexExpr:
+		return &IndexExpr{
+			Span:  e.Span,
+			Base:  r.expr(s, e.Base),
+			Index: r.expr(s, e.Index),
+		}
+	case *DictExpr:
+		keys := make([]Expr, len(e.Keys))
+		vals := make([]Expr, len(e.Vals))
+		for i := range e.Keys {
+			keys[i] = r.expr(s, e.Keys[i])
+			vals[i] = r.expr(s, e.Vals[i])
+		}
+		return &DictExpr{Span: e.Span, Keys: keys, Vals: vals}
+	case *RecordExpr:
+		vals := make([]Expr, len(e.Vals))
+		for i := range e.Vals {
+			vals[i] = r.expr(s, e.Vals[i])
+		}
+		return &RecordExpr{
+			Span:   e.Span,
+			Type:   r.typeName(e, e.Type),
+			Fields: e.Fields,
+			Vals:   vals,
+		}
+	case *MatchExpr:
+		cases := make([]*MatchCase, len(e.Cases))
+		for i, c := range e.Cases {
+			inner := s.push()
+			for _, name := range c.Vars {
+				inner.vars[name] = true
+			}
+			k, tag := r.ctor(c)
+			cases[i] = &MatchCase{
+				Span:  c.Span,
+				Type:  k.typ,
+				Tag:   tag,
+				Index: k.index,
+				Vars:  c.Vars,
+				Body:  r.expr(inner, c.Body),
+			}
+		}
+		var els Expr
+		if e.Else != nil {
+			els = r.expr(s, e.Else)
+		}
+		return &MatchExpr{
+			Span:  e.Span,
+			Var:   e.Var,
+			Val:   r.expr(s, e.Val),
+			Cases: cases,
+			Else:  els,
+		}
+	case *ForExpr:
+		list := r.expr(s, e.List)
+		inner := s.push()
+		inner.vars[e.Var] = true
+		return &ForExpr{
+			Span: e.Span,
+			Var:  e.Var,
+			List: list,
+			Body: r.expr(inner, e.Body),
+		}
+	case *IfExpr:
+		return &IfExpr{
+			Span: e.Span,
+			Cond: r.expr(s, e.Cond),
+			Then: r.expr(s, e.Then),
+			Else: r.expr(s, e.Else),
+		}
+	case *FuncExpr:
+		inner := s.push()
+		if e.Name != "" {
+			inner.vars[e.Name] = true
+		}
+		for _, p := range e.Args {
+			inner.vars[p] = true
+		}
+		return &FuncExpr{
+			Span:        e.Span,
+			Name:        e.Name,
+			Args:        e.Args,
+			ArgTypes:    r.types(e.ArgTypes),
+			ReturnTypes: r.types(e.ReturnTypes),
+			Body:        r.expr(inner, e.Body),
+		}
+	default:
+		panic(fmt.Sprintf("unhandled case: %T", e))
+	}
+	return expr
+}
+
+// qualified resolves name.member, where name refers to the module m
+func (r *resolver) qualified(e *DotExpr, name string, m *module) Expr {
+	switch m {
+	case nil:
+		// the import failed, which has already been reported
+		return &BadExpr{Span: e.Span}
+	case primModule:
+		// the typechecker knows what is in prim
+		return &DotExpr{
+			Span:  e.Span,
+			Op:    e.Op,
+			Left:  &VarExpr{Span: spanOf(e.Left), Name: primPath},
+			Right: e.Right,
+		}
+	}
+	if c, ok := m.ctors[e.Right]; ok {
+		if !c.public {
+			r.l.error(errorAt(e, "%s.%s is not public", name, e.Right))
+			return &BadExpr{Span: e.Span}
+		}
+		return &VariantExpr{Span: e.Span, Type: c.typ, Tag: e.Right}
+	}
+	global, ok := m.names[e.Right]
+	if !ok {
+		r.l.error(errorAt(e, "%s.%s not in scope", name, e.Right))
+		return &BadExpr{Span: e.Span}
+	}
+	if !m.public[e.Right] {
+		r.l.error(errorAt(e, "%s.%s is not public", name, e.Right))
+		return &BadExpr{Span: e.Span}
+	}
+	return &VarExpr{Span: e.Span, Name: global}
+}
+
+// typ resolves the module names in a type annotation.
+// types are in a separate namespace from variables,
+// so a variable doesn't shadow a module there.
+func (r *resolver) typ(t TypeExpr) TypeExpr {
+	switch t := t.(type) {
+	case nil:
+		return nil
+	case *NamedTypeExpr:
+		return &NamedTypeExpr{Span: t.Span, Name: r.typeName(t, t.Name), Args: r.types(t.Args)}
+	case *FuncTypeExpr:
+		return &FuncTypeExpr{Span: t.Span, Params: r.types(t.Params), Results: r.types(t.Results)}
+	case *TupleTypeExpr:
+		return &TupleTypeExpr{Span: t.Span, Types: r.types(t.Types)}
+	default:
+		panic(fmt.Sprintf("unhandled case in resolver.typ: %T", t))
+	}
+}
+
+// ctor resolves the constructor in a case of a match,
+// which may be module.name. it also returns the constructor's
+// own name; if it isn't a constructor, the ctor's type is "".
+func (r *resolver) ctor(c *MatchCase) (ctor, string) {
+	name := c.Tag
+	i := strings.Index(name, ".")
+	if i < 0 {
+		k, ok := r.m.ctors[name]
+		if !ok {
+			r.l.error(errorAt(c, "%s is not a constructor", name))
+		}
+		return k, name
+	}
+	// an import which failed is nil, and psc/prim has no constructors
+	m, ok := r.imports[name[:i]]
+	if !ok || m == nil || m == primModule {
+		r.l.error(errorAt(c, "%s is not a constructor", name))
+		return ctor{}, name
+	}
+	k, ok := m.ctors[name[i+1:]]
+	if !ok {
+		r.l.error(errorAt(c, "%s is not a constructor", name))
+	} else if !k.public {
+		r.l.error(errorAt(c, "%s is not public", name))
+	}
+	return k, name[i+1:]
+}
+
+// typeName resolves the name of a type, which may be
+// one of the module's record types or module.name.
+// names it doesn't know are left for the typechecker.
+func (r *resolver) typeName(e Expr, name string) string {
+	i := strings.Index(name, ".")
+	if i < 0 {
+		if global, ok := r.m.types[name]; ok {
+			return global
+		}
+		return name
+	}
+	m, ok := r.imports[name[:i]]
+	switch {
+	case !ok || m == nil:
+		// not a module, or the import failed
+		return name
+	case m == primModule:
+		return primPath + name[i:]
+	}
+	global, ok := m.types[name[i+1:]]
+	if !ok {
+		r.l.error(errorAt(e, "%s not in scope", name))
+		return name
+	}
+	if !m.pubtype[name[i+1:]] {
+		r.l.error(errorAt(e, "%s is not public", name))
+	}
+	return global
+}
+
+func (r *resolver) types(list []TypeExpr) []TypeExpr {
+	if list == nil {
+		return nil
+	}
+	out := make([]TypeExpr, len(list))
+	for i, t := range list {
+		out[i] = r.typ(t)
+	}
+	return out
+}
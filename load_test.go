@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFiles creates a directory tree for testing the loader
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "psctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, text := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(text), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main/main.lang": `import . ( util )
+import "https://example.com/foo@v1" ( f "bar/baz" )
+import "psc/prim"
+let x = util.double(f.one)
+let y: prim.int32 = prim.toint32(x)
+let z = even(x)
+func even(n) if n == 0 then true else odd(n - 1) end end
+func odd(n) if n == 0 then false else even(n - 1) end end
+if z then x + prim.fromint32(y) else 0 end
+`,
+		"main/util/a.lang": `let two = 2
+`,
+		"main/util/b.lang": `import "example.com/foo@v1" ( bar/baz )
+public func double(n) n * two + baz.one - 1 end
+`,
+		"main/psc.pkg": `require example.com/foo@v1 v1.2.0
+`,
+		"pkg/example.com/foo@v1.2.0/bar/baz/baz.lang": `public let one = 1
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	l := newLoader()
+	l.pkgDir = filepath.Join(dir, "pkg")
+	filename := filepath.Join(dir, "main", "main.lang")
+	f, err := parseFile(filename)
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	expr, err := l.load(filename, f, nil)
+	if err != nil {
+		t.Fatal("load failed: ", err)
+	}
+	// modules are linked in dependency order;
+	// the main program's variables keep their names.
+	// z uses the functions, so it comes after them.
+	const want = `let example.com/foo@v1/bar/baz.one = 1 in
+  let ./util.two = 2 in
+    #letrec ./util.double = func (n)
+      n * ./util.two + example.com/foo@v1/bar/baz.one - 1
+    end in
+      let x = ./util.double(example.com/foo@v1/bar/baz.one) in
+        let y: psc/prim.int32 = psc/prim.toint32(x) in
+          #letrec even = func (n)
+            if n == 0 then
+              true
+            else
+              odd(n - 1)
+            end
+          end and odd = func (n)
+            if n == 0 then
+              false
+            else
+              even(n - 1)
+            end
+          end in
+            let z = even(x) in
+              if z then
+                x + psc/prim.fromint32(y)
+              else
+                0
+              end
+            end
+          end
+        end
+      end
+    end
+  end
+end
+`
+	var buf bytes.Buffer
+	formatExpr(&buf, expr)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if _, _, err := check(expr); err != nil {
+		t.Errorf("typecheck failed: %v", err)
+	}
+}
+
+func TestLoadTypes(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.lang": `import . ( geo )
+type point { z int }
+func f(p geo.point) p.x + p.y end
+f(geo.point{x: 1, y: 2}) + point{z: 3}.z
+`,
+		"geo/geo.lang": `public type point { x int, y int }
+type hidden { p point }
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	l := newLoader()
+	filename := filepath.Join(dir, "main.lang")
+	f, err := parseFile(filename)
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	expr, err := l.load(filename, f, nil)
+	if err != nil {
+		t.Fatal("load failed: ", err)
+	}
+	// like variables, the types in an imported module are renamed
+	const want = `#type public type ./geo.point { x int, y int } and type ./geo.hidden { p ./geo.point } in
+  #type type point { z int } in
+    #letrec f = func (p ./geo.point)
+      p.x + p.y
+    end in
+      f(./geo.point{x: 1, y: 2}) + point{z: 3}.z
+    end
+  end
+end
+`
+	var buf bytes.Buffer
+	formatExpr(&buf, expr)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if _, _, err := check(expr); err != nil {
+		t.Errorf("typecheck failed: %v", err)
+	}
+}
+
+func TestLoadVariants(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.lang": `import . ( geo )
+type opt = some(int) | none
+func f(s) match s case geo.circle(r) then r case geo.square(none) then none end end
+func g(some) f(geo.square(some)) end
+f(geo.circle(1)) + g(2) + match some(3) case some(n) then n else 0 end
+`,
+		"geo/geo.lang": `public type shape = circle(int) | square(int)
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	l := newLoader()
+	filename := filepath.Join(dir, "main.lang")
+	f, err := parseFile(filename)
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	expr, err := l.load(filename, f, nil)
+	if err != nil {
+		t.Fatal("load failed: ", err)
+	}
+	// the variables in a case and the parameters of a function
+	// shadow the constructors, but a case's tag doesn't
+	const want = `#type public type ./geo.shape = circle(int) | square(int) in
+  #type type opt = some(int) | none in
+    #letrec f = func (s)
+      match s
+      case circle(r) then
+        r
+      case square(none) then
+        none
+      end
+    end in
+      #letrec g = func (some)
+        f(square(some))
+      end in
+        f(circle(1)) + g(2) + match some(3)
+        case some(n) then
+          n
+        else
+          0
+        end
+      end
+    end
+  end
+end
+`
+	var buf bytes.Buffer
+	formatExpr(&buf, expr)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if _, _, err := check(expr); err != nil {
+		t.Errorf("typecheck failed: %v", err)
+	}
+}
+
+func TestLoadFuncGroups(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.lang": `func g(n) if id(true) then id(n) else 2 end end
+func even(n) if n == 0 then true else odd(n - 1) end end
+func id(x) x end
+func odd(n) if n == 0 then false else even(n - 1) end end
+if even(g(4)) then 1 else 0 end
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	expr, err := loadProgram(filepath.Join(dir, "main.lang"))
+	if err != nil {
+		t.Fatal("load failed: ", err)
+	}
+	// id is generalized before g uses it,
+	// and even and odd are checked together
+	const want = `#letrec id = func (x)
+  x
+end in
+  #letrec g = func (n)
+    if id(true) then
+      id(n)
+    else
+      2
+    end
+  end in
+    #letrec even = func (n)
+      if n == 0 then
+        true
+      else
+        odd(n - 1)
+      end
+    end and odd = func (n)
+      if n == 0 then
+        false
+      else
+        even(n - 1)
+      end
+    end in
+      if even(g(4)) then
+        1
+      else
+        0
+      end
+    end
+  end
+end
+`
+	var buf bytes.Buffer
+	formatExpr(&buf, expr)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if _, _, err := check(expr); err != nil {
+		t.Errorf("typecheck failed: %v", err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.lang": `import . ( a )
+import "std" ( nothing )
+import "nowhere" ( a )
+let f = func(a) a.x end
+let v: a.hidden = 1
+a.x + a.y + a + f(1) + a.z
+`,
+		"a/a.lang": `import . ( b )
+public let x = b.y
+let z = x
+public func g() h() end
+let w = g()
+func h() w end
+type hidden { n int }
+`,
+		"b/b.lang": `import . ( a )
+public let y = 1
+y
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	l := newLoader()
+	l.stdDir = filepath.Join(dir, "lib")
+	filename := filepath.Join(dir, "main.lang")
+	f, err := parseFile(filename)
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	_, err = l.load(filename, f, nil)
+	if err == nil {
+		t.Fatal("expected errors but found none")
+	}
+	want := []string{
+		"b/b.lang:3:1: only the main program can have a result",
+		"b/b.lang:1:12: import cycle: ./b imports ./a",
+		"main.lang:2:16: cannot find module std/nothing in " + filepath.Join(dir, "lib", "nothing"),
+		"main.lang:3:20: a is already imported",
+		`main.lang:3:20: invalid package path "nowhere"`,
+		"a/a.lang:6:1: function h cannot use w, which is initialized after this module's functions",
+		"main.lang:5:8: a.hidden is not public",
+		"main.lang:6:7: a.y not in scope",
+		"main.lang:6:13: use of module a without selector",
+		"main.lang:6:24: a.z is not public",
+	}
+	list := err.(ErrorList)
+	if len(list) != len(want) {
+		t.Errorf("got %d errors, want %d:\n%v", len(list), len(want), err)
+	}
+	for i := 0; i < len(list) && i < len(want); i++ {
+		if got := list[i].Error(); got != filepath.Join(dir, want[i]) {
+			t.Errorf("error %d = %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+func TestLoadSyntaxError(t *testing.T) {
+	// a module the parser gives up on has no result to complain about
+	dir := writeFiles(t, map[string]string{
+		"main.lang": `import . ( a )
+a.x
+`,
+		"a/a.lang": `# not a comment
+public let x = 1
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "main.lang")
+	f, err := parseFile(filename)
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	_, err = newLoader().load(filename, f, nil)
+	want := filepath.Join(dir, "a/a.lang") + `:1:1: syntax error: unexpected "#"
+` + filepath.Join(dir, "main.lang") + ":2:1: a.x not in scope"
+	if err == nil || err.Error() != want {
+		t.Errorf("got error:\n%v\nwant:\n%s", err, want)
+	}
+}
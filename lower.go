@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"math/big"
 	"os"
 	"strconv"
 )
@@ -12,8 +13,9 @@ import (
 // it needs a new name.
 
 type Prog struct {
-	funcs  []*Func
-	blocks []*block
+	funcs   []*Func
+	blocks  []*block
+	strings []string // string literals, by index
 }
 
 type Func struct {
@@ -22,7 +24,8 @@ type Func struct {
 	Type     Type
 	blocks   []*block
 	regtype  map[Reg]Type
-	literals map[Reg]int64 // used during ir->asm lowering
+	literals map[Reg]int64  // used during ir->asm lowering
+	funclits map[Reg]string // likewise, for function literals
 }
 
 // A block is the basic building-block of the low-level code.
@@ -49,12 +52,13 @@ const (
 	//ArithOp   // %a = arith "+" %x %y
 	CompareOp // %a = compare "==" %x %y
 
-	BranchOp      // branch %c -> label j, label k
-	JumpOp        // jump label a(%x, %y, %z)
-	CallOp        // %a, %b, ... = call %f, %x, %y, ...
-	ReturnOp      // return %a, %b, ...
-	LiteralOp     // %a = literal <value>
-	FuncLiteralOp // %a = function_literal <function_name>
+	BranchOp        // branch %c -> label j, label k
+	JumpOp          // jump label a(%x, %y, %z)
+	CallOp          // %a, %b, ... = call %f, %x, %y, ...
+	ReturnOp        // return %a, %b, ...
+	LiteralOp       // %a = literal <value>
+	FuncLiteralOp   // %a = function_literal <function_name>
+	StringLiteralOp // %a = string_literal <index>
 
 	RecordGetOp // %a = record_get %tuple <0>
 	RecordSetOp // record_set %tuple, %x <0>
@@ -87,6 +91,8 @@ func (l Opcode) String() string {
 		return "literal"
 	case FuncLiteralOp:
 		return "function_literal"
+	case StringLiteralOp:
+		return "string_literal"
 	case RecordGetOp:
 		return "record_get"
 	case RecordSetOp:
@@ -128,6 +134,8 @@ func (l Opcode) GoString() string {
 		return "LiteralOp"
 	case FuncLiteralOp:
 		return "FuncLiteralOp"
+	case StringLiteralOp:
+		return "StringLiteralOp"
 
 	case RecordGetOp:
 		return "RecordGetOp"
@@ -142,6 +150,8 @@ func (l Opcode) GoString() string {
 		return "LoadOp "
 	case StoreOp:
 		return "StoreOp"
+	case CallWithContinuationOp:
+		return "CallWithContinuationOp"
 	default:
 		return fmt.Sprintf("Opcode(%d)", int(l))
 	}
@@ -158,6 +168,14 @@ type Op struct {
 
 type compiler struct {
 	funcs []*Func
+	// closures whose function is known statically.
+	// calls through these can skip loading the function from the closure
+	closures map[Reg]*Func
+	// the types the typechecker inferred
+	types *typeTable
+	// string literals, and where to find each one in strings
+	strings     []string
+	stringIndex map[string]int64
 	//blocks  []*block
 	lastreg int64
 	lastlab int64
@@ -177,22 +195,23 @@ func (f *Func) entry() *block {
 	return f.blocks[0]
 }
 
-// lower generates bytecode from an expr
-func lower(expr Expr) *Prog {
+// lower generates bytecode from an expr.
+// types holds the types of the expressions and variables in it,
+// and the layout of each record and variant type.
+func lower(expr Expr, types *typeTable) *Prog {
 	c := new(compiler)
+	c.closures = make(map[Reg]*Func)
+	c.types = types
 	// TODO type checking??
 	// first pass: resolve scopes, extract functions,
 	//   and convert the AST into high-level SSA
 	f := new(Func)
 	f.Name = "<toplevel>"
+	f.Type = &FuncT{Return: c.exprTypes(expr)}
 	var s scope
 	c.funcs = append(c.funcs, f)
-	exitb, val := c.visitExpr(&s, f.entry(), expr)
 	// return the final value
-	exitb.emit(Op{
-		Opcode: ReturnOp,
-		Src:    val,
-	})
+	c.visitTail(&s, f.entry(), expr)
 
 	// second pass: CPS covert??
 	//
@@ -201,7 +220,7 @@ func lower(expr Expr) *Prog {
 	// third pass: lower everything to machine types?
 	//
 
-	return &Prog{funcs: c.funcs} // XXX
+	return &Prog{funcs: c.funcs, strings: c.strings} // XXX
 }
 
 type scope struct {
@@ -228,7 +247,8 @@ type mvar struct {
 
 func (s *scope) define(name string) *mvar {
 	if _, alreadyDefined := s.vars[name]; alreadyDefined {
-		// error
+		// uniquify gives every variable a distinct name,
+		// so this only happens in programs which skipped it
 	}
 	v := new(mvar)
 	s.vars[name] = v
@@ -315,8 +335,8 @@ func (c *compiler) visitBody(expr Expr) {
 }
 */
 
-func (c *compiler) errorf(format string, v ...interface{}) {
-	c.errors = append(c.errors, fmt.Errorf(format, v...))
+func (c *compiler) errorf(e Expr, format string, v ...interface{}) {
+	c.errors = append(c.errors, errorAt(e, format, v...))
 	fmt.Fprintln(os.Stderr, c.errors[len(c.errors)-1]) // XXX
 }
 
@@ -367,7 +387,7 @@ func (v *compiler) visitExpr(s *scope, b *block, e Expr) (bl *block, dst []Reg)
 	switch e := e.(type) {
 	case *VarExpr:
 		if !s.has(e.Name) {
-			v.errorf("%v is not in scope", e.Name)
+			v.errorf(e, "%v is not in scope", e.Name)
 			dst = v.newreg1() // invent a register so we don't crash
 			b.setType(dst[0], AnyT{})
 			break
@@ -411,6 +431,13 @@ func (v *compiler) visitExpr(s *scope, b *block, e Expr) (bl *block, dst []Reg)
 			Value:  value,
 		})
 	case *IntExpr:
+		if hi, lo, ok := splitBigLiteral(e.Value); !ok {
+			// too big for a small int.
+			// build it out of smaller pieces at runtime
+			big := binExpr("+", binExpr("*", &IntExpr{Span: e.Span, Value: hi}, &IntExpr{Span: e.Span, Value: "4294967296"}), &IntExpr{Span: e.Span, Value: lo})
+			b, dst = v.visitExpr(s, b, big)
+			break
+		}
 		// emit literal
 		dst = v.newreg1()
 		b.setType(dst[0], IntT{})
@@ -419,6 +446,15 @@ func (v *compiler) visitExpr(s *scope, b *block, e Expr) (bl *block, dst []Reg)
 			Dst:    dst,
 			Value:  e.Value,
 		})
+	case *StrExpr:
+		// the literal itself goes in the program's data
+		dst = v.newreg1()
+		b.setType(dst[0], StrT{})
+		b.emit(Op{
+			Opcode: StringLiteralOp,
+			Dst:    dst,
+			Value:  v.stringLiteral(e.Value),
+		})
 	case *LetExpr:
 		/*
 			// evaluate the rvalue
@@ -457,11 +493,25 @@ func (v *compiler) visitExpr(s *scope, b *block, e Expr) (bl *block, dst []Reg)
 		// create a new scope
 		// and add the variable to it
 		inner := s.push()
-		varInfo := inner.define(e.Var)
-		varInfo.Reg = val[0]
+		v.defineVar(inner, b, e.Var, val[0])
 		// evaluate the body of the let expression
 		// in the new scope
 		b, dst = v.visitExpr(inner, b, e.Body)
+	case *LetValuesExpr:
+		var vals []Reg
+		b, vals = v.visitValues(s, b, e.Val, len(e.Vars))
+		inner := s.push()
+		for i, name := range e.Vars {
+			v.defineVar(inner, b, name, vals[i])
+		}
+		b, dst = v.visitExpr(inner, b, e.Body)
+	case *LetRecExpr:
+		var inner *scope
+		b, inner = v.visitLetRec(s, b, e)
+		b, dst = v.visitExpr(inner, b, e.Body)
+	case *LetTypeExpr:
+		// types don't exist at runtime
+		b, dst = v.visitExpr(s, b, e.Body)
 	case *IfExpr:
 		// Evaluate the condition
 		bThen, bElse := v.visitCond(s, b, e.Cond)
@@ -469,111 +519,65 @@ func (v *compiler) visitExpr(s *scope, b *block, e Expr) (bl *block, dst []Reg)
 		bt, dt := v.visitExpr(s, bThen, e.Then)
 		bf, df := v.visitExpr(s, bElse, e.Else)
 		// Join the branches
-		//be := b.join("end", bt, bf)
-		be := newblock(b.Func, v.newlabel("end"))
-		be.pred = append(be.pred, bt, bf)
-		bt.succ = append(bt.succ, be)
-		bf.succ = append(bf.succ, be)
-		b.Func.blocks = append(b.Func.blocks, be)
-		be.args = v.newreg1() // TODO: len(dt)?
-		be.setType(be.args[0], BoolT{})
-		bt.emit(Op{
-			Opcode: JumpOp,
-			Label:  []Label{be.name},
-			Src:    dt,
-		})
-		bf.emit(Op{
-			Opcode: JumpOp,
-			Label:  []Label{be.name},
-			Src:    df,
-		})
-		b, dst = be, be.args
+		b = v.join(bt, dt, bf, df, v.exprTypes(e))
+		dst = b.args
 	case *AndExpr, *OrExpr:
-		bThen, bElse := v.visitCond(s, b, e)
-		// Evaluate the branches
-		bt, dt := v.visitExpr(s, bThen, &BoolExpr{true})
-		bf, df := v.visitExpr(s, bElse, &BoolExpr{false})
-		// Join the branches
-		be := newblock(b.Func, v.newlabel("end"))
-		be.pred = append(be.pred, bt, bf)
-		bt.succ = append(bt.succ, be)
-		bf.succ = append(bf.succ, be)
-		b.Func.blocks = append(b.Func.blocks, be)
-		be.args = v.newreg1() // TODO: len(dt)?
-		be.setType(be.args[0], BoolT{})
-		bt.emit(Op{
-			Opcode: JumpOp,
-			Label:  []Label{be.name},
-			Src:    dt,
-		})
-		bf.emit(Op{
-			Opcode: JumpOp,
-			Label:  []Label{be.name},
-			Src:    df,
-		})
-		b, dst = be, be.args
-	case *FuncExpr:
-		f := v.visitFunc(s, b, e)
-		// emit a function reference
-		dst = v.newreg1()
-		// TODO setType
-		b.emit(Op{
-			Opcode: FuncLiteralOp,
-			Dst:    dst,
-			Value:  f.Name,
-		})
-	case *CallExpr:
-		// evaluate the function
+		b, dst = v.visitBool(s, b, e)
+	case *ClosureExpr:
+		// evaluate the captured variables
+		var free = make([]Reg, len(e.Free))
+		var types = make([]Type, len(e.Free)+1)
 		var tmp []Reg
-		b, tmp = v.visitExpr(s, b, e.Func)
-		src := make([]Reg, len(e.Args)+1)
-		src[0] = tmp[0] // XXX
-		// evaluate the arguments
-		for i, a := range e.Args {
+		for i, a := range e.Free {
 			b, tmp = v.visitExpr(s, b, a)
-			src[i+1] = tmp[0] // XXX
+			free[i] = tmp[0]
+			types[i+1] = b.getType(tmp[0])
 		}
-		// call the function
-		dst = v.newreg1()
-		// TODO setType
+		// the closure is a tuple of the function and the captured variables
+		env := &TupleT{types}
+		f := v.visitFunc(s, e.Func, env)
+		fn := v.newreg1()
+		b.setType(fn[0], f.Type)
 		b.emit(Op{
-			Opcode: CallOp,
-			Dst:    dst,
-			Src:    src,
+			Opcode: FuncLiteralOp,
+			Dst:    fn,
+			Value:  f.Name,
 		})
+		dst = []Reg{v.newTuple(b, append(fn, free...), env)}
+		v.closures[dst[0]] = f
+	case *CallExpr:
+		b, dst = v.visitCallN(s, b, e, 1)
 	case *BinExpr:
+		if e.isCompare() {
+			// comparing ints might need a call into the runtime,
+			// so branch on the comparison and join the results
+			b, dst = v.visitBool(s, b, e)
+			break
+		}
 		b1, y := v.visitExpr(s, b, e.Left)
 		b2, z := v.visitExpr(s, b1, e.Right)
-		b = b2
-		dst = v.newreg1()
-		switch e.Op {
-		case "+", "-", "*", "/":
-			b.setType(dst[0], IntT{})
-		case "<", "<=", ">=", ">", "eq", "ne":
-			b.setType(dst[0], BoolT{})
-		}
-		// Even if this is a comparison operator ("<")
-		// we emit a BinOp, not a CompareOp.
-		// the ir->asm pass interprets them differently:
-		// BinOp "<" means to produce a boolean value;
-		// CompareOp "<" means set the flags for a subsequent BranchOp
-		b.emit(Op{
-			Opcode:  BinOp,
-			Variant: e.Op,
-			Dst:     dst,
-			Src:     []Reg{y[0], z[0]}, //XXX
-		})
+		if e.Op == ".." {
+			b, dst = v.visitConcat(b2, y[0], z[0])
+			break
+		}
+		b, dst = v.visitArith(b2, e.Op, y[0], z[0])
 	case *DotExpr:
-		var tmp []Reg
-		b, tmp = v.visitExpr(s, b, e.Left)
+		// a record field.
+		// the fields are stored in the order they were declared
+		var rec []Reg
+		b, rec = v.visitExpr(s, b, e.Left)
+		t, ok := b.getType(rec[0]).(*RecordT)
+		if !ok {
+			panic(fmt.Sprintf("field %s of non-record type %v", e.Right, b.getType(rec[0])))
+		}
+		i := indexOf(t.Fields, e.Right)
 		dst = v.newreg1()
-		// TODO: setType
+		b.setType(dst[0], reprType(t.Types[i]))
 		b.emit(Op{
-			Opcode:  BinOp,
-			Variant: ".",
-			Dst:     dst,
-			Src:     []Reg{tmp[0]},
-			Value:   e.Right, //XXX
+			Opcode: RecordGetOp,
+			Dst:    dst,
+			Src:    rec,
+			Value:  int64(i),
 		})
 	case *TupleExpr:
 		// evaluate the arguments
@@ -585,53 +589,99 @@ func (v *compiler) visitExpr(s *scope, b *block, e Expr) (bl *block, dst []Reg)
 			args[i] = tmp[0]
 			types[i] = b.getType(tmp[0])
 		}
-		// %n = len(args)
-		n := v.newreg1()
+		dst = []Reg{v.newTuple(b, args, &TupleT{types})}
+	case *ValuesExpr:
+		dst = make([]Reg, len(e.Args))
+		var tmp []Reg
+		for i, a := range e.Args {
+			b, tmp = v.visitExpr(s, b, a)
+			dst[i] = tmp[0]
+		}
+	case *TupleIndexExpr:
+		var tu []Reg
+		b, tu = v.visitExpr(s, b, e.Base)
+		dst = v.newreg1()
+		if t, ok := b.getType(tu[0]).(*TupleT); ok {
+			b.setType(dst[0], t.Type[e.Index])
+		} else {
+			b.setType(dst[0], AnyT{})
+		}
 		b.emit(Op{
-			Opcode: LiteralOp,
-			Dst:    n,
-			Value:  int64(len(args)),
+			Opcode: RecordGetOp,
+			Dst:    dst,
+			Src:    tu,
+			Value:  int64(e.Index),
 		})
-		// %ptr = <pointer mask>
-		ptrmask := uint64(0)
-		for i, t := range types {
-			if isTupleT(t) {
-				ptrmask |= 1 << i
-			}
+	case *PrimExpr:
+		b, dst = v.visitPrim(s, b, e)
+	case *ListExpr:
+		b, dst = v.visitList(s, b, e)
+	case *IndexExpr:
+		var list, i []Reg
+		b, list = v.visitExpr(s, b, e.Base)
+		b, i = v.visitExpr(s, b, e.Index)
+		dst = v.newreg1()
+		if t, ok := b.getType(list[0]).(*ListT); ok {
+			b.setType(dst[0], t.Elem)
+		} else {
+			b.setType(dst[0], AnyT{})
 		}
-		ptr := v.newreg1()
+		// the runtime checks the bounds
 		b.emit(Op{
-			Opcode: LiteralOp,
-			Dst:    ptr,
-			Value:  int64(ptrmask),
+			Opcode:  CallOp,
+			Variant: "psc_list_get",
+			Dst:     dst,
+			Src:     []Reg{list[0], i[0]},
 		})
-		// call newtuple
+	case *ListLenExpr:
+		// the length is the first field of the list,
+		// and it's always a small int
+		var list []Reg
+		b, list = v.visitExpr(s, b, e.List)
 		dst = v.newreg1()
-		b.setType(dst[0], &TupleT{types})
+		b.setType(dst[0], IntT{})
 		b.emit(Op{
-			Opcode:  CallOp, // primcall?
-			Variant: "psc_newtuple",
-			Dst:     dst,
-			Src:     []Reg{n[0], ptr[0]},
+			Opcode: RecordGetOp,
+			Dst:    dst,
+			Src:    list,
+			Value:  int64(0),
 		})
-		// set tuple elements
-		for i, a := range args {
-			b.emit(Op{
-				Opcode: RecordSetOp,
-				Src:    []Reg{dst[0], a},
-				Value:  int64(i),
-			})
-		}
-	case *TupleIndexExpr:
-		var tu []Reg
-		b, tu = v.visitExpr(s, b, e.Base)
+	case *AppendExpr:
+		var list, x []Reg
+		b, list = v.visitExpr(s, b, e.List)
+		b, x = v.visitExpr(s, b, e.Elem)
+		dst = []Reg{v.appendList(b, list[0], x[0])}
+	case *DictExpr:
+		b, dst = v.visitDict(s, b, e)
+	case *DictOpExpr:
+		b, dst = v.visitDictOp(s, b, e)
+	case *RecordExpr:
+		b, dst = v.visitRecord(s, b, e)
+	case *VariantExpr:
+		b, dst = v.visitVariant(s, b, e)
+	case *VariantTagExpr:
+		// the tag is stored first, before the values
+		var base []Reg
+		b, base = v.visitExpr(s, b, e.Base)
 		dst = v.newreg1()
-		b.setType(dst[0], b.getType(tu[0]).(*TupleT).Type[e.Index])
+		b.setType(dst[0], IntT{})
 		b.emit(Op{
 			Opcode: RecordGetOp,
 			Dst:    dst,
-			Src:    tu,
-			Value:  int64(e.Index),
+			Src:    base,
+			Value:  int64(0),
+		})
+	case *VariantGetExpr:
+		t := v.types.named[e.Type].(*VariantT)
+		var base []Reg
+		b, base = v.visitExpr(s, b, e.Base)
+		dst = v.newreg1()
+		b.setType(dst[0], reprType(t.Types[indexOf(t.Tags, e.Tag)][e.Index]))
+		b.emit(Op{
+			Opcode: RecordGetOp,
+			Dst:    dst,
+			Src:    base,
+			Value:  int64(1 + e.Index),
 		})
 	default:
 		panic(fmt.Sprintf("unhandled case in visitExpr: %T", e))
@@ -639,6 +689,757 @@ func (v *compiler) visitExpr(s *scope, b *block, e Expr) (bl *block, dst []Reg)
 	return b, dst
 }
 
+// visitLetRec creates the closures for a group of functions
+// which can call each other, and returns a scope with them in it.
+// each closure holds the others, so they are all allocated
+// before their references to each other are filled in.
+func (v *compiler) visitLetRec(s *scope, b *block, e *LetRecExpr) (*block, *scope) {
+	group := make(map[string]int)
+	for i, name := range e.Vars {
+		group[name] = i
+	}
+	sibling := func(a Expr) (int, bool) {
+		x, ok := a.(*VarExpr)
+		if !ok {
+			return 0, false
+		}
+		i, ok := group[x.Name]
+		return i, ok
+	}
+	clos := make([]Reg, len(e.Vals))
+	for i, val := range e.Vals {
+		c := val.(*ClosureExpr)
+		var free = make([]Reg, len(c.Free))
+		var types = make([]Type, len(c.Free)+1)
+		var tmp []Reg
+		for j, a := range c.Free {
+			if _, ok := sibling(a); ok {
+				// a placeholder, which the garbage collector ignores
+				free[j] = v.newreg()
+				b.emit(Op{
+					Opcode: LiteralOp,
+					Dst:    []Reg{free[j]},
+					Value:  int64(0),
+				})
+				types[j+1] = v.varType(a.(*VarExpr).Name)
+				continue
+			}
+			b, tmp = v.visitExpr(s, b, a)
+			free[j] = tmp[0]
+			types[j+1] = b.getType(tmp[0])
+		}
+		env := &TupleT{types}
+		f := v.visitFunc(s, c.Func, env)
+		fn := v.newreg1()
+		b.setType(fn[0], f.Type)
+		b.emit(Op{
+			Opcode: FuncLiteralOp,
+			Dst:    fn,
+			Value:  f.Name,
+		})
+		clos[i] = v.newTuple(b, append(fn, free...), env)
+		v.closures[clos[i]] = f
+	}
+	inner := s.push()
+	for i, val := range e.Vals {
+		for j, a := range val.(*ClosureExpr).Free {
+			if k, ok := sibling(a); ok {
+				b.emit(Op{
+					Opcode: RecordSetOp,
+					Src:    []Reg{clos[i], clos[k]},
+					Value:  int64(j + 1),
+				})
+			}
+		}
+		v.defineVar(inner, b, e.Vars[i], clos[i])
+	}
+	return b, inner
+}
+
+// visitBool lowers a boolean-valued expression
+// by branching on it and joining the branches.
+func (v *compiler) visitBool(s *scope, b *block, e Expr) (*block, []Reg) {
+	bThen, bElse := v.visitCond(s, b, e)
+	// Evaluate the branches
+	bt, dt := v.visitExpr(s, bThen, &BoolExpr{Value: true})
+	bf, df := v.visitExpr(s, bElse, &BoolExpr{Value: false})
+	// Join the branches
+	be := v.join(bt, dt, bf, df, []Type{BoolT{}})
+	return be, be.args
+}
+
+// runtime functions for arithmetic on ints which aren't small
+var intFuncs = map[string]string{
+	"+": "psc_int_add",
+	"-": "psc_int_sub",
+	"*": "psc_int_mul",
+	"/": "psc_int_div",
+}
+
+// visitArith lowers an arithmetic operation on two ints.
+// ints are arbitrary-precision, but most of them are small;
+// if both operands are small, we do the arithmetic inline
+// and only call into the runtime if it overflows.
+//
+//	    compare small %y, %z -> fast, slow
+//	fast:
+//	    %a = binop "+" %y, %z
+//	    compare overflow -> slow, ok
+//	ok:
+//	    jump end(%a)
+//	slow:
+//	    %b = call psc_int_add %y, %z
+//	    jump end(%b)
+//	end(%dst):
+//
+// division checks for a zero divisor before the fast path,
+// which would trap; the runtime reports it instead.
+//
+//	    compare small %y, %z -> nonzero, slow
+//	nonzero:
+//	    %0 = literal 0
+//	    compare eq %z, %0 -> slow, fast
+func (v *compiler) visitArith(b *block, op string, y, z Reg) (*block, []Reg) {
+	fn, ok := intFuncs[op]
+	if !ok {
+		panic(fmt.Sprintf("unhandled binop: %s", op))
+	}
+	fast := newblock(b.Func, v.newlabel("fast"))
+	okb := newblock(b.Func, v.newlabel("ok"))
+	slow := newblock(b.Func, v.newlabel("slow"))
+	if op == "/" {
+		nonzero := newblock(b.Func, v.newlabel("nonzero"))
+		b.Func.blocks = append(b.Func.blocks, nonzero)
+		v.branch(b, "small", []Reg{y, z}, nonzero, slow)
+		zero := v.newreg1()
+		nonzero.setType(zero[0], IntT{})
+		nonzero.emit(Op{
+			Opcode: LiteralOp,
+			Dst:    zero,
+			Value:  "0",
+		})
+		b = nonzero
+		v.branch(b, "eq", []Reg{z, zero[0]}, slow, fast)
+	} else {
+		v.branch(b, "small", []Reg{y, z}, fast, slow)
+	}
+	b.Func.blocks = append(b.Func.blocks, fast, okb, slow)
+
+	a := v.newreg1()
+	fast.setType(a[0], IntT{})
+	fast.emit(Op{
+		Opcode:  BinOp,
+		Variant: op,
+		Dst:     a,
+		Src:     []Reg{y, z},
+	})
+	v.branch(fast, "overflow", nil, slow, okb)
+
+	r := v.newreg1()
+	slow.setType(r[0], IntT{})
+	slow.emit(Op{
+		Opcode:  CallOp,
+		Variant: fn,
+		Dst:     r,
+		Src:     []Reg{y, z},
+	})
+	be := v.join(okb, a, slow, r, []Type{IntT{}})
+	return be, be.args
+}
+
+// visitConcat lowers a string concatenation.
+// the runtime converts either operand to a string if it is an int.
+func (v *compiler) visitConcat(b *block, y, z Reg) (*block, []Reg) {
+	dst := v.newreg1()
+	b.setType(dst[0], StrT{})
+	b.emit(Op{
+		Opcode:  CallOp,
+		Variant: "psc_str_concat",
+		Dst:     dst,
+		Src:     []Reg{y, z},
+	})
+	return b, dst
+}
+
+// visitList lowers a list literal.
+// the runtime allocates the list with room for all the elements
+// and then they are appended one at a time.
+func (v *compiler) visitList(s *scope, b *block, e *ListExpr) (*block, []Reg) {
+	var args = make([]Reg, len(e.Args))
+	var elem Type = AnyT{}
+	var tmp []Reg
+	for i, a := range e.Args {
+		b, tmp = v.visitExpr(s, b, a)
+		args[i] = tmp[0]
+		if i == 0 {
+			elem = b.getType(tmp[0])
+		}
+	}
+	n := v.newreg()
+	b.emit(Op{
+		Opcode: LiteralOp,
+		Dst:    []Reg{n},
+		Value:  int64(len(args)),
+	})
+	list := v.newreg()
+	b.setType(list, &ListT{Elem: elem})
+	b.emit(Op{
+		Opcode:  CallOp,
+		Variant: "psc_list_new",
+		Dst:     []Reg{list},
+		Src:     []Reg{n},
+	})
+	for _, x := range args {
+		list = v.appendList(b, list, x)
+	}
+	return b, []Reg{list}
+}
+
+// appendList emits a call to append x to a list.
+// the list is changed in place, but it might need to grow,
+// and the runtime needs to know whether the garbage collector
+// should look at its elements
+func (v *compiler) appendList(b *block, list, x Reg) Reg {
+	p := v.ptrLiteral(b, b.getType(x))
+	dst := v.newreg()
+	b.setType(dst, b.getType(list))
+	b.emit(Op{
+		Opcode:  CallOp,
+		Variant: "psc_list_append",
+		Dst:     []Reg{dst},
+		Src:     []Reg{list, x, p},
+	})
+	return dst
+}
+
+// ptrLiteral emits a raw int with bit i set if a value of types[i]
+// might point into the heap
+func (v *compiler) ptrLiteral(b *block, types ...Type) Reg {
+	var isptr int64
+	for i, t := range types {
+		if mayPoint(t) {
+			isptr |= 1 << i
+		}
+	}
+	p := v.newreg()
+	b.emit(Op{
+		Opcode: LiteralOp,
+		Dst:    []Reg{p},
+		Value:  isptr,
+	})
+	return p
+}
+
+// runtime functions for the dict builtins
+var dictFuncs = map[string]string{
+	"lookup":   "psc_dict_get",
+	"set":      "psc_dict_set",
+	"delete":   "psc_dict_delete",
+	"contains": "psc_dict_contains",
+	"keys":     "psc_dict_keys",
+}
+
+// visitDict lowers a dict literal.
+// like a list, it is allocated with room for all the entries
+// and then they are added one at a time.
+func (v *compiler) visitDict(s *scope, b *block, e *DictExpr) (*block, []Reg) {
+	var keys = make([]Reg, len(e.Keys))
+	var vals = make([]Reg, len(e.Vals))
+	var t = &DictT{Key: AnyT{}, Val: AnyT{}}
+	var tmp []Reg
+	for i := range e.Keys {
+		b, tmp = v.visitExpr(s, b, e.Keys[i])
+		keys[i] = tmp[0]
+		b, tmp = v.visitExpr(s, b, e.Vals[i])
+		vals[i] = tmp[0]
+		if i == 0 {
+			t = &DictT{Key: b.getType(keys[i]), Val: b.getType(vals[i])}
+		}
+	}
+	n := v.newreg()
+	b.emit(Op{
+		Opcode: LiteralOp,
+		Dst:    []Reg{n},
+		Value:  int64(len(keys)),
+	})
+	d := v.newreg()
+	b.setType(d, t)
+	b.emit(Op{
+		Opcode:  CallOp,
+		Variant: "psc_dict_new",
+		Dst:     []Reg{d},
+		Src:     []Reg{n},
+	})
+	for i := range keys {
+		p := v.ptrLiteral(b, b.getType(keys[i]), b.getType(vals[i]))
+		d2 := v.newreg()
+		b.setType(d2, t)
+		b.emit(Op{
+			Opcode:  CallOp,
+			Variant: "psc_dict_set",
+			Dst:     []Reg{d2},
+			Src:     []Reg{d, keys[i], vals[i], p},
+		})
+		d = d2
+	}
+	return b, []Reg{d}
+}
+
+// visitDictOp lowers one of the dict builtins to a call into the runtime
+func (v *compiler) visitDictOp(s *scope, b *block, e *DictOpExpr) (*block, []Reg) {
+	var args = make([]Reg, len(e.Args))
+	var tmp []Reg
+	for i, a := range e.Args {
+		b, tmp = v.visitExpr(s, b, a)
+		args[i] = tmp[0]
+	}
+	t, ok := b.getType(args[0]).(*DictT)
+	if !ok {
+		t = &DictT{Key: AnyT{}, Val: AnyT{}}
+	}
+	dst := v.newreg1()
+	switch e.Op {
+	case "lookup":
+		b.setType(dst[0], t.Val)
+	case "set":
+		// the runtime needs to know whether the collector should
+		// look at the entries, like with append
+		args = append(args, v.ptrLiteral(b, b.getType(args[1]), b.getType(args[2])))
+		b.setType(dst[0], t)
+	case "delete":
+		b.setType(dst[0], t)
+	case "contains":
+		b.setType(dst[0], BoolT{})
+	case "keys":
+		args = append(args, v.ptrLiteral(b, t.Key))
+		b.setType(dst[0], &ListT{Elem: t.Key})
+	default:
+		panic(fmt.Sprintf("unknown dict op %s", e.Op))
+	}
+	b.emit(Op{
+		Opcode:  CallOp,
+		Variant: dictFuncs[e.Op],
+		Dst:     dst,
+		Src:     args,
+	})
+	return b, dst
+}
+
+// stringLiteral returns the index of a string literal in the program's data,
+// adding it if it isn't there yet
+func (v *compiler) stringLiteral(lit string) int64 {
+	if i, ok := v.stringIndex[lit]; ok {
+		return i
+	}
+	if v.stringIndex == nil {
+		v.stringIndex = make(map[string]int64)
+	}
+	i := int64(len(v.strings))
+	v.strings = append(v.strings, lit)
+	v.stringIndex[lit] = i
+	return i
+}
+
+// runtime functions for converting between ints and sized ints,
+// for the cases that can't be done inline
+var primIntFuncs = map[string]string{
+	"toint32":    "psc_int_lo32",
+	"toint64":    "psc_int_lo64",
+	"fromint64":  "psc_int_from_uint64",
+	"fromint64s": "psc_int_from_int64",
+}
+
+// visitPrim lowers a use of psc/prim.
+// constants are literals, and most functions are a single binop
+// with the same name as the function.
+//
+// converting an int to a sized int is done inline if the int is small,
+// like visitArith. converting an int64 to an int might need to allocate
+// a bigint, so it always calls into the runtime.
+func (v *compiler) visitPrim(s *scope, b *block, e *PrimExpr) (*block, []Reg) {
+	p := primFuncs[e.Name]
+	if p.Const {
+		dst := v.newreg1()
+		b.setType(dst[0], p.Results[0])
+		b.emit(Op{
+			Opcode: LiteralOp,
+			Dst:    dst,
+			Value:  p.Value,
+		})
+		return b, dst
+	}
+	var args = make([]Reg, len(e.Args))
+	var tmp []Reg
+	for i, a := range e.Args {
+		b, tmp = v.visitExpr(s, b, a)
+		args[i] = tmp[0]
+	}
+	dst := make([]Reg, len(p.Results))
+	for i := range dst {
+		dst[i] = v.newreg()
+		b.setType(dst[i], p.Results[i])
+	}
+	op := Op{
+		Opcode:  BinOp,
+		Variant: e.Name,
+		Dst:     dst,
+		Src:     args,
+	}
+	fn := primIntFuncs[e.Name]
+	switch {
+	case p.Op == "toint":
+		fast := newblock(b.Func, v.newlabel("fast"))
+		slow := newblock(b.Func, v.newlabel("slow"))
+		b.Func.blocks = append(b.Func.blocks, fast, slow)
+		v.branch(b, "small", []Reg{args[0], args[0]}, fast, slow)
+		fast.emit(op)
+
+		r := v.newreg1()
+		slow.setType(r[0], p.Results[0])
+		slow.emit(Op{
+			Opcode:  CallOp,
+			Variant: fn,
+			Dst:     r,
+			Src:     args,
+		})
+		be := v.join(fast, dst, slow, r, p.Results[:1])
+		return be, be.args
+	case fn != "":
+		op.Opcode = CallOp
+		op.Variant = fn
+	}
+	b.emit(op)
+	return b, dst
+}
+
+// visitValues lowers an expression which produces n values,
+// like the value of a destructuring let.
+// calls need to be told how many values to expect;
+// everything else works it out from its subexpressions.
+func (v *compiler) visitValues(s *scope, b *block, e Expr, n int) (*block, []Reg) {
+	switch e := e.(type) {
+	case *CallExpr:
+		return v.visitCallN(s, b, e, n)
+	case *LetExpr:
+		var val []Reg
+		b, val = v.visitExpr(s, b, e.Val)
+		inner := s.push()
+		v.defineVar(inner, b, e.Var, val[0])
+		return v.visitValues(inner, b, e.Body, n)
+	case *LetValuesExpr:
+		var vals []Reg
+		b, vals = v.visitValues(s, b, e.Val, len(e.Vars))
+		inner := s.push()
+		for i, name := range e.Vars {
+			v.defineVar(inner, b, name, vals[i])
+		}
+		return v.visitValues(inner, b, e.Body, n)
+	case *LetRecExpr:
+		b, inner := v.visitLetRec(s, b, e)
+		return v.visitValues(inner, b, e.Body, n)
+	case *IfExpr:
+		bThen, bElse := v.visitCond(s, b, e.Cond)
+		bt, dt := v.visitValues(s, bThen, e.Then, n)
+		bf, df := v.visitValues(s, bElse, e.Else, n)
+		be := v.join(bt, dt, bf, df, v.exprTypes(e))
+		return be, be.args
+	default:
+		return v.visitExpr(s, b, e)
+	}
+}
+
+// join creates a block where the branches of an if meet.
+// its arguments are the values of the branches, which have the given types.
+func (v *compiler) join(bt *block, dt []Reg, bf *block, df []Reg, types []Type) *block {
+	be := newblock(bt.Func, v.newlabel("end"))
+	be.pred = append(be.pred, bt, bf)
+	bt.succ = append(bt.succ, be)
+	bf.succ = append(bf.succ, be)
+	bt.Func.blocks = append(bt.Func.blocks, be)
+	be.args = make([]Reg, len(dt))
+	for i := range be.args {
+		be.args[i] = v.newreg()
+		if i < len(types) {
+			be.setType(be.args[i], types[i])
+		} else {
+			be.setType(be.args[i], AnyT{})
+		}
+	}
+	bt.emit(Op{
+		Opcode: JumpOp,
+		Label:  []Label{be.name},
+		Src:    dt,
+	})
+	bf.emit(Op{
+		Opcode: JumpOp,
+		Label:  []Label{be.name},
+		Src:    df,
+	})
+	return be
+}
+
+// visitCallN lowers a call which returns n values
+func (v *compiler) visitCallN(s *scope, b *block, e *CallExpr, n int) (*block, []Reg) {
+	var src []Reg
+	b, src = v.visitCall(s, b, e)
+	dst := make([]Reg, n)
+	types := v.exprTypes(e)
+	for i := range dst {
+		dst[i] = v.newreg()
+		if i < len(types) {
+			b.setType(dst[i], types[i])
+		} else {
+			b.setType(dst[i], AnyT{})
+		}
+	}
+	b.emit(Op{
+		Opcode: CallOp,
+		Dst:    dst,
+		Src:    src,
+	})
+	return b, dst
+}
+
+// visitCall evaluates the function and arguments of a call.
+// it returns the registers to pass to the call op:
+// the function, the closure, and the arguments.
+func (v *compiler) visitCall(s *scope, b *block, e *CallExpr) (*block, []Reg) {
+	// evaluate the closure
+	var tmp []Reg
+	b, tmp = v.visitExpr(s, b, e.Func)
+	clo := tmp[0]
+	src := make([]Reg, len(e.Args)+2)
+	src[1] = clo
+	// evaluate the arguments
+	for i, a := range e.Args {
+		b, tmp = v.visitExpr(s, b, a)
+		src[i+2] = tmp[0] // XXX
+	}
+	// get the function out of the closure
+	fn := v.newreg()
+	if f, ok := v.closures[clo]; ok {
+		b.setType(fn, f.Type)
+		b.emit(Op{
+			Opcode: FuncLiteralOp,
+			Dst:    []Reg{fn},
+			Value:  f.Name,
+		})
+	} else {
+		if t, ok := b.getType(clo).(*TupleT); ok {
+			b.setType(fn, t.Type[0])
+		} else {
+			b.setType(fn, AnyT{})
+		}
+		b.emit(Op{
+			Opcode: RecordGetOp,
+			Dst:    []Reg{fn},
+			Src:    []Reg{clo},
+			Value:  int64(0),
+		})
+	}
+	src[0] = fn
+	return b, src
+}
+
+// visitTail lowers an expression in tail position:
+// its value is returned from the current function.
+// calls in tail position become tail calls,
+// which reuse the current function's stack frame.
+func (v *compiler) visitTail(s *scope, b *block, e Expr) {
+	switch e := e.(type) {
+	case *CallExpr:
+		var src []Reg
+		b, src = v.visitCall(s, b, e)
+		b.emit(Op{
+			Opcode: CallWithContinuationOp,
+			Src:    src,
+		})
+	case *LetExpr:
+		var val []Reg
+		b, val = v.visitExpr(s, b, e.Val)
+		inner := s.push()
+		v.defineVar(inner, b, e.Var, val[0])
+		v.visitTail(inner, b, e.Body)
+	case *LetValuesExpr:
+		var vals []Reg
+		b, vals = v.visitValues(s, b, e.Val, len(e.Vars))
+		inner := s.push()
+		for i, name := range e.Vars {
+			v.defineVar(inner, b, name, vals[i])
+		}
+		v.visitTail(inner, b, e.Body)
+	case *LetRecExpr:
+		b, inner := v.visitLetRec(s, b, e)
+		v.visitTail(inner, b, e.Body)
+	case *LetTypeExpr:
+		v.visitTail(s, b, e.Body)
+	case *IfExpr:
+		// no need to join the branches;
+		// each one returns on its own
+		bThen, bElse := v.visitCond(s, b, e.Cond)
+		v.visitTail(s, bThen, e.Then)
+		v.visitTail(s, bElse, e.Else)
+	default:
+		// a ValuesExpr returns all of its values
+		var dst []Reg
+		b, dst = v.visitExpr(s, b, e)
+		b.emit(Op{
+			Opcode: ReturnOp,
+			Src:    dst,
+		})
+	}
+}
+
+// newTuple allocates a tuple and fills it with args
+func (v *compiler) newTuple(b *block, args []Reg, t *TupleT) Reg {
+	// %n = len(args)
+	n := v.newreg1()
+	b.emit(Op{
+		Opcode: LiteralOp,
+		Dst:    n,
+		Value:  int64(len(args)),
+	})
+	// %ptr = <pointer mask>
+	ptrmask := uint64(0)
+	for i, t := range t.Type {
+		if mayPoint(t) {
+			ptrmask |= 1 << i
+		}
+	}
+	ptr := v.newreg1()
+	b.emit(Op{
+		Opcode: LiteralOp,
+		Dst:    ptr,
+		Value:  int64(ptrmask),
+	})
+	// call newtuple
+	dst := v.newreg()
+	b.setType(dst, t)
+	b.emit(Op{
+		Opcode:  CallOp, // primcall?
+		Variant: "psc_newtuple",
+		Dst:     []Reg{dst},
+		Src:     []Reg{n[0], ptr[0]},
+	})
+	// set tuple elements
+	for i, a := range args {
+		b.emit(Op{
+			Opcode: RecordSetOp,
+			Src:    []Reg{dst, a},
+			Value:  int64(i),
+		})
+	}
+	return dst
+}
+
+// visitRecord lowers a record constructor.
+// the values are evaluated in the order they are written,
+// but the record stores them in the order the fields were declared.
+func (v *compiler) visitRecord(s *scope, b *block, e *RecordExpr) (*block, []Reg) {
+	t := v.types.named[e.Type].(*RecordT)
+	var args = make([]Reg, len(t.Fields))
+	var tmp []Reg
+	for i, a := range e.Vals {
+		b, tmp = v.visitExpr(s, b, a)
+		args[indexOf(t.Fields, e.Fields[i])] = tmp[0]
+	}
+	types := make([]Type, len(t.Types))
+	for i := range t.Types {
+		types[i] = reprType(t.Types[i])
+	}
+	var dst Reg
+	if len(args) > maxTupleLen {
+		dst = v.newBigTuple(b, args, types)
+	} else {
+		dst = v.newTuple(b, args, &TupleT{Type: types})
+	}
+	b.setType(dst, t)
+	return b, []Reg{dst}
+}
+
+// visitVariant lowers a variant constructor.
+// a variant is stored like a tuple of its tag, which is the index
+// of the variant in the type declaration, followed by its values.
+func (v *compiler) visitVariant(s *scope, b *block, e *VariantExpr) (*block, []Reg) {
+	t := v.types.named[e.Type].(*VariantT)
+	i := indexOf(t.Tags, e.Tag)
+	tag := v.newreg()
+	b.setType(tag, IntT{})
+	b.emit(Op{
+		Opcode: LiteralOp,
+		Dst:    []Reg{tag},
+		Value:  strconv.Itoa(i),
+	})
+	args := []Reg{tag}
+	types := []Type{IntT{}}
+	var tmp []Reg
+	for j, a := range e.Args {
+		b, tmp = v.visitExpr(s, b, a)
+		args = append(args, tmp[0])
+		types = append(types, reprType(t.Types[i][j]))
+	}
+	var dst Reg
+	if len(args) > maxTupleLen {
+		dst = v.newBigTuple(b, args, types)
+	} else {
+		dst = v.newTuple(b, args, &TupleT{Type: types})
+	}
+	b.setType(dst, t)
+	return b, []Reg{dst}
+}
+
+// the most elements a tuple can have.
+// the collector keeps track of which elements are pointers
+// with one byte each in the tuple's header, which has room for 63.
+const maxTupleLen = 63
+
+// newBigTuple allocates a tuple with more elements than fit in
+// an ordinary tuple's header. its pointer mask is stored after
+// the elements, one bit per element, 64 to a word.
+func (v *compiler) newBigTuple(b *block, args []Reg, types []Type) Reg {
+	n := v.newreg()
+	b.emit(Op{
+		Opcode: LiteralOp,
+		Dst:    []Reg{n},
+		Value:  int64(len(args)),
+	})
+	dst := v.newreg()
+	b.setType(dst, &TupleT{Type: types})
+	b.emit(Op{
+		Opcode:  CallOp,
+		Variant: "psc_newbigtuple",
+		Dst:     []Reg{dst},
+		Src:     []Reg{n},
+	})
+	for i, a := range args {
+		b.emit(Op{
+			Opcode: RecordSetOp,
+			Src:    []Reg{dst, a},
+			Value:  int64(i),
+		})
+	}
+	masks := make([]uint64, (len(types)+63)/64)
+	for i, t := range types {
+		if mayPoint(t) {
+			masks[i/64] |= 1 << (i % 64)
+		}
+	}
+	for j, mask := range masks {
+		m := v.newreg()
+		b.emit(Op{
+			Opcode: LiteralOp,
+			Dst:    []Reg{m},
+			Value:  int64(mask),
+		})
+		b.emit(Op{
+			Opcode: RecordSetOp,
+			Src:    []Reg{dst, m},
+			Value:  int64(len(args) + j),
+		})
+	}
+	return dst
+}
+
 func (e *BinExpr) isCompare() bool {
 	switch e.Op {
 	case "eq", "ne", "<", "<=", ">=", ">":
@@ -648,6 +1449,25 @@ func (e *BinExpr) isCompare() bool {
 	}
 }
 
+// branch emits a compare op and a branch on its result
+func (v *compiler) branch(b *block, variant string, src []Reg, bThen, bElse *block) {
+	cond := v.newreg1()
+	b.emit(Op{
+		Opcode:  CompareOp,
+		Variant: variant,
+		Dst:     cond,
+		Src:     src,
+	})
+	b.emit(Op{
+		Opcode: BranchOp,
+		Src:    cond,
+		Label:  []Label{bThen.name, bElse.name},
+	})
+	b.succ = append(b.succ, bThen, bElse)
+	bThen.pred = append(bThen.pred, b)
+	bElse.pred = append(bElse.pred, b)
+}
+
 func (v *compiler) visitCond(s *scope, b *block, e Expr) (blThen, blElse *block) {
 	bThen := newblock(b.Func, v.newlabel("then"))
 	bElse := newblock(b.Func, v.newlabel("else"))
@@ -692,62 +1512,49 @@ func (v *compiler) visitCond2(s *scope, b *block, e Expr, bThen, bElse *block) {
 				Dst:    []Reg{false},
 				Value:  int64(0),
 			})
-			cond := v.newreg1()
-			b.emit(Op{
-				Opcode:  CompareOp,
-				Variant: "ne",
-				Dst:     cond,
-				Src:     []Reg{ref, false}, //XXX
-			})
-			// Emit branch
-			b.emit(Op{
-				Opcode: BranchOp,
-				Src:    cond,
-				Label:  []Label{bThen.name, bElse.name},
-			})
-			b.succ = append(b.succ, bThen, bElse)
-			bThen.pred = append(bThen.pred, b)
-			bElse.pred = append(bElse.pred, b)
+			v.branch(b, "ne", []Reg{ref, false}, bThen, bElse)
 		} else {
-			v.errorf("%v is not in scope", e.Name)
+			v.errorf(e, "%v is not in scope", e.Name)
 		}
 	case *BinExpr:
 		if e.isCompare() {
-			// Emit compare op
 			b1, y := v.visitExpr(s, b, e.Left)
 			b2, z := v.visitExpr(s, b1, e.Right)
 			b = b2
-			cond := v.newreg1()
-			b.emit(Op{
-				Opcode:  CompareOp,
-				Variant: e.Op,
-				Dst:     cond,
-				Src:     []Reg{y[0], z[0]}, //XXX
-			})
-			// Emit branch
-			b.emit(Op{
-				Opcode: BranchOp,
-				Src:    cond,
-				Label:  []Label{bThen.name, bElse.name},
-			})
-			b.succ = append(b.succ, bThen, bElse)
-			bThen.pred = append(bThen.pred, b)
-			bElse.pred = append(bElse.pred, b)
+			if (b.getType(y[0]) == BoolT{} && b.getType(z[0]) == BoolT{}) {
+				v.branch(b, e.Op, []Reg{y[0], z[0]}, bThen, bElse)
+				break
+			}
+			if (b.getType(y[0]) == StrT{} || b.getType(z[0]) == StrT{}) {
+				// strings are always compared by the runtime
+				v.compareResult(b, "psc_str_cmp", e.Op, y[0], z[0], bThen, bElse)
+				break
+			}
+			// small ints can be compared directly.
+			// otherwise ask the runtime, which returns -1, 0, or 1
+			fast := newblock(b.Func, v.newlabel("fast"))
+			slow := newblock(b.Func, v.newlabel("slow"))
+			b.Func.blocks = append(b.Func.blocks, fast, slow)
+			v.branch(b, "small", []Reg{y[0], z[0]}, fast, slow)
+			v.branch(fast, e.Op, []Reg{y[0], z[0]}, bThen, bElse)
+			v.compareResult(slow, "psc_int_cmp", e.Op, y[0], z[0], bThen, bElse)
 		} else {
-			v.errorf("cannot use non-boolean expression as condition: %v", e)
+			v.errorf(e, "cannot use non-boolean expression as condition")
 		}
 	case *AndExpr:
 		// if left is false, goto bElse
 		// otherwise check right
+		// the liveness analysis wants every block to come
+		// before its successors, so add b2 before we fill it in
 		b2 := newblock(b.Func, v.newlabel("and"))
 		v.visitCond2(s, b, e.Left, b2, bElse)
-		v.visitCond2(s, b2, e.Right, bThen, bElse)
 		b.Func.blocks = append(b.Func.blocks, b2)
+		v.visitCond2(s, b2, e.Right, bThen, bElse)
 	case *OrExpr:
 		b2 := newblock(b.Func, v.newlabel("or"))
 		v.visitCond2(s, b, e.Left, bThen, b2)
-		v.visitCond2(s, b2, e.Right, bThen, bElse)
 		b.Func.blocks = append(b.Func.blocks, b2)
+		v.visitCond2(s, b2, e.Right, bThen, bElse)
 	case *IfExpr:
 		// this is an if embedded in the condition of another if.
 		// its branches evaluate to booleans which become the condition
@@ -763,43 +1570,175 @@ func (v *compiler) visitCond2(s *scope, b *block, e Expr, bThen, bElse *block) {
 		// create a new scope
 		// and add the variable to it
 		inner := s.push()
-		varInfo := inner.define(e.Var)
-		varInfo.Reg = val[0]
+		v.defineVar(inner, b, e.Var, val[0])
 		// evaluate the body of the let expression
 		// in the new scope
 		v.visitCond2(inner, b, e.Body, bThen, bElse)
+	case *CallExpr, *TupleIndexExpr, *PrimExpr, *IndexExpr, *DictOpExpr, *DotExpr, *VariantGetExpr:
+		// evaluate the expression and test it like a variable
+		b, val := v.visitExpr(s, b, e)
+		false := v.newreg()
+		b.emit(Op{
+			Opcode: LiteralOp,
+			Dst:    []Reg{false},
+			Value:  int64(0),
+		})
+		v.branch(b, "ne", []Reg{val[0], false}, bThen, bElse)
 	default:
 		panic(fmt.Sprintf("unhandled case in visitCond: %T", e))
 	}
 }
 
-func (c *compiler) visitFunc(s *scope, b *block, e *FuncExpr) *Func {
+// compareResult calls a runtime function which compares y and z,
+// returning -1, 0, or 1, and branches on its result
+func (v *compiler) compareResult(b *block, fn, op string, y, z Reg, bThen, bElse *block) {
+	c := v.newreg()
+	b.emit(Op{
+		Opcode:  CallOp,
+		Variant: fn,
+		Dst:     []Reg{c},
+		Src:     []Reg{y, z},
+	})
+	zero := v.newreg()
+	b.emit(Op{
+		Opcode: LiteralOp,
+		Dst:    []Reg{zero},
+		Value:  int64(0),
+	})
+	v.branch(b, op, []Reg{c, zero}, bThen, bElse)
+}
+
+// visitFunc lowers a closure-converted function.
+// its first parameter is the closure itself, with type env.
+func (c *compiler) visitFunc(s *scope, e *FuncExpr, env *TupleT) *Func {
 	f := new(Func)
 	t := new(FuncT)
-	if e.Name == "" {
-		f.Name = "<lambda>"
-	} else {
-		f.Name = e.Name
+	if ft, ok := c.types.single(e).(*FuncT); ok {
+		// a function made by cps conversion has no type,
+		// but then it never returns
+		for _, rt := range ft.Return {
+			t.Return = append(t.Return, reprType(rt))
+		}
 	}
+	f.Name = c.funcName(e.Name)
 	f.Type = t
-	entry := newblock(f, "entry")
+	env.Type[0] = t
+	c.funcs = append(c.funcs, f)
+	entry := f.entry()
 	inner := s.push()
-	if e.Name != "" {
-		mf := inner.define(e.Name)
-		mf.Func = f
-	}
-	for _, a := range e.Args {
+	for i, a := range e.Args {
 		m := inner.define(a)
 		m.Reg = c.newreg()
+		if i == 0 {
+			entry.setType(m.Reg, env)
+			c.closures[m.Reg] = f
+		} else if isContinuation(a) {
+			entry.setType(m.Reg, continuationType)
+			t.Params = append(t.Params, continuationType)
+		} else {
+			pt := c.varType(a)
+			entry.setType(m.Reg, pt)
+			t.Params = append(t.Params, pt)
+		}
+		entry.args = append(entry.args, m.Reg)
 	}
-	b, dst := c.visitExpr(inner, entry, e.Body)
-	// return the last thing evaluated
-	b.emit(Op{
-		Opcode: ReturnOp,
-		Src:    dst,
-	})
-	// TODO: t.Params
-	t.Return = []Type{b.getType(dst[0])}
-	c.funcs = append(c.funcs, f)
+	c.visitTail(inner, entry, e.Body)
 	return f
 }
+
+// defineVar adds a let-bound variable to the scope.
+// if lower couldn't work out the type of its value,
+// it uses the type the typechecker inferred.
+func (v *compiler) defineVar(s *scope, b *block, name string, r Reg) {
+	m := s.define(name)
+	m.Reg = r
+	if t, ok := b.Func.regtype[r]; !ok || (t == AnyT{}) {
+		b.setType(r, v.varType(name))
+	}
+}
+
+// varType returns the machine-level type of a variable,
+// according to the typechecker
+func (c *compiler) varType(name string) Type {
+	return reprType(c.types.varType(name))
+}
+
+// exprTypes returns the machine-level types of the values of e,
+// according to the typechecker
+func (c *compiler) exprTypes(e Expr) []Type {
+	var types []Type
+	for _, t := range c.types.of(e) {
+		types = append(types, reprType(t))
+	}
+	return types
+}
+
+// reprType converts a type from the typechecker into
+// the type of its runtime representation.
+// function values are closures, which are tuples whose first
+// element is the code; the garbage collector needs to know that.
+// type variables which were never bound could be anything.
+func reprType(t Type) Type {
+	switch t := prune(t).(type) {
+	case *FuncT:
+		f := &FuncT{Params: make([]Type, len(t.Params)), Return: make([]Type, len(t.Return))}
+		for i := range t.Params {
+			f.Params[i] = reprType(t.Params[i])
+		}
+		for i := range t.Return {
+			f.Return[i] = reprType(t.Return[i])
+		}
+		return &TupleT{Type: []Type{f}}
+	case *TupleT:
+		u := &TupleT{Type: make([]Type, len(t.Type))}
+		for i := range t.Type {
+			u.Type[i] = reprType(t.Type[i])
+		}
+		return u
+	case *ListT:
+		return &ListT{Elem: reprType(t.Elem)}
+	case *DictT:
+		return &DictT{Key: reprType(t.Key), Val: reprType(t.Val)}
+	case *TypeVar:
+		return AnyT{}
+	default:
+		return t
+	}
+}
+
+// the range of a small int. see runtime.c
+const (
+	minSmallInt = -1 << 62
+	maxSmallInt = 1<<62 - 1
+)
+
+// splitBigLiteral checks whether an int literal fits in a small int.
+// if it doesn't, it splits it into hi*2**32 + lo.
+func splitBigLiteral(lit string) (hi, lo string, ok bool) {
+	n, valid := new(big.Int).SetString(lit, 0)
+	if !valid {
+		// let SelectInstructions complain about it
+		return "", "", true
+	}
+	if n.IsInt64() && minSmallInt <= n.Int64() && n.Int64() <= maxSmallInt {
+		return "", "", true
+	}
+	l := new(big.Int).And(n, big.NewInt(1<<32-1))
+	h := new(big.Int).Rsh(n, 32)
+	return h.String(), l.String(), false
+}
+
+// funcName picks a name for a new function.
+// the name doubles as the function's assembly symbol,
+// so it has to be distinct from every other function in the program.
+func (c *compiler) funcName(name string) string {
+	if name == "" {
+		return c.newlabel("lambda")
+	}
+	for _, f := range c.funcs {
+		if f.symbol() == funcSymbol(name) {
+			return c.newlabel(name)
+		}
+	}
+	return name
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func lowerSource(t *testing.T, source string) *Prog {
+	t.Helper()
+	expr, err := parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	expr, types, err := check(expr)
+	if err != nil {
+		t.Fatal("typecheck failed: ", err)
+	}
+	expr = anf(uncoverTuples(expr, types), types)
+	return lower(convertClosures(expr, types), types)
+}
+
+func TestLowerParamTypes(t *testing.T) {
+	// p is a closure, so the garbage collector has to know about it
+	prog := lowerSource(t, `let f = func f(p, n) p(n * 2) + 1 end in f(func(x) x end, 2) end`)
+	var f *Func
+	for _, fn := range prog.funcs {
+		if fn.Name == "f" {
+			f = fn
+		}
+	}
+	if f == nil {
+		t.Fatal("function f not found")
+	}
+	args := f.blocks[0].args
+	if len(args) != 3 {
+		t.Fatalf("f has %d parameters, want 3", len(args))
+	}
+	if typ := f.regtype[args[1]]; !isTupleT(typ) {
+		t.Errorf("p has type %#v, want a closure", typ)
+	}
+	if typ := f.regtype[args[2]]; (typ != IntT{}) {
+		t.Errorf("n has type %#v, want IntT", typ)
+	}
+}
+
+func TestLowerIfType(t *testing.T) {
+	// the value of the if is a tuple, not a bool
+	prog := lowerSource(t, `let x = if 1 < 2 then tuple(1) else tuple(2) end in get(x, 0) end`)
+	f := prog.funcs[0]
+	var join *block
+	for _, b := range f.blocks {
+		if strings.HasPrefix(string(b.name), "end") {
+			join = b
+		}
+	}
+	if join == nil {
+		t.Fatal("join block not found")
+	}
+	if typ := f.regtype[join.args[0]]; !isTupleT(typ) {
+		t.Errorf("if has type %#v, want a tuple", typ)
+	}
+	gcable := gcableVars(f)
+	if !gcable[asmArg{Var: string(join.args[0])}] {
+		t.Errorf("value of if is not gcable")
+	}
+}
+
+func TestLowerCallType(t *testing.T) {
+	// the result of calling a parameter is a list,
+	// which the typechecker knows even though lower doesn't
+	prog := lowerSource(t, `let f = func f(p) len(p(1)) end in f(func(x) [x] end) end`)
+	var call *Op
+	for _, fn := range prog.funcs {
+		if fn.Name != "f" {
+			continue
+		}
+		for _, b := range fn.blocks {
+			for i, op := range b.code {
+				if op.Opcode == CallOp && op.Variant == "" {
+					call = &b.code[i]
+				}
+			}
+		}
+		if call == nil {
+			t.Fatal("call not found")
+		}
+		if typ, ok := fn.regtype[call.Dst[0]].(*ListT); !ok {
+			t.Errorf("call has type %#v, want a list", typ)
+		}
+	}
+	if call == nil {
+		t.Fatal("function f not found")
+	}
+}
+
+func TestSplitBigLiteral(t *testing.T) {
+	for _, tt := range []struct {
+		lit    string
+		hi, lo string
+		ok     bool
+	}{
+		{"42", "", "", true},
+		{"4611686018427387903", "", "", true},
+		{"-4611686018427387904", "", "", true},
+		{"4611686018427387904", "1073741824", "0", false},
+		{"-4611686018427387905", "-1073741825", "4294967295", false},
+		{"123456789012345678901234567890", "28744523649184424174", "1312754386", false},
+	} {
+		hi, lo, ok := splitBigLiteral(tt.lit)
+		if hi != tt.hi || lo != tt.lo || ok != tt.ok {
+			t.Errorf("splitBigLiteral(%s) = %q, %q, %v, want %q, %q, %v", tt.lit, hi, lo, ok, tt.hi, tt.lo, tt.ok)
+		}
+	}
+}
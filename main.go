@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,128 +11,328 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
-
-	"github.com/kr/pretty"
+	"syscall"
 )
 
+// psc is the driver for the compiler.
+//
+// usage:
+//
+//	psc build [-o output] [-v] [-cps] file.lang
+//	psc run [-v] [-cps] file.lang
+//	psc check file.lang...
+//	psc fmt [-w] file.lang...
+
+const usageText = `usage: psc <command> [arguments]
+
+commands:
+	build   compile a program to an executable
+	run     compile and run a program
+	check   parse and typecheck programs without compiling them
+	fmt     reformat programs
+`
+
+// verbose enables debugging output from the compiler passes
+var verbose = false
+
+// useCPS converts programs to continuation-passing style before lowering them
+var useCPS = false
+
 func main() {
-	if err := main3(); err != nil {
-		fmt.Println(err)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usageText)
+		os.Exit(2)
+	}
+	cmd, args := os.Args[1], os.Args[2:]
+	var err error
+	switch cmd {
+	case "build":
+		err = buildCmd(args)
+	case "run":
+		err = runCmd(args)
+	case "check":
+		err = checkCmd(args)
+	case "fmt":
+		err = fmtCmd(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usageText)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "psc: unknown command %q\n", cmd)
+		fmt.Fprint(os.Stderr, usageText)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
-func main3() error {
-	//const source = `let v = 1 in let w = 42 in let x = v + 7 in let y = x in let z = x + w in z - y end end end end end`
-	//const source = `let x = 1+0 in let y = 2+0 in if (if x < 1 then x == 0 else x == 2 end) then let z = 2+0 in y + z end else y + 10 end end end`
-	//const source = `let x = 1+0 in let y = 2+0 in let z = x < y in if z or x == 1 then 42 else x + y end end end end`
-	//const source = `true`
-	//const source = `let t = tuple(1, true, 42) in get(t, 2) end`
-	const source = `get(get(tuple(tuple(1, 42, true)), 0), 1)`
-	//const source = `let sqrt = func sqrt(a) a end in let a = 1+0 in let b = 2+0 in let c = 3+0 in -b + sqrt(4*a*c - b*b)/(2*a) end end end end`
-	//const source = `let a = 1+0 in let b = 2+0 in let c = 3+0 in -b + (4*a*c - b*b)/(2*a) end end end`
-	expr, err := parse(strings.NewReader(source))
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: psc %s %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func buildCmd(args []string) error {
+	fs := newFlagSet("build", "[-o output] [-v] [-cps] file.lang")
+	output := fs.String("o", "", "write the executable to `file`")
+	fs.BoolVar(&verbose, "v", false, "print debugging output")
+	fs.BoolVar(&useCPS, "cps", false, "compile via continuation-passing style")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	filename := fs.Arg(0)
+	exeName := *output
+	if exeName == "" {
+		exeName = strings.TrimSuffix(filepath.Base(filename), ".lang")
+	}
+	// don't replace the program with its own executable
+	// (psc build prog, or psc build -o x.lang x.lang)
+	if src, err := os.Stat(filename); err == nil {
+		if dst, err := os.Stat(exeName); err == nil && os.SameFile(src, dst) {
+			return fmt.Errorf("%s: output would overwrite the source file; use -o", filename)
+		}
+	}
+	return build(filename, exeName)
+}
+
+func runCmd(args []string) error {
+	fs := newFlagSet("run", "[-v] [-cps] file.lang")
+	fs.BoolVar(&verbose, "v", false, "print debugging output")
+	fs.BoolVar(&useCPS, "cps", false, "compile via continuation-passing style")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	tempDir, err := ioutil.TempDir("", "pscrun")
 	if err != nil {
 		return err
 	}
-	printExpr(expr)
-	expr = uncoverBools(expr)
-	if err := typecheck(expr); err != nil {
+	defer os.RemoveAll(tempDir)
+	exeName := filepath.Join(tempDir, "a.out")
+	if err := build(fs.Arg(0), exeName); err != nil {
+		return err
+	}
+	cmd := exec.Command(exeName)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		// the program already said everything it wanted to say;
+		// just pass along its exit status.
+		// but a crash shouldn't look like an ordinary failure
+		os.RemoveAll(tempDir)
+		if status, ok := exit.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			fmt.Fprintf(os.Stderr, "psc: %s killed by signal: %v\n", fs.Arg(0), status.Signal())
+			os.Exit(128 + int(status.Signal()))
+		}
+		os.Exit(exit.ExitCode())
+	}
+	return err
+}
+
+func checkCmd(args []string) error {
+	fs := newFlagSet("check", "file.lang...")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var errors []error
+	for _, filename := range fs.Args() {
+		expr, err := loadProgram(filename)
+		if err != nil {
+			errors = append(errors, err)
+		}
+		if expr == nil {
+			continue
+		}
+		// keep going even if there were syntax errors;
+		// the typechecker skips over the broken parts
+		if _, _, err := check(expr); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	return multiError(errors...)
+}
+
+func fmtCmd(args []string) error {
+	fs := newFlagSet("fmt", "[-w] file.lang...")
+	write := fs.Bool("w", false, "write the result back to the source file instead of stdout")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var errors []error
+	for _, filename := range fs.Args() {
+		file, err := parseFile(filename)
+		if err != nil {
+			errors = append(errors, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := formatFile(&buf, file); err != nil {
+			errors = append(errors, err)
+			continue
+		}
+		if *write {
+			err = ioutil.WriteFile(filename, buf.Bytes(), 0o666)
+		} else {
+			_, err = buf.WriteTo(os.Stdout)
+		}
+		if err != nil {
+			errors = append(errors, err)
+		}
+	}
+	return multiError(errors...)
+}
+
+// build compiles the program in filename to an executable
+func build(filename, exeName string) error {
+	expr, err := loadProgram(filename)
+	if err != nil {
+		return err
+	}
+	expr, types, err := check(expr)
+	if err != nil {
+		return err
+	}
+	asm, err := compile(expr, types)
+	if err != nil {
 		return err
 	}
-	expr = uncoverTuples(expr)
-	printExpr(expr)
-	prog := lower(expr)
-	print(prog)
-	//pretty.Println(prog)
+	return compileAsm(asm, exeName)
+}
+
+// check runs the front-end passes which can report errors in the program.
+// it returns the expression with variables renamed and booleans uncovered,
+// and the types the typechecker inferred for it.
+func check(expr Expr) (Expr, *typeTable, error) {
+	expr, names := uniquify(expr)
+	if verbose {
+		printRenames(names)
+	}
+	expr = uncoverBools(expr)
+	tc := typechecker{
+		names: names,
+		vars:  make(map[string]Type),
+		exprs: make(map[Expr][]Type),
+	}
+	if _, err := tc.check(expr); err != nil {
+		return expr, nil, err
+	}
+	return expr, tc.table(), nil
+}
+
+// compile lowers a typechecked expression all the way down to assembly.
+// its variables must have unique names and types holds their types;
+// check takes care of both.
+func compile(expr Expr, types *typeTable) ([]byte, error) {
+	// the program prints its result,
+	// so we need to know what type it is
+	var result Type = AnyT{}
+	if t := types.of(expr); len(t) == 1 {
+		result = t[0]
+	}
+	expr = uncoverTuples(expr, types)
+	expr = anf(expr, types)
+	if useCPS {
+		expr = cpsProgram(expr, types)
+	}
+	expr = convertClosures(expr, types)
+	if verbose {
+		printExpr(expr)
+	}
+	prog := lower(expr, types)
+	if verbose {
+		print(prog)
+	}
 
-	printCFG(prog.funcs[0].blocks)
+	var procs []*asmProg
+	for _, f := range prog.funcs {
+		p, err := compileFunc(f)
+		if err != nil {
+			return nil, err
+		}
+		procs = append(procs, p)
+	}
 
-	printAsmBlock := func(b *asmBlock) {
-		var p AsmPrinter
-		p.w = os.Stdout
-		p.ConvertBlock(b)
+	var pr AsmPrinter
+	buf := new(bytes.Buffer)
+	pr.w = buf
+	pr.ConvertProg(procs, prog.strings, result)
+	if verbose {
+		fmt.Print(buf.String())
 	}
+	return buf.Bytes(), nil
+}
 
-	fmt.Println("-----------------------------------")
+// compileFunc runs the back-end passes on a single function,
+// turning it into an assembly procedure
+func compileFunc(f *Func) (*asmProg, error) {
+	if verbose {
+		fmt.Println("FUNCTION", f.Name)
+		printCFG(f.blocks)
+	}
 	var blocks []*asmBlock
-	for _, irblock := range prog.funcs[0].blocks {
-		blocks = append(blocks, irblock.SelectInstructions(prog.funcs[0]))
+	for _, irblock := range f.blocks {
+		blocks = append(blocks, irblock.SelectInstructions(f))
 	}
-	copyCFG(blocks, prog.funcs[0])
-	for _, b := range blocks {
-		//fmt.Println(string(b.label) + ":")
-		printAsmBlock(b)
+	copyCFG(blocks, f)
+	if verbose {
+		fmt.Println("-----------------------------------")
+		for _, b := range blocks {
+			printAsmBlock(b)
+		}
+		fmt.Println("-----------------------------------")
 	}
-	fmt.Println("-----------------------------------")
 	for _, b := range blocks {
 		if err := b.checkMachineInstructions(); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	gcable := gcableVars(prog.funcs[0])
+	gcable := gcableVars(f)
 	params := sysvRegisters
-	p := &asmProg{blocks: blocks, gcable: gcable}
+	p := &asmProg{name: f.symbol(), blocks: blocks, gcable: gcable, retbuf: retbufSlots(f)}
+	if n := len(f.blocks[0].args) - len(params.Args); n > 0 {
+		p.stackargs = n
+	}
 	p.assignHomes(gcable)
 	p.addStackFrameInstructions(params)
 	for _, b := range p.blocks {
 		b.patchInstructions()
 	}
-
-	var pr AsmPrinter
-	buf := new(bytes.Buffer)
-	pr.w = buf
-	pr.ConvertProg(p)
-	fmt.Print(buf.String())
-
-	return compileAsm(buf.Bytes(), "./a.out")
+	return p, nil
 }
 
-func main2() error {
-	x, err := parse(os.Stdin)
-	if err != nil {
-		return nil
+// printRenames prints the variables renamed by uniquify
+func printRenames(names map[string]string) {
+	var renamed []string
+	for name := range names {
+		renamed = append(renamed, name)
+	}
+	sort.Strings(renamed)
+	for _, name := range renamed {
+		fmt.Println("renamed", names[name], "to", name)
 	}
-	printExpr(x)
-	fmt.Println("=======")
-	y := cpsConvert(&VarExpr{"return"}, x)
-	printExpr(y)
-	return err
 }
 
-func main1() error {
-	// fun test expressions:
-	//
-	// a+b*c(d(),)
-	// (func(a) let f = func(b) 5 + a end in f(a) end end)(a)
-	//
-
-	x, err := parse(os.Stdin)
-	if err != nil {
-		return err
-	}
-	pretty.Println(x)
-	printExpr(x)
-	y := lower(x)
-	pretty.Println(y)
-	print(y)
-
-	/*
-		prog := &Prog{
-			blocks: []*block{
-				{
-					code: []Lop{
-						{Op: Linit, A: "b", K: 6},
-						{Op: Linit, A: "c", K: 2},
-						{Op: Ladd, A: "a", B: "b", C: "c"},
-					},
-				},
-			},
-		}
-		fmt.Println(gen(prog))
-	*/
-	return nil
+func printAsmBlock(b *asmBlock) {
+	var p AsmPrinter
+	p.w = os.Stdout
+	p.ConvertBlock(b)
 }
 
 func printCFG(blocks []*block) {
@@ -158,10 +360,25 @@ func (list ErrorList) Error() string {
 	return string(b)
 }
 
-func parse(r io.Reader) (Expr, error) {
+// parseFile parses a source file, without loading its imports
+func parseFile(filename string) (*File, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseSource(filename, f)
+}
+
+// parseSource parses a source file from r.
+// filename is used in error messages.
+func parseSource(filename string, r io.Reader) (*File, error) {
 	l := new(lexer)
-	l.Init(r)
+	l.Init(filename, r)
 	yyParse(l)
+	if l.result != nil {
+		l.result.Comments = l.comments
+	}
 	var err error
 	if len(l.errors) > 0 {
 		err = ErrorList(l.errors)
@@ -179,7 +396,9 @@ func compileAsm(assemblyText []byte, exeName string) error {
 		return err
 	}
 	defer func() {
-		log.Println("rm -rf", tempDir)
+		if verbose {
+			log.Println("rm -rf", tempDir)
+		}
 		err := os.RemoveAll(tempDir)
 		if err != nil {
 			log.Println(err)
@@ -190,12 +409,7 @@ func compileAsm(assemblyText []byte, exeName string) error {
 	if err != nil {
 		return err
 	}
-	exeDir := "."
-	if exePath, _ := os.Executable(); exePath != "" {
-		exeDir, _ = filepath.Split(exePath)
-	}
-	runtimePath := filepath.Join(exeDir, "runtime.c")
-	cmd := exec.Command("cc", "-O2", "-fcf-protection=none", "-o", exeName, asmPath, runtimePath)
+	cmd := exec.Command("cc", "-O2", "-fcf-protection=none", "-o", exeName, asmPath, findRuntime())
 	cmd.Stderr = os.Stderr
 	err = cmd.Run()
 	if err != nil {
@@ -203,3 +417,17 @@ func compileAsm(assemblyText []byte, exeName string) error {
 	}
 	return err
 }
+
+// findRuntime returns the path to runtime.c.
+// it lives next to the psc executable,
+// or in the current directory if we were started with go run.
+func findRuntime() string {
+	if exePath, _ := os.Executable(); exePath != "" {
+		exeDir, _ := filepath.Split(exePath)
+		runtimePath := filepath.Join(exeDir, "runtime.c")
+		if _, err := os.Stat(runtimePath); err == nil {
+			return runtimePath
+		}
+	}
+	return "runtime.c"
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/scanner"
+)
+
+// mvs.go decides which version of each package a program uses,
+// with minimal version selection (https://research.swtch.com/vgo-mvs).
+//
+// the root directory of a package has a manifest, psc.pkg:
+//
+//	package example.com/foo
+//	require example.com/bar@v1 v1.2.0
+//	require example.com/baz v0.3.1
+//
+// a requirement names a package, including the channel it is imported
+// with (the part after the @ in an import path), and the oldest version
+// of it which will do. the build uses the newest version which anything
+// requires, and no newer, so it only changes when a manifest does.
+// a version is in a channel if the channel is a prefix of it:
+// v1.2.0 is in channels v1 and v1.2. everything is in the empty channel.
+//
+// versions are found in the package cache, in directories like
+// $PSCPKGDIR/example.com/bar@v1.2.0. there's no downloading yet,
+// so they have to be put there by hand.
+//
+// psc.sum, next to the main package's manifest, records a hash of every
+// version that has been used. if a version in the cache doesn't match
+// its hash, the build fails. new versions are added to the file.
+
+const (
+	manifestName = "psc.pkg"
+	sumName      = "psc.sum"
+)
+
+// a manifest is a parsed psc.pkg file
+type manifest struct {
+	Path     string // may be empty in the main package
+	Requires []requirement
+}
+
+// a requirement is a package and the minimum version of it which is needed
+type requirement struct {
+	Path    string // with the channel, like example.com/bar@v1
+	Version string
+}
+
+func readManifest(filename string) (*manifest, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(filename, data)
+}
+
+func parseManifest(filename string, data []byte) (*manifest, error) {
+	m := new(manifest)
+	var errors []error
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; sc.Scan(); line++ {
+		errorf := func(format string, v ...interface{}) {
+			pos := scanner.Position{Filename: filename, Line: line, Column: 1}
+			errors = append(errors, &Error{Pos: pos, Msg: fmt.Sprintf(format, v...)})
+		}
+		text := sc.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		f := strings.Fields(text)
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "package":
+			if len(f) != 2 {
+				errorf("usage: package path")
+			} else if m.Path != "" {
+				errorf("package declared twice")
+			} else {
+				m.Path = f[1]
+			}
+		case "require":
+			if len(f) != 3 {
+				errorf("usage: require path[@channel] version")
+				continue
+			}
+			r := requirement{Path: f[1], Version: f[2]}
+			path, channel := splitChannel(r.Path)
+			if !validPackagePath(path) {
+				errorf("invalid package path %q", path)
+				continue
+			}
+			if !inChannel(r.Version, channel) {
+				errorf("version %s is not in channel %s", r.Version, channel)
+				continue
+			}
+			m.Requires = append(m.Requires, r)
+		default:
+			errorf("unknown directive %q", f[0])
+		}
+	}
+	return m, multiError(errors...)
+}
+
+// splitChannel splits a package path into the path and its channel
+func splitChannel(path string) (string, string) {
+	if i := strings.LastIndex(path, "@"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+// inChannel reports whether version belongs to channel
+func inChannel(version, channel string) bool {
+	return channel == "" || version == channel || strings.HasPrefix(version, channel+".")
+}
+
+// compareVersions compares two versions a piece at a time,
+// numerically if both pieces are numbers, so that v1.10 > v1.9.
+// it returns -1, 0, or +1.
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, errx := strconv.Atoi(as[i])
+		y, erry := strconv.Atoi(bs[i])
+		switch {
+		case errx == nil && erry == nil && x < y:
+			return -1
+		case errx == nil && erry == nil && x > y:
+			return +1
+		case errx != nil || erry != nil:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return +1
+	}
+	return 0
+}
+
+// buildList does minimal version selection.
+// it returns the newest version of each package that is required
+// by root or by any of the versions they require, and so on.
+// reqs returns the requirements of a version of a package.
+func buildList(root []requirement, reqs func(requirement) ([]requirement, error)) (map[string]string, error) {
+	selected := make(map[string]string)
+	seen := make(map[requirement]bool)
+	var errors []error
+	queue := append([]requirement(nil), root...)
+	for len(queue) > 0 {
+		r := queue[0]
+		queue = queue[1:]
+		if seen[r] {
+			continue
+		}
+		seen[r] = true
+		if v, ok := selected[r.Path]; !ok || compareVersions(r.Version, v) > 0 {
+			selected[r.Path] = r.Version
+		}
+		next, err := reqs(r)
+		if err != nil {
+			errors = append(errors, err)
+		}
+		queue = append(queue, next...)
+	}
+	return selected, multiError(errors...)
+}
+
+// a sumFile is a parsed psc.sum file
+type sumFile struct {
+	filename string
+	sums     map[string]string // path@version -> hash
+	checked  map[string]error  // what verify found for each key
+	changed  bool
+}
+
+// errReported is what verify returns for a key which failed before,
+// so that a bad package is reported once, not once per import of it
+var errReported = errors.New("package already reported")
+
+func readSums(filename string) (*sumFile, error) {
+	s := &sumFile{filename: filename, sums: make(map[string]string), checked: make(map[string]error)}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 2 {
+			pos := scanner.Position{Filename: filename, Line: i + 1, Column: 1}
+			return nil, &Error{Pos: pos, Msg: "malformed line"}
+		}
+		s.sums[f[0]] = f[1]
+	}
+	return s, nil
+}
+
+// verify checks the contents of dir, which holds the version key
+// (like example.com/bar@v1.2.0), against its recorded hash.
+// if there isn't one yet, it records it.
+func (s *sumFile) verify(key, dir string) error {
+	if err, ok := s.checked[key]; ok {
+		if err != nil {
+			return errReported
+		}
+		return nil
+	}
+	err := s.check(key, dir)
+	s.checked[key] = err
+	return err
+}
+
+func (s *sumFile) check(key, dir string) error {
+	hash, err := hashDir(dir)
+	if err != nil {
+		return err
+	}
+	if want, ok := s.sums[key]; !ok {
+		s.sums[key] = hash
+		s.changed = true
+	} else if hash != want {
+		return fmt.Errorf("checksum mismatch for %s in %s:\n\thave %s\n\twant %s (from %s)", key, dir, hash, want, s.filename)
+	}
+	return nil
+}
+
+// write writes the file back out, if anything was added to it
+func (s *sumFile) write() error {
+	if !s.changed {
+		return nil
+	}
+	var keys []string
+	for key := range s.sums {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "%s %s\n", key, s.sums[key])
+	}
+	return ioutil.WriteFile(s.filename, buf.Bytes(), 0o666)
+}
+
+// hashDir computes a hash of all the files in a directory:
+// a sha256 of the sha256 and name of each file, in order by name
+func hashDir(dir string) (string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, path := range files {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		fmt.Fprintf(h, "%x  %s\n", sha256.Sum256(data), filepath.ToSlash(rel))
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
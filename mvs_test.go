@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	// in increasing order
+	versions := []string{"v0.1", "v0.1.0", "v0.9", "v1", "v1.2.0", "v1.9.9", "v1.10.0", "v2.0.0", "v2.0.0.1", "v10.0.0"}
+	for i, a := range versions {
+		for j, b := range versions {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = +1
+			}
+			if got := compareVersions(a, b); got != want {
+				t.Errorf("compareVersions(%q, %q) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	const text = `# a comment
+package example.com/a
+require example.com/b@v1 v1.2.0
+require example.com/c v0.3.1 # another comment
+require example.com/d@v2 v1.0.0
+require nowhere v1.0.0
+frobnicate
+`
+	m, err := parseManifest("psc.pkg", []byte(text))
+	want := &manifest{
+		Path: "example.com/a",
+		Requires: []requirement{
+			{"example.com/b@v1", "v1.2.0"},
+			{"example.com/c", "v0.3.1"},
+		},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %+v, want %+v", m, want)
+	}
+	wantErr := `psc.pkg:5:1: version v1.0.0 is not in channel v2
+psc.pkg:6:1: invalid package path "nowhere"
+psc.pkg:7:1: unknown directive "frobnicate"`
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("got error:\n%v\nwant:\n%s", err, wantErr)
+	}
+}
+
+// the example from https://research.swtch.com/vgo-mvs
+var mvsFixture = map[string]string{
+	"main/psc.pkg": "require example.com/b v1.2\nrequire example.com/c v1.2\n",
+	"main/main.lang": `import "example.com/b"
+import "example.com/c"
+import "example.com/d"
+b.x + c.x + d.x
+`,
+	"pkg/example.com/b@v1.1/psc.pkg":   "require example.com/d v1.1\n",
+	"pkg/example.com/b@v1.2/psc.pkg":   "package example.com/b\nrequire example.com/d v1.3\n",
+	"pkg/example.com/b@v1.2/b.lang":    "import \"example.com/d\"\npublic let x = d.x\n",
+	"pkg/example.com/c@v1.2/psc.pkg":   "require example.com/d v1.4\n",
+	"pkg/example.com/c@v1.2/c.lang":    "public let x = 20\n",
+	"pkg/example.com/c@v1.3/psc.pkg":   "require example.com/f v1.1\n",
+	"pkg/example.com/d@v1.3/psc.pkg":   "require example.com/e v1.2\n",
+	"pkg/example.com/d@v1.3/d.lang":    "public let x = 3\n",
+	"pkg/example.com/d@v1.4/psc.pkg":   "require example.com/e v1.2\n",
+	"pkg/example.com/d@v1.4/d.lang":    "public let x = 4\n",
+	"pkg/example.com/d@v1.5/d.lang":    "public let x = 5\n",
+	"pkg/example.com/e@v1.2/e.lang":    "public let x = 100\n",
+	"pkg/example.com/f@v1.1/f.lang":    "public let x = 1000\n",
+	"pkg/example.com/b@v1.2/sub/x.txt": "this is part of the hash too",
+}
+
+func TestBuildList(t *testing.T) {
+	dir := writeFiles(t, mvsFixture)
+	defer os.RemoveAll(dir)
+
+	l := newLoader()
+	l.pkgDir = filepath.Join(dir, "pkg")
+	l.selectVersions(filepath.Join(dir, "main"))
+	if len(l.errors) > 0 {
+		t.Fatal(ErrorList(l.errors))
+	}
+	// c@v1.3 and d@v1.5 exist, but nothing asks for them
+	want := map[string]string{
+		"example.com/b": "v1.2",
+		"example.com/c": "v1.2",
+		"example.com/d": "v1.4",
+		"example.com/e": "v1.2",
+	}
+	if !reflect.DeepEqual(l.selected, want) {
+		t.Errorf("got %v, want %v", l.selected, want)
+	}
+}
+
+func TestLoadVersions(t *testing.T) {
+	dir := writeFiles(t, mvsFixture)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "main", "main.lang")
+	if old, ok := os.LookupEnv("PSCPKGDIR"); ok {
+		defer os.Setenv("PSCPKGDIR", old)
+	} else {
+		defer os.Unsetenv("PSCPKGDIR")
+	}
+	os.Setenv("PSCPKGDIR", filepath.Join(dir, "pkg"))
+
+	expr, err := loadProgram(filename)
+	if err != nil {
+		t.Fatal("load failed: ", err)
+	}
+	// b and the main program share d@v1.4
+	if _, _, err := check(expr); err != nil {
+		t.Errorf("typecheck failed: %v", err)
+	}
+
+	// the versions which were used are recorded in psc.sum,
+	// including d@v1.3, whose manifest was read
+	sumFilename := filepath.Join(dir, "main", sumName)
+	data, err := ioutil.ReadFile(sumFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		keys = append(keys, strings.Fields(line)[0])
+	}
+	wantKeys := []string{"example.com/b@v1.2", "example.com/c@v1.2", "example.com/d@v1.3", "example.com/d@v1.4", "example.com/e@v1.2"}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Errorf("psc.sum has %v, want %v", keys, wantKeys)
+	}
+
+	// loading again verifies them
+	if _, err := loadProgram(filename); err != nil {
+		t.Fatal("second load failed: ", err)
+	}
+
+	// and a package which has changed is an error
+	err = ioutil.WriteFile(filepath.Join(dir, "pkg", "example.com", "b@v1.2", "sub", "x.txt"), []byte("tampered"), 0o666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadProgram(filename)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch for example.com/b@v1.2") {
+		t.Errorf("got %v, want a checksum mismatch", err)
+	}
+
+	// once, even though d is read by the version selection
+	// and imported by both b and the main program
+	err = ioutil.WriteFile(filepath.Join(dir, "pkg", "example.com", "d@v1.4", "d.lang"), []byte("public let x = 40\n"), 0o666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadProgram(filename)
+	if err == nil || strings.Count(err.Error(), "checksum mismatch for example.com/d@v1.4") != 1 {
+		t.Errorf("got %v, want one checksum mismatch for d", err)
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseErrorRecovery(t *testing.T) {
+	const source = `let a = 1 + in
+  let b = if a < then 1 else 2 end in
+    f(a, * b, 3)
+  end
+end`
+	expr, err := parseReader("test.lang", strings.NewReader(source))
+	if err == nil {
+		t.Fatal("expected syntax errors but found none")
+	}
+	want := []string{
+		"test.lang:1:13: syntax error: unexpected 'in'",
+		"test.lang:2:18: syntax error: unexpected 'then'",
+		"test.lang:3:10: syntax error: unexpected '*'",
+	}
+	list, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("got %T, want ErrorList", err)
+	}
+	if len(list) != len(want) {
+		t.Errorf("got %d errors, want %d:\n%v", len(list), len(want), err)
+	}
+	for i := 0; i < len(list) && i < len(want); i++ {
+		if got := list[i].Error(); got != want[i] {
+			t.Errorf("error %d = %q, want %q", i, got, want[i])
+		}
+	}
+
+	// the partial AST should have error nodes in place of the broken parts
+	let, ok := expr.(*LetExpr)
+	if !ok {
+		t.Fatalf("got %T, want *LetExpr", expr)
+	}
+	if _, ok := let.Val.(*BadExpr); !ok {
+		t.Errorf("let value is %T, want *BadExpr", let.Val)
+	}
+
+	// and the typechecker shouldn't report anything about them
+	err = typecheck(expr)
+	if err == nil || err.Error() != "test.lang:3:5: f not in scope" {
+		t.Errorf("typecheck(partial AST) = %v, want only the scope error", err)
+	}
+}
+
+func TestParseTypeAnnotations(t *testing.T) {
+	const source = `let x: tuple(int, bool) = tuple(1, true) in
+let f = func f(a int, g func(int) -> int, b) -> int g(a) - b end in
+let h = func() -> (int, func()) 1 end in
+f(1, func(n) -n end, 2)
+end end end`
+	expr, err := parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	const want = `let x: tuple(int, bool) = tuple(1, #true) in
+  let f = func f(a int, g func(int) -> int, b) -> int
+    g(a) - b
+  end in
+    let h = func () -> (int, func())
+      1
+    end in
+      f(1, func (n)
+        0 - n
+      end, 2)
+    end
+  end
+end
+`
+	var buf bytes.Buffer
+	formatExpr(&buf, uncoverBools(expr))
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseLetValues(t *testing.T) {
+	const source = `let q, r = divmod(7, 2) in let a, b, c = values(q, r, 1) in a end end`
+	expr, err := parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	const want = `let q, r = divmod(7, 2) in
+  let a, b, c = #values(q, r, 1) in
+    a
+  end
+end
+`
+	var buf bytes.Buffer
+	formatExpr(&buf, uncoverTuples(expr, nil))
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseStrings(t *testing.T) {
+	const source = `let s: str = "a\tb" .. 1 + 2 in (s .. "\"c\"") .. "" < "d" .. s end`
+	expr, err := parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	// .. binds looser than + and tighter than <
+	const want = `let s: str = "a\tb" .. 1 + 2 in
+  s .. "\"c\"" .. "" < "d" .. s
+end
+`
+	var buf bytes.Buffer
+	formatExpr(&buf, expr)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseLists(t *testing.T) {
+	const source = `let xs: list(int) = [1, 2 + 3] in for x in xs do [x][0] * len(xs) end end`
+	expr, err := parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	const want = `let xs: list(int) = [1, 2 + 3] in
+  for x in xs do
+    [x][0] * len(xs)
+  end
+end
+`
+	var buf bytes.Buffer
+	formatExpr(&buf, expr)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseDicts(t *testing.T) {
+	const source = `let d: dict(str, int) = {"a": 1, "b": 1 + 1,} in lookup(set(d, "c", 3), "a") + len(keys({})) end`
+	expr, err := parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	const want = `let d: dict(str, int) = {"a": 1, "b": 1 + 1} in
+  #lookup(#set(d, "c", 3), "a") + #len(#keys({}))
+end
+`
+	var buf bytes.Buffer
+	formatExpr(&buf, uncoverTuples(expr, nil))
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseRecords(t *testing.T) {
+	const source = `type point { x int, y int }
+public type seg {a point, b geo.point,}
+type empty {}
+func f(s seg) s.a.x end
+f(seg{b: geo.point{x: 1, y: 2}, a: point{x: 3, y: 4}})
+`
+	f, err := parseSource("test.lang", strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	const want = `type point { x int, y int }
+
+public type seg { a point, b geo.point }
+
+type empty {}
+
+func f(s seg)
+  s.a.x
+end
+
+f(seg{b: geo.point{x: 1, y: 2}, a: point{x: 3, y: 4}})
+`
+	var buf bytes.Buffer
+	formatFile(&buf, f)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseVariants(t *testing.T) {
+	const source = `public type shape = circle(int) | rect(int,int) | empty
+func area(s) match s case circle(r) then r * r case geo.square(n) then n * n else 0 end end
+area(rect(1, 2))
+`
+	f, err := parseSource("test.lang", strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	const want = `public type shape = circle(int) | rect(int, int) | empty
+
+func area(s)
+  match s
+  case circle(r) then
+    r * r
+  case geo.square(n) then
+    n * n
+  else
+    0
+  end
+end
+
+area(rect(1, 2))
+`
+	var buf bytes.Buffer
+	formatFile(&buf, f)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseMatch(t *testing.T) {
+	const source = `type shape = circle(int) | rect(int, int) | empty
+match rect(1, 2) case rect(w, h) then w * h case empty then 0 case circle(r) then r end`
+	expr, err := parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	// a match becomes a chain of ifs which test the tag.
+	// there is no else, so the last case isn't tested
+	const want = `#type type shape = circle(int) | rect(int, int) | empty in
+  let $match = rect(1, 2) in
+    let $tag = #tag($match) in
+      if $tag == 1 then
+        let w = #get_rect($match, 0) in
+          let h = #get_rect($match, 1) in
+            w * h
+          end
+        end
+      else
+        if $tag == 2 then
+          0
+        else
+          let r = #get_circle($match, 0) in
+            r
+          end
+        end
+      end
+    end
+  end
+end
+`
+	var buf bytes.Buffer
+	formatExpr(&buf, uncoverTuples(expr, nil))
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseForLoop(t *testing.T) {
+	const source = `for x in xs do append([], x) end`
+	expr, err := parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	// a for loop becomes a recursive function
+	// which builds a new list
+	const want = `let $list.x = xs in
+  let $for.x = func $loop.x($i.x, $out.x)
+    if $i.x < #len($list.x) then
+      let x = $list.x[$i.x] in
+        $loop.x($i.x + 1, #append($out.x, #append([], x)))
+      end
+    else
+      $out.x
+    end
+  end in
+    $for.x(0, [])
+  end
+end
+`
+	var buf bytes.Buffer
+	formatExpr(&buf, uncoverTuples(expr, nil))
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseTopLevel(t *testing.T) {
+	const source = `import "std" ( fmt )
+let zero = 0
+public let one: int = 1
+func sign(n) if n < 0 then 0 - 1 else 1 end end
+public func add(a, b) a + b end
+add(sign(zero), one)
+`
+	f, err := parseSource("test.lang", strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	const want = `import "std" ( fmt )
+
+let zero = 0
+
+public let one: int = 1
+
+func sign(n)
+  if n < 0 then
+    0 - 1
+  else
+    1
+  end
+end
+
+public func add(a, b)
+  a + b
+end
+
+add(sign(zero), one)
+`
+	var buf bytes.Buffer
+	formatFile(&buf, f)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFormatComments(t *testing.T) {
+	const source = `// compute a thing
+import "std" ( fmt ) // trailing
+
+/* a block
+   comment */
+let y = 2
+func f(a, b)
+  // inside
+  let x = 1 in /* keep me */ x + a end
+end
+f(y, /* mid */ 3)
+// the end
+`
+	f, err := parseSource("test.lang", strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	// fmt -w mustn't lose any comments,
+	// even if it has to move them
+	const want = `// compute a thing
+import "std" ( fmt ) // trailing
+
+/* a block
+   comment */
+let y = 2
+
+func f(a, b)
+  // inside
+  let x = 1 in /* keep me */
+    x + a
+  end
+end
+
+f(y, 3) /* mid */
+// the end
+`
+	var buf bytes.Buffer
+	formatFile(&buf, f)
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseTopLevelErrors(t *testing.T) {
+	const source = `public func(x) x end
+f(1)
+func f(x) x end
+2
+`
+	_, err := parseSource("test.lang", strings.NewReader(source))
+	want := `test.lang:1:1: a public function must have a name
+test.lang:2:1: only the last item in a file can be an expression`
+	if err == nil || err.Error() != want {
+		t.Errorf("got error:\n%v\nwant:\n%s", err, want)
+	}
+}
+
+func TestParseUnsupportedTokens(t *testing.T) {
+	// the parser mustn't mistake a token it doesn't know for the end of the file
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"let x = 2 in x end\n3.0", "test.lang:2:3: syntax error: unexpected number, expecting identifier"},
+		{"1 + 2 'x' + 3", `test.lang:1:7: syntax error: unexpected "'"`},
+		{"1 + `a` + 3", "test.lang:1:5: syntax error: unexpected \"`\""},
+		{"1 # 2", `test.lang:1:3: syntax error: unexpected "#"`},
+	}
+	for _, tt := range tests {
+		_, err := parseSource("test.lang", strings.NewReader(tt.source))
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("parse(%q): got error %v, want %s", tt.source, err, tt.want)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	// formatting a formatted file doesn't change it
+	const source = `let a = -5 // five
+
+func neg(x) // negate
+  -x // minus
+end
+
+func f(x, y) -> int
+  -(x * y) - -(-x).y + -f(x, 1)
+end
+
+func pair(p (int, (bool, str)), q tuple(int)) -> tuple(int, int)
+  tuple(get(p, 0), get(q, 0))
+end
+
+let y = neg(a) in // why
+  y - -3 // result
+end // done
+`
+	f, err := parseSource("test.lang", strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	var buf bytes.Buffer
+	formatFile(&buf, f)
+	if got := buf.String(); got != source {
+		t.Errorf("got:\n%s\nwant:\n%s", got, source)
+	}
+}
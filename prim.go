@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strconv"
+)
+
+// prim.go describes psc/prim, a package which is built into the compiler.
+//
+// prim has sized integer types, prim.int32 and prim.int64,
+// and operations on them which map more or less directly onto
+// machine instructions. they are the building blocks for writing
+// things like bigints in the language itself (see bigint.txt).
+//
+// unlike ints, sized ints are untagged machine words.
+// an int32 is kept zero-extended to 64 bits.
+// arithmetic wraps around, and the operations which can carry
+// return the carry as a second result.
+//
+//	prim.add32(a, b) -> (sum, carry)
+//	prim.sub32(a, b) -> (difference, borrow)
+//	prim.mul32(a, b) -> (hi, lo)
+//	prim.divmod32(a, b) -> (quotient, remainder)
+//	prim.and32(a, b), prim.or32(a, b), prim.xor32(a, b)
+//	prim.shl32(a, n), prim.shr32(a, n), prim.shr32s(a, n)
+//	prim.eq32(a, b), prim.less32(a, b), prim.gt32(a, b) -> bool
+//	prim.toint32(int) -> int32
+//	prim.fromint32(int32) -> int, prim.fromint32s(int32) -> int
+//	prim.zero32, prim.one32
+//
+// and likewise for int64. everything treats its operands as unsigned
+// except for the functions whose names end in s.
+// shift counts are taken mod 32 (or 64), like the machine does,
+// and dividing by zero crashes the program.
+
+// prim has to be imported, like any other module:
+//
+//	import "psc/prim"
+//
+// the loader rewrites the name it is imported as to primPath.
+// a program can't bind psc/prim itself, so no local variable
+// can hide it the way one could hide prim.
+// primPackage is the name we use for it in error messages.
+const (
+	primPath    = "psc/prim"
+	primPackage = "prim"
+)
+
+// a primFunc is a function or constant in psc/prim
+type primFunc struct {
+	Op      string // the operation, without the size
+	Size    int    // 32 or 64
+	Params  []Type
+	Results []Type
+	Const   bool  // a constant rather than a function
+	Value   int64 // the value of a constant
+}
+
+// primFuncs maps the names of prim's members to their descriptions.
+// functions on sized ints are lowered to binops with the same name.
+var primFuncs = makePrimFuncs()
+
+func makePrimFuncs() map[string]*primFunc {
+	m := make(map[string]*primFunc)
+	for _, size := range []int{32, 64} {
+		var t Type = Int32T{}
+		if size == 64 {
+			t = Int64T{}
+		}
+		add := func(op string, params, results []Type) {
+			m[op+strconv.Itoa(size)] = &primFunc{Op: op, Size: size, Params: params, Results: results}
+		}
+		binary := []Type{t, t}
+		for _, op := range []string{"add", "sub", "mul", "divmod"} {
+			add(op, binary, []Type{t, t})
+		}
+		for _, op := range []string{"and", "or", "xor", "shl", "shr"} {
+			add(op, binary, []Type{t})
+		}
+		for _, op := range []string{"eq", "less", "gt"} {
+			add(op, binary, []Type{BoolT{}})
+		}
+		add("toint", []Type{IntT{}}, []Type{t})
+		add("fromint", []Type{t}, []Type{IntT{}})
+		m["shr"+strconv.Itoa(size)+"s"] = &primFunc{Op: "shrs", Size: size, Params: binary, Results: []Type{t}}
+		m["fromint"+strconv.Itoa(size)+"s"] = &primFunc{Op: "fromints", Size: size, Params: []Type{t}, Results: []Type{IntT{}}}
+		m["zero"+strconv.Itoa(size)] = &primFunc{Size: size, Results: []Type{t}, Const: true, Value: 0}
+		m["one"+strconv.Itoa(size)] = &primFunc{Size: size, Results: []Type{t}, Const: true, Value: 1}
+	}
+	return m
+}
+
+// primName returns the name of the member of prim that e refers to,
+// if e is prim.name (after loading; see above).
+// it doesn't check whether the member exists.
+func primName(s *scope, e Expr) (string, bool) {
+	d, ok := e.(*DotExpr)
+	if !ok {
+		return "", false
+	}
+	v, ok := d.Left.(*VarExpr)
+	if !ok || v.Name != primPath || s.has(v.Name) {
+		return "", false
+	}
+	return d.Right, true
+}
+
+// primType looks up a sized integer type by the name
+// it is written with in type annotations, like prim.int32,
+// after the loader has rewritten it to psc/prim.int32
+func primType(name string) (Type, bool) {
+	switch name {
+	case primPath + ".int32":
+		return Int32T{}, true
+	case primPath + ".int64":
+		return Int64T{}, true
+	}
+	return nil, false
+}
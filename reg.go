@@ -91,6 +91,13 @@ func regalloc(f *asmProg) map[variable]int {
 	// Build conflict graph
 	V := []variable{}
 	G := make(map[variable]*colorNode)
+	// machine registers get precolored nodes up front,
+	// so that a register which is live before it is ever assigned
+	// (like the argument registers on entry to a function)
+	// still conflicts with variables defined while it is live
+	for r, reg := range params.Registers {
+		G[asmArg{Reg: reg}] = &colorNode{Var: asmArg{Reg: reg}, Reg: r, Order: -r}
+	}
 	for _, b := range f.blocks {
 		L := L[b]
 		for i := range b.code {
@@ -156,11 +163,15 @@ func regalloc(f *asmProg) map[variable]int {
 				for _, v := range L[i+1] {
 					other := G[v]
 					if other == nil {
-						fmt.Println("regalloc: variable not in graph:", v)
+						if verbose {
+							fmt.Println("regalloc: variable not in graph:", v)
+						}
 						continue
 					}
 					if f.gcable[other.Var] {
-						fmt.Println("regalloc: must spill", other.Var)
+						if verbose {
+							fmt.Println("regalloc: must spill", other.Var)
+						}
 						// gc-able variables (i.e. tuples)
 						// can't live across an allocation,
 						// and any call might make an allocation,
@@ -179,6 +190,8 @@ func regalloc(f *asmProg) map[variable]int {
 						}
 					}
 				}
+			case asmTailCall:
+				// nothing is live afterwards
 			case asmJump:
 				// TODO: treat as a mov between its args
 				// and the target block's params
@@ -310,17 +323,19 @@ func (l *asmOp) dest() *asmArg {
 	switch l.tag {
 	case asmInstr:
 		switch l.variant {
-		case "idiv":
+		case "idiv", "mull", "mulq", "divl", "divq":
 			return &asmArg{Reg: "rdx"} // and rax
-		case "imul":
-			return &asmArg{Reg: "rdx"} // and rax
-		case "cmpq":
+		case "cmpq", "testq":
 			// nothing
 		case "cqto":
 			return &asmArg{Reg: "rdx"}
+		case "ret":
+			// nothing
 		default:
 			return &l.args[0]
 		}
+	case asmCall:
+		return &asmArg{Reg: "rdx"} // and rax (the results)
 	}
 	return nil
 }
@@ -329,7 +344,7 @@ func (l *asmOp) src() []asmArg {
 	switch l.tag {
 	case asmInstr:
 		switch l.variant {
-		case "movq", "movzbq":
+		case "movq", "movzbq", "leaq":
 			return l.args[1:]
 		case "addq", "subq", "cmpq":
 			return l.args[0:]
@@ -338,6 +353,8 @@ func (l *asmOp) src() []asmArg {
 		default:
 			return l.args[0:]
 		}
+	case asmCall, asmTailCall:
+		return l.args
 	}
 	return nil
 }
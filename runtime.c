@@ -1,20 +1,28 @@
 // +build ignore
 
+#include <stddef.h>
 #include <stdint.h>
 #include <stdlib.h>
 #include <stdio.h>
+#include <string.h>
 #include <assert.h>
 
+// psc_main runs the program and prints its result
 int psc_main(void);
 
 int main(int argc, char**argv) {
 	(void)argc;
 	(void)argv;
-	int result = psc_main();
-	printf("%d\n", result);
+	psc_main();
 	return 0;
 }
 
+/* multiple return values */
+
+// a function returns its first two results in rax and rdx,
+// and the rest in psc_retbuf, which the compiler sizes to fit
+// the most results any function returns.
+// see resultLocs and ConvertProg in asm.go
 
 /* cheney 2-space copying collector */
 
@@ -22,13 +30,16 @@ int main(int argc, char**argv) {
 EXPORT void psc_gcinit(size_t stack_size, size_t heap_size);
 EXPORT void psc_gccollect(void** rootstack_ptr);
 EXPORT void psc_gcgetsize(size_t* heap_inuse_size, size_t* heap_size);
+EXPORT void psc_stack_overflow(void);
 EXPORT struct tuple* psc_newtuple(void** rootstack_ptr, int nelem, uint64_t ptrmask);
+EXPORT struct tuple* psc_newbigtuple(void** rootstack_ptr, uint64_t nelem);
 void *free_ptr;
 void *fromspace_begin;
 void *fromspace_end;
 void *tospace_begin;
 void *tospace_end;
 EXPORT void **rootstack_begin;
+EXPORT void **rootstack_limit;
 
 int debug = 1;
 
@@ -40,6 +51,9 @@ void psc_gcinit(size_t stack_size, size_t heap_size)
 	stack_size += -stack_size&63;
 	heap_size += -heap_size&63;
 	rootstack_begin = calloc(stack_size, 1);
+	// the compiled code checks the limit when it pushes roots.
+	// the runtime functions use a few slots past the top without checking
+	rootstack_limit = (void**)((char*)rootstack_begin + stack_size - 4096);
 	fromspace_begin = calloc(heap_size, 1);
 	fromspace_end = (char*)fromspace_begin + heap_size;
 	tospace_begin = calloc(heap_size, 1);
@@ -53,6 +67,14 @@ void psc_gcgetsize(size_t *heap_inuse_size, size_t *heap_size)
 	if(heap_inuse_size) *heap_inuse_size = (size_t)(free_ptr - fromspace_begin);
 }
 
+// psc_stack_overflow is called by a procedure whose roots
+// would go past rootstack_limit
+void psc_stack_overflow(void)
+{
+	fprintf(stderr, "stack overflow\n");
+	abort();
+}
+
 // the size and layout of this struct is known to the compiler
 // there is also a copy in test_tuples.c
 struct tuple {
@@ -62,6 +84,158 @@ struct tuple {
 	uintptr_t elem[]; // followed by len x uint64 values
 };
 
+// the len of a bigint. no tuple is this long
+#define BIGINT 0xff
+
+// a bigint is an int which doesn't fit in a small int.
+// it has the same header as a tuple, so that the collector
+// can tell them apart; it doesn't contain any pointers.
+struct bigint {
+	uint8_t kind; // always BIGINT
+	uint8_t neg; // whether the value is negative
+	uint8_t pad[2];
+	uint32_t nlimbs; // number of limbs in the magnitude
+	uint8_t unused[56];
+	struct bigint* forwarding; // same as in a tuple
+	uint32_t limb[]; // the magnitude, least significant limb first
+};
+
+_Static_assert(offsetof(struct bigint, forwarding) == offsetof(struct tuple, forwarding),
+	"bigint and tuple headers must match");
+
+// the kind of a string. no tuple is this long either
+#define STRING 0xfe
+
+// a string is an immutable sequence of bytes.
+// like a bigint, it has the same header as a tuple and no pointers.
+// string literals have the same layout too, but they are in the
+// program's data instead of the heap (see ConvertString in asm.go),
+// so the collector leaves them alone.
+struct string {
+	uint8_t kind; // always STRING
+	uint8_t pad[7];
+	uint64_t len; // number of bytes
+	uint8_t unused[48];
+	struct string* forwarding; // same as in a tuple
+	char data[]; // followed by len bytes, padded to a multiple of 8
+};
+
+_Static_assert(offsetof(struct string, forwarding) == offsetof(struct tuple, forwarding),
+	"string and tuple headers must match");
+
+// the kind of an array. no tuple is this long either
+#define ARRAY 0xfd
+
+// an array holds the elements of a list.
+// a list is a tuple of its length (a small int) and its array,
+// so that appending can replace the array with a bigger one.
+// the collector only looks at the elements whose bit is set in isptr,
+// and then it looks at all of them, even unused slots, which are kept zeroed.
+// element i has bit i%stride: a list's elements all have bit 0,
+// but a dict's entries are (hash, key, value) and the values can be
+// raw ints even if the keys are pointers.
+struct array {
+	uint8_t kind; // always ARRAY
+	uint8_t isptr; // which elements might be pointers
+	uint8_t stride; // how many elements isptr has bits for
+	uint8_t pad[5];
+	uint64_t cap; // number of elements there is room for
+	uint8_t unused[48];
+	struct array* forwarding; // same as in a tuple
+	uintptr_t elem[]; // followed by cap x uint64 values
+};
+
+_Static_assert(offsetof(struct array, forwarding) == offsetof(struct tuple, forwarding),
+	"array and tuple headers must match");
+
+// the kind of a big tuple. no tuple is this long either
+#define BIGTUPLE 0xfc
+
+// a big tuple is a tuple with more elements than there is room
+// for in the header's isptr. instead, the elements are followed
+// by a bitmap of which ones are pointers, 64 to a word.
+// the elements are at the same offset as in a tuple, so the compiler
+// gets and sets them the same way (see newBigTuple in lower.go).
+struct bigtuple {
+	uint8_t kind; // always BIGTUPLE
+	uint8_t pad[7];
+	uint64_t len; // number of elements
+	uint8_t unused[48];
+	struct bigtuple* forwarding; // same as in a tuple
+	uintptr_t elem[]; // followed by len x uint64 values, then the bitmap
+};
+
+_Static_assert(offsetof(struct bigtuple, forwarding) == offsetof(struct tuple, forwarding),
+	"bigtuple and tuple headers must match");
+_Static_assert(offsetof(struct bigtuple, elem) == offsetof(struct tuple, elem),
+	"bigtuple and tuple elements must line up");
+
+// the number of words in a big tuple's pointer bitmap
+static uint64_t bigtuple_masklen(uint64_t len)
+{
+	return (len + 63) / 64;
+}
+
+// objsize returns the size of a heap object in bytes
+static size_t objsize(struct tuple* t)
+{
+	if (t->len == BIGINT) {
+		struct bigint* b = (struct bigint*)t;
+		return sizeof(struct bigint) + (b->nlimbs*sizeof(uint32_t) + 7) / 8 * 8;
+	}
+	if (t->len == STRING) {
+		struct string* s = (struct string*)t;
+		return sizeof(struct string) + (s->len + 7) / 8 * 8;
+	}
+	if (t->len == ARRAY) {
+		struct array* a = (struct array*)t;
+		return sizeof(struct array) + a->cap*sizeof(uintptr_t);
+	}
+	if (t->len == BIGTUPLE) {
+		struct bigtuple* bt = (struct bigtuple*)t;
+		return sizeof(struct bigtuple) + (bt->len + bigtuple_masklen(bt->len))*sizeof(uintptr_t);
+	}
+	assert(t->len <= 63);
+	return sizeof(struct tuple) + t->len*sizeof(uintptr_t);
+}
+
+// is_heap_ptr reports whether v points to an object in the heap.
+// roots and tuple elements can also hold small ints (which are odd),
+// bools, and code pointers, so the collector has to check.
+static int is_heap_ptr(uintptr_t v)
+{
+	return (v&1) == 0 && fromspace_begin <= (void*)v && (void*)v < fromspace_end;
+}
+
+// forward returns the new address of an object.
+// if the object hasn't been copied to tospace yet, it is copied
+// to the end of the queue. values which don't point to the heap
+// are returned unchanged.
+//
+// this assumes an absence of interior pointers
+// (any references to a tuple must point to the beginning of that tuple,
+// not to an element within it)
+static uintptr_t forward(uintptr_t v, void** end_ptr)
+{
+	if (!is_heap_ptr(v)) {
+		return v;
+	}
+	struct tuple* oldptr = (struct tuple*)v;
+	if (oldptr->forwarding == NULL) {
+		// copy the object to tospace.
+		// this is a shallow copy - we don't recursively copy
+		// any other tuples yet, nor do we update any pointers
+		size_t size = objsize(oldptr);
+		struct tuple* newptr = *end_ptr;
+		assert((char*)*end_ptr + size <= (char*)tospace_end);
+		memcpy(newptr, oldptr, size);
+		assert(newptr->forwarding == NULL);
+		oldptr->forwarding = newptr;
+		*end_ptr = (char*)*end_ptr + size;
+	}
+	return (uintptr_t)oldptr->forwarding;
+}
+
 // Collects unreachable objects. Copies the heap from fromspace to tospace
 void psc_gccollect(void** rootstack_ptr)
 {
@@ -76,88 +250,45 @@ void psc_gccollect(void** rootstack_ptr)
 
 	// first step:
 	// iterate over the root stack
-	// copy each tuple to tospace
+	// copy each object to tospace and update the root.
+	// the rootstack can contain duplicate pointers,
+	// but forward only copies each object once
 	for (void **p = rootstack_begin; p < rootstack_ptr; p++) {
-		struct tuple* oldptr = *p;
-		struct tuple* newptr = end_ptr;
-		if (oldptr == NULL) {
-			continue;
-		}
-		assert(fromspace_begin <= (void*)oldptr && (void*)oldptr < fromspace_end);
-		// the rootstack can contain duplicate pointers,
-		// so we have to be prepared for that
-		if (oldptr->forwarding != NULL) {
-			continue;
-		}
-		// copy tuple to tospace
-		// this is a shallow copy - we don't recursively copy
-		// any other tuples yet, nor do we update any pointers
-		*newptr = *oldptr;
-		assert(newptr->len >= 0);
-		assert(newptr->len <= 63);
-		assert(newptr->forwarding == NULL);
-		for (int i = 0; i < oldptr->len; i++) {
-			newptr->elem[i] = oldptr->elem[i];
-		}
-		oldptr->forwarding = newptr;
-		end_ptr = (struct tuple*)end_ptr + 1;
-		end_ptr = (uintptr_t*)end_ptr + oldptr->len;
+		*p = (void*)forward((uintptr_t)*p, &end_ptr);
 	}
 
 	// graph copy:
 	// use tospace as both our queue of to-be-copied items
 	// and as our destination for copied items.
-	//
-	// oh, interesting. this algorithm assumes an absence of interior pointers
-	// (any references to a tuple must point to the beginning of that tuple,
-	// not to an element within it)
-	while (scan_ptr < end_ptr && scan_ptr < tospace_end) {
+	while (scan_ptr < end_ptr) {
 		struct tuple* cur = scan_ptr;
 		// walk over the current tuple looking for pointers
-		// they should all point to the old space
-		// if the pointed-at tuple has a forwarding address, update this pointer
-		// otherwise copy the old object to the end of the queue (and then update the pointer)
-		assert(cur->len >= 0);
-		assert(cur->len <= 63);
-		for (int i = 0; i < cur->len; i++) {
-			if (!cur->isptr[i]) {
-				continue;
+		// they should all point to the old space.
+		// bigints and strings don't have any
+		if (cur->len == ARRAY) {
+			struct array* a = (struct array*)cur;
+			for (uint64_t i = 0; a->isptr && i < a->cap; i++) {
+				if ((a->isptr >> (i % a->stride)) & 1) {
+					a->elem[i] = forward(a->elem[i], &end_ptr);
+				}
 			}
-			struct tuple* oldptr = (struct tuple*)cur->elem[i];
-			if (oldptr == NULL) {
-				continue;
+		} else if (cur->len == BIGTUPLE) {
+			struct bigtuple* bt = (struct bigtuple*)cur;
+			uint64_t* mask = &bt->elem[bt->len];
+			for (uint64_t i = 0; i < bt->len; i++) {
+				if ((mask[i/64]>>(i%64))&1) {
+					bt->elem[i] = forward(bt->elem[i], &end_ptr);
+				}
 			}
-			//if((tospace_begin <= (void*)oldptr && (void*)oldptr < tospace_end)){
-			//	printf("tospace =   %p .. %p\n", tospace_begin, tospace_end);
-			//	printf("fromspace = %p .. %p\n", fromspace_begin, fromspace_end);
-			//	printf("cur       = %p\n", cur);
-			//	printf("cur->elem[%d] = %p\n", i, oldptr);
-			//}
-			assert(!(tospace_begin <= (void*)oldptr && (void*)oldptr < tospace_end));
-			assert(fromspace_begin <= (void*)oldptr && (void*)oldptr < fromspace_end);
-			struct tuple* newptr = oldptr->forwarding;
-			if (newptr == NULL) {
-				// copy tuple to tospace (shallow copy)
-				newptr = end_ptr;
-				*newptr = *oldptr;
-				assert(newptr->len >= 0);
-				assert(newptr->len <= 63);
-				assert(newptr->forwarding == NULL);
-				for (int j = 0; j < oldptr->len; j++) {
-					newptr->elem[j] = oldptr->elem[j];
+		} else if (cur->len != BIGINT && cur->len != STRING) {
+			for (int i = 0; i < cur->len; i++) {
+				if (cur->isptr[i]) {
+					cur->elem[i] = forward(cur->elem[i], &end_ptr);
 				}
-				// advance end_ptr
-				end_ptr = (struct tuple*)end_ptr + 1;
-				end_ptr = (uintptr_t*)end_ptr + oldptr->len;
-				// set forwarding address
-				oldptr->forwarding = newptr;
 			}
-			// update cur
-			cur->elem[i] = (uintptr_t)newptr;
 		}
 		// advance scan_ptr
-		scan_ptr = (struct tuple*)scan_ptr + 1;
-		scan_ptr = (uintptr_t*)scan_ptr + cur->len;
+		scan_ptr = (char*)scan_ptr + objsize(cur);
 		assert(tospace_begin <= scan_ptr && scan_ptr <= tospace_end);
 	}
 
@@ -171,14 +302,6 @@ void psc_gccollect(void** rootstack_ptr)
 	tospace_end = tmp;
 
 	free_ptr = end_ptr;
-
-	// update root pointers
-	// XXX should we do this earlier?
-	for (void **p = rootstack_begin; p < rootstack_ptr; p++) {
-		struct tuple *t = *p;
-		assert(t->forwarding != NULL);
-		*p = t->forwarding;
-	}
 }
 
 // allocate bytes_to_alloc bytes of memory from the GC heap.
@@ -245,3 +368,882 @@ struct tuple* psc_newtuple(void** rootstack, int nelem, uint64_t ptrmask)
 	}
 	return new;
 }
+
+// psc_newbigtuple allocates a big tuple.
+// the elements and the bitmap start out zeroed;
+// the compiler fills them in before anything else is allocated.
+struct tuple* psc_newbigtuple(void** rootstack, uint64_t nelem)
+{
+	size_t size = sizeof(struct bigtuple) + (nelem + bigtuple_masklen(nelem))*sizeof(uintptr_t);
+	struct bigtuple* new = psc_alloc(rootstack, size);
+	memset(new, 0, size);
+	new->kind = BIGTUPLE;
+	new->len = nelem;
+	return (struct tuple*)new;
+}
+
+/* integers */
+
+// an int is either a small int or a pointer to a bigint.
+// a small int n is stored as n<<1|1, so small ints are always odd
+// and pointers are always even. the compiler does arithmetic on
+// small ints inline and calls the functions below when either
+// operand is a bigint or the result overflows.
+//
+// results which fit in a small int are always returned as one,
+// so two ints are equal iff they are the same word or they are
+// both bigints with the same value.
+
+#define SMALL_MIN (-((intptr_t)1<<62))
+#define SMALL_MAX (((intptr_t)1<<62) - 1)
+
+EXPORT uintptr_t psc_int_add(void** rootstack, uintptr_t a, uintptr_t b);
+EXPORT uintptr_t psc_int_sub(void** rootstack, uintptr_t a, uintptr_t b);
+EXPORT uintptr_t psc_int_mul(void** rootstack, uintptr_t a, uintptr_t b);
+EXPORT uintptr_t psc_int_div(void** rootstack, uintptr_t a, uintptr_t b);
+EXPORT intptr_t psc_int_cmp(void** rootstack, uintptr_t a, uintptr_t b);
+EXPORT uint64_t psc_int_lo32(void** rootstack, uintptr_t v);
+EXPORT uint64_t psc_int_lo64(void** rootstack, uintptr_t v);
+EXPORT uintptr_t psc_int_from_uint64(void** rootstack, uint64_t v);
+EXPORT uintptr_t psc_int_from_int64(void** rootstack, uint64_t v);
+EXPORT void psc_printint(uintptr_t v);
+EXPORT void psc_printbool(uintptr_t v);
+EXPORT uintptr_t psc_str_concat(void** rootstack, uintptr_t a, uintptr_t b);
+EXPORT intptr_t psc_str_cmp(void** rootstack, uintptr_t a, uintptr_t b);
+EXPORT void psc_printstr(uintptr_t v);
+EXPORT uintptr_t psc_list_new(void** rootstack, uint64_t cap);
+EXPORT uintptr_t psc_list_append(void** rootstack, uintptr_t list, uintptr_t x, uint64_t isptr);
+EXPORT uintptr_t psc_list_get(void** rootstack, uintptr_t list, uintptr_t i);
+EXPORT uintptr_t psc_dict_new(void** rootstack, uint64_t n);
+EXPORT uintptr_t psc_dict_get(void** rootstack, uintptr_t d, uintptr_t key);
+EXPORT uintptr_t psc_dict_set(void** rootstack, uintptr_t d, uintptr_t key, uintptr_t val, uint64_t isptr);
+EXPORT uintptr_t psc_dict_delete(void** rootstack, uintptr_t d, uintptr_t key);
+EXPORT uintptr_t psc_dict_contains(void** rootstack, uintptr_t d, uintptr_t key);
+EXPORT uintptr_t psc_dict_keys(void** rootstack, uintptr_t d, uint64_t isptr);
+
+static int is_small(uintptr_t v) { return (v&1) != 0; }
+static intptr_t small_value(uintptr_t v) { return (intptr_t)v >> 1; }
+static uintptr_t make_small(intptr_t n) { return ((uintptr_t)n << 1) | 1; }
+
+// newbigint allocates a zeroed bigint with room for nlimbs limbs
+static struct bigint* newbigint(void** rootstack, uint32_t nlimbs)
+{
+	size_t size = sizeof(struct bigint) + (nlimbs*sizeof(uint32_t) + 7) / 8 * 8;
+	struct bigint* new = psc_alloc(rootstack, size);
+	if (new == NULL) {
+		fprintf(stderr, "out of memory\n");
+		abort();
+	}
+	memset(new, 0, size);
+	new->kind = BIGINT;
+	new->nlimbs = nlimbs;
+	return new;
+}
+
+// is_int reports whether v is a small int or points to a bigint.
+static int is_int(uintptr_t v)
+{
+	return is_small(v) || (is_heap_ptr(v) && ((struct bigint*)v)->kind == BIGINT);
+}
+
+// a num is a sign and magnitude view of either kind of int
+struct num {
+	int neg;
+	uint32_t n;
+	uint32_t* limb;
+	uint32_t small[2];
+};
+
+// unpack fills in x from v.
+// x points into the bigint, so don't allocate while using it
+static void unpack(uintptr_t v, struct num* x)
+{
+	if (is_small(v)) {
+		intptr_t n = small_value(v);
+		uint64_t mag = n < 0 ? -(uint64_t)n : (uint64_t)n;
+		x->neg = n < 0;
+		x->small[0] = (uint32_t)mag;
+		x->small[1] = (uint32_t)(mag>>32);
+		x->limb = x->small;
+		x->n = x->small[1] ? 2 : x->small[0] ? 1 : 0;
+	} else {
+		struct bigint* b = (struct bigint*)v;
+		assert(b->kind == BIGINT);
+		x->neg = b->neg;
+		x->n = b->nlimbs;
+		x->limb = b->limb;
+	}
+}
+
+// nlimbs returns the number of limbs in the magnitude of v
+static uint32_t nlimbs(uintptr_t v)
+{
+	struct num x;
+	unpack(v, &x);
+	return x.n;
+}
+
+// finish trims leading zeros from r and returns it as an int,
+// converting it to a small int if it fits
+static uintptr_t finish(struct bigint* r)
+{
+	while (r->nlimbs > 0 && r->limb[r->nlimbs-1] == 0) {
+		r->nlimbs--;
+	}
+	if (r->nlimbs <= 2) {
+		uint64_t mag = 0;
+		if (r->nlimbs >= 1) {
+			mag = r->limb[0];
+		}
+		if (r->nlimbs == 2) {
+			mag |= (uint64_t)r->limb[1] << 32;
+		}
+		if (!r->neg && mag <= (uint64_t)SMALL_MAX) {
+			return make_small((intptr_t)mag);
+		}
+		if (r->neg && mag <= -(uint64_t)SMALL_MIN) {
+			return make_small((intptr_t)-mag);
+		}
+	}
+	if (r->nlimbs == 0) {
+		r->neg = 0;
+	}
+	return (uintptr_t)r;
+}
+
+// cmp_mag compares the magnitudes a and b
+static int cmp_mag(const uint32_t* a, uint32_t an, const uint32_t* b, uint32_t bn)
+{
+	while (an > 0 && a[an-1] == 0) an--;
+	while (bn > 0 && b[bn-1] == 0) bn--;
+	if (an != bn) {
+		return an < bn ? -1 : 1;
+	}
+	for (uint32_t i = an; i-- > 0; ) {
+		if (a[i] != b[i]) {
+			return a[i] < b[i] ? -1 : 1;
+		}
+	}
+	return 0;
+}
+
+// add_mag sets z = a + b. z must have room for max(an, bn)+1 limbs
+static void add_mag(uint32_t* z, const uint32_t* a, uint32_t an, const uint32_t* b, uint32_t bn)
+{
+	uint64_t carry = 0;
+	uint32_t n = an > bn ? an : bn;
+	for (uint32_t i = 0; i < n; i++) {
+		uint64_t s = carry;
+		if (i < an) s += a[i];
+		if (i < bn) s += b[i];
+		z[i] = (uint32_t)s;
+		carry = s >> 32;
+	}
+	z[n] = (uint32_t)carry;
+}
+
+// sub_mag sets z = a - b. a must be at least as large as b
+static void sub_mag(uint32_t* z, const uint32_t* a, uint32_t an, const uint32_t* b, uint32_t bn)
+{
+	int64_t borrow = 0;
+	for (uint32_t i = 0; i < an; i++) {
+		int64_t d = (int64_t)a[i] - borrow;
+		if (i < bn) d -= b[i];
+		borrow = d < 0;
+		z[i] = (uint32_t)(d + (borrow << 32));
+	}
+	assert(borrow == 0);
+}
+
+static uintptr_t addsub(void** rootstack, uintptr_t a, uintptr_t b, int negb)
+{
+	uint32_t an = nlimbs(a), bn = nlimbs(b);
+	rootstack[0] = (void*)a;
+	rootstack[1] = (void*)b;
+	struct bigint* r = newbigint(rootstack+2, (an > bn ? an : bn) + 1);
+	a = (uintptr_t)rootstack[0];
+	b = (uintptr_t)rootstack[1];
+
+	struct num x, y;
+	unpack(a, &x);
+	unpack(b, &y);
+	y.neg ^= negb;
+	if (x.neg == y.neg) {
+		add_mag(r->limb, x.limb, x.n, y.limb, y.n);
+		r->neg = x.neg;
+	} else if (cmp_mag(x.limb, x.n, y.limb, y.n) >= 0) {
+		sub_mag(r->limb, x.limb, x.n, y.limb, y.n);
+		r->neg = x.neg;
+	} else {
+		sub_mag(r->limb, y.limb, y.n, x.limb, x.n);
+		r->neg = y.neg;
+	}
+	return finish(r);
+}
+
+uintptr_t psc_int_add(void** rootstack, uintptr_t a, uintptr_t b)
+{
+	return addsub(rootstack, a, b, 0);
+}
+
+uintptr_t psc_int_sub(void** rootstack, uintptr_t a, uintptr_t b)
+{
+	return addsub(rootstack, a, b, 1);
+}
+
+uintptr_t psc_int_mul(void** rootstack, uintptr_t a, uintptr_t b)
+{
+	uint32_t an = nlimbs(a), bn = nlimbs(b);
+	rootstack[0] = (void*)a;
+	rootstack[1] = (void*)b;
+	struct bigint* r = newbigint(rootstack+2, an + bn);
+	a = (uintptr_t)rootstack[0];
+	b = (uintptr_t)rootstack[1];
+
+	struct num x, y;
+	unpack(a, &x);
+	unpack(b, &y);
+	for (uint32_t i = 0; i < x.n; i++) {
+		uint64_t carry = 0;
+		for (uint32_t j = 0; j < y.n; j++) {
+			uint64_t t = (uint64_t)x.limb[i]*y.limb[j] + r->limb[i+j] + carry;
+			r->limb[i+j] = (uint32_t)t;
+			carry = t >> 32;
+		}
+		r->limb[i+y.n] = (uint32_t)carry;
+	}
+	r->neg = x.neg ^ y.neg;
+	return finish(r);
+}
+
+// psc_int_div returns a/b, rounded towards zero
+uintptr_t psc_int_div(void** rootstack, uintptr_t a, uintptr_t b)
+{
+	if (nlimbs(b) == 0) {
+		fprintf(stderr, "integer divide by zero\n");
+		abort();
+	}
+	uint32_t an = nlimbs(a), bn = nlimbs(b);
+	rootstack[0] = (void*)a;
+	rootstack[1] = (void*)b;
+	struct bigint* q = newbigint(rootstack+2, an);
+	a = (uintptr_t)rootstack[0];
+	b = (uintptr_t)rootstack[1];
+
+	struct num x, y;
+	unpack(a, &x);
+	unpack(b, &y);
+
+	// binary long division.
+	// slow, but simple
+	uint32_t* rem = calloc(bn+1, sizeof(uint32_t));
+	assert(rem != NULL);
+	for (uint32_t i = an*32; i-- > 0; ) {
+		// rem = rem<<1 | bit i of x
+		uint32_t carry = (x.limb[i/32] >> (i%32)) & 1;
+		for (uint32_t j = 0; j <= bn; j++) {
+			uint32_t next = rem[j] >> 31;
+			rem[j] = rem[j]<<1 | carry;
+			carry = next;
+		}
+		if (cmp_mag(rem, bn+1, y.limb, y.n) >= 0) {
+			sub_mag(rem, rem, bn+1, y.limb, y.n);
+			q->limb[i/32] |= (uint32_t)1 << (i%32);
+		}
+	}
+	free(rem);
+	q->neg = x.neg ^ y.neg;
+	return finish(q);
+}
+
+// psc_int_cmp returns -1, 0, or 1 if a is less than, equal to, or greater than b.
+// the result is a raw integer, not a small int
+intptr_t psc_int_cmp(void** rootstack, uintptr_t a, uintptr_t b)
+{
+	(void)rootstack;
+	// an == on values of unknown type can get here with bools or tuples,
+	// which are compared by identity
+	if ((is_small(a) && is_small(b)) || !is_int(a) || !is_int(b)) {
+		return (intptr_t)a < (intptr_t)b ? -1 : (intptr_t)a > (intptr_t)b;
+	}
+	struct num x, y;
+	unpack(a, &x);
+	unpack(b, &y);
+	if (x.neg != y.neg) {
+		return x.neg ? -1 : 1;
+	}
+	int c = cmp_mag(x.limb, x.n, y.limb, y.n);
+	return x.neg ? -c : c;
+}
+
+// conversions to and from the sized ints in psc/prim.
+// converting an int to a sized int keeps the low bits
+// of its two's complement representation.
+
+uint64_t psc_int_lo64(void** rootstack, uintptr_t v)
+{
+	(void)rootstack;
+	struct num x;
+	unpack(v, &x);
+	uint64_t mag = 0;
+	if (x.n >= 1) {
+		mag = x.limb[0];
+	}
+	if (x.n >= 2) {
+		mag |= (uint64_t)x.limb[1] << 32;
+	}
+	return x.neg ? -mag : mag;
+}
+
+uint64_t psc_int_lo32(void** rootstack, uintptr_t v)
+{
+	return (uint32_t)psc_int_lo64(rootstack, v);
+}
+
+// from_mag makes an int with the given sign and magnitude
+static uintptr_t from_mag(void** rootstack, int neg, uint64_t mag)
+{
+	struct bigint* r = newbigint(rootstack, 2);
+	r->neg = neg;
+	r->limb[0] = (uint32_t)mag;
+	r->limb[1] = (uint32_t)(mag>>32);
+	return finish(r);
+}
+
+uintptr_t psc_int_from_uint64(void** rootstack, uint64_t v)
+{
+	if (v <= (uint64_t)SMALL_MAX) {
+		return make_small((intptr_t)v);
+	}
+	return from_mag(rootstack, 0, v);
+}
+
+uintptr_t psc_int_from_int64(void** rootstack, uint64_t v)
+{
+	intptr_t n = (intptr_t)v;
+	if (SMALL_MIN <= n && n <= SMALL_MAX) {
+		return make_small(n);
+	}
+	return from_mag(rootstack, n < 0, n < 0 ? -v : v);
+}
+
+// int_text_size returns the size of a buffer
+// which is big enough for format_int(v)
+static size_t int_text_size(uintptr_t v)
+{
+	// each limb is at most 10 digits.
+	// leave room for a sign and a NUL too
+	return nlimbs(v)*10 + 3;
+}
+
+// format_int writes v in decimal to buf, followed by a NUL,
+// and returns the number of bytes before the NUL
+static size_t format_int(uintptr_t v, char* buf)
+{
+	if (is_small(v)) {
+		return sprintf(buf, "%ld", (long)small_value(v));
+	}
+	struct num x;
+	unpack(v, &x);
+
+	// divide a copy of the magnitude by 10^9 until it's zero,
+	// collecting the remainders
+	uint32_t n = x.n;
+	uint32_t* mag = malloc(n*sizeof(uint32_t));
+	uint32_t* chunks = malloc((n*2+1)*sizeof(uint32_t));
+	assert(mag != NULL && chunks != NULL);
+	memcpy(mag, x.limb, n*sizeof(uint32_t));
+	uint32_t nchunks = 0;
+	while (n > 0) {
+		uint64_t rem = 0;
+		for (uint32_t i = n; i-- > 0; ) {
+			uint64_t cur = rem<<32 | mag[i];
+			mag[i] = (uint32_t)(cur / 1000000000);
+			rem = cur % 1000000000;
+		}
+		chunks[nchunks++] = (uint32_t)rem;
+		while (n > 0 && mag[n-1] == 0) {
+			n--;
+		}
+	}
+	char* p = buf;
+	if (x.neg) {
+		*p++ = '-';
+	}
+	p += sprintf(p, "%u", nchunks > 0 ? chunks[nchunks-1] : 0);
+	for (uint32_t i = nchunks-1; i-- > 0; ) {
+		p += sprintf(p, "%09u", chunks[i]);
+	}
+	free(mag);
+	free(chunks);
+	return p - buf;
+}
+
+void psc_printint(uintptr_t v)
+{
+	char* buf = malloc(int_text_size(v));
+	assert(buf != NULL);
+	format_int(v, buf);
+	printf("%s\n", buf);
+	free(buf);
+}
+
+void psc_printbool(uintptr_t v)
+{
+	printf("%s\n", v ? "true" : "false");
+}
+
+/* strings */
+
+// newstring allocates a string with room for len bytes
+static struct string* newstring(void** rootstack, uint64_t len)
+{
+	size_t size = sizeof(struct string) + (len + 7) / 8 * 8;
+	struct string* new = psc_alloc(rootstack, size);
+	if (new == NULL) {
+		fprintf(stderr, "out of memory\n");
+		abort();
+	}
+	memset(new, 0, size);
+	new->kind = STRING;
+	new->len = len;
+	return new;
+}
+
+// int_to_str converts an int to a string in decimal.
+// v may be a bigint, so it's formatted before allocating
+static struct string* int_to_str(void** rootstack, uintptr_t v)
+{
+	char* buf = malloc(int_text_size(v));
+	assert(buf != NULL);
+	size_t n = format_int(v, buf);
+	struct string* s = newstring(rootstack, n);
+	memcpy(s->data, buf, n);
+	free(buf);
+	return s;
+}
+
+// psc_str_concat returns a new string containing a followed by b.
+// either of them may be an int, which is converted to a string first.
+uintptr_t psc_str_concat(void** rootstack, uintptr_t a, uintptr_t b)
+{
+	rootstack[0] = (void*)a;
+	rootstack[1] = (void*)b;
+	for (int i = 0; i < 2; i++) {
+		if (is_int((uintptr_t)rootstack[i])) {
+			rootstack[i] = int_to_str(rootstack+2, (uintptr_t)rootstack[i]);
+		}
+	}
+	struct string* x = rootstack[0];
+	struct string* y = rootstack[1];
+	struct string* r = newstring(rootstack+2, x->len + y->len);
+	x = rootstack[0];
+	y = rootstack[1];
+	memcpy(r->data, x->data, x->len);
+	memcpy(r->data + x->len, y->data, y->len);
+	return (uintptr_t)r;
+}
+
+// psc_str_cmp compares the bytes of two strings.
+// like psc_int_cmp, it returns -1, 0, or 1 as a raw integer
+intptr_t psc_str_cmp(void** rootstack, uintptr_t a, uintptr_t b)
+{
+	(void)rootstack;
+	struct string* x = (struct string*)a;
+	struct string* y = (struct string*)b;
+	uint64_t n = x->len < y->len ? x->len : y->len;
+	int c = memcmp(x->data, y->data, n);
+	if (c != 0) {
+		return c < 0 ? -1 : 1;
+	}
+	return x->len < y->len ? -1 : x->len > y->len;
+}
+
+void psc_printstr(uintptr_t v)
+{
+	struct string* s = (struct string*)v;
+	fwrite(s->data, 1, s->len, stdout);
+	printf("\n");
+}
+
+/* lists */
+
+// newarray allocates a zeroed array with room for cap elements
+static struct array* newarray(void** rootstack, uint64_t cap)
+{
+	size_t size = sizeof(struct array) + cap*sizeof(uintptr_t);
+	struct array* new = psc_alloc(rootstack, size);
+	if (new == NULL) {
+		fprintf(stderr, "out of memory\n");
+		abort();
+	}
+	memset(new, 0, size);
+	new->kind = ARRAY;
+	new->stride = 1;
+	new->cap = cap;
+	return new;
+}
+
+// psc_list_new returns an empty list with room for cap elements.
+// cap is a raw integer
+uintptr_t psc_list_new(void** rootstack, uint64_t cap)
+{
+	rootstack[0] = newarray(rootstack, cap);
+	struct tuple* l = psc_newtuple(rootstack+1, 2, 2);
+	l->elem[0] = make_small(0);
+	l->elem[1] = (uintptr_t)rootstack[0];
+	return (uintptr_t)l;
+}
+
+// psc_list_append adds x to the end of a list, in place,
+// and returns the list.
+// isptr says whether x might be a pointer; once any element
+// is one, the collector looks at all of them.
+// a call from a generic function says x might be a pointer whatever it is,
+// so only a pointer into the heap changes the array: otherwise
+// a list of raw ints which went through one would be scanned
+uintptr_t psc_list_append(void** rootstack, uintptr_t list, uintptr_t x, uint64_t isptr)
+{
+	struct tuple* l = (struct tuple*)list;
+	struct array* a = (struct array*)l->elem[1];
+	uint64_t n = (uint64_t)small_value(l->elem[0]);
+	if (n == a->cap) {
+		uint64_t cap = 2*n < 4 ? 4 : 2*n;
+		rootstack[0] = l;
+		rootstack[1] = isptr ? (void*)x : NULL;
+		struct array* b = newarray(rootstack+2, cap);
+		l = rootstack[0];
+		if (isptr) {
+			x = (uintptr_t)rootstack[1];
+		}
+		a = (struct array*)l->elem[1];
+		b->isptr = a->isptr;
+		memcpy(b->elem, a->elem, n*sizeof(uintptr_t));
+		l->elem[1] = (uintptr_t)b;
+		a = b;
+	}
+	if (isptr && is_heap_ptr(x)) {
+		a->isptr = 1;
+	}
+	a->elem[n] = x;
+	l->elem[0] = make_small((intptr_t)n + 1);
+	return (uintptr_t)l;
+}
+
+// psc_list_get returns the element of a list at index i,
+// which must be in range
+uintptr_t psc_list_get(void** rootstack, uintptr_t list, uintptr_t i)
+{
+	(void)rootstack;
+	struct tuple* l = (struct tuple*)list;
+	struct array* a = (struct array*)l->elem[1];
+	if (!is_small(i) || small_value(i) < 0 || small_value(i) >= small_value(l->elem[0])) {
+		fprintf(stderr, "index out of range\n");
+		abort();
+	}
+	return a->elem[small_value(i)];
+}
+
+/* dicts */
+
+// a dict is a hash table which remembers the order its keys were added in.
+// it is a tuple of
+//
+//   0: the number of keys, as a small int
+//   1: the number of entries used, including deleted ones, as a small int
+//   2: the entries, an array of (hash, key, value) triples, oldest first
+//   3: the index, an array with twice as many slots as there are entries.
+//      each slot is 0 if it's empty, or 1 + the number of an entry.
+//      it only holds raw ints, so the collector never looks at it
+//
+// the hash of an entry is stored as a small int, so it doesn't look
+// like a pointer. a deleted entry has a hash of 0 and stays
+// in the index until the dict is resized.
+//
+// the collector moves keys around, so they are hashed and compared
+// by value. the typechecker makes sure they are ints, bools, strings,
+// or tuples of those: a word which is even and not 0 (false) is
+// a bigint, a string, or a tuple, maybe a string literal.
+
+#define DICT_COUNT 0
+#define DICT_USED 1
+#define DICT_ENTRIES 2
+#define DICT_INDEX 3
+
+// hash_mix scrambles the bits of h
+static uint64_t hash_mix(uint64_t h)
+{
+	h ^= h >> 33;
+	h *= 0xff51afd7ed558ccdULL;
+	h ^= h >> 33;
+	h *= 0xc4ceb9fe1a85ec53ULL;
+	h ^= h >> 33;
+	return h;
+}
+
+// hash_bytes is FNV-1a
+static uint64_t hash_bytes(const void* p, size_t n)
+{
+	const unsigned char* b = p;
+	uint64_t h = 0xcbf29ce484222325ULL;
+	for (size_t i = 0; i < n; i++) {
+		h ^= b[i];
+		h *= 0x100000001b3ULL;
+	}
+	return h;
+}
+
+// hash_value hashes a dict key.
+// it doesn't allocate, so the key can't move while it is hashed
+static uint64_t hash_value(uintptr_t v)
+{
+	if ((v&1) || v == 0) {
+		return hash_mix(v);
+	}
+	struct tuple* t = (struct tuple*)v;
+	if (t->len == BIGINT) {
+		struct bigint* b = (struct bigint*)v;
+		return hash_mix(hash_bytes(b->limb, b->nlimbs*sizeof(uint32_t)) + b->neg);
+	}
+	if (t->len == STRING) {
+		struct string* s = (struct string*)v;
+		return hash_bytes(s->data, s->len);
+	}
+	assert(t->len <= 63);
+	uint64_t h = t->len;
+	for (int i = 0; i < t->len; i++) {
+		h = hash_mix(h*31 + hash_value(t->elem[i]));
+	}
+	return h;
+}
+
+// values_equal reports whether two dict keys are equal
+static int values_equal(uintptr_t a, uintptr_t b)
+{
+	if (a == b) {
+		return 1;
+	}
+	if ((a&1) || a == 0 || (b&1) || b == 0) {
+		return 0;
+	}
+	struct tuple* x = (struct tuple*)a;
+	struct tuple* y = (struct tuple*)b;
+	if (x->len != y->len) {
+		return 0;
+	}
+	if (x->len == BIGINT) {
+		struct bigint* p = (struct bigint*)a;
+		struct bigint* q = (struct bigint*)b;
+		return p->neg == q->neg && p->nlimbs == q->nlimbs &&
+			memcmp(p->limb, q->limb, p->nlimbs*sizeof(uint32_t)) == 0;
+	}
+	if (x->len == STRING) {
+		return psc_str_cmp(NULL, a, b) == 0;
+	}
+	for (int i = 0; i < x->len; i++) {
+		if (!values_equal(x->elem[i], y->elem[i])) {
+			return 0;
+		}
+	}
+	return 1;
+}
+
+// dict_hash returns the hash of a key as it is stored in an entry
+static uintptr_t dict_hash(uintptr_t key)
+{
+	return make_small((intptr_t)(hash_value(key) >> 2));
+}
+
+// dict_find returns the index slot for key.
+// if the key isn't in the dict, the slot is the empty one
+// where it would go
+static uint64_t dict_find(struct tuple* d, uintptr_t key, uintptr_t h)
+{
+	struct array* entries = (struct array*)d->elem[DICT_ENTRIES];
+	struct array* index = (struct array*)d->elem[DICT_INDEX];
+	uint64_t mask = index->cap - 1;
+	for (uint64_t i = (uint64_t)small_value(h) & mask; ; i = (i + 1) & mask) {
+		uint64_t slot = index->elem[i];
+		if (slot == 0) {
+			return i;
+		}
+		uintptr_t* e = &entries->elem[3*(slot-1)];
+		if (e[0] == h && values_equal(e[1], key)) {
+			return i;
+		}
+	}
+}
+
+// dict_resize gives a dict new entries and a new index
+// with room for n entries, dropping any deleted entries,
+// and returns the dict
+static struct tuple* dict_resize(void** rootstack, struct tuple* d, uint64_t n)
+{
+	uint64_t cap = 8;
+	while (cap < n) {
+		cap *= 2;
+	}
+	rootstack[0] = d;
+	rootstack[1] = newarray(rootstack+1, 3*cap);
+	struct array* index = newarray(rootstack+2, 2*cap);
+	d = rootstack[0];
+	struct array* entries = rootstack[1];
+	entries->stride = 3;
+	struct array* old = (struct array*)d->elem[DICT_ENTRIES];
+	uint64_t used = 0;
+	if (old != NULL) {
+		entries->isptr = old->isptr;
+		for (uint64_t i = 0; i < (uint64_t)small_value(d->elem[DICT_USED]); i++) {
+			uintptr_t* e = &old->elem[3*i];
+			if (e[0] != 0) {
+				memcpy(&entries->elem[3*used], e, 3*sizeof(uintptr_t));
+				used++;
+			}
+		}
+	}
+	d->elem[DICT_ENTRIES] = (uintptr_t)entries;
+	d->elem[DICT_INDEX] = (uintptr_t)index;
+	d->elem[DICT_USED] = make_small((intptr_t)used);
+	for (uint64_t i = 0; i < used; i++) {
+		uintptr_t* e = &entries->elem[3*i];
+		index->elem[dict_find(d, e[1], e[0])] = i + 1;
+	}
+	return d;
+}
+
+// psc_dict_new returns an empty dict with room for n entries.
+// n is a raw integer
+uintptr_t psc_dict_new(void** rootstack, uint64_t n)
+{
+	struct tuple* d = psc_newtuple(rootstack, 4, 0xc);
+	d->elem[DICT_COUNT] = make_small(0);
+	d->elem[DICT_USED] = make_small(0);
+	d->elem[DICT_ENTRIES] = 0;
+	d->elem[DICT_INDEX] = 0;
+	return (uintptr_t)dict_resize(rootstack, d, n);
+}
+
+// dict_entry returns the entry for key, or NULL if it isn't in the dict
+static uintptr_t* dict_entry(struct tuple* d, uintptr_t key)
+{
+	struct array* entries = (struct array*)d->elem[DICT_ENTRIES];
+	struct array* index = (struct array*)d->elem[DICT_INDEX];
+	uint64_t slot = index->elem[dict_find(d, key, dict_hash(key))];
+	if (slot == 0) {
+		return NULL;
+	}
+	return &entries->elem[3*(slot-1)];
+}
+
+// psc_dict_get returns the value of key, which must be in the dict
+uintptr_t psc_dict_get(void** rootstack, uintptr_t d, uintptr_t key)
+{
+	(void)rootstack;
+	uintptr_t* e = dict_entry((struct tuple*)d, key);
+	if (e == NULL) {
+		fprintf(stderr, "key not found\n");
+		abort();
+	}
+	return e[2];
+}
+
+// dict_mark tells the collector to look at the keys or the values
+// of a dict's entries, if key or val points into the heap.
+// isptr is like in psc_dict_set
+static void dict_mark(struct array* entries, uintptr_t key, uintptr_t val, uint64_t isptr)
+{
+	if ((isptr&1) && is_heap_ptr(key)) {
+		entries->isptr |= 2;
+	}
+	if ((isptr&2) && is_heap_ptr(val)) {
+		entries->isptr |= 4;
+	}
+}
+
+// psc_dict_set sets the value of key, in place, and returns the dict.
+// a new key goes after all the others; an old one keeps its place.
+// bit 0 of isptr says whether the key might be a pointer
+// and bit 1 whether the value might be, like in psc_list_append
+uintptr_t psc_dict_set(void** rootstack, uintptr_t d, uintptr_t key, uintptr_t val, uint64_t isptr)
+{
+	struct tuple* t = (struct tuple*)d;
+	struct array* entries = (struct array*)t->elem[DICT_ENTRIES];
+	uintptr_t* e = dict_entry(t, key);
+	if (e != NULL) {
+		dict_mark(entries, key, val, isptr);
+		e[2] = val;
+		return d;
+	}
+	uint64_t used = (uint64_t)small_value(t->elem[DICT_USED]);
+	if (3*used == entries->cap) {
+		// full. make room for twice as many keys as there are now
+		uint64_t count = (uint64_t)small_value(t->elem[DICT_COUNT]);
+		rootstack[0] = (isptr&1) ? (void*)key : NULL;
+		rootstack[1] = (isptr&2) ? (void*)val : NULL;
+		t = dict_resize(rootstack+2, t, 2*(count+1));
+		if (isptr&1) {
+			key = (uintptr_t)rootstack[0];
+		}
+		if (isptr&2) {
+			val = (uintptr_t)rootstack[1];
+		}
+		entries = (struct array*)t->elem[DICT_ENTRIES];
+		used = (uint64_t)small_value(t->elem[DICT_USED]);
+	}
+	dict_mark(entries, key, val, isptr);
+	uintptr_t h = dict_hash(key);
+	struct array* index = (struct array*)t->elem[DICT_INDEX];
+	e = &entries->elem[3*used];
+	e[0] = h;
+	e[1] = key;
+	e[2] = val;
+	index->elem[dict_find(t, key, h)] = used + 1;
+	t->elem[DICT_USED] = make_small((intptr_t)used + 1);
+	t->elem[DICT_COUNT] = make_small(small_value(t->elem[DICT_COUNT]) + 1);
+	return (uintptr_t)t;
+}
+
+// psc_dict_delete removes key from the dict, in place,
+// if it is there, and returns the dict
+uintptr_t psc_dict_delete(void** rootstack, uintptr_t d, uintptr_t key)
+{
+	(void)rootstack;
+	struct tuple* t = (struct tuple*)d;
+	uintptr_t* e = dict_entry(t, key);
+	if (e != NULL) {
+		e[0] = e[1] = e[2] = 0;
+		t->elem[DICT_COUNT] = make_small(small_value(t->elem[DICT_COUNT]) - 1);
+	}
+	return d;
+}
+
+// psc_dict_contains reports whether key is in the dict, as a raw bool
+uintptr_t psc_dict_contains(void** rootstack, uintptr_t d, uintptr_t key)
+{
+	(void)rootstack;
+	return dict_entry((struct tuple*)d, key) != NULL;
+}
+
+// psc_dict_keys returns a new list of the keys in a dict,
+// in the order they were added.
+// isptr says whether the keys might be pointers,
+// but the entries know whether any of them are
+uintptr_t psc_dict_keys(void** rootstack, uintptr_t d, uint64_t isptr)
+{
+	uint64_t count = (uint64_t)small_value(((struct tuple*)d)->elem[DICT_COUNT]);
+	rootstack[0] = (void*)d;
+	struct tuple* list = (struct tuple*)psc_list_new(rootstack+1, count);
+	struct tuple* t = rootstack[0];
+	struct array* entries = (struct array*)t->elem[DICT_ENTRIES];
+	struct array* a = (struct array*)list->elem[1];
+	a->isptr = isptr != 0 && (entries->isptr & 2) != 0;
+	uint64_t n = 0;
+	for (uint64_t i = 0; i < (uint64_t)small_value(t->elem[DICT_USED]); i++) {
+		uintptr_t* e = &entries->elem[3*i];
+		if (e[0] != 0) {
+			a->elem[n++] = e[1];
+		}
+	}
+	list->elem[0] = make_small((intptr_t)n);
+	return (uintptr_t)list;
+}
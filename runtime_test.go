@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// the runtime's declarations, for testing it from c
+const runtimeDecls = `
+#include <stddef.h>
+#include <stdint.h>
+#include <stdio.h>
+
+extern void **rootstack_begin;
+void psc_gcinit(size_t stack_size, size_t heap_size);
+uintptr_t psc_list_new(void** rootstack, uint64_t cap);
+uintptr_t psc_list_append(void** rootstack, uintptr_t list, uintptr_t x, uint64_t isptr);
+uintptr_t psc_list_get(void** rootstack, uintptr_t list, uintptr_t i);
+void* psc_newtuple(void** rootstack, int nelem, uint64_t ptrmask);
+uintptr_t psc_dict_new(void** rootstack, uint64_t n);
+uintptr_t psc_dict_set(void** rootstack, uintptr_t d, uintptr_t key, uintptr_t val, uint64_t isptr);
+uintptr_t psc_dict_get(void** rootstack, uintptr_t d, uintptr_t key);
+
+#define small(n) ((uintptr_t)(n)*2 + 1)
+`
+
+// runC links a c program with the runtime, runs it,
+// and returns what it printed
+func runC(t *testing.T, source string) string {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("no c compiler")
+	}
+	dir, err := ioutil.TempDir("", "psctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.c")
+	if err := ioutil.WriteFile(filename, []byte(runtimeDecls+source), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	exeName := filepath.Join(dir, "test")
+	out, err := exec.Command("cc", "-O2", "-o", exeName, filename, findRuntime()).CombinedOutput()
+	if err != nil {
+		t.Fatalf("compile failed: %v\n%s", err, out)
+	}
+	out, err = exec.Command(exeName).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return programOutput(out)
+}
+
+func TestListAppendRawInts(t *testing.T) {
+	// the list holds raw ints which are the address of an object
+	// in the heap at the time. a collection mustn't change them,
+	// even after a generic function appends to it
+	const source = `
+int psc_main(void)
+{
+	psc_gcinit(1<<20, 4096);
+	void** roots = rootstack_begin;
+	uintptr_t want[1000];
+	roots[0] = (void*)psc_list_new(roots+1, 0);
+	roots[1] = (void*)psc_list_new(roots+2, 0);
+	roots[1] = (void*)psc_list_append(roots+2, (uintptr_t)roots[1], small(1), 1);
+	for (int i = 0; i < 1000; i++) {
+		want[i] = (uintptr_t)roots[0];
+		roots[1] = (void*)psc_list_append(roots+2, (uintptr_t)roots[1], want[i], 0);
+	}
+	int bad = 0;
+	for (int i = 0; i < 1000; i++) {
+		if (psc_list_get(roots+2, (uintptr_t)roots[1], small(i+1)) != want[i]) {
+			bad++;
+		}
+	}
+	printf("%d changed\n", bad);
+	return 0;
+}
+`
+	if got := runC(t, source); got != "0 changed" {
+		t.Errorf("got %q, want %q", got, "0 changed")
+	}
+}
+
+func TestDictSetRawInts(t *testing.T) {
+	// likewise for the values of a dict, even though
+	// one of its keys is a pointer
+	const source = `
+int psc_main(void)
+{
+	psc_gcinit(1<<20, 4096);
+	void** roots = rootstack_begin;
+	uintptr_t want[1000];
+	roots[0] = (void*)psc_list_new(roots+1, 0);
+	roots[1] = (void*)psc_dict_new(roots+2, 0);
+	roots[2] = psc_newtuple(roots+3, 1, 0);
+	roots[1] = (void*)psc_dict_set(roots+3, (uintptr_t)roots[1], (uintptr_t)roots[2], small(0), 3);
+	for (int i = 0; i < 1000; i++) {
+		want[i] = (uintptr_t)roots[0];
+		roots[1] = (void*)psc_dict_set(roots+2, (uintptr_t)roots[1], small(i+1), want[i], 1);
+	}
+	int bad = 0;
+	for (int i = 0; i < 1000; i++) {
+		if (psc_dict_get(roots+2, (uintptr_t)roots[1], small(i+1)) != want[i]) {
+			bad++;
+		}
+	}
+	printf("%d changed\n", bad);
+	return 0;
+}
+`
+	if got := runC(t, source); got != "0 changed" {
+		t.Errorf("got %q, want %q", got, "0 changed")
+	}
+}
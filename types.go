@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 // types:
@@ -13,7 +15,9 @@ import (
 //   lists
 //   bytes? - unsigned 8-bit value, with trapping overflow
 //   no null
-//   some sort of dict or object or table
+//   dicts
+//   records
+//   variants
 //   any
 
 // note: basic types are used as values (i.e IntT{})
@@ -25,6 +29,10 @@ type IntT struct{}
 type StrT struct{}
 type BoolT struct{}
 
+// sized integers, from psc/prim
+type Int32T struct{}
+type Int64T struct{}
+
 type FuncT struct {
 	Params []Type
 	Return []Type
@@ -38,95 +46,477 @@ type TupleT struct {
 	Type []Type
 }
 
+type DictT struct {
+	Key Type
+	Val Type
+}
+
+// a RecordT is a record type declared by a type declaration.
+// record types are nominal: two of them are the same type
+// only if they are the same declaration, so they are compared
+// by pointer, and the field types are never unified.
+type RecordT struct {
+	Name   string
+	Fields []string
+	Types  []Type
+}
+
+// a VariantT is a variant type declared by a type declaration.
+// a value of it is one of its variants, which each have a tag
+// and some values. like record types, variant types are nominal.
+type VariantT struct {
+	Name  string
+	Tags  []string
+	Types [][]Type // the types of each variant's values
+}
+
 type AnyT struct{}
 
+// types print the way they are written in type annotations
+
+func (IntT) String() string  { return "int" }
+func (StrT) String() string  { return "str" }
+func (BoolT) String() string { return "bool" }
+func (AnyT) String() string  { return "any" }
+
+func (Int32T) String() string { return "prim.int32" }
+func (Int64T) String() string { return "prim.int64" }
+
+func (t *FuncT) String() string    { return typeString(t) }
+func (t *ListT) String() string    { return typeString(t) }
+func (t *TupleT) String() string   { return typeString(t) }
+func (t *DictT) String() string    { return typeString(t) }
+func (t *RecordT) String() string  { return t.Name }
+func (t *VariantT) String() string { return t.Name }
+func (v *TypeVar) String() string  { return typeString(v) }
+
+// results are the result types of a function, for formatting.
+// a single result doesn't need parentheses.
+type results []Type
+
+func (list results) String() string {
+	var p typePrinter
+	return p.resultString(list)
+}
+
+// typeString formats a type.
+// unlike fmt.Sprint, it doesn't panic on a nil Type.
+func typeString(t Type) string {
+	var p typePrinter
+	return p.typeString(t)
+}
+
+// a typePrinter formats types.
+// an unbound type variable prints as ?N, unless the printer has names
+// for them, in which case it names them a, b, c, ... in the order
+// it meets them. error messages use names (see namedTypes),
+// so that they don't show the typechecker's numbering
+// and the same variable has the same name throughout a message.
+type typePrinter struct {
+	names map[*TypeVar]string
+}
+
+func (p *typePrinter) typeString(t Type) string {
+	switch t := t.(type) {
+	case nil:
+		return "<nil>"
+	case *TypeVar:
+		if t.Type != nil {
+			return p.typeString(t.Type)
+		}
+		if p.names == nil {
+			return "?" + strconv.Itoa(t.ID)
+		}
+		if _, ok := p.names[t]; !ok {
+			p.names[t] = typeVarName(len(p.names))
+		}
+		return p.names[t]
+	case *FuncT:
+		s := "func" + p.listString(t.Params)
+		if len(t.Return) == 0 {
+			return s
+		}
+		return s + " -> " + p.resultString(t.Return)
+	case *ListT:
+		return "list(" + p.typeString(t.Elem) + ")"
+	case *TupleT:
+		if len(t.Type) < 2 {
+			return "tuple" + p.listString(t.Type)
+		}
+		return p.listString(t.Type)
+	case *DictT:
+		return "dict(" + p.typeString(t.Key) + ", " + p.typeString(t.Val) + ")"
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+func (p *typePrinter) resultString(list []Type) string {
+	if len(list) == 1 {
+		if t, ok := resolve(list[0]).(*TupleT); ok && len(t.Type) >= 2 {
+			// -> (int, bool) would be two results
+			return "tuple" + p.listString(t.Type)
+		}
+		return p.typeString(list[0])
+	}
+	return p.listString(list)
+}
+
+func (p *typePrinter) listString(list []Type) string {
+	s := "("
+	for i, t := range list {
+		if i > 0 {
+			s += ", "
+		}
+		s += p.typeString(t)
+	}
+	return s + ")"
+}
+
+// typeVarName returns the name of the nth type variable in a message:
+// a through z, then a1 through z1, and so on
+func typeVarName(n int) string {
+	name := string(rune('a' + n%26))
+	if n >= 26 {
+		name += strconv.Itoa(n / 26)
+	}
+	return name
+}
+
+// a namedType formats a type with a typePrinter
+// which is shared by the other types in a message
+type namedType struct {
+	p *typePrinter
+	t Type
+}
+
+type namedResults struct {
+	p    *typePrinter
+	list results
+}
+
+func (n namedType) String() string    { return n.p.typeString(n.t) }
+func (n namedResults) String() string { return n.p.resultString(n.list) }
+
+// namedTypes replaces the types among the arguments to an error message
+// with ones which print their type variables as a, b, c, ...
+func namedTypes(args []interface{}) []interface{} {
+	p := &typePrinter{names: make(map[*TypeVar]string)}
+	named := make([]interface{}, len(args))
+	for i, a := range args {
+		switch a := a.(type) {
+		case results:
+			named[i] = namedResults{p, a}
+		case *TypeVar, *FuncT, *ListT, *TupleT, *DictT:
+			named[i] = namedType{p, a}
+		default:
+			named[i] = a
+		}
+	}
+	return named
+}
+
+// a TypeVar is a type which hasn't been inferred yet.
+// unification binds it to another type.
+type TypeVar struct {
+	ID    int
+	Type  Type // the type this variable is bound to, or nil
+	Level int  // the let-nesting depth of the binding which created it
+	// the variable is the type of an operand of ..,
+	// so it can only be bound to str or int (see concatOperand)
+	Concat bool
+	// the variable stands for a type variable of a generic function
+	// or value, so it can't be bound to a sized int (see genericArg)
+	Generic bool
+}
+
+// a Scheme is the type of a polymorphic let-bound variable.
+// each use of the variable gets a fresh copy of Type
+// with new type variables in place of Vars.
+type Scheme struct {
+	Vars []*TypeVar
+	Type Type
+}
+
 func typecheck(e Expr) error {
 	_, err := typecheck2(e)
 	return err
 }
 
 func typecheck2(e Expr) (Type, error) {
+	var tc typechecker
+	return tc.check(e)
+}
+
+// a typeTable holds the types the typechecker inferred, for the passes
+// after it: the type of each expression's values, and of each variable
+// by name (the names are unique; see uniquify).
+//
+// the later passes rebuild the AST, so each one gives the expressions
+// it builds the types of the ones they replace (see same), and types
+// the variables and expressions it makes up itself.
+// the tests run some passes on their own with a nil table.
+type typeTable struct {
+	exprs map[Expr][]Type
+	vars  map[string]Type
+	named map[string]Type // the record and variant types, by name
+}
+
+// of returns the types of the values of e, or nil if it has none
+func (t *typeTable) of(e Expr) []Type {
+	if t == nil {
+		return nil
+	}
+	return t.exprs[e]
+}
+
+// set records the types of the values of e, and returns e
+func (t *typeTable) set(e Expr, types ...Type) Expr {
+	if t != nil && types != nil {
+		t.exprs[e] = types
+	}
+	return e
+}
+
+// same records that e has the same types as old, which it replaces,
+// and returns e
+func (t *typeTable) same(old, e Expr) Expr {
+	return t.set(e, t.of(old)...)
+}
+
+// single returns the type of the value of e,
+// or AnyT if it doesn't have one
+func (t *typeTable) single(e Expr) Type {
+	if types := t.of(e); len(types) == 1 {
+		return types[0]
+	}
+	return AnyT{}
+}
+
+// varType returns the type of a variable, or AnyT if it doesn't have one
+func (t *typeTable) varType(name string) Type {
+	if t != nil {
+		if typ, ok := t.vars[name]; ok {
+			return typ
+		}
+	}
+	return AnyT{}
+}
+
+// define records the type of a variable
+func (t *typeTable) define(name string, typ Type) {
+	if t != nil {
+		t.vars[name] = typ
+	}
+}
+
+// bind records that a variable has the type of the expression
+// it is bound to
+func (t *typeTable) bind(name string, e Expr) {
+	if types := t.of(e); len(types) == 1 {
+		t.define(name, types[0])
+	}
+}
+
+// table returns the types the typechecker recorded
+func (tc *typechecker) table() *typeTable {
+	t := &typeTable{exprs: tc.exprs, vars: tc.vars, named: tc.named}
+	for e, types := range t.exprs {
+		for i := range types {
+			types[i] = resolve(types[i])
+		}
+		t.exprs[e] = types
+	}
+	for name, typ := range t.vars {
+		t.vars[name] = resolve(typ)
+	}
+	return t
+}
+
+func (tc *typechecker) check(e Expr) (Type, error) {
 	top := newscope(nil)
 	top.vars["true"] = BoolT{}
 	top.vars["false"] = BoolT{}
-	return typecheckExpr(top, e)
+	t, err := tc.typecheckExpr(top, e)
+	return resolve(t), dropBadExprErrors(err)
+}
+
+// errBadExpr is the error returned for a BadExpr.
+// The parser has already reported a syntax error for it,
+// so it isn't included in the final list of errors;
+// it just stops the checks which depend on it from piling on more errors.
+// mismatch returns it too, for a mismatch with a type which came
+// from an error that has already been reported.
+var errBadExpr = errors.New("bad expression")
+
+func dropBadExprErrors(err error) error {
+	var list []error
+	var walk func(err error)
+	walk = func(err error) {
+		if l, ok := err.(ErrorList); ok {
+			for _, err := range l {
+				walk(err)
+			}
+		} else if err != nil && err != errBadExpr {
+			list = append(list, err)
+		}
+	}
+	walk(err)
+	return multiError(list...)
+}
+
+// typechecker infers types using Hindley-Milner type inference.
+//
+// every function parameter starts out as a fresh type variable,
+// and the ways it is used constrain it until (hopefully) it is
+// bound to a concrete type. variables bound by a let are generalized,
+// so a let-bound function which doesn't care about the type of its
+// argument can be used with arguments of different types.
+//
+// AnyT unifies with everything. it is the type of expressions which
+// already have an error, so that they don't cause any more errors.
+type typechecker struct {
+	lastvar int
+	level   int
+	vars    map[string]Type       // if not nil, records the type of each variable
+	exprs   map[Expr][]Type       // and of each expression (see table)
+	named   map[string]Type       // the declared record and variant types
+	fields  map[string][]*RecordT // the records which have each field
+	names   map[string]string     // the source names of the variables uniquify renamed
+
+	// the variable and type which the last call to unify
+	// failed to unify because the type would be infinite
+	infinite *TypeVar
+	within   Type
+	// or the type which failed to unify with
+	// the type of an operand of ..
+	notConcat Type
+	// or with a type variable of a generic function
+	notGeneric Type
+}
+
+// sourceName returns the name of a variable as it was written,
+// for error messages
+func (tc *typechecker) sourceName(name string) string {
+	if orig, ok := tc.names[name]; ok {
+		return orig
+	}
+	return name
+}
+
+// define records the type of a variable
+func (tc *typechecker) define(name string, t Type) {
+	if tc.vars != nil {
+		tc.vars[name] = t
+	}
+}
+
+// record records the types of the values of an expression
+func (tc *typechecker) record(e Expr, types []Type) {
+	if tc.exprs != nil {
+		tc.exprs[e] = types
+	}
+}
+
+func (tc *typechecker) newvar() *TypeVar {
+	tc.lastvar++
+	return &TypeVar{ID: tc.lastvar, Level: tc.level}
 }
 
-func typecheckExpr(s *scope, expr Expr) (Type, error) {
+func (tc *typechecker) typecheckExpr(s *scope, expr Expr) (t Type, err error) {
+	defer func() { tc.record(expr, []Type{t}) }()
 	switch e := expr.(type) {
 	case *VarExpr:
 		if !s.has(e.Name) {
-			return AnyT{}, fmt.Errorf("%v not in scope", e.Name)
+			return AnyT{}, errorAt(e, "%v not in scope", tc.sourceName(e.Name))
+		}
+		switch t := s.lookup(e.Name).(type) {
+		case *Scheme:
+			return tc.instantiate(t), nil
+		default:
+			return t.(Type), nil
 		}
-		return s.lookup(e.Name).(Type), nil
 	case *IntExpr:
 		return IntT{}, nil
+	case *StrExpr:
+		return StrT{}, nil
 	case *BoolExpr:
 		return BoolT{}, nil
+	case *BadExpr:
+		return AnyT{}, errBadExpr
 	case *BinExpr:
-		t1, err1 := typecheckExpr(s, e.Left)
-		t2, err2 := typecheckExpr(s, e.Right)
+		t1, err1 := tc.typecheckExpr(s, e.Left)
+		t2, err2 := tc.typecheckExpr(s, e.Right)
 		if err1 != nil || err2 != nil {
-			return AnyT{}, multiError(err1, err2)
+			return binopType(e.Op), multiError(err1, err2)
 		}
 		var err error
 		switch e.Op {
 		case "+", "-", "*", "/":
-			if !((t1 == IntT{} || t1 == AnyT{}) && (t2 == IntT{} || t2 == AnyT{})) {
-				err = fmt.Errorf("operands to %s must be IntT, found %T and %T", e.Op, t1, t2)
+			if !(tc.unify(t1, IntT{}) && tc.unify(t2, IntT{})) {
+				err = tc.mismatch(e, "operands to %s must be int, found %v and %v", e.Op, t1, t2)
 			}
-			return IntT{}, err
 		case "<", "<=", ">=", ">":
-			if !(t1 == IntT{} && t2 == IntT{}) {
-				err = fmt.Errorf("operands to %s must be IntT, found %T and %T", e.Op, t1, t2)
+			// strings are ordered too.
+			// if neither operand is known to be one, they are ints
+			var want Type = IntT{}
+			if (prune(t1) == StrT{} || prune(t2) == StrT{}) {
+				want = StrT{}
+			}
+			if !(tc.unify(t1, want) && tc.unify(t2, want)) {
+				err = tc.mismatch(e, "operands to %s must be %v, found %v and %v", e.Op, want, t1, t2)
+			}
+		case "..":
+			// ints are converted to strings, like in lua
+			if !(tc.concatOperand(t1) && tc.concatOperand(t2)) {
+				err = tc.mismatch(e, "operands to .. must be str or int, found %v and %v", t1, t2)
 			}
-			return BoolT{}, err
 		case "eq":
-			if !comparableTypes(t1, t2) {
-				err = fmt.Errorf("cannot compare %T and %T", t1, t2)
+			if !tc.unify(t1, t2) || !comparableTypes(t1, t2) {
+				err = tc.mismatch(e, "cannot compare %v and %v", t1, t2)
 			}
-			return BoolT{}, err
 		default:
 			panic(fmt.Sprintf("unhandled binop: %s", e.Op))
 		}
+		return binopType(e.Op), err
 	case *AndExpr:
-		t1, err1 := typecheckExpr(s, e.Left)
-		t2, err2 := typecheckExpr(s, e.Right)
+		t1, err1 := tc.typecheckExpr(s, e.Left)
+		t2, err2 := tc.typecheckExpr(s, e.Right)
 		if err1 != nil || err2 != nil {
 			return BoolT{}, multiError(err1, err2)
 		}
 		var err error
-		if !(t1 == BoolT{} && t2 == BoolT{}) {
-			err = fmt.Errorf("operands to 'and' must be BoolT, found %T and %T", t1, t2)
+		if !(tc.unify(t1, BoolT{}) && tc.unify(t2, BoolT{})) {
+			err = tc.mismatch(e, "operands to 'and' must be bool, found %v and %v", t1, t2)
 		}
 		return BoolT{}, err
 	case *OrExpr:
-		t1, err1 := typecheckExpr(s, e.Left)
-		t2, err2 := typecheckExpr(s, e.Right)
+		t1, err1 := tc.typecheckExpr(s, e.Left)
+		t2, err2 := tc.typecheckExpr(s, e.Right)
 		if err1 != nil || err2 != nil {
 			return BoolT{}, multiError(err1, err2)
 		}
 		var err error
-		if !(t1 == BoolT{} && t2 == BoolT{}) {
-			err = fmt.Errorf("operands to 'or' must be BoolT, found %T and %T", t1, t2)
+		if !(tc.unify(t1, BoolT{}) && tc.unify(t2, BoolT{})) {
+			err = tc.mismatch(e, "operands to 'or' must be bool, found %v and %v", t1, t2)
 		}
 		return BoolT{}, err
 	case *IfExpr:
-		t1, err1 := typecheckExpr(s, e.Cond)
-		t2, err2 := typecheckExpr(s, e.Then)
-		t3, err3 := typecheckExpr(s, e.Else)
-		if err1 == nil && (t1 != BoolT{}) {
-			err1 = fmt.Errorf("if condition must be BoolT, found %T", t1)
+		t1, err1 := tc.typecheckExpr(s, e.Cond)
+		t2, err2 := tc.typecheckExpr(s, e.Then)
+		t3, err3 := tc.typecheckExpr(s, e.Else)
+		if err1 == nil && !tc.unify(t1, BoolT{}) {
+			err1 = tc.mismatch(e.Cond, "if condition must be bool, found %v", t1)
 		}
 		if err2 == nil && err3 == nil {
-			if sameType(t2, t3) {
+			if tc.unify(t2, t3) {
 				return t2, err1
 			} else {
-				err := fmt.Errorf("both branches of an if must have the same type, found %T and %T", t2, t3)
+				err := tc.mismatch(e, "both branches of an if must have the same type, found %v and %v", t2, t3)
 				return AnyT{}, multiError(err1, err)
 			}
 		} else {
-			if sameType(t2, t3) {
+			if tc.unify(t2, t3) {
 				return t2, multiError(err1, err2, err3)
 			} else {
 				return AnyT{}, multiError(err1, err2, err3)
@@ -134,128 +524,1378 @@ func typecheckExpr(s *scope, expr Expr) (Type, error) {
 		}
 	case *LetExpr:
 		inner := s.push()
-		t1, err1 := typecheckExpr(s, e.Val)
-		inner.vars[e.Var] = t1
-		t2, err2 := typecheckExpr(inner, e.Body)
+		t1, err1 := tc.typecheckLetVal(s, e)
+		inner.vars[e.Var] = tc.generalizeValue(s, e.Val, t1)
+		tc.define(e.Var, t1)
+		t2, err2 := tc.typecheckExpr(inner, e.Body)
 		return t2, multiError(err1, err2)
 	case *FuncExpr:
-		var params = make([]Type, len(e.Args))
-		for i := range e.Args {
-			params[i] = AnyT{} // XXX
-		}
-		inner := s.push()
-		for i := range e.Args {
-			inner.vars[e.Args[i]] = params[i]
-		}
-		if e.Name != "" && inner.vars[e.Name] == nil {
-			inner.vars[e.Name] = &FuncT{
-				Params: params,
-				// oh i guess we need to know the return type before typechecking the body,
-				// at least for recursive functions
-				Return: []Type{AnyT{}},
-			}
+		t, err := tc.funcType(e)
+		return t, multiError(err, tc.typecheckFunc(s, e, t))
+	case *LetRecExpr:
+		inner, err1 := tc.bindFuncs(s, e)
+		t2, err2 := tc.typecheckExpr(inner, e.Body)
+		return t2, multiError(err1, err2)
+	case *LetTypeExpr:
+		err1 := tc.declareTypes(e)
+		t2, err2 := tc.typecheckExpr(s, e.Body)
+		return t2, multiError(err1, err2)
+	case *RecordExpr:
+		return tc.typecheckRecord(s, e)
+	case *VariantExpr:
+		return tc.typecheckVariant(s, e)
+	case *MatchExpr:
+		return tc.typecheckMatch(s, e)
+	case *VariantTagExpr:
+		// after uncoverTuples
+		_, err := tc.typecheckExpr(s, e.Base)
+		return IntT{}, err
+	case *VariantGetExpr:
+		// after uncoverTuples
+		bt, err := tc.typecheckExpr(s, e.Base)
+		t, ok := tc.named[e.Type].(*VariantT)
+		if !ok || !tc.unify(t, bt) {
+			return AnyT{}, multiError(err, tc.mismatch(e, "%v is not a variant of %s", bt, e.Type))
 		}
-		rt, err := typecheckExpr(inner, e.Body) // TODO: multiple returns?
-		return &FuncT{Params: params, Return: []Type{rt}}, err
+		return t.Types[indexOf(t.Tags, e.Tag)][e.Index], err
 	case *CallExpr:
-		var errors []error
 		if v, ok := e.Func.(*VarExpr); ok {
 			if !s.has(v.Name) && isBuiltin(v.Name) {
-				return typecheckBuiltin(v.Name, e.Args, s)
+				return tc.typecheckBuiltin(e, v.Name, e.Args, s)
 			}
 		}
-		// get the function type
-		t1, err1 := typecheckExpr(s, e.Func)
-		if _, ok := t1.(*FuncT); !ok {
-			if err1 != nil {
-				return AnyT{}, err1
-			} else {
-				// TODO: allow calling AnyT
-				return AnyT{}, fmt.Errorf("cannot call non-function type %T", t1)
+		if name, ok := primName(s, e.Func); ok {
+			results, err := tc.typecheckPrim(s, e, name, e.Args, true)
+			if len(results) != 1 {
+				return AnyT{}, multiError(err, errorAt(e, "%s.%s returns %d values, used in a single-value context", primPackage, name, len(results)))
 			}
+			return results[0], err
+		}
+		results, err := tc.typecheckCall(s, e)
+		if len(results) > 1 {
+			err = multiError(err, errorAt(e, "function with multiple return values used in a single-value context"))
 		}
-		// get the argument types
-		f := t1.(*FuncT)
-		args := make([]Type, len(e.Args))
+		if len(results) == 0 {
+			err = multiError(err, errorAt(e, "function with no return value used as an expression"))
+			return AnyT{}, err
+		}
+		return results[0], err
+	case *ValuesExpr:
+		// after uncoverTuples
+		results, err := tc.typecheckValues(s, e.Args)
+		if len(results) != 1 {
+			return AnyT{}, multiError(err, errorAt(e, "%d values used in a single-value context", len(results)))
+		}
+		return results[0], err
+	case *LetValuesExpr:
+		inner, err1 := tc.bindValues(s, e)
+		t2, err2 := tc.typecheckExpr(inner, e.Body)
+		return t2, multiError(err1, err2)
+	case *DotExpr:
+		if name, ok := primName(s, e); ok {
+			results, err := tc.typecheckPrim(s, e, name, nil, false)
+			return results[0], err
+		}
+		t, err := tc.typecheckExpr(s, e.Left)
+		if err != nil {
+			// probably a module which wasn't imported
+			return AnyT{}, err
+		}
+		return tc.typecheckField(e, t)
+	case *PrimExpr:
+		// after uncoverTuples
+		p := primFuncs[e.Name]
+		results, err := tc.typecheckPrim(s, e, e.Name, e.Args, !p.Const)
+		if len(results) != 1 {
+			return AnyT{}, multiError(err, errorAt(e, "%s.%s returns %d values, used in a single-value context", primPackage, e.Name, len(results)))
+		}
+		return results[0], err
+	case *TupleExpr:
+		// after uncoverTuples
+		var types = make([]Type, len(e.Args))
+		var errors []error
 		for i := range e.Args {
 			var err error
-			args[i], err = typecheckExpr(s, e.Args[i])
+			types[i], err = tc.typecheckExpr(s, e.Args[i])
 			errors = append(errors, err)
 		}
-		// check arguments against parameter types
-		if len(f.Params) != len(e.Args) {
-			errors = append(errors, fmt.Errorf("function has %d arguments, found %d", len(f.Params), len(e.Args)))
+		return &TupleT{Type: types}, multiError(errors...)
+	case *ListExpr:
+		var elem Type = tc.newvar()
+		var errors []error
+		for _, a := range e.Args {
+			t, err := tc.typecheckExpr(s, a)
+			if err == nil && !tc.unify(elem, t) {
+				err = tc.mismatch(a, "list elements must have the same type, found %v and %v", elem, t)
+			}
+			errors = append(errors, err)
 		}
-		for i := 0; i < len(f.Params) && i < len(args); i++ {
-			// TODO: don't add this error if the argument failed to typecheck
-			if !sameType(f.Params[i], args[i]) && (f.Params[i] != AnyT{}) {
-				errors = append(errors, fmt.Errorf("argument %d is %T, found %T", i, f.Params[i], args[i]))
+		return &ListT{Elem: elem}, multiError(errors...)
+	case *IndexExpr:
+		elem := tc.newvar()
+		t1, err1 := tc.typecheckExpr(s, e.Base)
+		t2, err2 := tc.typecheckExpr(s, e.Index)
+		if err1 == nil && !tc.unify(t1, &ListT{Elem: elem}) {
+			if _, ok := resolve(t1).(*DictT); ok {
+				err1 = errorAt(e.Base, "cannot index %v; use lookup to get a value from a dict", t1)
+			} else {
+				err1 = tc.mismatch(e.Base, "cannot index %v", t1)
 			}
+			// the type of the index doesn't tell us anything more
+			tc.unify(elem, AnyT{})
+			return elem, multiError(err1, err2)
 		}
-		if len(f.Return) > 1 {
-			errors = append(errors, fmt.Errorf("function with mulitple return values used in a single-value context"))
+		if err2 == nil && !tc.unify(t2, IntT{}) {
+			err2 = tc.mismatch(e.Index, "list index must be int, found %v", t2)
 		}
-		if len(f.Return) == 0 {
-			errors = append(errors, fmt.Errorf("function with no return value used as an expression"))
-			return AnyT{}, multiError(errors...)
+		return elem, multiError(err1, err2)
+	case *ForExpr:
+		// the result is a list of the values of the body
+		elem := tc.newvar()
+		t1, err1 := tc.typecheckExpr(s, e.List)
+		if err1 == nil && !tc.unify(t1, &ListT{Elem: elem}) {
+			// the body can still be checked
+			err1 = tc.mismatch(e.List, "cannot iterate over %v", t1)
+			tc.unify(elem, AnyT{})
 		}
-		return f.Return[0], multiError(errors...)
-	case *DotExpr:
-		return AnyT{}, fmt.Errorf("TODO dot expression")
+		inner := s.push()
+		inner.vars[e.Var] = elem
+		tc.define(e.Var, elem)
+		t2, err2 := tc.typecheckExpr(inner, e.Body)
+		return &ListT{Elem: t2}, multiError(err1, err2)
+	case *DictExpr:
+		d := &DictT{Key: tc.newvar(), Val: tc.newvar()}
+		var errors []error
+		for i := range e.Keys {
+			t1, err1 := tc.typecheckExpr(s, e.Keys[i])
+			if err1 == nil && !tc.unify(d.Key, t1) {
+				err1 = tc.mismatch(e.Keys[i], "dict keys must have the same type, found %v and %v", d.Key, t1)
+			}
+			t2, err2 := tc.typecheckExpr(s, e.Vals[i])
+			if err2 == nil && !tc.unify(d.Val, t2) {
+				err2 = tc.mismatch(e.Vals[i], "dict values must have the same type, found %v and %v", d.Val, t2)
+			}
+			errors = append(errors, err1, err2)
+		}
+		if multiError(errors...) == nil {
+			errors = append(errors, checkKey(e, d.Key))
+		}
+		return d, multiError(errors...)
+	case *DictOpExpr:
+		// after uncoverTuples
+		return tc.typecheckDictOp(s, e, e.Op, e.Args)
+	case *ListLenExpr:
+		// after uncoverTuples
+		return tc.typecheckLen(s, e.List)
+	case *AppendExpr:
+		// after uncoverTuples
+		return tc.typecheckAppend(s, e.List, e.Elem)
+	case *TupleIndexExpr:
+		t, err := tc.typecheckExpr(s, e.Base)
+		if err != nil {
+			return AnyT{}, err
+		}
+		t = prune(t)
+		if !isTupleT(t) {
+			return AnyT{}, errorAt(e.Base, "first argument to 'get' must be a tuple, found %v", t)
+		}
+		if e.Index < 0 || e.Index >= len(t.(*TupleT).Type) {
+			return AnyT{}, errorAt(e, "tuple index %d out of range", e.Index)
+		}
+		return t.(*TupleT).Type[e.Index], nil
 	default:
 		panic(fmt.Sprintf("unhandled case: %T", e))
 	}
 }
 
+// typecheckCall returns the types of the values returned by a call.
+// if the function has an error, the result is a single AnyT.
+func (tc *typechecker) typecheckCall(s *scope, e *CallExpr) ([]Type, error) {
+	var errors []error
+	if v, ok := e.Func.(*VarExpr); ok {
+		if !s.has(v.Name) && isBuiltin(v.Name) {
+			if v.Name == "values" {
+				return tc.typecheckValues(s, e.Args)
+			}
+			t, err := tc.typecheckBuiltin(e, v.Name, e.Args, s)
+			return []Type{t}, err
+		}
+	}
+	if name, ok := primName(s, e.Func); ok {
+		return tc.typecheckPrim(s, e, name, e.Args, true)
+	}
+	// get the function type
+	t1, err1 := tc.typecheckExpr(s, e.Func)
+	if err1 != nil {
+		return []Type{AnyT{}}, err1
+	}
+	if v, ok := prune(t1).(*TypeVar); ok {
+		// probably a function parameter.
+		// it must be a function which takes these arguments
+		params := make([]Type, len(e.Args))
+		for i := range params {
+			params[i] = tc.newvar()
+		}
+		tc.unify(v, &FuncT{Params: params, Return: []Type{tc.newvar()}})
+	}
+	f, ok := prune(t1).(*FuncT)
+	if !ok {
+		if (prune(t1) == AnyT{}) {
+			// we can't check anything but the arguments
+			for i := range e.Args {
+				_, err := tc.typecheckExpr(s, e.Args[i])
+				errors = append(errors, err)
+			}
+			return []Type{AnyT{}}, multiError(errors...)
+		}
+		return []Type{AnyT{}}, errorAt(e.Func, "cannot call non-function type %v", t1)
+	}
+	// get the argument types
+	args := make([]Type, len(e.Args))
+	for i := range e.Args {
+		var err error
+		args[i], err = tc.typecheckExpr(s, e.Args[i])
+		errors = append(errors, err)
+	}
+	// check arguments against parameter types
+	if len(f.Params) != len(e.Args) {
+		errors = append(errors, errorAt(e, "function has %d arguments, found %d", len(f.Params), len(e.Args)))
+	}
+	for i := 0; i < len(f.Params) && i < len(args); i++ {
+		if errors[i] != nil {
+			// don't pile on if the argument failed to typecheck
+			continue
+		}
+		if !tc.unify(f.Params[i], args[i]) {
+			errors = append(errors, tc.mismatch(e.Args[i], "argument %d is %v, found %v", i, f.Params[i], args[i]))
+		}
+	}
+	return f.Return, multiError(errors...)
+}
+
+// typecheckPrim returns the types of the values produced by
+// a member of psc/prim: a constant, or a call to a function.
+func (tc *typechecker) typecheckPrim(s *scope, e Expr, name string, args []Expr, call bool) ([]Type, error) {
+	// get the argument types
+	var errors []error
+	types := make([]Type, len(args))
+	for i := range args {
+		var err error
+		types[i], err = tc.typecheckExpr(s, args[i])
+		errors = append(errors, err)
+	}
+	p, ok := primFuncs[name]
+	if !ok {
+		return []Type{AnyT{}}, multiError(append(errors, errorAt(e, "%s.%s not in scope", primPackage, name))...)
+	}
+	if p.Const {
+		if call {
+			return []Type{AnyT{}}, multiError(append(errors, errorAt(e, "cannot call non-function type %v", p.Results[0]))...)
+		}
+		return p.Results, nil
+	}
+	if !call {
+		return []Type{AnyT{}}, errorAt(e, "%s.%s must be called", primPackage, name)
+	}
+	// check arguments against parameter types
+	if len(p.Params) != len(args) {
+		errors = append(errors, errorAt(e, "function has %d arguments, found %d", len(p.Params), len(args)))
+	}
+	for i := 0; i < len(p.Params) && i < len(args); i++ {
+		if errors[i] != nil {
+			// don't pile on if the argument failed to typecheck
+			continue
+		}
+		if !tc.unify(p.Params[i], types[i]) {
+			errors = append(errors, tc.mismatch(args[i], "argument %d is %v, found %v", i, p.Params[i], types[i]))
+		}
+	}
+	return p.Results, multiError(errors...)
+}
+
+// typecheckValues returns the types of the arguments to values(...)
+func (tc *typechecker) typecheckValues(s *scope, args []Expr) ([]Type, error) {
+	var types = make([]Type, len(args))
+	var errors []error
+	for i := range args {
+		var err error
+		types[i], err = tc.typecheckExpr(s, args[i])
+		errors = append(errors, err)
+	}
+	return types, multiError(errors...)
+}
+
+// typecheckMulti is like typecheckExpr but for expressions
+// which may produce more than one value:
+// the value of a destructuring let, and the body of a function.
+func (tc *typechecker) typecheckMulti(s *scope, expr Expr) (types []Type, err error) {
+	defer func() { tc.record(expr, types) }()
+	switch e := expr.(type) {
+	case *CallExpr:
+		return tc.typecheckCall(s, e)
+	case *ValuesExpr:
+		return tc.typecheckValues(s, e.Args)
+	case *PrimExpr:
+		return tc.typecheckPrim(s, e, e.Name, e.Args, !primFuncs[e.Name].Const)
+	case *IfExpr:
+		t1, err1 := tc.typecheckExpr(s, e.Cond)
+		t2, err2 := tc.typecheckMulti(s, e.Then)
+		t3, err3 := tc.typecheckMulti(s, e.Else)
+		if err1 == nil && !tc.unify(t1, BoolT{}) {
+			err1 = tc.mismatch(e.Cond, "if condition must be bool, found %v", t1)
+		}
+		if isAnyList(t2) {
+			return t3, multiError(err1, err2, err3)
+		}
+		if isAnyList(t3) {
+			return t2, multiError(err1, err2, err3)
+		}
+		if tc.unifyList(t2, t3) {
+			return t2, multiError(err1, err2, err3)
+		}
+		if err2 == nil && err3 == nil {
+			err := tc.mismatch(e, "both branches of an if must have the same type, found %v and %v", results(t2), results(t3))
+			return []Type{AnyT{}}, multiError(err1, err)
+		}
+		return []Type{AnyT{}}, multiError(err1, err2, err3)
+	case *LetExpr:
+		// the let's variable is checked in the usual way;
+		// only the body may have multiple values
+		inner := s.push()
+		t1, err1 := tc.typecheckLetVal(s, e)
+		inner.vars[e.Var] = tc.generalizeValue(s, e.Val, t1)
+		tc.define(e.Var, t1)
+		t2, err2 := tc.typecheckMulti(inner, e.Body)
+		return t2, multiError(err1, err2)
+	case *LetValuesExpr:
+		inner, err1 := tc.bindValues(s, e)
+		t2, err2 := tc.typecheckMulti(inner, e.Body)
+		return t2, multiError(err1, err2)
+	case *LetRecExpr:
+		inner, err1 := tc.bindFuncs(s, e)
+		t2, err2 := tc.typecheckMulti(inner, e.Body)
+		return t2, multiError(err1, err2)
+	default:
+		t, err := tc.typecheckExpr(s, e)
+		return []Type{t}, err
+	}
+}
+
+// bindValues typechecks the value of a destructuring let
+// and returns a scope with its variables in it
+func (tc *typechecker) bindValues(s *scope, e *LetValuesExpr) (*scope, error) {
+	inner := s.push()
+	tc.level++
+	types, err := tc.typecheckMulti(s, e.Val)
+	tc.level--
+	if len(types) != len(e.Vars) {
+		if err == nil && !isAnyList(types) {
+			err = errorAt(e, "assignment mismatch: %d variables but %d values", len(e.Vars), len(types))
+		}
+		types = make([]Type, len(e.Vars))
+		for i := range types {
+			types[i] = AnyT{}
+		}
+	}
+	for i, name := range e.Vars {
+		inner.vars[name] = tc.generalizeValue(s, e.Val, types[i])
+		tc.define(name, types[i])
+	}
+	return inner, err
+}
+
+// funcType returns the type of a function before its body is checked.
+// annotations give us a head start; anything else is inferred.
+func (tc *typechecker) funcType(e *FuncExpr) (*FuncT, error) {
+	var errors []error
+	var params = make([]Type, len(e.Args))
+	for i := range e.Args {
+		if e.ArgTypes != nil && e.ArgTypes[i] != nil {
+			var err error
+			params[i], err = tc.typeOf(e.ArgTypes[i])
+			errors = append(errors, err)
+		} else {
+			params[i] = tc.newvar()
+		}
+	}
+	// we need to know the return type before typechecking the body,
+	// at least for recursive functions
+	t := &FuncT{Params: params, Return: []Type{tc.newvar()}}
+	if e.ReturnTypes != nil {
+		var err error
+		t.Return = make([]Type, len(e.ReturnTypes))
+		for i := range e.ReturnTypes {
+			t.Return[i], err = tc.typeOf(e.ReturnTypes[i])
+			errors = append(errors, err)
+		}
+	}
+	return t, multiError(errors...)
+}
+
+// typecheckFunc checks the body of a function whose type is t
+func (tc *typechecker) typecheckFunc(s *scope, e *FuncExpr, t *FuncT) error {
+	ret := t.Return[0]
+	inner := s.push()
+	if e.Name != "" {
+		// not generalized: a recursive call has to have the same type
+		// as the function itself
+		inner.vars[e.Name] = t
+		tc.define(e.Name, t)
+	}
+	for i := range e.Args {
+		inner.vars[e.Args[i]] = t.Params[i]
+		tc.define(e.Args[i], t.Params[i])
+	}
+	rt, err := tc.typecheckMulti(inner, e.Body)
+	if err == nil && len(rt) != 1 && e.ReturnTypes == nil && prune(ret) == ret {
+		// a function with multiple results.
+		// nothing has used the result yet, so we can still change it
+		t.Return = rt
+	} else if err == nil && !tc.unifyList(t.Return, rt) {
+		if e.ReturnTypes != nil {
+			err = tc.mismatch(e.Body, "function is declared to return %v, found %v", results(t.Return), results(rt))
+		} else {
+			err = tc.mismatch(e, "function returns %v, but its recursive calls expect %v", results(rt), results(t.Return))
+		}
+	}
+	return err
+}
+
+// bindFuncs typechecks a group of functions which can call each other
+// and returns a scope with them in it.
+// like a recursive call, a call to another function in the group
+// isn't generalized, so they all have types before any are checked.
+func (tc *typechecker) bindFuncs(s *scope, e *LetRecExpr) (*scope, error) {
+	var errors []error
+	types := make([]*FuncT, len(e.Vals))
+	group := s.push()
+	tc.level++
+	for i, val := range e.Vals {
+		var err error
+		types[i], err = tc.funcType(val.(*FuncExpr))
+		errors = append(errors, err)
+		group.vars[e.Vars[i]] = types[i]
+		tc.record(val, []Type{types[i]})
+	}
+	for i, val := range e.Vals {
+		errors = append(errors, tc.typecheckFunc(group, val.(*FuncExpr), types[i]))
+	}
+	tc.level--
+	inner := s.push()
+	for i, name := range e.Vars {
+		inner.vars[name] = tc.generalize(types[i])
+		tc.define(name, types[i])
+	}
+	return inner, multiError(errors...)
+}
+
+// isAnyList reports whether types is the result of
+// an expression which has an error
+func isAnyList(types []Type) bool {
+	return len(types) == 1 && prune(types[0]) == AnyT{}
+}
+
+func (tc *typechecker) unifyList(t1, t2 []Type) bool {
+	if len(t1) != len(t2) {
+		return false
+	}
+	for i := range t1 {
+		if !tc.unify(t1[i], t2[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// typecheckLetVal returns the type of a let's variable
+func (tc *typechecker) typecheckLetVal(s *scope, e *LetExpr) (Type, error) {
+	tc.level++
+	t1, err1 := tc.typecheckExpr(s, e.Val)
+	tc.level--
+	if e.Type != nil {
+		want, err := tc.typeOf(e.Type)
+		if err != nil {
+			err1 = multiError(err1, err)
+		} else if err1 == nil && !tc.unify(t1, want) {
+			err1 = tc.mismatch(e.Val, "%s is declared as %v, found %v", tc.sourceName(e.Var), want, t1)
+		}
+		t1 = want
+	}
+	return t1, err1
+}
+
+// declareTypes defines the record and variant types in a LetTypeExpr.
+// they are all created before any of their fields' types are
+// looked up, so that they can refer to each other.
+func (tc *typechecker) declareTypes(e *LetTypeExpr) error {
+	if tc.named == nil {
+		tc.named = make(map[string]Type)
+		tc.fields = make(map[string][]*RecordT)
+	}
+	list := make([]Type, len(e.Types))
+	for i, d := range e.Types {
+		if d.Variants != nil {
+			list[i] = &VariantT{Name: d.Name}
+		} else {
+			list[i] = &RecordT{Name: d.Name, Fields: d.Fields}
+		}
+		tc.named[d.Name] = list[i]
+	}
+	var errors []error
+	for i, d := range e.Types {
+		if v, ok := list[i].(*VariantT); ok {
+			errors = append(errors, tc.declareVariants(v, d))
+			continue
+		}
+		t := list[i].(*RecordT)
+		var err error
+		t.Types, err = tc.typeList(d.Types)
+		errors = append(errors, err)
+		for j, f := range d.Fields {
+			if indexOf(d.Fields[:j], f) >= 0 {
+				errors = append(errors, errorAt(d.Types[j], "duplicate field %s in type %s", f, d.Name))
+				continue
+			}
+			tc.fields[f] = append(tc.fields[f], t)
+		}
+	}
+	return multiError(errors...)
+}
+
+// declareVariants fills in the variants of a variant type
+func (tc *typechecker) declareVariants(t *VariantT, d *TypeDecl) error {
+	var errors []error
+	for _, v := range d.Variants {
+		// the linker has made sure the tags are unique
+		types, err := tc.typeList(v.Types)
+		errors = append(errors, err)
+		t.Tags = append(t.Tags, v.Tag)
+		t.Types = append(t.Types, types)
+	}
+	return multiError(errors...)
+}
+
+// typecheckRecord checks a record constructor,
+// which has to give every field a value exactly once
+func (tc *typechecker) typecheckRecord(s *scope, e *RecordExpr) (Type, error) {
+	var errors []error
+	t, ok := tc.named[e.Type].(*RecordT)
+	if !ok {
+		errors = append(errors, errorAt(e, "unknown record type %s", e.Type))
+	}
+	for i, f := range e.Fields {
+		vt, err := tc.typecheckExpr(s, e.Vals[i])
+		if err != nil || !ok {
+			errors = append(errors, err)
+			continue
+		}
+		j := indexOf(t.Fields, f)
+		switch {
+		case j < 0:
+			err = errorAt(e.Vals[i], "%v has no field %s", t, f)
+		case indexOf(e.Fields[:i], f) >= 0:
+			err = errorAt(e.Vals[i], "duplicate field %s in %v", f, t)
+		case !tc.unify(t.Types[j], vt):
+			err = tc.mismatch(e.Vals[i], "field %s of %v must be %v, found %v", f, t, t.Types[j], vt)
+		}
+		errors = append(errors, err)
+	}
+	if !ok {
+		return AnyT{}, multiError(errors...)
+	}
+	for _, f := range t.Fields {
+		if indexOf(e.Fields, f) < 0 {
+			errors = append(errors, errorAt(e, "missing field %s in %v", f, t))
+		}
+	}
+	return t, multiError(errors...)
+}
+
+// typecheckVariant checks a constructor of a variant type,
+// which has to be given the variant's values
+func (tc *typechecker) typecheckVariant(s *scope, e *VariantExpr) (Type, error) {
+	var errors []error
+	t, ok := tc.named[e.Type].(*VariantT)
+	var want []Type
+	if ok {
+		want = t.Types[indexOf(t.Tags, e.Tag)]
+		if len(e.Args) != len(want) {
+			plural := "s"
+			if len(want) == 1 {
+				plural = ""
+			}
+			errors = append(errors, errorAt(e, "%s takes %d value%s, found %d", e.Tag, len(want), plural, len(e.Args)))
+		}
+	}
+	for i, a := range e.Args {
+		at, err := tc.typecheckExpr(s, a)
+		if err == nil && i < len(want) && !tc.unify(want[i], at) {
+			err = tc.mismatch(a, "value %d of %s must be %v, found %v", i+1, e.Tag, want[i], at)
+		}
+		errors = append(errors, err)
+	}
+	if !ok {
+		return AnyT{}, multiError(errors...)
+	}
+	return t, multiError(errors...)
+}
+
+// typecheckMatch checks a match expression.
+// its cases must all be variants of the same type, and unless
+// it has an else, there must be a case for every variant.
+func (tc *typechecker) typecheckMatch(s *scope, e *MatchExpr) (Type, error) {
+	vt, err := tc.typecheckExpr(s, e.Val)
+	errors := []error{err}
+	var t *VariantT
+	for _, c := range e.Cases {
+		if ct, ok := tc.named[c.Type].(*VariantT); ok {
+			t = ct
+			break
+		}
+	}
+	if t != nil && err == nil && !tc.unify(t, vt) {
+		errors = append(errors, tc.mismatch(e.Val, "cannot match %v against the variants of %v", vt, t))
+	}
+	var result Type
+	unifyResult := func(bt Type, body Expr) {
+		if result == nil {
+			result = bt
+		} else if !tc.unify(result, bt) {
+			errors = append(errors, tc.mismatch(body, "all the cases of a match must have the same type, found %v and %v", result, bt))
+		}
+	}
+	for i, c := range e.Cases {
+		inner := s.push()
+		var types []Type
+		switch {
+		case c.Type == "":
+			// the linker has already complained
+		case t == nil || c.Type != t.Name:
+			errors = append(errors, errorAt(c, "%s is not a variant of %v", c.Tag, t))
+		case matchIndex(e.Cases[:i], c.Tag) >= 0:
+			errors = append(errors, errorAt(c, "duplicate case %s", c.Tag))
+		default:
+			types = t.Types[indexOf(t.Tags, c.Tag)]
+			if len(c.Vars) != len(types) {
+				plural := "s"
+				if len(types) == 1 {
+					plural = ""
+				}
+				errors = append(errors, errorAt(c, "case %s needs %d variable%s, found %d", c.Tag, len(types), plural, len(c.Vars)))
+				types = nil
+			}
+		}
+		for j, name := range c.Vars {
+			var vt Type = AnyT{}
+			if types != nil {
+				vt = types[j]
+			}
+			inner.vars[name] = vt
+			tc.define(name, vt)
+		}
+		bt, err := tc.typecheckExpr(inner, c.Body)
+		errors = append(errors, err)
+		unifyResult(bt, c.Body)
+	}
+	if e.Else != nil {
+		bt, err := tc.typecheckExpr(s, e.Else)
+		errors = append(errors, err)
+		unifyResult(bt, e.Else)
+	} else if t != nil {
+		var missing []string
+		for _, tag := range t.Tags {
+			if matchIndex(e.Cases, tag) < 0 {
+				missing = append(missing, tag)
+			}
+		}
+		if len(missing) > 0 {
+			errors = append(errors, errorAt(e, "match is not exhaustive: missing %s", strings.Join(missing, ", ")))
+		}
+	}
+	if result == nil {
+		result = AnyT{}
+	}
+	return result, multiError(errors...)
+}
+
+// matchIndex returns the index of the case for tag, or -1
+func matchIndex(cases []*MatchCase, tag string) int {
+	for i, c := range cases {
+		if c.Tag == tag {
+			return i
+		}
+	}
+	return -1
+}
+
+// typecheckField returns the type of a field of a record.
+// if the record's type isn't known yet, it is the record
+// which has a field by that name, if there is only one.
+func (tc *typechecker) typecheckField(e *DotExpr, t Type) (Type, error) {
+	if v, ok := prune(t).(*TypeVar); ok {
+		switch records := tc.fields[e.Right]; len(records) {
+		case 0:
+			return AnyT{}, errorAt(e, "no record type has a field %s", e.Right)
+		case 1:
+			tc.unify(v, records[0])
+		default:
+			return AnyT{}, errorAt(e, "field %s is in more than one record type; declare which one this is", e.Right)
+		}
+	}
+	switch r := prune(t).(type) {
+	case AnyT:
+		return AnyT{}, nil
+	case *RecordT:
+		i := indexOf(r.Fields, e.Right)
+		if i < 0 {
+			return AnyT{}, errorAt(e, "%v has no field %s", r, e.Right)
+		}
+		return r.Types[i], nil
+	default:
+		return AnyT{}, errorAt(e, "%v has no field %s", t, e.Right)
+	}
+}
+
+// indexOf returns the index of s in list, or -1
+func indexOf(list []string, s string) int {
+	for i := range list {
+		if list[i] == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// typeOf converts a type annotation to a Type
+func (tc *typechecker) typeOf(te TypeExpr) (Type, error) {
+	switch te := te.(type) {
+	case *NamedTypeExpr:
+		// record and variant types can shadow the built-in types
+		if t, ok := tc.named[te.Name]; ok {
+			if te.Args != nil {
+				return t, errorAt(te, "type %s does not take arguments", te.Name)
+			}
+			return t, nil
+		}
+		if te.Name == "tuple" {
+			types, err := tc.typeList(te.Args)
+			return &TupleT{Type: types}, err
+		}
+		if te.Name == "list" {
+			if len(te.Args) != 1 {
+				return AnyT{}, errorAt(te, "list takes 1 type argument, found %d", len(te.Args))
+			}
+			elem, err := tc.typeOf(te.Args[0])
+			return &ListT{Elem: elem}, err
+		}
+		if te.Name == "dict" {
+			if len(te.Args) != 2 {
+				return AnyT{}, errorAt(te, "dict takes 2 type arguments, found %d", len(te.Args))
+			}
+			types, err := tc.typeList(te.Args)
+			if err == nil {
+				err = checkKey(te.Args[0], types[0])
+			}
+			return &DictT{Key: types[0], Val: types[1]}, err
+		}
+		var t Type
+		switch te.Name {
+		case "int":
+			t = IntT{}
+		case "bool":
+			t = BoolT{}
+		case "str":
+			t = StrT{}
+		default:
+			var ok bool
+			if t, ok = primType(te.Name); !ok {
+				return AnyT{}, errorAt(te, "unknown type %s", te.Name)
+			}
+		}
+		if te.Args != nil {
+			return t, errorAt(te, "type %s does not take arguments", te.Name)
+		}
+		return t, nil
+	case *FuncTypeExpr:
+		params, err1 := tc.typeList(te.Params)
+		results, err2 := tc.typeList(te.Results)
+		return &FuncT{Params: params, Return: results}, multiError(err1, err2)
+	case *TupleTypeExpr:
+		types, err := tc.typeList(te.Types)
+		return &TupleT{Type: types}, err
+	default:
+		panic(fmt.Sprintf("unhandled case in typeOf: %T", te))
+	}
+}
+
+func (tc *typechecker) typeList(list []TypeExpr) ([]Type, error) {
+	var types = make([]Type, len(list))
+	var errors []error
+	for i := range list {
+		var err error
+		types[i], err = tc.typeOf(list[i])
+		errors = append(errors, err)
+	}
+	return types, multiError(errors...)
+}
+
+// concatOperand reports whether t can be an operand of ..
+// an operand whose type isn't known yet can still be either,
+// so its type variable is marked and unify checks whatever
+// it is bound to later. if it's never bound, the function it's in
+// is generic over it, and the runtime converts it if it's an int.
+func (tc *typechecker) concatOperand(t Type) bool {
+	switch t := prune(t).(type) {
+	case IntT, StrT, AnyT:
+		return true
+	case *TypeVar:
+		t.Concat = true
+		return true
+	}
+	return false
+}
+
+// genericArg reports whether t can be used for a type variable
+// of a generic function. the function is compiled once, for values
+// of any type, and the collector has to assume they might be pointers.
+// so it can't hold a raw prim.int32 or prim.int64, which could look
+// like one. a type variable which isn't bound yet is marked,
+// like in concatOperand.
+func (tc *typechecker) genericArg(t Type) bool {
+	switch t := prune(t).(type) {
+	case Int32T, Int64T:
+		return false
+	case *TypeVar:
+		t.Generic = true
+	}
+	return true
+}
+
+// binopType returns the result type of a binary operator
+func binopType(op string) Type {
+	switch op {
+	case "+", "-", "*", "/":
+		return IntT{}
+	case "..":
+		return StrT{}
+	default:
+		return BoolT{}
+	}
+}
+
 func isBuiltin(s string) bool {
 	switch s {
-	case "tuple", "get":
+	case "tuple", "get", "values", "len", "append":
+		return true
+	case "lookup", "set", "delete", "contains", "keys":
 		return true
 	default:
 		return false
 	}
 }
 
-func typecheckBuiltin(name string, args []Expr, s *scope) (Type, error) {
+func (tc *typechecker) typecheckBuiltin(call *CallExpr, name string, args []Expr, s *scope) (Type, error) {
 	switch name {
 	case "tuple":
 		var types = make([]Type, len(args))
 		var errors []error
 		for i := range args {
 			var err error
-			types[i], err = typecheckExpr(s, args[i])
+			types[i], err = tc.typecheckExpr(s, args[i])
 			if err != nil {
 				errors = append(errors, err)
 			}
 		}
 		return &TupleT{Type: types}, multiError(errors...)
+	case "values":
+		types, err := tc.typecheckValues(s, args)
+		if len(types) != 1 {
+			return AnyT{}, multiError(err, errorAt(call, "%d values used in a single-value context", len(types)))
+		}
+		return types[0], err
 	case "get":
 		if len(args) != 2 {
 			// TODO: still typecheck first arg, if present?
-			return AnyT{}, fmt.Errorf("get takes 2 arguments, found %d", len(args))
+			return AnyT{}, errorAt(call, "get takes 2 arguments, found %d", len(args))
 		}
-		t, err := typecheckExpr(s, args[0])
+		t, err := tc.typecheckExpr(s, args[0])
 		if err != nil {
 			return AnyT{}, err
 		}
+		// we can't infer the size of a tuple from a get,
+		// so its type has to be known already
+		t = prune(t)
 		if !isTupleT(t) {
-			return AnyT{}, fmt.Errorf("first argument to 'get' must be a tuple, found %T", t)
+			return AnyT{}, errorAt(args[0], "first argument to 'get' must be a tuple, found %v", t)
 		}
 		// *don't* typecheck the second arg; it must be a literal
 		if !isInt(args[1]) {
-			return AnyT{}, fmt.Errorf("second argument to 'get' must be an integer literal, found %#v", args[1])
+			return AnyT{}, errorAt(args[1], "second argument to 'get' must be an integer literal")
 		}
 		n, err := strconv.Atoi(args[1].(*IntExpr).Value)
 		if err != nil {
 			fatalf("couldn't parse tuple index: %v", err)
 		}
+		if n < 0 || n >= len(t.(*TupleT).Type) {
+			return AnyT{}, errorAt(args[1], "tuple index %d out of range", n)
+		}
 		return t.(*TupleT).Type[n], nil
+	case "len":
+		if len(args) != 1 {
+			return IntT{}, errorAt(call, "len takes 1 argument, found %d", len(args))
+		}
+		return tc.typecheckLen(s, args[0])
+	case "append":
+		if len(args) != 2 {
+			return AnyT{}, errorAt(call, "append takes 2 arguments, found %d", len(args))
+		}
+		return tc.typecheckAppend(s, args[0], args[1])
+	case "lookup", "set", "delete", "contains", "keys":
+		return tc.typecheckDictOp(s, call, name, args)
 	default:
 		fatalf("unknown builtin %s", name)
 	}
 	panic("unreachable")
 }
 
+// typecheckLen checks a use of len, which returns the length of a list
+func (tc *typechecker) typecheckLen(s *scope, list Expr) (Type, error) {
+	t, err := tc.typecheckExpr(s, list)
+	if err == nil && !tc.unify(t, &ListT{Elem: tc.newvar()}) {
+		err = tc.mismatch(list, "argument to 'len' must be a list, found %v", t)
+	}
+	return IntT{}, err
+}
+
+// typecheckAppend checks a use of append, which adds elem to the end of list
+// and returns the list
+func (tc *typechecker) typecheckAppend(s *scope, list, elem Expr) (Type, error) {
+	t1, err1 := tc.typecheckExpr(s, list)
+	t2, err2 := tc.typecheckExpr(s, elem)
+	want := &ListT{Elem: tc.newvar()}
+	if err1 == nil && !tc.unify(t1, want) {
+		return want, tc.mismatch(list, "first argument to 'append' must be a list, found %v", t1)
+	}
+	if err2 == nil && !tc.unify(want.Elem, t2) {
+		return want, tc.mismatch(elem, "cannot append %v to %v", t2, t1)
+	}
+	return want, multiError(err1, err2)
+}
+
+// the number of arguments each dict builtin takes, including the dict
+var dictOps = map[string]int{
+	"lookup":   2,
+	"set":      3,
+	"delete":   2,
+	"contains": 2,
+	"keys":     1,
+}
+
+// typecheckDictOp checks a use of one of the dict builtins.
+// the first argument is the dict, and the second, if there is one, is a key
+func (tc *typechecker) typecheckDictOp(s *scope, call Expr, op string, args []Expr) (Type, error) {
+	d := &DictT{Key: tc.newvar(), Val: tc.newvar()}
+	var result Type
+	switch op {
+	case "lookup":
+		result = d.Val
+	case "set", "delete":
+		result = d
+	case "contains":
+		result = BoolT{}
+	case "keys":
+		result = &ListT{Elem: d.Key}
+	default:
+		fatalf("unknown dict builtin %s", op)
+	}
+	if n := dictOps[op]; len(args) != n {
+		plural := "s"
+		if n == 1 {
+			plural = ""
+		}
+		tc.unify(d, &DictT{Key: AnyT{}, Val: AnyT{}})
+		return result, errorAt(call, "%s takes %d argument%s, found %d", op, n, plural, len(args))
+	}
+	var errors = make([]error, len(args))
+	var types = make([]Type, len(args))
+	for i := range args {
+		types[i], errors[i] = tc.typecheckExpr(s, args[i])
+	}
+	if errors[0] == nil && !tc.unify(types[0], d) {
+		tc.unify(d, &DictT{Key: AnyT{}, Val: AnyT{}})
+		return result, multiError(append(errors, tc.mismatch(args[0], "first argument to '%s' must be a dict, found %v", op, types[0]))...)
+	}
+	if len(args) >= 2 && errors[1] == nil {
+		if !tc.unify(d.Key, types[1]) {
+			errors[1] = tc.mismatch(args[1], "key of %v must be %v, found %v", types[0], d.Key, types[1])
+		} else {
+			errors[1] = checkKey(args[1], d.Key)
+		}
+	}
+	if len(args) >= 3 && errors[2] == nil && !tc.unify(d.Val, types[2]) {
+		errors[2] = tc.mismatch(args[2], "value of %v must be %v, found %v", types[0], d.Val, types[2])
+	}
+	return result, multiError(errors...)
+}
+
+// checkKey reports an error if values of type t can't be dict keys.
+// keys are hashed and compared by value, so they can only be
+// ints, bools, strings, and tuples of those.
+// a key whose type isn't known yet is allowed.
+func checkKey(e Expr, t Type) error {
+	if !isKeyType(t) {
+		return errorAt(e, "cannot use %v as a dict key", t)
+	}
+	return nil
+}
+
+func isKeyType(t Type) bool {
+	switch t := prune(t).(type) {
+	case IntT, BoolT, StrT, AnyT, *TypeVar:
+		return true
+	case *TupleT:
+		for _, x := range t.Type {
+			if !isKeyType(x) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// unify makes t1 and t2 the same type by binding type variables.
+// it reports whether it succeeded.
+// if it fails, some variables may have been bound anyway.
+func (tc *typechecker) unify(t1, t2 Type) bool {
+	tc.infinite, tc.notConcat, tc.notGeneric = nil, nil, nil
+	t1, t2 = prune(t1), prune(t2)
+	if v, ok := t1.(*TypeVar); ok {
+		if v == t2 {
+			return true
+		}
+		if occurs(v, t2) {
+			// infinite type. see mismatch
+			tc.infinite, tc.within = v, t2
+			return false
+		}
+		if v.Concat && !tc.concatOperand(t2) {
+			tc.notConcat = t2
+			return false
+		}
+		if v.Generic && !tc.genericArg(t2) {
+			// the other uses of the variable would fail the same way
+			tc.notGeneric = t2
+			v.Type = AnyT{}
+			return false
+		}
+		adjustLevels(t2, v.Level)
+		v.Type = t2
+		return true
+	}
+	if _, ok := t2.(*TypeVar); ok {
+		return tc.unify(t2, t1)
+	}
+	if (t1 == AnyT{} || t2 == AnyT{}) {
+		return true
+	}
+	switch t1 := t1.(type) {
+	case *FuncT:
+		t2, ok := t2.(*FuncT)
+		if !ok || len(t1.Params) != len(t2.Params) || len(t1.Return) != len(t2.Return) {
+			return false
+		}
+		for i := range t1.Params {
+			if !tc.unify(t1.Params[i], t2.Params[i]) {
+				return false
+			}
+		}
+		for i := range t1.Return {
+			if !tc.unify(t1.Return[i], t2.Return[i]) {
+				return false
+			}
+		}
+		return true
+	case *TupleT:
+		t2, ok := t2.(*TupleT)
+		if !ok || len(t1.Type) != len(t2.Type) {
+			return false
+		}
+		for i := range t1.Type {
+			if !tc.unify(t1.Type[i], t2.Type[i]) {
+				return false
+			}
+		}
+		return true
+	case *ListT:
+		t2, ok := t2.(*ListT)
+		return ok && tc.unify(t1.Elem, t2.Elem)
+	case *DictT:
+		t2, ok := t2.(*DictT)
+		return ok && tc.unify(t1.Key, t2.Key) && tc.unify(t1.Val, t2.Val)
+	default:
+		return t1 == t2
+	}
+}
+
+// mismatch reports that unify failed.
+// usually that's because the types don't match, which the message
+// explains, but if the last unify failed because a type would have had
+// to contain itself, like a function which is passed to itself,
+// or because an operand of .. would have been something other than
+// a str or an int, or a generic function would have been used with
+// a sized int, that's what it reports instead.
+//
+// if one of the types comes from an expression which already has an
+// error, the mismatch is most likely a consequence of that error,
+// so it isn't reported again.
+func (tc *typechecker) mismatch(e Expr, format string, v ...interface{}) error {
+	if tc.notGeneric != nil {
+		// the variable is AnyT now, so this comes first
+		t := tc.notGeneric
+		tc.infinite, tc.within, tc.notConcat, tc.notGeneric = nil, nil, nil, nil
+		return errorAt(e, "cannot use %v with a generic function; convert it to int", t)
+	}
+	for _, x := range v {
+		if hasAny(x) {
+			tc.infinite, tc.within, tc.notConcat = nil, nil, nil
+			return errBadExpr
+		}
+	}
+	if tc.infinite != nil {
+		v, t := tc.infinite, tc.within
+		tc.infinite, tc.within = nil, nil
+		return errorAt(e, "infinite type: %v would have to be %v", v, t)
+	}
+	if tc.notConcat != nil {
+		t := tc.notConcat
+		tc.notConcat = nil
+		return errorAt(e, "operands to .. must be str or int, found %v", t)
+	}
+	return errorAt(e, format, v...)
+}
+
+// prune follows bound type variables until it reaches
+// a type which isn't one
+func prune(t Type) Type {
+	for {
+		v, ok := t.(*TypeVar)
+		if !ok || v.Type == nil {
+			return t
+		}
+		t = v.Type
+	}
+}
+
+// occurs reports whether v appears in t
+func occurs(v *TypeVar, t Type) bool {
+	found := false
+	walkTypeVars(t, func(u *TypeVar) {
+		if u == v {
+			found = true
+		}
+	})
+	return found
+}
+
+// adjustLevels moves the unbound variables in t out to the given level,
+// if they are deeper than that.
+// a variable which is unified with a type from an outer let
+// can't be generalized by an inner one.
+func adjustLevels(t Type, level int) {
+	walkTypeVars(t, func(u *TypeVar) {
+		if u.Level > level {
+			u.Level = level
+		}
+	})
+}
+
+// hasAny reports whether x is a type which contains AnyT
+func hasAny(x interface{}) bool {
+	switch t := prune(x).(type) {
+	case AnyT:
+		return true
+	case *FuncT:
+		return hasAny(results(t.Params)) || hasAny(results(t.Return))
+	case *TupleT:
+		return hasAny(results(t.Type))
+	case *ListT:
+		return hasAny(t.Elem)
+	case *DictT:
+		return hasAny(t.Key) || hasAny(t.Val)
+	case results:
+		for _, r := range t {
+			if hasAny(r) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// walkTypeVars calls fn for each unbound type variable in t
+func walkTypeVars(t Type, fn func(*TypeVar)) {
+	switch t := prune(t).(type) {
+	case *TypeVar:
+		fn(t)
+	case *FuncT:
+		for _, p := range t.Params {
+			walkTypeVars(p, fn)
+		}
+		for _, r := range t.Return {
+			walkTypeVars(r, fn)
+		}
+	case *TupleT:
+		for _, x := range t.Type {
+			walkTypeVars(x, fn)
+		}
+	case *ListT:
+		walkTypeVars(t.Elem, fn)
+	case *DictT:
+		walkTypeVars(t.Key, fn)
+		walkTypeVars(t.Val, fn)
+	}
+}
+
+// generalize turns the type of a let-bound value into a Scheme
+// if it has any type variables which were created inside the let.
+// otherwise it returns the type unchanged.
+func (tc *typechecker) generalize(t Type) interface{} {
+	var vars []*TypeVar
+	walkTypeVars(t, func(u *TypeVar) {
+		if u.Level > tc.level {
+			for _, v := range vars {
+				if v == u {
+					return
+				}
+			}
+			vars = append(vars, u)
+		}
+	})
+	if len(vars) == 0 {
+		return t
+	}
+	return &Scheme{Vars: vars, Type: t}
+}
+
+// generalizeValue generalizes the type of a let-bound variable,
+// but only if its value is a function or some other value
+// which can't create a list or a dict. they are mutable, so a list(?1)
+// can't be generic: appending an int to it in one place
+// and a bool in another would break it.
+// the variables are moved out to the current level instead,
+// so that an enclosing let can't generalize them either.
+func (tc *typechecker) generalizeValue(s *scope, val Expr, t Type) interface{} {
+	if isValue(s, val) {
+		return tc.generalize(t)
+	}
+	adjustLevels(t, tc.level)
+	return t
+}
+
+// isValue reports whether an expression is a value:
+// a function, a literal, a variable, or a tuple of values
+func isValue(s *scope, e Expr) bool {
+	switch e := e.(type) {
+	case *FuncExpr, *VarExpr, *IntExpr, *StrExpr, *BoolExpr, *BadExpr:
+		return true
+	case *CallExpr:
+		if v, ok := e.Func.(*VarExpr); !ok || s.has(v.Name) || (v.Name != "tuple" && v.Name != "values") {
+			return false
+		}
+		return areValues(s, e.Args)
+	case *TupleExpr:
+		return areValues(s, e.Args)
+	case *ValuesExpr:
+		return areValues(s, e.Args)
+	}
+	return false
+}
+
+func areValues(s *scope, list []Expr) bool {
+	for _, e := range list {
+		if !isValue(s, e) {
+			return false
+		}
+	}
+	return true
+}
+
+// instantiate returns a copy of a scheme's type
+// with fresh type variables
+func (tc *typechecker) instantiate(sc *Scheme) Type {
+	fresh := make(map[*TypeVar]Type)
+	for _, v := range sc.Vars {
+		u := tc.newvar()
+		u.Concat = v.Concat
+		u.Generic = true
+		fresh[v] = u
+	}
+	var inst func(t Type) Type
+	inst = func(t Type) Type {
+		switch t := prune(t).(type) {
+		case *TypeVar:
+			if u, ok := fresh[t]; ok {
+				return u
+			}
+			return t
+		case *FuncT:
+			f := &FuncT{Params: make([]Type, len(t.Params)), Return: make([]Type, len(t.Return))}
+			for i := range t.Params {
+				f.Params[i] = inst(t.Params[i])
+			}
+			for i := range t.Return {
+				f.Return[i] = inst(t.Return[i])
+			}
+			return f
+		case *TupleT:
+			u := &TupleT{Type: make([]Type, len(t.Type))}
+			for i := range t.Type {
+				u.Type[i] = inst(t.Type[i])
+			}
+			return u
+		case *ListT:
+			return &ListT{Elem: inst(t.Elem)}
+		case *DictT:
+			return &DictT{Key: inst(t.Key), Val: inst(t.Val)}
+		default:
+			return t
+		}
+	}
+	return inst(sc.Type)
+}
+
+// resolve replaces the bound type variables in t with their types,
+// writing the inferred types back into any function and tuple types.
+// unbound variables are left alone; the value doesn't depend on them.
+func resolve(t Type) Type {
+	switch t := prune(t).(type) {
+	case *FuncT:
+		for i := range t.Params {
+			t.Params[i] = resolve(t.Params[i])
+		}
+		for i := range t.Return {
+			t.Return[i] = resolve(t.Return[i])
+		}
+		return t
+	case *TupleT:
+		for i := range t.Type {
+			t.Type[i] = resolve(t.Type[i])
+		}
+		return t
+	case *ListT:
+		t.Elem = resolve(t.Elem)
+		return t
+	case *DictT:
+		t.Key = resolve(t.Key)
+		t.Val = resolve(t.Val)
+		return t
+	default:
+		return t
+	}
+}
+
 // aggregates multiple errors.
 // strips out nils (may modify the input list).
 func multiError(errors ...error) error {
@@ -279,21 +1919,32 @@ func multiError(errors ...error) error {
 }
 
 func comparableTypes(t1, t2 Type) bool {
+	t1, t2 = prune(t1), prune(t2)
+	// an unbound variable could be anything;
+	// assume it'll be something comparable
+	if _, ok := t1.(*TypeVar); ok {
+		t1 = AnyT{}
+	}
+	if _, ok := t2.(*TypeVar); ok {
+		t2 = AnyT{}
+	}
 	switch {
 	case t1 == IntT{} && t2 == IntT{}:
 		return true
 	case t1 == BoolT{} && t2 == BoolT{}:
 		return true
+	case t1 == StrT{} && t2 == StrT{}:
+		return true
 	case t1 == AnyT{}:
 		switch t2.(type) {
-		case AnyT, IntT, BoolT:
+		case AnyT, IntT, BoolT, StrT:
 			return true
 		default:
 			return false
 		}
 	case t2 == AnyT{}:
 		switch t1.(type) {
-		case AnyT, IntT, BoolT:
+		case AnyT, IntT, BoolT, StrT:
 			return true
 		default:
 			return false
@@ -303,8 +1954,37 @@ func comparableTypes(t1, t2 Type) bool {
 	}
 }
 
+// sameType reports whether two types are structurally identical
 func sameType(t1, t2 Type) bool {
-	return t1 == t2
+	t1, t2 = prune(t1), prune(t2)
+	switch t1 := t1.(type) {
+	case *FuncT:
+		t2, ok := t2.(*FuncT)
+		return ok && sameTypes(t1.Params, t2.Params) && sameTypes(t1.Return, t2.Return)
+	case *TupleT:
+		t2, ok := t2.(*TupleT)
+		return ok && sameTypes(t1.Type, t2.Type)
+	case *ListT:
+		t2, ok := t2.(*ListT)
+		return ok && sameType(t1.Elem, t2.Elem)
+	case *DictT:
+		t2, ok := t2.(*DictT)
+		return ok && sameType(t1.Key, t2.Key) && sameType(t1.Val, t2.Val)
+	default:
+		return t1 == t2
+	}
+}
+
+func sameTypes(l1, l2 []Type) bool {
+	if len(l1) != len(l2) {
+		return false
+	}
+	for i := range l1 {
+		if !sameType(l1[i], l2[i]) {
+			return false
+		}
+	}
+	return true
 }
 
 func isTupleT(t Type) bool {
@@ -312,6 +1992,19 @@ func isTupleT(t Type) bool {
 	return ok
 }
 
+// mayPoint reports whether a value of type t can point into the heap.
+// tuples, lists, dicts, records, variants and strings always do
+// (except for string literals), and so do ints which are too big
+// to be small ints.
+// an AnyT could be any of them.
+func mayPoint(t Type) bool {
+	switch t.(type) {
+	case *TupleT, *ListT, *DictT, *RecordT, *VariantT, IntT, StrT, AnyT:
+		return true
+	}
+	return false
+}
+
 // Typecheck decorates a Prog with types.
 // It returns any type errors encountered.
 func Typecheck(*Prog) error {
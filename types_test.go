@@ -1,6 +1,7 @@
 package main
 
 import (
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
@@ -23,6 +24,61 @@ var typecheckTests = []struct {
 	{"if true then 1 else 0 end", IntT{}},
 	{"let a = true in let b = false in let c = true in (a or b) and (b or c) and (a or c) end end end", BoolT{}},
 	{"(func inf() 1+inf() end)()", IntT{}},
+	{"let fib = func fib(n) if n < 2 then 1 else fib(n-1) + fib(n-2) end end in fib(5) end", IntT{}},
+	{"let id = func(x) x end in if id(true) then id(1) else 2 end end", IntT{}},
+	{"let apply = func(f, x) f(x) end in apply(func(n) n < 1 end, 2) end", BoolT{}},
+	{"let eq = func(a, b) a == b end in eq(1, 2) and eq(true, false) end", BoolT{}},
+	{"let f = func(a int, b int) -> int a + b end in f(1, 2) end", IntT{}},
+	{"let x: int = 1 in x end", IntT{}},
+	{"let p: tuple(int, bool) = tuple(1, true) in get(p, 1) end", BoolT{}},
+	{"let p: (int, (bool, str)) = tuple(1, tuple(true, \"a\")) in get(get(p, 1), 0) end", BoolT{}},
+	{"let f = func(x int) -> tuple(int, bool) tuple(x, x < 1) end in get(f(1), 1) end", BoolT{}},
+	{"(func(t tuple(int, int)) get(t, 0) end)(tuple(1, 2))", IntT{}},
+	{"let apply = func(f func(int) -> int, x) f(x) end in apply(func(n) n end, 1) end", IntT{}},
+	{"tuple(1, true)", &TupleT{Type: []Type{IntT{}, BoolT{}}}},
+	{"func(n) n + 1 end", &FuncT{Params: []Type{IntT{}}, Return: []Type{IntT{}}}},
+	{"let q, r = (func(a, b) values(a / b, a - b) end)(7, 2) in q + r end", IntT{}},
+	{"let f = func(x int) -> (int, bool) values(x, x < 1) end in let a, b = f(1) in b end end", BoolT{}},
+	{"let a, b = if true then values(1, false) else values(2, true) end in b end", BoolT{}},
+	{"func(x) values(x + 1, true) end", &FuncT{Params: []Type{IntT{}}, Return: []Type{IntT{}, BoolT{}}}},
+	{"values(1)", IntT{}},
+	{"import \"psc/prim\" let s, c = prim.add32(prim.toint32(1), prim.one32) in prim.fromint32(s) + prim.fromint32(c) end", IntT{}},
+	{"import \"psc/prim\" prim.less64(prim.zero64, prim.one64)", BoolT{}},
+	{"import \"psc/prim\" let xs = [prim.one64] in prim.fromint64(append(xs, prim.zero64)[1]) end", IntT{}},
+	{"import \"psc/prim\" func(x prim.int32) prim.shl32(x, prim.one32) end", &FuncT{Params: []Type{Int32T{}}, Return: []Type{Int32T{}}}},
+	{`"a" .. "b"`, StrT{}},
+	{`"a" .. 1 .. 2`, StrT{}},
+	{`"a" < "b"`, BoolT{}},
+	{`let s: str = "a" in s == "a" end`, BoolT{}},
+	{`func(x, y) -> str x .. y end(1, "a")`, StrT{}},
+	{`let k = func(x) "k" .. x end in k(1) .. k("a") end`, StrT{}},
+	{`let f = func(x, y) x .. y end in f(1, 2) end`, StrT{}},
+	{`func(x) "a" <= x end`, &FuncT{Params: []Type{StrT{}}, Return: []Type{BoolT{}}}},
+	{"[1, 2, 3]", &ListT{Elem: IntT{}}},
+	{"[[true], []]", &ListT{Elem: &ListT{Elem: BoolT{}}}},
+	{"let xs = [1, 2] in xs[0] + len(xs) end", IntT{}},
+	{"append([], tuple(1, true))", &ListT{Elem: &TupleT{Type: []Type{IntT{}, BoolT{}}}}},
+	{"for x in [1, 2] do x < 2 end", &ListT{Elem: BoolT{}}},
+	{"func(xs, i) xs[i] + 1 end", &FuncT{Params: []Type{&ListT{Elem: IntT{}}, IntT{}}, Return: []Type{IntT{}}}},
+	{"let xs: list(str) = [] in xs end", &ListT{Elem: StrT{}}},
+	{"let empty = func() [] end in len(append(empty(), 1)) + len(append(empty(), true)) end", IntT{}},
+	{`{"a": 1, "b": 2}`, &DictT{Key: StrT{}, Val: IntT{}}},
+	{`lookup({tuple(1, true): "x"}, tuple(2, false))`, StrT{}},
+	{"let d = {} in contains(set(d, 1, true), 2) end", BoolT{}},
+	{"keys(delete({true: 1}, false))", &ListT{Elem: BoolT{}}},
+	{`func(d) lookup(d, "a") + 1 end`, &FuncT{Params: []Type{&DictT{Key: StrT{}, Val: IntT{}}}, Return: []Type{IntT{}}}},
+	{"let d: dict(str, list(int)) = {} in d end", &DictT{Key: StrT{}, Val: &ListT{Elem: IntT{}}}},
+	{"type point { x int, y int } point{y: 2, x: 1}.x", IntT{}},
+	{"type p { xs list(str) } p{xs: []}.xs", &ListT{Elem: StrT{}}},
+	// a is inferred to be a p, the only record with a field b
+	{"type p { x int, b bool } (func(a) a.b end)(p{x: 1, b: true})", BoolT{}},
+	// record types can refer to each other, and shadow the built-in types
+	{"type a { b b } type b { n int } a{b: b{n: 1}}.b.n", IntT{}},
+	{"type int { v bool } let x: int = int{v: true} in x.v end", BoolT{}},
+	{"type s = a(int) | b match a(1) case a(x) then x case b then 0 end", IntT{}},
+	{"type s = a(int) | b | c(bool) match b case c(x) then x else false end", BoolT{}},
+	// n is inferred to be a t from the cases
+	{"type t = leaf | node(t, int) (func(n) match n case leaf then 0 case node(l, v) then v end end)(leaf)", IntT{}},
 }
 
 var typecheckErrorTests = []struct {
@@ -30,15 +86,89 @@ var typecheckErrorTests = []struct {
 	typ   Type
 	error string
 }{
-	{"1 == 2 == 3", BoolT{}, "cannot compare main.BoolT and main.IntT"},
-	{"true + false", IntT{}, "operands to [+] must be IntT, found .*"},
-	{"true < false", BoolT{}, "operands to < must be IntT, found .*"},
+	{"1 == 2 == 3", BoolT{}, "cannot compare bool and int"},
+	{"true + false", IntT{}, "operands to [+] must be int, found .*"},
+	{"true < false", BoolT{}, "operands to < must be int, found .*"},
 	{"true == 1", BoolT{}, "cannot compare .* and .*"},
-	{"46 and 2", BoolT{}, "operands to 'and' must be BoolT, found .*"},
-	{"2 or 3", BoolT{}, "operands to 'or' must be BoolT, found .*"},
-	{"if 1 then 42 else 0 end", IntT{}, "condition must be BoolT"},
+	{`"a" == 1`, BoolT{}, "cannot compare str and int"},
+	{`"a" < 1`, BoolT{}, "operands to < must be str, found str and int"},
+	{`"a" + 1`, IntT{}, "operands to [+] must be int, found str and int"},
+	{`"a" .. true`, StrT{}, "operands to [.][.] must be str or int, found str and bool"},
+	{`let k = func(x) "k" .. x end in k(true) end`, StrT{}, "operands to [.][.] must be str or int, found bool$"},
+	{`let f = func(x) if "a" .. x == "ab" then 1 else if x then 2 else 3 end end end in 1 end`, IntT{}, "operands to [.][.] must be str or int, found bool$"},
+	{"[1, true]", &ListT{Elem: IntT{}}, "list elements must have the same type, found int and bool"},
+	{"1[0]", AnyT{}, "cannot index int"},
+	{`{"a": 1}["a"]`, AnyT{}, `cannot index dict\(str, int\); use lookup to get a value from a dict$`},
+	{"[1][true]", IntT{}, "list index must be int, found bool"},
+	{"for x in 1 do x end", &ListT{Elem: AnyT{}}, "cannot iterate over int"},
+	{"len(1)", IntT{}, "argument to 'len' must be a list, found int"},
+	{"len([1], [2])", IntT{}, "len takes 1 argument, found 2"},
+	{"append([1], true)", &ListT{Elem: IntT{}}, `cannot append bool to list\(int\)`},
+	{"let xs: list(int, bool) = [] in xs end", AnyT{}, "list takes 1 type argument, found 2"},
+	// the value restriction: xs isn't a value, so it isn't generalized
+	{"let xs = append([], 1) in append(xs, true) end", &ListT{Elem: IntT{}}, `cannot append bool to list\(int\)`},
+	{`{1: true, "a": false}`, &DictT{Key: IntT{}, Val: BoolT{}}, "dict keys must have the same type, found int and str"},
+	{`{1: true, 2: 3}`, &DictT{Key: IntT{}, Val: BoolT{}}, "dict values must have the same type, found bool and int"},
+	{"{[1]: 2}", &DictT{Key: &ListT{Elem: IntT{}}, Val: IntT{}}, `cannot use list\(int\) as a dict key`},
+	{"lookup([1], 0)", AnyT{}, "first argument to 'lookup' must be a dict, found list\\(int\\)"},
+	{`set({1: 2}, "a", 3)`, &DictT{Key: IntT{}, Val: IntT{}}, `key of dict\(int, int\) must be int, found str`},
+	{`set({1: 2}, 1, "a")`, &DictT{Key: IntT{}, Val: IntT{}}, `value of dict\(int, int\) must be int, found str`},
+	{"contains({1: 2})", BoolT{}, "contains takes 2 arguments, found 1"},
+	{"keys({1: 2}, 3)", &ListT{Elem: AnyT{}}, "keys takes 1 argument, found 2"},
+	{"let d: dict(func(), int) = {} in d end", &DictT{Key: &FuncT{}, Val: IntT{}}, `cannot use func\(\) as a dict key`},
+	{"let d = set({}, 1, 2) in set(d, true, 2) end", &DictT{Key: IntT{}, Val: IntT{}}, `key of dict\(int, int\) must be int, found bool`},
+	{"type p { x int } p{x: 1, y: 2}.x", AnyT{}, "p has no field y"},
+	{"type p { x int, y int } p{x: 1}.y", AnyT{}, "missing field y in p"},
+	{"type p { x int } p{x: 1, x: 2}.x", AnyT{}, "duplicate field x in p"},
+	{"type p { x int } p{x: true}.x", AnyT{}, "field x of p must be int, found bool"},
+	{"type p { x int } q{x: 1}", AnyT{}, "unknown record type q"},
+	{"type p { x int } p{x: 1}.y", AnyT{}, "p has no field y"},
+	{"type p { x int, x int } 1", IntT{}, "duplicate field x in type p"},
+	{"type p { x list } 1", IntT{}, "list takes 1 type argument, found 0"},
+	{"tuple(1, 2).x", AnyT{}, `\(int, int\) has no field x`},
+	{"(func(a) a.z end)(1)", AnyT{}, "no record type has a field z"},
+	{"type p { x int } type q { x int } (func(a) a.x end)(1)", AnyT{}, "field x is in more than one record type"},
+	{"type p { x int } p{x: 1} == p{x: 1}", BoolT{}, "cannot compare p and p"},
+	{"type s = a(int) | b match a(true) case a(x) then x else 0 end", IntT{}, "value 1 of a must be int, found bool"},
+	{"type s = a(int) | b match a(1, 2) case a(x) then x case b then 0 end", IntT{}, "a takes 1 value, found 2"},
+	{"type s = a(int) | b match b case a(x) then x end", IntT{}, "match is not exhaustive: missing b"},
+	{"type s = a(int) | b | c | d(bool) match b case b then 1 end", IntT{}, "match is not exhaustive: missing a, c, d$"},
+	{"type s = a(int) | b match b case a(x, y) then 1 case b then 2 end", IntT{}, "case a needs 1 variable, found 2"},
+	{"type s = a | b match b case b then 1 case a then 2 case b then 3 end", IntT{}, "duplicate case b"},
+	{`type s = a | b match a case a then 1 case b then "x" end`, IntT{}, "all the cases of a match must have the same type, found int and str"},
+	{"type s = a | b type t = c match a case a then 1 case c then 2 else 3 end", IntT{}, "c is not a variant of s"},
+	{"type s = a | b match 1 case a then 1 else 2 end", IntT{}, "cannot match int against the variants of s"},
+	{"46 and 2", BoolT{}, "operands to 'and' must be bool, found .*"},
+	{"2 or 3", BoolT{}, "operands to 'or' must be bool, found .*"},
+	{"if 1 then 42 else 0 end", IntT{}, "condition must be bool"},
 	{"if true then 42 else false end", AnyT{}, "both branches.*must have the same type, found"},
 	{"1(2)", AnyT{}, "cannot call non-function"},
+	{"let f = func(x) x + 1 end in f(true) end", IntT{}, "argument 0 is int, found bool"},
+	{"let f = func f(x) f end in 1 end", IntT{}, `infinite type: a would have to be func\(b\) -> a$`},
+	{"(func(g) if g(1) then g(true) else false end end)(func(x) true end)", AnyT{}, "argument 0 is int, found bool"},
+	{"let x: bool = 1 in x end", BoolT{}, "x is declared as bool, found int"},
+	{"let x: foo = 1 in x end", AnyT{}, "unknown type foo"},
+	{"(func(a int) -> bool a + 1 end)(1)", AnyT{}, "function is declared to return bool, found int"},
+	{"(func(a int) a end)(true)", IntT{}, "argument 0 is int, found bool"},
+	{"if true then tuple(1, true) else tuple(1, 2) end", AnyT{}, `found \(int, bool\) and \(int, int\)$`},
+	{"if true then func(x int) -> bool x < 1 end else 2 end", AnyT{}, `found func\(int\) -> bool and int$`},
+	{"let a, b = 1 in a end", AnyT{}, "assignment mismatch: 2 variables but 1 values"},
+	{"let f = func() values(1, 2) end in f() + 1 end", IntT{}, "function with multiple return values used in a single-value context"},
+	{"values(1, 2)", AnyT{}, "2 values used in a single-value context"},
+	{"(func(x) -> (int, int) x end)(1)", AnyT{}, `function is declared to return \(int, int\), found a$`},
+	{"let a, b = if true then values(1, 2) else values(1) end in a end", AnyT{}, `found \(int, int\) and int$`},
+	// type variables are named in the order they appear in the message
+	{"let f = func(g) g(1) + 0 end in f(func(x, y) x end) end", IntT{}, `argument 0 is func\(int\) -> int, found func\(a, b\) -> a$`},
+	{"let f = func(x) x(x) end in 1 end", IntT{}, `infinite type: a would have to be func\(a\) -> b$`},
+	{"let l = [] in len(append(l, l)) end", IntT{}, `infinite type: a would have to be list\(a\)$`},
+	{"prim.one32", AnyT{}, "prim not in scope"},
+	{"import \"psc/prim\" prim.add32(prim.zero32, prim.one32)", AnyT{}, "prim.add32 returns 2 values, used in a single-value context"},
+	{"import \"psc/prim\" prim.add32(prim.zero32, prim.one64)", AnyT{}, "argument 1 is prim.int32, found prim.int64"},
+	{"import \"psc/prim\" prim.frob32", AnyT{}, "prim.frob32 not in scope"},
+	{"import \"psc/prim\" prim.toint32", AnyT{}, "prim.toint32 must be called"},
+	// generic code can't hold sized ints, and the rest of the uses don't report it again
+	{"import \"psc/prim\" func push(xs, x) append(xs, x) end prim.fromint64(push([prim.one64], prim.zero64)[1])", IntT{}, `^[^\n]*:1:74: cannot use prim\.int64 with a generic function; convert it to int$`},
+	{"import \"psc/prim\" let id = func(x) x end in let p = tuple(id, 1) in get(p, 0)(prim.one32) end end", AnyT{}, `cannot use prim\.int32 with a generic function; convert it to int$`},
 }
 
 func TestTypecheck(t *testing.T) {
@@ -79,3 +209,113 @@ func TestTypecheck(t *testing.T) {
 		}
 	}
 }
+
+func TestTypecheckErrorPositions(t *testing.T) {
+	const source = "let x = 1 in\n  let y = true in\n    if y then x + y else z end\n  end\nend\n"
+	expr, err := parseReader("test.lang", strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	err = typecheck(expr)
+	if err == nil {
+		t.Fatal("expected errors but found none")
+	}
+	want := "test.lang:3:15: operands to + must be int, found int and bool\n" +
+		"test.lang:3:26: z not in scope"
+	if got := err.Error(); got != want {
+		t.Errorf("got errors:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestTypecheckErrorNames(t *testing.T) {
+	// the second x is renamed x.1,
+	// but the message uses the name in the source
+	const source = "let x = 1 in\n  let x: bool = x + 1 in x end\nend\n"
+	expr, err := parseReader("test.lang", strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	_, _, err = check(expr)
+	if err == nil {
+		t.Fatal("expected errors but found none")
+	}
+	want := "test.lang:2:17: x is declared as bool, found int"
+	if got := err.Error(); got != want {
+		t.Errorf("got errors:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestTypecheckErrorCascade(t *testing.T) {
+	// x and y already have errors,
+	// so the mismatches involving them aren't reported
+	const source = "let x = z in\n  let y = if true then 1 else false end in\n    (x and 1) .. (x .. true) .. (y or 2)\n  end\nend\n"
+	expr, err := parseReader("test.lang", strings.NewReader(source))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	err = typecheck(expr)
+	if err == nil {
+		t.Fatal("expected errors but found none")
+	}
+	want := "test.lang:1:9: z not in scope\n" +
+		"test.lang:2:11: both branches of an if must have the same type, found int and bool"
+	if got := err.Error(); got != want {
+		t.Errorf("got errors:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestTypecheckInference(t *testing.T) {
+	// the parameter and return types are inferred from the body
+	expr, err := parse(strings.NewReader("func(n, b) if b then n + 1 else 0 end end"))
+	if err != nil {
+		t.Fatal("parse failed: ", err)
+	}
+	typ, err := typecheck2(expr)
+	if err != nil {
+		t.Fatal("typecheck failed: ", err)
+	}
+	want := &FuncT{Params: []Type{IntT{}, BoolT{}}, Return: []Type{IntT{}}}
+	if !reflect.DeepEqual(typ, want) {
+		t.Errorf("got %#v, want %#v", typ, want)
+	}
+}
+
+func TestTypeString(t *testing.T) {
+	tests := []struct {
+		typ  Type
+		want string
+	}{
+		{IntT{}, "int"},
+		{BoolT{}, "bool"},
+		{&TupleT{Type: []Type{IntT{}, BoolT{}}}, "(int, bool)"},
+		{&TupleT{Type: []Type{IntT{}}}, "tuple(int)"},
+		{&FuncT{Params: []Type{IntT{}}, Return: []Type{IntT{}}}, "func(int) -> int"},
+		{&FuncT{Params: []Type{IntT{}, IntT{}}, Return: []Type{IntT{}, BoolT{}}}, "func(int, int) -> (int, bool)"},
+		{&FuncT{Params: []Type{IntT{}}, Return: []Type{&TupleT{Type: []Type{IntT{}, BoolT{}}}}}, "func(int) -> tuple(int, bool)"},
+		{&FuncT{}, "func()"},
+		{&ListT{Elem: &TupleT{}}, "list(tuple())"},
+		{&TypeVar{ID: 3}, "?3"},
+		{&TypeVar{ID: 3, Type: IntT{}}, "int"},
+	}
+	for _, tt := range tests {
+		if got := typeString(tt.typ); got != tt.want {
+			t.Errorf("typeString(%#v) = %q, want %q", tt.typ, got, tt.want)
+		}
+	}
+}
+
+func TestSameType(t *testing.T) {
+	pair := func() Type { return &TupleT{Type: []Type{IntT{}, &FuncT{Params: []Type{BoolT{}}}}} }
+	if !sameType(pair(), pair()) {
+		t.Errorf("separately allocated tuple types are not the same")
+	}
+	if !sameType(&TypeVar{Type: pair()}, pair()) {
+		t.Errorf("bound type variable is not the same as its type")
+	}
+	if sameType(pair(), &TupleT{Type: []Type{IntT{}, &FuncT{Params: []Type{IntT{}}}}}) {
+		t.Errorf("tuple types with different elements are the same")
+	}
+	if sameType(&ListT{Elem: IntT{}}, &ListT{Elem: BoolT{}}) {
+		t.Errorf("list(int) and list(bool) are the same")
+	}
+}
@@ -1,351 +1,764 @@
-// Code generated by goyacc - DO NOT EDIT.
+// Code generated by goyacc -o y.go -v  grammar.y. DO NOT EDIT.
+
+//line grammar.y:2
 
 package main
 
 import __yyfmt__ "fmt"
 
+//line grammar.y:3
+
+import "strings"
+
+func binExpr(op string, left, right Expr) Expr {
+	return &BinExpr{Span: between(left, right), Op: op, Left: left, Right: right}
+}
+
+// badExpr returns a BadExpr covering the gap between two tokens.
+// (the error token itself doesn't have a useful span.)
+func badExpr(before, after Span) Expr {
+	return &BadExpr{Span: Span{Start: before.End, End: after.Start}}
+}
+
+// dictExpr makes a dict literal out of alternating keys and values
+func dictExpr(span Span, pairs []Expr) Expr {
+	e := &DictExpr{Span: span}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		e.Keys = append(e.Keys, pairs[i])
+		e.Vals = append(e.Vals, pairs[i+1])
+	}
+	return e
+}
+
+// a param is a function parameter and its type, if it has one
+type param struct {
+	name string
+	typ  TypeExpr
+}
+
+// a fieldInit is the value of one field in a record constructor
+type fieldInit struct {
+	name string
+	val  Expr
+}
+
+func recordExpr(span Span, typ string, inits []fieldInit) Expr {
+	e := &RecordExpr{Span: span, Type: typ}
+	for _, f := range inits {
+		e.Fields = append(e.Fields, f.name)
+		e.Vals = append(e.Vals, f.val)
+	}
+	return e
+}
+
+// matchExpr makes a match expression. the variable which holds
+// the value gets a unique name from uniquify, like any other.
+func matchExpr(span Span, val Expr, cases []*MatchCase, els Expr) Expr {
+	return &MatchExpr{Span: span, Var: "$match", Val: val, Cases: cases, Else: els}
+}
+
+func typeDecl(span Span, name string, fields []param) *TypeDecl {
+	d := &TypeDecl{Span: span, Name: name}
+	for _, f := range fields {
+		d.Fields = append(d.Fields, f.name)
+		d.Types = append(d.Types, f.typ)
+	}
+	return d
+}
+
+func funcExpr(span Span, name string, params []param, results []TypeExpr, body Expr) *FuncExpr {
+	e := &FuncExpr{Span: span, Name: name, Body: body, ReturnTypes: results}
+	for _, p := range params {
+		e.Args = append(e.Args, p.name)
+	}
+	for i, p := range params {
+		if p.typ != nil {
+			if e.ArgTypes == nil {
+				e.ArgTypes = make([]TypeExpr, len(params))
+			}
+			e.ArgTypes[i] = p.typ
+		}
+	}
+	return e
+}
+
+// importDecls fills in the package for the modules in an import.
+// an import with no list of modules imports the package's base module,
+// which goes by the last element of the package's path.
+func importDecls(span Span, path string, list []*ImportDecl) []*ImportDecl {
+	version := ""
+	if i := strings.LastIndex(path, "@"); i >= 0 {
+		path, version = path[:i], path[i+1:]
+	}
+	if list == nil {
+		list = []*ImportDecl{{Span: span, Name: path[strings.LastIndex(path, "/")+1:]}}
+	}
+	for _, imp := range list {
+		imp.Package = path
+		imp.Version = version
+	}
+	return list
+}
+
+// newFile sorts out the items at the top level of a file.
+// a named function is a declaration; any other expression
+// is the result of the program, which has to come last.
+func newFile(l *lexer, imports []*ImportDecl, items []Decl) *File {
+	f := &File{Imports: imports}
+	for i, item := range items {
+		if fn, ok := item.(*FuncExpr); ok && fn.Name != "" {
+			item = &FuncDecl{Span: fn.Span, Func: fn}
+		}
+		switch d := item.(type) {
+		case *LetDecl, *TypeDecl:
+			f.Decls = append(f.Decls, d)
+		case *FuncDecl:
+			if d.Func.Name == "" {
+				l.errorAt(d.Span.Start, "a public function must have a name")
+			}
+			f.Decls = append(f.Decls, d)
+		default:
+			if i != len(items)-1 {
+				l.errorAt(spanOf(d).Start, "only the last item in a file can be an expression")
+			}
+			f.Body = d
+		}
+	}
+	return f
+}
+
+// qualifiedName is the name of a record type in another module, like geo.point
+func qualifiedName(l *lexer, mod Expr, name string) string {
+	v, ok := mod.(*VarExpr)
+	if !ok {
+		l.errorAt(spanOf(mod).Start, "record type must be a name or module.name")
+		return name
+	}
+	return v.Name + "." + name
+}
+
+// publicDecl marks a declaration as public
+func publicDecl(public Span, d Decl) Decl {
+	switch d := d.(type) {
+	case *LetDecl:
+		d.Public = true
+		d.Span.Start = public.Start
+	case *TypeDecl:
+		d.Public = true
+		d.Span.Start = public.Start
+	}
+	return d
+}
+
+//line grammar.y:149
 type yySymType struct {
 	yys      int
+	span     Span // every token has a span
 	ident    string
 	num      string
+	str      string
 	args     []string
+	params   []param
+	inits    []fieldInit
+	variants []*Variant
+	variant  *Variant
+	cases    []*MatchCase
+	mcase    *MatchCase
 	expr     Expr
 	exprlist []Expr
+	typ      TypeExpr
+	types    []TypeExpr
+	file     *File
+	imports  []*ImportDecl
+	decls    []Decl
+	decl     Decl
 }
 
-type yyXError struct {
-	state, xsym int
-}
-
-const (
-	yyDefault = 57358
-	yyEofCode = 57344
-	yyErrCode = 57345
-	kAnd      = 57355
-	kElse     = 57352
-	kEnd      = 57354
-	kFunc     = 57353
-	kIf       = 57350
-	kIn       = 57349
-	kLet      = 57348
-	kOr       = 57356
-	kThen     = 57351
-	tIdent    = 57346
-	tNumber   = 57347
-	unary     = 57357
-
-	yyMaxDepth = 200
-	yyTabOfs   = -41
-)
+const tIdent = 57346
+const tNumber = 57347
+const tString = 57348
+const kImport = 57349
+const kPublic = 57350
+const kType = 57351
+const kLet = 57352
+const kIn = 57353
+const kIf = 57354
+const kThen = 57355
+const kElse = 57356
+const kFunc = 57357
+const kEnd = 57358
+const kFor = 57359
+const kDo = 57360
+const kMatch = 57361
+const kCase = 57362
+const tArrow = 57363
+const tConcat = 57364
+const kAnd = 57365
+const kOr = 57366
+const unary = 57367
+
+var yyToknames = [...]string{
+	"$end",
+	"error",
+	"$unk",
+	"tIdent",
+	"tNumber",
+	"tString",
+	"kImport",
+	"kPublic",
+	"kType",
+	"kLet",
+	"kIn",
+	"kIf",
+	"kThen",
+	"kElse",
+	"kFunc",
+	"kEnd",
+	"kFor",
+	"kDo",
+	"kMatch",
+	"kCase",
+	"tArrow",
+	"tConcat",
+	"kAnd",
+	"kOr",
+	"'<'",
+	"'>'",
+	"'='",
+	"'+'",
+	"'-'",
+	"'*'",
+	"'/'",
+	"unary",
+	"'('",
+	"'['",
+	"'.'",
+	"'{'",
+	"')'",
+	"':'",
+	"'}'",
+	"','",
+	"'|'",
+	"']'",
+}
+
+var yyStatenames = [...]string{}
+
+const yyEofCode = 1
+const yyErrCode = 2
+const yyInitialStackSize = 16
+
+//line yacctab:1
+var yyExca = [...]int16{
+	-1, 0,
+	1, 4,
+	4, 4,
+	5, 4,
+	6, 4,
+	7, 4,
+	8, 4,
+	9, 4,
+	10, 4,
+	12, 4,
+	15, 4,
+	17, 4,
+	19, 4,
+	29, 4,
+	33, 4,
+	34, 4,
+	36, 4,
+	-2, 0,
+	-1, 1,
+	1, -1,
+	-2, 0,
+	-1, 23,
+	42, 122,
+	-2, 0,
+	-1, 24,
+	39, 129,
+	-2, 0,
+	-1, 51,
+	37, 122,
+	-2, 0,
+	-1, 57,
+	39, 136,
+	-2, 0,
+	-1, 109,
+	37, 124,
+	42, 124,
+	-2, 0,
+	-1, 111,
+	39, 131,
+	-2, 0,
+	-1, 129,
+	39, 136,
+	-2, 0,
+	-1, 152,
+	39, 138,
+	-2, 0,
+}
+
+const yyPrivate = 57344
+
+const yyLast = 1072
+
+var yyAct = [...]int16{
+	14, 203, 246, 236, 222, 223, 149, 138, 35, 102,
+	121, 61, 115, 53, 56, 46, 40, 41, 44, 45,
+	43, 47, 48, 49, 50, 108, 51, 52, 42, 192,
+	276, 259, 97, 75, 274, 134, 27, 28, 16, 154,
+	78, 220, 59, 81, 29, 98, 94, 30, 184, 32,
+	155, 31, 96, 190, 165, 152, 111, 95, 104, 96,
+	107, 18, 109, 92, 215, 17, 23, 189, 24, 151,
+	110, 229, 118, 46, 40, 41, 44, 45, 43, 47,
+	48, 49, 50, 127, 51, 52, 42, 49, 50, 199,
+	51, 52, 42, 27, 128, 289, 140, 142, 153, 144,
+	283, 147, 150, 280, 275, 46, 40, 41, 44, 45,
+	43, 47, 48, 49, 50, 263, 51, 52, 42, 140,
+	118, 112, 260, 172, 258, 206, 174, 176, 164, 140,
+	104, 170, 167, 133, 51, 52, 42, 101, 129, 179,
+	140, 27, 57, 34, 137, 183, 100, 245, 140, 27,
+	28, 16, 209, 194, 210, 59, 140, 29, 277, 186,
+	30, 185, 32, 193, 31, 187, 205, 166, 72, 119,
+	212, 27, 36, 77, 18, 230, 214, 178, 17, 23,
+	182, 24, 141, 82, 63, 285, 221, 140, 140, 204,
+	11, 226, 224, 150, 140, 284, 191, 71, 228, 227,
+	139, 271, 58, 60, 198, 140, 140, 270, 242, 67,
+	248, 249, 239, 251, 69, 267, 73, 47, 48, 49,
+	50, 140, 51, 52, 42, 79, 80, 140, 254, 84,
+	86, 87, 88, 89, 90, 91, 125, 93, 208, 123,
+	99, 140, 201, 114, 46, 272, 273, 44, 45, 43,
+	47, 48, 49, 50, 241, 51, 52, 42, 13, 39,
+	140, 27, 282, 181, 30, 124, 7, 130, 131, 257,
+	132, 213, 141, 9, 21, 262, 27, 286, 248, 135,
+	287, 169, 143, 168, 37, 38, 195, 122, 27, 105,
+	240, 27, 3, 1, 156, 175, 158, 160, 161, 163,
+	55, 76, 27, 27, 33, 8, 5, 126, 281, 173,
+	6, 4, 177, 46, 40, 41, 44, 45, 43, 47,
+	48, 49, 50, 46, 51, 52, 42, 2, 106, 47,
+	48, 49, 50, 15, 51, 52, 42, 171, 196, 197,
+	120, 148, 25, 26, 20, 27, 28, 16, 19, 10,
+	13, 12, 22, 29, 207, 66, 30, 65, 32, 62,
+	31, 247, 54, 103, 146, 216, 218, 219, 145, 117,
+	18, 116, 0, 225, 17, 23, 0, 24, 0, 0,
+	0, 0, 0, 0, 231, 232, 234, 235, 238, 0,
+	0, 0, 0, 244, 288, 0, 250, 0, 0, 252,
+	46, 40, 41, 44, 45, 43, 47, 48, 49, 50,
+	0, 51, 52, 42, 264, 265, 0, 0, 0, 0,
+	256, 0, 0, 0, 0, 0, 0, 238, 0, 0,
+	0, 46, 40, 41, 44, 45, 43, 47, 48, 49,
+	50, 279, 51, 52, 42, 278, 0, 0, 0, 0,
+	0, 46, 40, 41, 44, 45, 43, 47, 48, 49,
+	50, 269, 51, 52, 42, 0, 0, 46, 40, 41,
+	44, 45, 43, 47, 48, 49, 50, 268, 51, 52,
+	42, 0, 0, 46, 40, 41, 44, 45, 43, 47,
+	48, 49, 50, 266, 51, 52, 42, 0, 0, 46,
+	40, 41, 44, 45, 43, 47, 48, 49, 50, 261,
+	51, 52, 42, 0, 0, 46, 40, 41, 44, 45,
+	43, 47, 48, 49, 50, 255, 51, 52, 42, 0,
+	0, 46, 40, 41, 44, 45, 43, 47, 48, 49,
+	50, 253, 51, 52, 42, 0, 0, 46, 40, 41,
+	44, 45, 43, 47, 48, 49, 50, 243, 51, 52,
+	42, 0, 0, 46, 40, 41, 44, 45, 43, 47,
+	48, 49, 50, 0, 51, 52, 42, 237, 0, 27,
+	28, 16, 0, 0, 0, 59, 0, 29, 0, 0,
+	30, 0, 32, 0, 31, 0, 0, 233, 0, 27,
+	28, 16, 0, 0, 18, 59, 0, 29, 17, 23,
+	30, 24, 32, 0, 31, 0, 0, 0, 0, 0,
+	0, 180, 0, 0, 18, 0, 0, 0, 17, 23,
+	0, 24, 46, 40, 41, 44, 45, 43, 47, 48,
+	49, 50, 0, 51, 52, 42, 217, 0, 27, 28,
+	16, 0, 0, 0, 59, 0, 29, 0, 0, 30,
+	0, 32, 0, 31, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 18, 0, 0, 0, 17, 23, 211,
+	24, 0, 0, 46, 40, 41, 44, 45, 43, 47,
+	48, 49, 50, 202, 51, 52, 42, 0, 0, 0,
+	0, 46, 40, 41, 44, 45, 43, 47, 48, 49,
+	50, 200, 51, 52, 42, 0, 0, 0, 0, 46,
+	40, 41, 44, 45, 43, 47, 48, 49, 50, 0,
+	51, 52, 42, 136, 0, 27, 28, 16, 0, 0,
+	0, 59, 0, 29, 0, 0, 30, 0, 32, 0,
+	31, 0, 0, 0, 0, 0, 0, 188, 0, 0,
+	18, 0, 0, 0, 17, 23, 0, 24, 46, 40,
+	41, 44, 45, 43, 47, 48, 49, 50, 0, 51,
+	52, 42, 162, 0, 27, 28, 16, 0, 0, 0,
+	59, 0, 29, 0, 0, 30, 0, 32, 0, 31,
+	0, 0, 159, 0, 27, 28, 16, 0, 0, 18,
+	59, 0, 29, 17, 23, 30, 24, 32, 0, 31,
+	0, 0, 157, 0, 27, 28, 16, 0, 0, 18,
+	59, 0, 29, 17, 23, 30, 24, 32, 0, 31,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 18,
+	0, 0, 0, 17, 23, 122, 24, 46, 40, 41,
+	44, 45, 43, 47, 48, 49, 50, 113, 51, 52,
+	42, 0, 0, 0, 0, 0, 46, 40, 41, 44,
+	45, 43, 47, 48, 49, 50, 0, 51, 52, 42,
+	64, 0, 27, 28, 16, 0, 0, 0, 59, 0,
+	29, 0, 0, 30, 0, 32, 0, 31, 0, 0,
+	0, 0, 27, 28, 16, 0, 0, 18, 59, 0,
+	29, 17, 23, 30, 24, 32, 0, 31, 0, 0,
+	0, 0, 27, 28, 16, 85, 0, 18, 59, 0,
+	29, 17, 23, 30, 24, 32, 0, 31, 0, 0,
+	74, 0, 27, 28, 16, 83, 0, 18, 59, 0,
+	29, 17, 23, 30, 24, 32, 0, 31, 0, 0,
+	70, 0, 27, 28, 16, 0, 0, 18, 59, 0,
+	29, 17, 23, 30, 24, 32, 0, 31, 0, 0,
+	68, 0, 27, 28, 16, 0, 0, 18, 59, 0,
+	29, 17, 23, 30, 24, 32, 0, 31, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 18, 0, 0,
+	0, 17, 23, 0, 24, 46, 40, 41, 44, 45,
+	43, 47, 48, 49, 50, 0, 51, 52, 42, 27,
+	28, 16, 0, 0, 0, 59, 0, 29, 0, 0,
+	30, 0, 32, 0, 31, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 18, 0, 0, 0, 17, 23,
+	0, 24,
+}
+
+var yyPact = [...]int16{
+	290, -32768, -32768, -32768, 259, 341, -32768, 137, -32768, -32768,
+	249, 1003, 298, 272, 106, -32768, -32768, 1035, 1035, -32768,
+	-32768, -32768, -32768, 888, 988, -32768, -32768, -32768, -32768, 968,
+	164, 948, 299, 140, -32768, -32768, -32768, -32768, -32768, 272,
+	1035, 1035, 272, 156, 928, 908, 1035, 1035, 1035, 1035,
+	1035, 888, 1035, 19, 5, 224, 110, 287, 291, 298,
+	101, -17, 22, 1003, -32768, 31, 16, 83, -32768, 854,
+	230, 272, 136, 835, 223, 254, 220, -32768, 56, 222,
+	222, 102, 1035, 1035, 301, 1035, 301, 189, 57, 57,
+	101, 101, 96, -7, 731, 167, 272, 1035, 272, -32768,
+	272, 272, 30, 15, 60, -32768, -32768, 12, -32768, 820,
+	-32768, 800, 1035, 780, 1035, 91, -32768, 14, 167, 272,
+	267, -32768, 272, -32768, 1035, -32768, 89, 1035, 167, 287,
+	301, 301, 301, -32768, -32768, 610, 252, 153, -32768, 167,
+	126, 132, -32768, 746, -32768, 28, 13, 167, -12, -32768,
+	130, -32768, 284, 1035, 731, 167, 1003, -32768, 51, -32768,
+	1003, 697, 228, 679, 168, 272, -32768, 88, -32768, 1035,
+	-32768, 225, 119, 661, -32768, 139, 265, 1003, 149, 25,
+	644, 1035, 1035, 1, -32768, 272, 167, 167, 1035, -32768,
+	272, -32768, 272, 167, 33, -32768, 1003, 610, 148, 1035,
+	595, 1035, 1035, 575, 257, 167, 168, 541, 145, 272,
+	272, 1035, 272, -32768, 1035, -32768, 525, 212, 509, 409,
+	167, -32768, 87, -9, 85, 493, 167, -32768, 78, 1035,
+	1035, 1003, 477, 199, 461, 445, 191, 185, 1003, -32768,
+	167, -32768, 32, -32768, 1003, -32768, 67, -10, -32768, 125,
+	429, -32768, 1003, -32768, -32768, -32768, 1035, 66, -32768, 167,
+	168, -32768, -32768, -32768, 1003, 409, -32768, -32768, -32768, -32768,
+	-32768, -32768, 63, 179, 169, -32768, 272, 272, -32768, 378,
+	-32768, -32768, -32768, -32768, -32768, -32768, -32768, 58, -32768, -32768,
+}
+
+var yyPgo = [...]int16{
+	0, 12, 371, 369, 368, 364, 9, 363, 362, 2,
+	361, 11, 359, 357, 355, 184, 3, 274, 352, 348,
+	344, 343, 342, 341, 6, 340, 10, 337, 333, 0,
+	48, 7, 1, 4, 5, 327, 311, 310, 307, 306,
+	305, 273, 304, 295, 293,
+}
+
+var yyR1 = [...]int8{
+	0, 44, 44, 35, 36, 36, 37, 37, 42, 42,
+	42, 38, 38, 38, 43, 43, 39, 39, 40, 40,
+	40, 40, 41, 41, 41, 4, 4, 4, 5, 5,
+	41, 23, 23, 24, 24, 15, 15, 15, 15, 15,
+	15, 15, 15, 15, 15, 15, 15, 15, 15, 15,
+	15, 15, 15, 15, 19, 19, 19, 8, 8, 19,
+	19, 19, 15, 20, 20, 20, 20, 15, 17, 17,
+	17, 17, 1, 16, 2, 2, 2, 3, 3, 3,
+	3, 32, 32, 32, 30, 30, 31, 31, 31, 31,
+	33, 33, 33, 34, 34, 15, 18, 15, 15, 15,
+	15, 15, 15, 22, 22, 22, 25, 25, 26, 26,
+	27, 27, 27, 27, 9, 9, 9, 10, 10, 15,
+	21, 21, 11, 11, 11, 12, 12, 12, 12, 13,
+	13, 13, 14, 14, 14, 14, 6, 6, 6, 7,
+	7, 7, 7, 29, 28,
+}
+
+var yyR2 = [...]int8{
+	0, 1, 1, 2, 0, 2, 2, 5, 1, 1,
+	1, 0, 2, 3, 1, 3, 0, 2, 1, 2,
+	2, 1, 4, 6, 5, 0, 1, 2, 2, 4,
+	4, 1, 3, 1, 4, 1, 1, 1, 3, 3,
+	3, 3, 4, 4, 4, 3, 3, 3, 3, 3,
+	3, 3, 2, 1, 7, 9, 7, 3, 3, 3,
+	7, 7, 1, 7, 7, 7, 7, 1, 7, 8,
+	7, 8, 1, 1, 0, 1, 2, 1, 2, 3,
+	4, 0, 2, 4, 1, 5, 1, 3, 4, 5,
+	0, 1, 2, 1, 3, 1, 4, 3, 4, 3,
+	4, 6, 1, 4, 6, 3, 1, 2, 4, 4,
+	1, 4, 3, 6, 0, 1, 2, 1, 3, 1,
+	7, 3, 0, 1, 2, 1, 3, 1, 3, 0,
+	1, 2, 3, 5, 1, 3, 0, 1, 2, 3,
+	5, 1, 3, 1, 1,
+}
+
+var yyChk = [...]int16{
+	-32768, -44, -35, 2, -36, -39, -37, 7, -40, -41,
+	8, -15, 10, 9, -29, -28, 6, 33, 29, -19,
+	-20, -17, -18, 34, 36, -22, -21, 4, 5, 12,
+	15, 19, 17, -42, 6, -29, 35, -41, -17, 10,
+	23, 24, 35, 27, 25, 26, 22, 28, 29, 30,
+	31, 33, 34, -29, -8, 2, -29, 36, -15, 10,
+	-15, -11, -12, -15, 2, -13, -14, -15, 2, -15,
+	2, 33, 4, -15, 2, -29, 2, 33, -29, -15,
+	-15, -29, 27, 27, -15, 27, -15, -15, -15, -15,
+	-15, -15, -11, -15, 27, 38, 40, 27, 40, 16,
+	36, 27, -6, -7, -29, 2, 37, -29, 42, 40,
+	39, 40, 38, 13, 13, -1, -2, -3, -29, 33,
+	-25, -26, 20, 16, 11, 16, -38, 27, 38, 36,
+	-15, -15, -15, 37, 42, -15, 2, -30, -31, 33,
+	-29, 15, -29, -15, -29, -4, -5, -29, -23, -24,
+	-29, 39, 40, 38, 27, 38, -15, 2, -15, 2,
+	-15, -15, 2, -15, 37, 40, -30, -1, 16, 14,
+	-26, -27, -29, -15, 37, -43, -29, -15, -30, -6,
+	11, 11, 27, -34, -30, 35, 33, 33, 11, 39,
+	40, -30, 41, 33, -29, 2, -15, -15, -30, 38,
+	14, 14, 14, -32, 21, -29, 37, -15, 13, 33,
+	35, 18, 31, 6, 27, 39, -15, 2, -15, -15,
+	40, -29, -33, -34, -33, -15, -29, -24, -33, 38,
+	27, -15, -15, 2, -15, -15, -16, 2, -15, -31,
+	33, -30, -32, 16, -15, 2, -9, -10, -29, -29,
+	-15, -29, -15, 16, 16, 16, 11, -30, 37, 40,
+	37, 16, -30, 37, -15, -15, 16, 16, 16, 16,
+	16, 16, -33, -16, 2, 37, 40, 33, 16, -15,
+	37, -30, -32, 37, 16, 16, -29, -9, 16, 37,
+}
+
+var yyDef = [...]int16{
+	-2, -2, 1, 2, 16, 3, 5, 0, 17, 18,
+	0, 21, 0, 0, 35, 36, 37, 0, 0, 53,
+	62, 67, 95, -2, -2, 102, 119, 143, 144, 0,
+	0, 0, 0, 6, 8, 9, 10, 19, 20, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, -2, 0, 0, 0, 0, 0, -2, 0, 0,
+	52, 0, 123, 125, 127, 0, 130, 0, 134, 0,
+	0, 74, 0, 0, 0, 0, 0, 11, 0, 39,
+	40, 41, 0, 0, 45, 0, 46, 47, 48, 49,
+	50, 51, 0, 0, 0, 0, 0, 0, 0, 59,
+	25, 0, 0, 137, 0, 141, 38, 0, 97, -2,
+	99, -2, 0, 0, 0, 0, 72, 75, 77, 74,
+	0, 106, 0, 105, 0, 121, 0, 0, 0, -2,
+	42, 43, 44, 96, 98, 22, 0, 0, 84, 0,
+	86, 0, 57, 0, 58, 0, 26, 0, 30, 31,
+	33, 100, -2, 0, 0, 0, 126, 128, 0, 135,
+	132, 0, 0, 0, 81, 76, 78, 0, 103, 0,
+	107, 0, 110, 0, 7, 12, 14, 22, 0, 0,
+	0, 0, 0, 0, 93, 0, 90, 90, 0, 24,
+	27, 28, 0, 90, 0, 142, 139, 0, 0, 0,
+	0, 0, 0, 0, 0, 79, 81, 0, 0, 114,
+	0, 0, 0, 13, 0, 101, 0, 0, 0, 23,
+	0, 87, 0, 91, 0, 0, 0, 32, 0, 0,
+	0, 133, 0, 0, 0, 0, 0, 0, 73, 82,
+	90, 80, 0, 104, 108, 109, 0, 115, 117, 112,
+	0, 15, 23, 54, 61, 60, 0, 94, 88, 92,
+	81, 56, 29, 34, 140, 0, 63, 66, 65, 64,
+	68, 70, 0, 0, 0, 111, 116, 114, 120, 0,
+	85, 94, 89, 83, 69, 71, 118, 0, 55, 113,
+}
+
+var yyTok1 = [...]int8{
+	1, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	33, 37, 30, 28, 40, 29, 35, 31, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 38, 3,
+	25, 27, 26, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 34, 3, 42, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 36, 41, 39,
+}
+
+var yyTok2 = [...]int8{
+	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
+	12, 13, 14, 15, 16, 17, 18, 19, 20, 21,
+	22, 23, 24, 32,
+}
+
+var yyTok3 = [...]int8{
+	0,
+}
+
+var yyErrorMessages = [...]struct {
+	state int
+	token int
+	msg   string
+}{}
+
+//line yaccpar:1
+
+/*	parser for yacc output	*/
 
 var (
-	yyPrec = map[int]int{
-		kAnd:  0,
-		kOr:   0,
-		'<':   1,
-		'>':   1,
-		'=':   1,
-		'+':   2,
-		'-':   2,
-		'*':   3,
-		'/':   3,
-		unary: 4,
-		'(':   5,
-		'.':   6,
-	}
-
-	yyXLAT = map[int]int{
-		40:    0,  // '(' (62x)
-		45:    1,  // '-' (60x)
-		41:    2,  // ')' (43x)
-		61:    3,  // '=' (41x)
-		42:    4,  // '*' (37x)
-		43:    5,  // '+' (37x)
-		46:    6,  // '.' (37x)
-		47:    7,  // '/' (37x)
-		60:    8,  // '<' (37x)
-		62:    9,  // '>' (37x)
-		57355: 10, // kAnd (37x)
-		57356: 11, // kOr (37x)
-		44:    12, // ',' (33x)
-		57354: 13, // kEnd (32x)
-		57344: 14, // $end (29x)
-		57346: 15, // tIdent (29x)
-		57368: 16, // ident (28x)
-		57352: 17, // kElse (28x)
-		57349: 18, // kIn (28x)
-		57351: 19, // kThen (28x)
-		57363: 20, // call (23x)
-		57364: 21, // expr (23x)
-		57367: 22, // func (23x)
-		57369: 23, // if (23x)
-		57353: 24, // kFunc (23x)
-		57350: 25, // kIf (23x)
-		57348: 26, // kLet (23x)
-		57370: 27, // let (23x)
-		57371: 28, // num (23x)
-		57347: 29, // tNumber (23x)
-		57359: 30, // arglist0 (2x)
-		57360: 31, // arglist1 (2x)
-		57361: 32, // args (2x)
-		57362: 33, // body (2x)
-		57365: 34, // exprlist0 (1x)
-		57366: 35, // exprlist1 (1x)
-		57372: 36, // top (1x)
-		57358: 37, // $default (0x)
-		57345: 38, // error (0x)
-		57357: 39, // unary (0x)
-	}
-
-	yySymNames = []string{
-		"'('",
-		"'-'",
-		"')'",
-		"'='",
-		"'*'",
-		"'+'",
-		"'.'",
-		"'/'",
-		"'<'",
-		"'>'",
-		"kAnd",
-		"kOr",
-		"','",
-		"kEnd",
-		"$end",
-		"tIdent",
-		"ident",
-		"kElse",
-		"kIn",
-		"kThen",
-		"call",
-		"expr",
-		"func",
-		"if",
-		"kFunc",
-		"kIf",
-		"kLet",
-		"let",
-		"num",
-		"tNumber",
-		"arglist0",
-		"arglist1",
-		"args",
-		"body",
-		"exprlist0",
-		"exprlist1",
-		"top",
-		"$default",
-		"error",
-		"unary",
-	}
-
-	yyTokenLiteralStrings = map[int]string{}
-
-	yyReductions = map[int]struct{ xsym, components int }{
-		0:  {0, 1},
-		1:  {36, 1},
-		2:  {21, 1},
-		3:  {21, 1},
-		4:  {21, 3},
-		5:  {21, 3},
-		6:  {21, 3},
-		7:  {21, 3},
-		8:  {21, 4},
-		9:  {21, 4},
-		10: {21, 4},
-		11: {21, 3},
-		12: {21, 3},
-		13: {21, 3},
-		14: {21, 3},
-		15: {21, 3},
-		16: {21, 3},
-		17: {21, 2},
-		18: {21, 1},
-		19: {27, 7},
-		20: {21, 1},
-		21: {23, 7},
-		22: {21, 1},
-		23: {22, 6},
-		24: {22, 7},
-		25: {32, 1},
-		26: {33, 1},
-		27: {30, 0},
-		28: {30, 1},
-		29: {30, 2},
-		30: {31, 1},
-		31: {31, 3},
-		32: {21, 1},
-		33: {20, 4},
-		34: {34, 0},
-		35: {34, 1},
-		36: {34, 2},
-		37: {35, 1},
-		38: {35, 3},
-		39: {16, 1},
-		40: {28, 1},
-	}
-
-	yyXErrors = map[yyXError]string{}
-
-	yyParseTab = [80][]uint8{
-		// 0
-		{46, 47, 15: 55, 44, 20: 54, 43, 52, 50, 53, 51, 49, 48, 45, 56, 36: 42},
-		{14: 41},
-		{80, 77, 3: 73, 78, 76, 72, 79, 74, 75, 70, 71, 14: 40},
-		{39, 39, 39, 39, 39, 39, 39, 39, 39, 39, 39, 39, 39, 39, 39, 17: 39, 39, 39},
-		{38, 38, 38, 38, 38, 38, 38, 38, 38, 38, 38, 38, 38, 38, 38, 17: 38, 38, 38},
-		// 5
-		{46, 47, 15: 55, 44, 20: 54, 119, 52, 50, 53, 51, 49, 48, 45, 56},
-		{46, 47, 15: 55, 44, 20: 54, 118, 52, 50, 53, 51, 49, 48, 45, 56},
-		{23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 23, 17: 23, 23, 23},
-		{15: 55, 112},
-		{21, 21, 21, 21, 21, 21, 21, 21, 21, 21, 21, 21, 21, 21, 21, 17: 21, 21, 21},
-		// 10
-		{46, 47, 15: 55, 44, 20: 54, 106, 52, 50, 53, 51, 49, 48, 45, 56},
-		{19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 19, 17: 19, 19, 19},
-		{57, 15: 58},
-		{9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9, 17: 9, 9, 9},
-		{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 17: 2, 2, 2},
-		// 15
-		{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 17: 1, 1, 1},
-		{2: 14, 15: 55, 63, 30: 61, 62, 102},
-		{59},
-		{2: 14, 15: 55, 63, 30: 61, 62, 60},
-		{2: 66},
-		// 20
-		{2: 16},
-		{2: 13, 12: 64},
-		{2: 11, 12: 11},
-		{2: 12, 15: 55, 65},
-		{2: 10, 12: 10},
-		// 25
-		{46, 47, 15: 55, 44, 20: 54, 67, 52, 50, 53, 51, 49, 48, 45, 56, 33: 68},
-		{80, 77, 3: 73, 78, 76, 72, 79, 74, 75, 70, 71, 13: 15},
-		{13: 69},
-		{17, 17, 17, 17, 17, 17, 17, 17, 17, 17, 17, 17, 17, 17, 17, 17: 17, 17, 17},
-		{46, 47, 15: 55, 44, 20: 54, 101, 52, 50, 53, 51, 49, 48, 45, 56},
-		// 30
-		{46, 47, 15: 55, 44, 20: 54, 100, 52, 50, 53, 51, 49, 48, 45, 56},
-		{15: 55, 99},
-		{3: 97},
-		{46, 47, 3: 95, 15: 55, 44, 20: 54, 94, 52, 50, 53, 51, 49, 48, 45, 56},
-		{46, 47, 3: 92, 15: 55, 44, 20: 54, 91, 52, 50, 53, 51, 49, 48, 45, 56},
-		// 35
-		{46, 47, 15: 55, 44, 20: 54, 90, 52, 50, 53, 51, 49, 48, 45, 56},
-		{46, 47, 15: 55, 44, 20: 54, 89, 52, 50, 53, 51, 49, 48, 45, 56},
-		{46, 47, 15: 55, 44, 20: 54, 88, 52, 50, 53, 51, 49, 48, 45, 56},
-		{46, 47, 15: 55, 44, 20: 54, 87, 52, 50, 53, 51, 49, 48, 45, 56},
-		{46, 47, 7, 15: 55, 44, 20: 54, 81, 52, 50, 53, 51, 49, 48, 45, 56, 34: 82, 83},
-		// 40
-		{80, 77, 4, 73, 78, 76, 72, 79, 74, 75, 70, 71, 4},
-		{2: 86},
-		{2: 6, 12: 84},
-		{46, 47, 5, 15: 55, 44, 20: 54, 85, 52, 50, 53, 51, 49, 48, 45, 56},
-		{80, 77, 3, 73, 78, 76, 72, 79, 74, 75, 70, 71, 3},
-		// 45
-		{8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 17: 8, 8, 8},
-		{80, 25, 25, 25, 25, 25, 72, 25, 25, 25, 25, 25, 25, 25, 25, 17: 25, 25, 25},
-		{80, 26, 26, 26, 26, 26, 72, 26, 26, 26, 26, 26, 26, 26, 26, 17: 26, 26, 26},
-		{80, 27, 27, 27, 78, 27, 72, 79, 27, 27, 27, 27, 27, 27, 27, 17: 27, 27, 27},
-		{80, 28, 28, 28, 78, 28, 72, 79, 28, 28, 28, 28, 28, 28, 28, 17: 28, 28, 28},
-		// 50
-		{80, 77, 29, 29, 78, 76, 72, 79, 29, 29, 29, 29, 29, 29, 29, 17: 29, 29, 29},
-		{46, 47, 15: 55, 44, 20: 54, 93, 52, 50, 53, 51, 49, 48, 45, 56},
-		{80, 77, 31, 31, 78, 76, 72, 79, 31, 31, 31, 31, 31, 31, 31, 17: 31, 31, 31},
-		{80, 77, 30, 30, 78, 76, 72, 79, 30, 30, 30, 30, 30, 30, 30, 17: 30, 30, 30},
-		{46, 47, 15: 55, 44, 20: 54, 96, 52, 50, 53, 51, 49, 48, 45, 56},
-		// 55
-		{80, 77, 32, 32, 78, 76, 72, 79, 32, 32, 32, 32, 32, 32, 32, 17: 32, 32, 32},
-		{46, 47, 15: 55, 44, 20: 54, 98, 52, 50, 53, 51, 49, 48, 45, 56},
-		{80, 77, 33, 33, 78, 76, 72, 79, 33, 33, 33, 33, 33, 33, 33, 17: 33, 33, 33},
-		{34, 34, 34, 34, 34, 34, 34, 34, 34, 34, 34, 34, 34, 34, 34, 17: 34, 34, 34},
-		{80, 77, 35, 73, 78, 76, 72, 79, 74, 75, 35, 35, 35, 35, 35, 17: 35, 35, 35},
-		// 60
-		{80, 77, 36, 73, 78, 76, 72, 79, 74, 75, 36, 36, 36, 36, 36, 17: 36, 36, 36},
-		{2: 103},
-		{46, 47, 15: 55, 44, 20: 54, 67, 52, 50, 53, 51, 49, 48, 45, 56, 33: 104},
-		{13: 105},
-		{18, 18, 18, 18, 18, 18, 18, 18, 18, 18, 18, 18, 18, 18, 18, 17: 18, 18, 18},
-		// 65
-		{80, 77, 3: 73, 78, 76, 72, 79, 74, 75, 70, 71, 19: 107},
-		{46, 47, 15: 55, 44, 20: 54, 108, 52, 50, 53, 51, 49, 48, 45, 56},
-		{80, 77, 3: 73, 78, 76, 72, 79, 74, 75, 70, 71, 17: 109},
-		{46, 47, 15: 55, 44, 20: 54, 110, 52, 50, 53, 51, 49, 48, 45, 56},
-		{80, 77, 3: 73, 78, 76, 72, 79, 74, 75, 70, 71, 13: 111},
-		// 70
-		{20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 20, 17: 20, 20, 20},
-		{3: 113},
-		{46, 47, 15: 55, 44, 20: 54, 114, 52, 50, 53, 51, 49, 48, 45, 56},
-		{80, 77, 3: 73, 78, 76, 72, 79, 74, 75, 70, 71, 18: 115},
-		{46, 47, 15: 55, 44, 20: 54, 116, 52, 50, 53, 51, 49, 48, 45, 56},
-		// 75
-		{80, 77, 3: 73, 78, 76, 72, 79, 74, 75, 70, 71, 13: 117},
-		{22, 22, 22, 22, 22, 22, 22, 22, 22, 22, 22, 22, 22, 22, 22, 17: 22, 22, 22},
-		{80, 24, 24, 24, 24, 24, 72, 24, 24, 24, 24, 24, 24, 24, 24, 17: 24, 24, 24},
-		{80, 77, 120, 73, 78, 76, 72, 79, 74, 75, 70, 71},
-		{37, 37, 37, 37, 37, 37, 37, 37, 37, 37, 37, 37, 37, 37, 37, 17: 37, 37, 37},
-	}
+	yyDebug        = 0
+	yyErrorVerbose = false
 )
 
-var yyDebug = 0
-
 type yyLexer interface {
 	Lex(lval *yySymType) int
 	Error(s string)
 }
 
-type yyLexerEx interface {
-	yyLexer
-	Reduced(rule, state int, lval *yySymType) bool
+type yyParser interface {
+	Parse(yyLexer) int
+	Lookahead() int
 }
 
-func yySymName(c int) (s string) {
-	x, ok := yyXLAT[c]
-	if ok {
-		return yySymNames[x]
+type yyParserImpl struct {
+	lval  yySymType
+	stack [yyInitialStackSize]yySymType
+	char  int
+}
+
+func (p *yyParserImpl) Lookahead() int {
+	return p.char
+}
+
+func yyNewParser() yyParser {
+	return &yyParserImpl{}
+}
+
+const yyFlag = -32768
+
+func yyTokname(c int) string {
+	if c >= 1 && c-1 < len(yyToknames) {
+		if yyToknames[c-1] != "" {
+			return yyToknames[c-1]
+		}
 	}
+	return __yyfmt__.Sprintf("tok-%v", c)
+}
+
+func yyStatname(s int) string {
+	if s >= 0 && s < len(yyStatenames) {
+		if yyStatenames[s] != "" {
+			return yyStatenames[s]
+		}
+	}
+	return __yyfmt__.Sprintf("state-%v", s)
+}
+
+func yyErrorMessage(state, lookAhead int) string {
+	const TOKSTART = 4
+
+	if !yyErrorVerbose {
+		return "syntax error"
+	}
+
+	for _, e := range yyErrorMessages {
+		if e.state == state && e.token == lookAhead {
+			return "syntax error: " + e.msg
+		}
+	}
+
+	res := "syntax error: unexpected " + yyTokname(lookAhead)
+
+	// To match Bison, suggest at most four expected tokens.
+	expected := make([]int, 0, 4)
+
+	// Look for shiftable tokens.
+	base := int(yyPact[state])
+	for tok := TOKSTART; tok-1 < len(yyToknames); tok++ {
+		if n := base + tok; n >= 0 && n < yyLast && int(yyChk[int(yyAct[n])]) == tok {
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+	}
+
+	if yyDef[state] == -2 {
+		i := 0
+		for yyExca[i] != -1 || int(yyExca[i+1]) != state {
+			i += 2
+		}
+
+		// Look for tokens that we accept or reduce.
+		for i += 2; yyExca[i] >= 0; i += 2 {
+			tok := int(yyExca[i])
+			if tok < TOKSTART || yyExca[i+1] == 0 {
+				continue
+			}
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
 
-	if c < 0x7f {
-		return __yyfmt__.Sprintf("%q", c)
+		// If the default action is to accept or reduce, give up.
+		if yyExca[i+1] != 0 {
+			return res
+		}
 	}
 
-	return __yyfmt__.Sprintf("%d", c)
+	for i, tok := range expected {
+		if i == 0 {
+			res += ", expecting "
+		} else {
+			res += " or "
+		}
+		res += yyTokname(tok)
+	}
+	return res
 }
 
-func yylex1(yylex yyLexer, lval *yySymType) (n int) {
-	n = yylex.Lex(lval)
-	if n <= 0 {
-		n = yyEofCode
+func yylex1(lex yyLexer, lval *yySymType) (char, token int) {
+	token = 0
+	char = lex.Lex(lval)
+	if char <= 0 {
+		token = int(yyTok1[0])
+		goto out
+	}
+	if char < len(yyTok1) {
+		token = int(yyTok1[char])
+		goto out
+	}
+	if char >= yyPrivate {
+		if char < yyPrivate+len(yyTok2) {
+			token = int(yyTok2[char-yyPrivate])
+			goto out
+		}
+	}
+	for i := 0; i < len(yyTok3); i += 2 {
+		token = int(yyTok3[i+0])
+		if token == char {
+			token = int(yyTok3[i+1])
+			goto out
+		}
+	}
+
+out:
+	if token == 0 {
+		token = int(yyTok2[1]) /* unknown char */
 	}
 	if yyDebug >= 3 {
-		__yyfmt__.Printf("\nlex %s(%#x %d), lval: %+v\n", yySymName(n), n, n, lval)
+		__yyfmt__.Printf("lex %s(%d)\n", yyTokname(token), uint(char))
 	}
-	return n
+	return char, token
 }
 
 func yyParse(yylex yyLexer) int {
-	const yyError = 38
+	return yyNewParser().Parse(yylex)
+}
 
-	yyEx, _ := yylex.(yyLexerEx)
+func (yyrcvr *yyParserImpl) Parse(yylex yyLexer) int {
 	var yyn int
-	var yylval yySymType
 	var yyVAL yySymType
-	yyS := make([]yySymType, 200)
+	var yyDollar []yySymType
+	_ = yyDollar // silence set and not used
+	yyS := yyrcvr.stack[:]
 
 	Nerrs := 0   /* number of errors */
 	Errflag := 0 /* error recovery flag */
-	yyerrok := func() {
-		if yyDebug >= 2 {
-			__yyfmt__.Printf("yyerrok()\n")
-		}
-		Errflag = 0
-	}
-	_ = yyerrok
 	yystate := 0
-	yychar := -1
-	var yyxchar int
-	var yyshift int
+	yyrcvr.char = -1
+	yytoken := -1 // yyrcvr.char translated into internal numbering
+	defer func() {
+		// Make sure we report no lookahead when not parsing.
+		yystate = -1
+		yyrcvr.char = -1
+		yytoken = -1
+	}()
 	yyp := -1
 	goto yystack
 
@@ -357,6 +770,10 @@ ret1:
 
 yystack:
 	/* put a state and value onto the stack */
+	if yyDebug >= 4 {
+		__yyfmt__.Printf("char %v in %v\n", yyTokname(yytoken), yyStatname(yystate))
+	}
+
 	yyp++
 	if yyp >= len(yyS) {
 		nyys := make([]yySymType, len(yyS)*2)
@@ -367,85 +784,66 @@ yystack:
 	yyS[yyp].yys = yystate
 
 yynewstate:
-	if yychar < 0 {
-		yylval.yys = yystate
-		yychar = yylex1(yylex, &yylval)
-		var ok bool
-		if yyxchar, ok = yyXLAT[yychar]; !ok {
-			yyxchar = len(yySymNames) // > tab width
-		}
+	yyn = int(yyPact[yystate])
+	if yyn <= yyFlag {
+		goto yydefault /* simple state */
 	}
-	if yyDebug >= 4 {
-		var a []int
-		for _, v := range yyS[:yyp+1] {
-			a = append(a, v.yys)
-		}
-		__yyfmt__.Printf("state stack %v\n", a)
+	if yyrcvr.char < 0 {
+		yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 	}
-	row := yyParseTab[yystate]
-	yyn = 0
-	if yyxchar < len(row) {
-		if yyn = int(row[yyxchar]); yyn != 0 {
-			yyn += yyTabOfs
-		}
+	yyn += yytoken
+	if yyn < 0 || yyn >= yyLast {
+		goto yydefault
 	}
-	switch {
-	case yyn > 0: // shift
-		yychar = -1
-		yyVAL = yylval
+	yyn = int(yyAct[yyn])
+	if int(yyChk[yyn]) == yytoken { /* valid shift */
+		yyrcvr.char = -1
+		yytoken = -1
+		yyVAL = yyrcvr.lval
 		yystate = yyn
-		yyshift = yyn
-		if yyDebug >= 2 {
-			__yyfmt__.Printf("shift, and goto state %d\n", yystate)
-		}
 		if Errflag > 0 {
 			Errflag--
 		}
 		goto yystack
-	case yyn < 0: // reduce
-	case yystate == 1: // accept
-		if yyDebug >= 2 {
-			__yyfmt__.Println("accept")
-		}
-		goto ret0
 	}
 
+yydefault:
+	/* default state action */
+	yyn = int(yyDef[yystate])
+	if yyn == -2 {
+		if yyrcvr.char < 0 {
+			yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
+		}
+
+		/* look through exception table */
+		xi := 0
+		for {
+			if yyExca[xi+0] == -1 && int(yyExca[xi+1]) == yystate {
+				break
+			}
+			xi += 2
+		}
+		for xi += 2; ; xi += 2 {
+			yyn = int(yyExca[xi+0])
+			if yyn < 0 || yyn == yytoken {
+				break
+			}
+		}
+		yyn = int(yyExca[xi+1])
+		if yyn < 0 {
+			goto ret0
+		}
+	}
 	if yyn == 0 {
 		/* error ... attempt to resume parsing */
 		switch Errflag {
 		case 0: /* brand new error */
+			yylex.Error(yyErrorMessage(yystate, yytoken))
+			Nerrs++
 			if yyDebug >= 1 {
-				__yyfmt__.Printf("no action for %s in state %d\n", yySymName(yychar), yystate)
-			}
-			msg, ok := yyXErrors[yyXError{yystate, yyxchar}]
-			if !ok {
-				msg, ok = yyXErrors[yyXError{yystate, -1}]
+				__yyfmt__.Printf("%s", yyStatname(yystate))
+				__yyfmt__.Printf(" saw %s\n", yyTokname(yytoken))
 			}
-			if !ok && yyshift != 0 {
-				msg, ok = yyXErrors[yyXError{yyshift, yyxchar}]
-			}
-			if !ok {
-				msg, ok = yyXErrors[yyXError{yyshift, -1}]
-			}
-			if yychar > 0 {
-				ls := yyTokenLiteralStrings[yychar]
-				if ls == "" {
-					ls = yySymName(yychar)
-				}
-				if ls != "" {
-					switch {
-					case msg == "":
-						msg = __yyfmt__.Sprintf("unexpected %s", ls)
-					default:
-						msg = __yyfmt__.Sprintf("unexpected %s, %s", ls, msg)
-					}
-				}
-			}
-			if msg == "" {
-				msg = "syntax error"
-			}
-			yylex.Error(msg)
-			Nerrs++
 			fallthrough
 
 		case 1, 2: /* incompletely recovered error ... try again */
@@ -453,14 +851,10 @@ yynewstate:
 
 			/* find a state where "error" is a legal shift action */
 			for yyp >= 0 {
-				row := yyParseTab[yyS[yyp].yys]
-				if yyError < len(row) {
-					yyn = int(row[yyError]) + yyTabOfs
-					if yyn > 0 { // hit
-						if yyDebug >= 2 {
-							__yyfmt__.Printf("error recovery found error shift in state %d\n", yyS[yyp].yys)
-						}
-						yystate = yyn /* simulate a shift of "error" */
+				yyn = int(yyPact[yyS[yyp].yys]) + yyErrCode
+				if yyn >= 0 && yyn < yyLast {
+					yystate = int(yyAct[yyn]) /* simulate a shift of "error" */
+					if int(yyChk[yystate]) == yyErrCode {
 						goto yystack
 					}
 				}
@@ -472,31 +866,33 @@ yynewstate:
 				yyp--
 			}
 			/* there is no state on the stack with an error shift ... abort */
-			if yyDebug >= 2 {
-				__yyfmt__.Printf("error recovery failed\n")
-			}
 			goto ret1
 
 		case 3: /* no shift yet; clobber input char */
 			if yyDebug >= 2 {
-				__yyfmt__.Printf("error recovery discards %s\n", yySymName(yychar))
+				__yyfmt__.Printf("error recovery discards %s\n", yyTokname(yytoken))
 			}
-			if yychar == yyEofCode {
+			if yytoken == yyEofCode {
 				goto ret1
 			}
-
-			yychar = -1
+			yyrcvr.char = -1
+			yytoken = -1
 			goto yynewstate /* try again in the same state */
 		}
 	}
 
-	r := -yyn
-	x0 := yyReductions[r]
-	x, n := x0.xsym, x0.components
+	/* reduction by production yyn */
+	if yyDebug >= 2 {
+		__yyfmt__.Printf("reduce %v in:\n\t%v\n", yyn, yyStatname(yystate))
+	}
+
+	yynt := yyn
 	yypt := yyp
 	_ = yypt // guard against "declared and not used"
 
-	yyp -= n
+	yyp -= int(yyR2[yyn])
+	// yyp is now the index of $0. Perform the default action. Iff the
+	// reduced production is ε, $1 is possibly out of range.
 	if yyp+1 >= len(yyS) {
 		nyys := make([]yySymType, len(yyS)*2)
 		copy(nyys, yyS)
@@ -505,131 +901,730 @@ yynewstate:
 	yyVAL = yyS[yyp+1]
 
 	/* consult goto table to find next state */
-	exState := yystate
-	yystate = int(yyParseTab[yyS[yyp].yys][x]) + yyTabOfs
-	/* reduction by production r */
-	if yyDebug >= 2 {
-		__yyfmt__.Printf("reduce using rule %v (%s), and goto state %d\n", r, yySymNames[x], yystate)
+	yyn = int(yyR1[yyn])
+	yyg := int(yyPgo[yyn])
+	yyj := yyg + yyS[yyp].yys + 1
+
+	if yyj >= yyLast {
+		yystate = int(yyAct[yyg])
+	} else {
+		yystate = int(yyAct[yyj])
+		if int(yyChk[yystate]) != -yyn {
+			yystate = int(yyAct[yyg])
+		}
 	}
+	// dummy call; replaced with literal code
+	switch yynt {
 
-	switch r {
 	case 1:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:216
 		{
-			yylex.(*lexer).result = yyS[yypt-0].expr
+			yylex.(*lexer).result = yyDollar[1].file
 		}
 	case 2:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:217
 		{
-			yyVAL.expr = &VarExpr{yyS[yypt-0].ident}
+			yylex.(*lexer).result = &File{Body: &BadExpr{}}
 		}
 	case 3:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line grammar.y:221
 		{
-			yyVAL.expr = &IntExpr{yyS[yypt-0].num}
+			yyVAL.file = newFile(yylex.(*lexer), yyDollar[1].imports, yyDollar[2].decls)
 		}
 	case 4:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line grammar.y:223
 		{
-			yyVAL.expr = yyS[yypt-1].expr
+			yyVAL.imports = nil
 		}
 	case 5:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line grammar.y:224
 		{
-			yyVAL.expr = &AndExpr{yyS[yypt-2].expr, yyS[yypt-0].expr}
+			yyVAL.imports = append(yyDollar[1].imports, yyDollar[2].imports...)
 		}
 	case 6:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line grammar.y:229
 		{
-			yyVAL.expr = &OrExpr{yyS[yypt-2].expr, yyS[yypt-0].expr}
+			yyVAL.imports = importDecls(between(yyDollar[1].span, yyDollar[2].span), yyDollar[2].str, nil)
 		}
 	case 7:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line grammar.y:230
 		{
-			yyVAL.expr = &DotExpr{".", yyS[yypt-2].expr, yyS[yypt-0].ident}
-		}
-	case 8:
-		{
-			yyVAL.expr = &BinExpr{"eq", yyS[yypt-3].expr, yyS[yypt-0].expr}
+			yyVAL.imports = importDecls(between(yyDollar[1].span, yyDollar[5].span), yyDollar[2].str, yyDollar[4].imports)
 		}
 	case 9:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:233
 		{
-			yyVAL.expr = &BinExpr{"<=", yyS[yypt-3].expr, yyS[yypt-0].expr}
+			yyVAL.str = yyDollar[1].ident
 		}
 	case 10:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:234
 		{
-			yyVAL.expr = &BinExpr{">=", yyS[yypt-3].expr, yyS[yypt-0].expr}
+			yyVAL.str = "."
 		}
 	case 11:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line grammar.y:236
 		{
-			yyVAL.expr = &BinExpr{"<", yyS[yypt-2].expr, yyS[yypt-0].expr}
+			yyVAL.imports = []*ImportDecl{}
 		}
 	case 12:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line grammar.y:237
 		{
-			yyVAL.expr = &BinExpr{">", yyS[yypt-2].expr, yyS[yypt-0].expr}
+			yyVAL.imports = append(yyDollar[1].imports, &ImportDecl{Span: yyDollar[2].span, Module: yyDollar[2].str, Name: yyDollar[2].str[strings.LastIndex(yyDollar[2].str, "/")+1:]})
 		}
 	case 13:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:238
 		{
-			yyVAL.expr = &BinExpr{"+", yyS[yypt-2].expr, yyS[yypt-0].expr}
+			yyVAL.imports = append(yyDollar[1].imports, &ImportDecl{Span: between(yyDollar[2].span, yyDollar[3].span), Module: yyDollar[3].str, Name: yyDollar[2].ident})
 		}
 	case 14:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:240
 		{
-			yyVAL.expr = &BinExpr{"-", yyS[yypt-2].expr, yyS[yypt-0].expr}
+			yyVAL.str = yyDollar[1].ident
 		}
 	case 15:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:241
 		{
-			yyVAL.expr = &BinExpr{"*", yyS[yypt-2].expr, yyS[yypt-0].expr}
+			yyVAL.str = yyDollar[1].str + "/" + yyDollar[3].ident
+			yyVAL.span = between(yyDollar[1].span, yyDollar[3].span)
 		}
 	case 16:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line grammar.y:248
 		{
-			yyVAL.expr = &BinExpr{"/", yyS[yypt-2].expr, yyS[yypt-0].expr}
+			yyVAL.decls = nil
 		}
 	case 17:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line grammar.y:249
 		{
-			yyVAL.expr = &BinExpr{"-", &IntExpr{"0"}, yyS[yypt-0].expr}
+			yyVAL.decls = append(yyDollar[1].decls, yyDollar[2].decl)
 		}
 	case 19:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line grammar.y:252
 		{
-			yyVAL.expr = &LetExpr{Var: yyS[yypt-5].ident, Val: yyS[yypt-3].expr, Body: yyS[yypt-1].expr}
+			yyVAL.decl = publicDecl(yyDollar[1].span, yyDollar[2].decl)
+		}
+	case 20:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line grammar.y:253
+		{
+			yyVAL.decl = &FuncDecl{Span: between(yyDollar[1].span, yyDollar[2].expr), Public: true, Func: yyDollar[2].expr.(*FuncExpr)}
 		}
 	case 21:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:254
 		{
-			yyVAL.expr = &IfExpr{yyS[yypt-5].expr, yyS[yypt-3].expr, yyS[yypt-1].expr}
+			yyVAL.decl = yyDollar[1].expr
+		}
+	case 22:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:256
+		{
+			yyVAL.decl = &LetDecl{Span: between(yyDollar[1].span, yyDollar[4].expr), Var: yyDollar[2].ident, Val: yyDollar[4].expr}
 		}
 	case 23:
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line grammar.y:257
 		{
-			yyVAL.expr = &FuncExpr{"", yyS[yypt-3].args, yyS[yypt-1].expr}
+			yyVAL.decl = &LetDecl{Span: between(yyDollar[1].span, yyDollar[6].expr), Var: yyDollar[2].ident, Type: yyDollar[4].typ, Val: yyDollar[6].expr}
 		}
 	case 24:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line grammar.y:260
 		{
-			yyVAL.expr = &FuncExpr{yyS[yypt-5].ident, yyS[yypt-3].args, yyS[yypt-1].expr}
+			yyVAL.decl = typeDecl(between(yyDollar[1].span, yyDollar[5].span), yyDollar[2].ident, yyDollar[4].params)
 		}
-	case 27:
+	case 25:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line grammar.y:262
 		{
-			yyVAL.args = nil
+			yyVAL.params = nil
+		}
+	case 28:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line grammar.y:265
+		{
+			yyVAL.params = []param{{name: yyDollar[1].ident, typ: yyDollar[2].typ}}
+		}
+	case 29:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:266
+		{
+			yyVAL.params = append(yyDollar[1].params, param{name: yyDollar[3].ident, typ: yyDollar[4].typ})
 		}
 	case 30:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:269
 		{
-			yyVAL.args = []string{yyS[yypt-0].ident}
+			yyVAL.decl = &TypeDecl{Span: between(yyDollar[1].span, yyDollar[4].variants[len(yyDollar[4].variants)-1]), Name: yyDollar[2].ident, Variants: yyDollar[4].variants}
 		}
 	case 31:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:271
+		{
+			yyVAL.variants = []*Variant{yyDollar[1].variant}
+		}
+	case 32:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:272
 		{
-			yyVAL.args = append(yyS[yypt-2].args, yyS[yypt-0].ident)
+			yyVAL.variants = append(yyDollar[1].variants, yyDollar[3].variant)
 		}
 	case 33:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:273
 		{
-			yyVAL.expr = &CallExpr{Func: yyS[yypt-3].expr, Args: yyS[yypt-1].exprlist}
+			yyVAL.variant = &Variant{Span: yyDollar[1].span, Tag: yyDollar[1].ident}
 		}
 	case 34:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:274
 		{
-			yyVAL.exprlist = nil
+			yyVAL.variant = &Variant{Span: between(yyDollar[1].span, yyDollar[4].span), Tag: yyDollar[1].ident, Types: yyDollar[3].types}
+		}
+	case 35:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:276
+		{
+			yyVAL.expr = &VarExpr{Span: yyDollar[1].span, Name: yyDollar[1].ident}
+		}
+	case 36:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:277
+		{
+			yyVAL.expr = &IntExpr{Span: yyDollar[1].span, Value: yyDollar[1].num}
 		}
 	case 37:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:278
 		{
-			yyVAL.exprlist = []Expr{yyS[yypt-0].expr}
+			yyVAL.expr = &StrExpr{Span: yyDollar[1].span, Value: yyDollar[1].str}
 		}
 	case 38:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:279
 		{
-			yyVAL.exprlist = append(yyS[yypt-2].exprlist, yyS[yypt-0].expr)
+			yyVAL.expr = yyDollar[2].expr
+		}
+	case 39:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:286
+		{
+			yyVAL.expr = &AndExpr{Span: between(yyDollar[1].expr, yyDollar[3].expr), Left: yyDollar[1].expr, Right: yyDollar[3].expr}
+		}
+	case 40:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:287
+		{
+			yyVAL.expr = &OrExpr{Span: between(yyDollar[1].expr, yyDollar[3].expr), Left: yyDollar[1].expr, Right: yyDollar[3].expr}
+		}
+	case 41:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:289
+		{
+			yyVAL.expr = &DotExpr{Span: between(yyDollar[1].expr, yyDollar[3].span), Op: ".", Left: yyDollar[1].expr, Right: yyDollar[3].ident}
+		}
+	case 42:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:291
+		{
+			yyVAL.expr = binExpr("eq", yyDollar[1].expr, yyDollar[4].expr)
+		}
+	case 43:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:292
+		{
+			yyVAL.expr = binExpr("<=", yyDollar[1].expr, yyDollar[4].expr)
+		}
+	case 44:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:293
+		{
+			yyVAL.expr = binExpr(">=", yyDollar[1].expr, yyDollar[4].expr)
+		}
+	case 45:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:294
+		{
+			yyVAL.expr = binExpr("<", yyDollar[1].expr, yyDollar[3].expr)
+		}
+	case 46:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:295
+		{
+			yyVAL.expr = binExpr(">", yyDollar[1].expr, yyDollar[3].expr)
+		}
+	case 47:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:297
+		{
+			yyVAL.expr = binExpr("..", yyDollar[1].expr, yyDollar[3].expr)
+		}
+	case 48:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:299
+		{
+			yyVAL.expr = binExpr("+", yyDollar[1].expr, yyDollar[3].expr)
+		}
+	case 49:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:300
+		{
+			yyVAL.expr = binExpr("-", yyDollar[1].expr, yyDollar[3].expr)
+		}
+	case 50:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:301
+		{
+			yyVAL.expr = binExpr("*", yyDollar[1].expr, yyDollar[3].expr)
+		}
+	case 51:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:302
+		{
+			yyVAL.expr = binExpr("/", yyDollar[1].expr, yyDollar[3].expr)
+		}
+	case 52:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line grammar.y:304
+		{
+			yyVAL.expr = &BinExpr{Span: between(yyDollar[1].span, yyDollar[2].expr), Op: "-", Left: &IntExpr{Span: yyDollar[1].span, Value: "0"}, Right: yyDollar[2].expr, Neg: true}
+		}
+	case 54:
+		yyDollar = yyS[yypt-7 : yypt+1]
+//line grammar.y:307
+		{
+			yyVAL.expr = &LetExpr{Span: between(yyDollar[1].span, yyDollar[7].span), Var: yyDollar[2].ident, Val: yyDollar[4].expr, Body: yyDollar[6].expr}
+		}
+	case 55:
+		yyDollar = yyS[yypt-9 : yypt+1]
+//line grammar.y:308
+		{
+			yyVAL.expr = &LetExpr{Span: between(yyDollar[1].span, yyDollar[9].span), Var: yyDollar[2].ident, Type: yyDollar[4].typ, Val: yyDollar[6].expr, Body: yyDollar[8].expr}
+		}
+	case 56:
+		yyDollar = yyS[yypt-7 : yypt+1]
+//line grammar.y:309
+		{
+			yyVAL.expr = &LetValuesExpr{Span: between(yyDollar[1].span, yyDollar[7].span), Vars: yyDollar[2].args, Val: yyDollar[4].expr, Body: yyDollar[6].expr}
+		}
+	case 57:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:312
+		{
+			yyVAL.args = []string{yyDollar[1].ident, yyDollar[3].ident}
+		}
+	case 58:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:313
+		{
+			yyVAL.args = append(yyDollar[1].args, yyDollar[3].ident)
+		}
+	case 59:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:318
+		{
+			yyVAL.expr = &BadExpr{Span: between(yyDollar[1].span, yyDollar[3].span)}
+		}
+	case 60:
+		yyDollar = yyS[yypt-7 : yypt+1]
+//line grammar.y:319
+		{
+			yyVAL.expr = &LetExpr{Span: between(yyDollar[1].span, yyDollar[7].span), Var: yyDollar[2].ident, Val: badExpr(yyDollar[3].span, yyDollar[5].span), Body: yyDollar[6].expr}
+		}
+	case 61:
+		yyDollar = yyS[yypt-7 : yypt+1]
+//line grammar.y:320
+		{
+			yyVAL.expr = &LetExpr{Span: between(yyDollar[1].span, yyDollar[7].span), Var: yyDollar[2].ident, Val: yyDollar[4].expr, Body: badExpr(yyDollar[5].span, yyDollar[7].span)}
+		}
+	case 63:
+		yyDollar = yyS[yypt-7 : yypt+1]
+//line grammar.y:323
+		{
+			yyVAL.expr = &IfExpr{Span: between(yyDollar[1].span, yyDollar[7].span), Cond: yyDollar[2].expr, Then: yyDollar[4].expr, Else: yyDollar[6].expr}
+		}
+	case 64:
+		yyDollar = yyS[yypt-7 : yypt+1]
+//line grammar.y:324
+		{
+			yyVAL.expr = &IfExpr{Span: between(yyDollar[1].span, yyDollar[7].span), Cond: badExpr(yyDollar[1].span, yyDollar[3].span), Then: yyDollar[4].expr, Else: yyDollar[6].expr}
+		}
+	case 65:
+		yyDollar = yyS[yypt-7 : yypt+1]
+//line grammar.y:325
+		{
+			yyVAL.expr = &IfExpr{Span: between(yyDollar[1].span, yyDollar[7].span), Cond: yyDollar[2].expr, Then: badExpr(yyDollar[3].span, yyDollar[5].span), Else: yyDollar[6].expr}
+		}
+	case 66:
+		yyDollar = yyS[yypt-7 : yypt+1]
+//line grammar.y:326
+		{
+			yyVAL.expr = &IfExpr{Span: between(yyDollar[1].span, yyDollar[7].span), Cond: yyDollar[2].expr, Then: yyDollar[4].expr, Else: badExpr(yyDollar[5].span, yyDollar[7].span)}
+		}
+	case 68:
+		yyDollar = yyS[yypt-7 : yypt+1]
+//line grammar.y:329
+		{
+			yyVAL.expr = funcExpr(between(yyDollar[1].span, yyDollar[7].span), "", yyDollar[3].params, yyDollar[5].types, yyDollar[6].expr)
+		}
+	case 69:
+		yyDollar = yyS[yypt-8 : yypt+1]
+//line grammar.y:330
+		{
+			yyVAL.expr = funcExpr(between(yyDollar[1].span, yyDollar[8].span), yyDollar[2].ident, yyDollar[4].params, yyDollar[6].types, yyDollar[7].expr)
+		}
+	case 70:
+		yyDollar = yyS[yypt-7 : yypt+1]
+//line grammar.y:331
+		{
+			yyVAL.expr = funcExpr(between(yyDollar[1].span, yyDollar[7].span), "", yyDollar[3].params, yyDollar[5].types, badExpr(yyDollar[4].span, yyDollar[7].span))
+		}
+	case 71:
+		yyDollar = yyS[yypt-8 : yypt+1]
+//line grammar.y:332
+		{
+			yyVAL.expr = funcExpr(between(yyDollar[1].span, yyDollar[8].span), yyDollar[2].ident, yyDollar[4].params, yyDollar[6].types, badExpr(yyDollar[5].span, yyDollar[8].span))
+		}
+	case 74:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line grammar.y:336
+		{
+			yyVAL.params = nil
+		}
+	case 77:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:339
+		{
+			yyVAL.params = []param{{name: yyDollar[1].ident}}
+		}
+	case 78:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line grammar.y:340
+		{
+			yyVAL.params = []param{{name: yyDollar[1].ident, typ: yyDollar[2].typ}}
+		}
+	case 79:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:341
+		{
+			yyVAL.params = append(yyDollar[1].params, param{name: yyDollar[3].ident})
+		}
+	case 80:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:342
+		{
+			yyVAL.params = append(yyDollar[1].params, param{name: yyDollar[3].ident, typ: yyDollar[4].typ})
+		}
+	case 81:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line grammar.y:347
+		{
+			yyVAL.types = nil
+		}
+	case 82:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line grammar.y:348
+		{
+			yyVAL.types = []TypeExpr{yyDollar[2].typ}
+		}
+	case 83:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:349
+		{
+			yyVAL.types = yyDollar[3].types
+		}
+	case 85:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line grammar.y:355
+		{
+			yyVAL.typ = &TupleTypeExpr{Span: between(yyDollar[1].span, yyDollar[5].span), Types: append(yyDollar[2].types, yyDollar[4].typ)}
+		}
+	case 86:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:356
+		{
+			yyVAL.typ = &NamedTypeExpr{Span: yyDollar[1].span, Name: yyDollar[1].ident}
+		}
+	case 87:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:357
+		{
+			yyVAL.typ = &NamedTypeExpr{Span: between(yyDollar[1].span, yyDollar[3].span), Name: yyDollar[1].ident + "." + yyDollar[3].ident}
+		}
+	case 88:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:358
+		{
+			yyVAL.typ = &NamedTypeExpr{Span: between(yyDollar[1].span, yyDollar[4].span), Name: yyDollar[1].ident, Args: yyDollar[3].types}
+		}
+	case 89:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line grammar.y:359
+		{
+			yyVAL.typ = &FuncTypeExpr{Span: between(yyDollar[1].span, yyDollar[4].span), Params: yyDollar[3].types, Results: yyDollar[5].types}
+		}
+	case 90:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line grammar.y:361
+		{
+			yyVAL.types = nil
+		}
+	case 93:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:364
+		{
+			yyVAL.types = []TypeExpr{yyDollar[1].typ}
+		}
+	case 94:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:365
+		{
+			yyVAL.types = append(yyDollar[1].types, yyDollar[3].typ)
+		}
+	case 96:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:368
+		{
+			yyVAL.expr = &CallExpr{Span: between(yyDollar[1].expr, yyDollar[4].span), Func: yyDollar[1].expr, Args: yyDollar[3].exprlist}
+		}
+	case 97:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:371
+		{
+			yyVAL.expr = &ListExpr{Span: between(yyDollar[1].span, yyDollar[3].span), Args: yyDollar[2].exprlist}
+		}
+	case 98:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:372
+		{
+			yyVAL.expr = &IndexExpr{Span: between(yyDollar[1].expr, yyDollar[4].span), Base: yyDollar[1].expr, Index: yyDollar[3].expr}
+		}
+	case 99:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:375
+		{
+			yyVAL.expr = dictExpr(between(yyDollar[1].span, yyDollar[3].span), yyDollar[2].exprlist)
+		}
+	case 100:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:378
+		{
+			yyVAL.expr = recordExpr(between(yyDollar[1].span, yyDollar[4].span), yyDollar[1].ident, yyDollar[3].inits)
+		}
+	case 101:
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line grammar.y:379
+		{
+			yyVAL.expr = recordExpr(between(yyDollar[1].expr, yyDollar[6].span), qualifiedName(yylex.(*lexer), yyDollar[1].expr, yyDollar[3].ident), yyDollar[5].inits)
+		}
+	case 103:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:384
+		{
+			yyVAL.expr = matchExpr(between(yyDollar[1].span, yyDollar[4].span), yyDollar[2].expr, yyDollar[3].cases, nil)
+		}
+	case 104:
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line grammar.y:385
+		{
+			yyVAL.expr = matchExpr(between(yyDollar[1].span, yyDollar[6].span), yyDollar[2].expr, yyDollar[3].cases, yyDollar[5].expr)
+		}
+	case 105:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:386
+		{
+			yyVAL.expr = &BadExpr{Span: between(yyDollar[1].span, yyDollar[3].span)}
+		}
+	case 106:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:388
+		{
+			yyVAL.cases = []*MatchCase{yyDollar[1].mcase}
+		}
+	case 107:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line grammar.y:389
+		{
+			yyVAL.cases = append(yyDollar[1].cases, yyDollar[2].mcase)
+		}
+	case 108:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:390
+		{
+			c := yyDollar[2].mcase
+			c.Span = between(yyDollar[1].span, yyDollar[4].expr)
+			c.Body = yyDollar[4].expr
+			yyVAL.mcase = c
+		}
+	case 109:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:391
+		{
+			c := yyDollar[2].mcase
+			c.Span = yyDollar[1].span
+			c.Body = badExpr(yyDollar[3].span, yyDollar[3].span)
+			yyVAL.mcase = c
+		}
+	case 110:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:393
+		{
+			yyVAL.mcase = &MatchCase{Tag: yyDollar[1].ident}
+		}
+	case 111:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line grammar.y:394
+		{
+			yyVAL.mcase = &MatchCase{Tag: yyDollar[1].ident, Vars: yyDollar[3].args}
+		}
+	case 112:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:395
+		{
+			yyVAL.mcase = &MatchCase{Tag: yyDollar[1].ident + "." + yyDollar[3].ident}
+		}
+	case 113:
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line grammar.y:396
+		{
+			yyVAL.mcase = &MatchCase{Tag: yyDollar[1].ident + "." + yyDollar[3].ident, Vars: yyDollar[5].args}
+		}
+	case 114:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line grammar.y:398
+		{
+			yyVAL.args = nil
+		}
+	case 117:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:401
+		{
+			yyVAL.args = []string{yyDollar[1].ident}
+		}
+	case 118:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:402
+		{
+			yyVAL.args = append(yyDollar[1].args, yyDollar[3].ident)
+		}
+	case 120:
+		yyDollar = yyS[yypt-7 : yypt+1]
+//line grammar.y:405
+		{
+			yyVAL.expr = &ForExpr{Span: between(yyDollar[1].span, yyDollar[7].span), Var: yyDollar[2].ident, List: yyDollar[4].expr, Body: yyDollar[6].expr}
+		}
+	case 121:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:406
+		{
+			yyVAL.expr = &BadExpr{Span: between(yyDollar[1].span, yyDollar[3].span)}
+		}
+	case 122:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line grammar.y:408
+		{
+			yyVAL.exprlist = nil
+		}
+	case 125:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:411
+		{
+			yyVAL.exprlist = []Expr{yyDollar[1].expr}
+		}
+	case 126:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:412
+		{
+			yyVAL.exprlist = append(yyDollar[1].exprlist, yyDollar[3].expr)
+		}
+	case 127:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:413
+		{
+			yyVAL.exprlist = []Expr{&BadExpr{}}
+		}
+	case 128:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:414
+		{
+			yyVAL.exprlist = append(yyDollar[1].exprlist, &BadExpr{Span: Span{Start: yyDollar[2].span.End}})
+		}
+	case 129:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line grammar.y:417
+		{
+			yyVAL.exprlist = nil
+		}
+	case 132:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:420
+		{
+			yyVAL.exprlist = []Expr{yyDollar[1].expr, yyDollar[3].expr}
+		}
+	case 133:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line grammar.y:421
+		{
+			yyVAL.exprlist = append(yyDollar[1].exprlist, yyDollar[3].expr, yyDollar[5].expr)
+		}
+	case 134:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:422
+		{
+			yyVAL.exprlist = []Expr{&BadExpr{}, &BadExpr{}}
+		}
+	case 135:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:423
+		{
+			yyVAL.exprlist = append(yyDollar[1].exprlist, &BadExpr{Span: Span{Start: yyDollar[2].span.End}}, &BadExpr{Span: Span{Start: yyDollar[2].span.End}})
+		}
+	case 136:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line grammar.y:425
+		{
+			yyVAL.inits = nil
+		}
+	case 139:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:428
+		{
+			yyVAL.inits = []fieldInit{{name: yyDollar[1].ident, val: yyDollar[3].expr}}
+		}
+	case 140:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line grammar.y:429
+		{
+			yyVAL.inits = append(yyDollar[1].inits, fieldInit{name: yyDollar[3].ident, val: yyDollar[5].expr})
+		}
+	case 141:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line grammar.y:430
+		{
+			yyVAL.inits = []fieldInit{{val: &BadExpr{}}}
+		}
+	case 142:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line grammar.y:431
+		{
+			yyVAL.inits = append(yyDollar[1].inits, fieldInit{val: &BadExpr{Span: Span{Start: yyDollar[2].span.End}}})
 		}
-
-	}
-
-	if yyEx != nil && yyEx.Reduced(r, exState, &yyVAL) {
-		return -1
 	}
 	goto yystack /* stack new state and value */
 }